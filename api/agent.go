@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// StateReader gives access to the services known by a member outside
+// raft, like the agents, which learn about them from gossip.
+type StateReader interface {
+	GetServices() []types.Service
+	GetService(string) (*types.Service, error)
+	SummaryStatus() types.SummaryStatus
+}
+
+// AgentApiService is the read-only subset of the API served by the agents,
+// letting backend hosts check their registration without reaching the
+// balancers. The state served may be slightly behind the leader.
+type AgentApiService struct {
+	*gin.Engine
+	reader StateReader
+}
+
+func NewAgentAPI(reader StateReader) AgentApiService {
+	gin.SetMode(gin.ReleaseMode)
+	as := AgentApiService{
+		Engine: gin.Default(),
+		reader: reader,
+	}
+
+	as.GET("/status", as.status)
+	as.GET("/services", as.serviceList)
+	as.GET("/services/:service_name", as.serviceGet)
+	as.GET("/services/:service_name/destinations", as.destinationList)
+	return as
+}
+
+// status reports whether the services served are up to date
+func (as AgentApiService) status(c *gin.Context) {
+	c.JSON(http.StatusOK, as.reader.SummaryStatus())
+}
+
+func (as AgentApiService) serviceList(c *gin.Context) {
+	services := as.reader.GetServices()
+	if len(services) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, services)
+}
+
+func (as AgentApiService) serviceGet(c *gin.Context) {
+	service, ok := as.getService(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, service)
+}
+
+func (as AgentApiService) destinationList(c *gin.Context) {
+	service, ok := as.getService(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, service.Destinations)
+}
+
+func (as AgentApiService) getService(c *gin.Context) (*types.Service, bool) {
+	service, err := as.reader.GetService(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return nil, false
+	}
+	return service, true
+}
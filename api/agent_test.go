@@ -0,0 +1,64 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/api/types"
+	"gopkg.in/check.v1"
+)
+
+type fakeReader []types.Service
+
+func (r fakeReader) GetServices() []types.Service {
+	return r
+}
+
+func (r fakeReader) GetService(id string) (*types.Service, error) {
+	for _, svc := range r {
+		if svc.GetId() == id {
+			return &svc, nil
+		}
+	}
+	return nil, types.ErrServiceNotFound
+}
+
+func (r fakeReader) SummaryStatus() types.SummaryStatus {
+	return types.SummaryStatus{Index: 7}
+}
+
+func (s *S) TestAgentAPI(c *check.C) {
+	reader := fakeReader{{
+		Id: "web", Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp",
+		Destinations: []types.Destination{{Name: "host-1", Host: "192.168.0.1", Port: 8080, ServiceId: "web"}},
+	}}
+	srv := httptest.NewServer(api.NewAgentAPI(reader))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/services/web/destinations")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var dsts []types.Destination
+	err = json.NewDecoder(resp.Body).Decode(&dsts)
+	c.Assert(err, check.IsNil)
+	c.Assert(dsts, check.DeepEquals, reader[0].Destinations)
+
+	resp, err = http.Get(srv.URL + "/services/unknown")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	resp, err = http.Get(srv.URL + "/status")
+	c.Assert(err, check.IsNil)
+	var status types.SummaryStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	c.Assert(err, check.IsNil)
+	c.Assert(status.Index, check.Equals, uint64(7))
+
+	// Writes aren't served by agents
+	resp, err = http.Post(srv.URL+"/services", "application/json", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
@@ -1,12 +1,21 @@
 package api
 
 import (
+	"crypto/tls"
 	"fmt"
-	"net"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/auth"
+	"github.com/luizbafilho/fusis/jobs"
 )
 
 // ApiService ...
@@ -14,62 +23,266 @@ type ApiService struct {
 	*gin.Engine
 	balancer Balancer
 	env      string
+	jobs     *jobs.Manager
 }
 
 type Balancer interface {
 	GetServices() []types.Service
+	GenerateServiceId(types.Service) string
 	AddService(*types.Service) error
+	UpdateService(*types.Service) error
+	RenameService(id, name string) (*types.Service, error)
 	GetService(string) (*types.Service, error)
+	GetServiceByExternalId(ref string) (*types.Service, error)
+	GetSyncStatus(string) (*types.SyncStatus, error)
+	GetServiceEvents(string) ([]types.Event, error)
+	WatchState() (changes <-chan struct{}, cancel func())
 	DeleteService(string) error
 	AddDestination(*types.Service, *types.Destination) error
 	GetDestination(string) (*types.Destination, error)
+	GetDestinationByExternalId(ref string) (*types.Destination, error)
+	UpdateDestination(*types.Destination) error
 	DeleteDestination(*types.Destination) error
+	DrainDestination(*types.Destination) error
+	ApplyDestinationBatch(serviceId string, batch *types.DestinationBatch) error
+	PlanDestinationBatch(serviceId string, batch *types.DestinationBatch) ([]types.Destination, error)
+	GetDestinationHealth(string) (*types.DestinationHealth, error)
+	ReportDestinationHealth(id string, healthy bool) error
+	GetQuarantined() []types.QuarantinedEntry
+	GetProbes() ([]types.ProbeResult, error)
 	IsLeader() bool
 	GetLeader() string
+	GetLeaderAPI() string
+	GetCluster() types.Cluster
+	GetClusterHealth() (*types.ClusterHealth, error)
+	GetPeers() ([]types.Peer, error)
+	AddPeer(types.Peer) error
+	RemovePeer(name string) error
+	ForceLeave(name string) error
+	Overloaded() (retryAfter time.Duration, overloaded bool)
+	ListKeys() (*types.Keyring, error)
+	RotateCertificates() error
+	InstallKey(key string) error
+	UseKey(key string) error
+	RemoveKey(key string) error
+	Barrier() error
+	ReadInfo() types.ReadInfo
+}
+
+// Options tune the API
+type Options struct {
+	// ReadOnly rejects the writes, see NewReadOnlyAPI
+	ReadOnly bool
+	// ProxyTLS, if set, is the TLS config requests are proxied to the
+	// leader with, over HTTPS
+	ProxyTLS *tls.Config
+	// Auth, if set, authorizes the requests by their token
+	Auth *auth.Authorizer
 }
 
 //NewAPI ...
 func NewAPI(balancer Balancer) ApiService {
+	return NewAPIWithOptions(balancer, Options{})
+}
+
+// NewReadOnlyAPI returns an API serving only the reads, for balancers
+// exposed to clients that mustn't change the cluster, e.g. followers behind
+// a monitoring VIP. Writes are rejected with ErrNoWritesOnThisNode instead
+// of being proxied to the leader.
+func NewReadOnlyAPI(balancer Balancer) ApiService {
+	return NewAPIWithOptions(balancer, Options{ReadOnly: true})
+}
+
+// NewAPIWithOptions returns an API tuned by opts
+func NewAPIWithOptions(balancer Balancer, opts Options) ApiService {
 	gin.SetMode(gin.ReleaseMode)
 	as := ApiService{
 		Engine:   gin.Default(),
 		balancer: balancer,
 		env:      getEnv(),
+		jobs:     jobs.NewManager(0),
 	}
 
-	as.registerRedirectMiddleware()
+	if opts.Auth != nil {
+		as.Use(authMiddleware(opts.Auth))
+	}
+	if opts.ReadOnly {
+		as.Use(readOnlyMiddleware)
+	}
+	as.Use(redirectMiddleware(as.balancer, opts.ProxyTLS))
+	as.Use(sheddingMiddleware(as.balancer))
 	as.registerRoutes()
 	return as
 }
 
 func (as ApiService) registerRoutes() {
+	as.GET("/metrics", as.metricsGet)
+	as.GET("/quarantine", as.quarantineList)
+	as.GET("/probes", as.probeList)
+	as.GET("/jobs", as.jobList)
+	as.GET("/jobs/:job_id", as.jobGet)
+	as.GET("/cluster", as.clusterGet)
+	as.GET("/cluster/health", as.clusterHealth)
+	as.GET("/cluster/peers", as.peerList)
+	as.POST("/cluster/peers", as.peerAdd)
+	as.DELETE("/cluster/peers/:peer", as.peerRemove)
+	as.DELETE("/cluster/members/:member_name", as.memberForceLeave)
+	as.GET("/keys", as.keyList)
+	as.POST("/keys", as.keyInstall)
+	as.POST("/keys/use", as.keyUse)
+	as.POST("/keys/remove", as.keyRemove)
+	as.POST("/certificates/rotate", as.certificatesRotate)
+	as.GET("/watch", as.stateWatch)
 	as.GET("/services", as.serviceList)
 	as.GET("/services/:service_name", as.serviceGet)
+	as.GET("/services/:service_name/status", as.serviceSyncStatus)
+	as.GET("/services/:service_name/events", as.serviceEvents)
+	as.GET("/services/:service_name/client-ip", as.serviceClientIP)
+	as.POST("/services/:service_name/simulate", as.serviceSimulate)
 	as.POST("/services", as.serviceCreate)
+	as.PUT("/services/:service_name", as.serviceUpdate)
+	as.POST("/services/:service_name/rename", as.serviceRename)
 	as.DELETE("/services/:service_name", as.serviceDelete)
+	as.GET("/services/:service_name/destinations", as.destinationList)
 	as.POST("/services/:service_name/destinations", as.destinationCreate)
+	as.PUT("/services/:service_name/destinations/:destination_name", as.destinationUpdate)
+	as.DELETE("/services/:service_name/destinations", as.destinationBulkDelete)
+	as.POST("/services/:service_name/destinations/batch", as.destinationBatch)
 	as.DELETE("/services/:service_name/destinations/:destination_name", as.destinationDelete)
+	as.GET("/services/:service_name/destinations/:destination_name/health", as.destinationHealth)
+	as.PUT("/services/:service_name/destinations/:destination_name/health", as.destinationReportHealth)
 }
 
-func redirectMiddleware(b Balancer) gin.HandlerFunc {
+// redirectMiddleware sends requests to the leader, proxying them when
+// received by a follower, so clients may reach any balancer. Reads are
+// served after a raft barrier, so they reflect every change committed
+// before them, unless the stale query param is given. Stale reads are
+// served by any balancer from its local state, which is cheaper but may be
+// behind the leader. Metrics are about the balancer itself, so they're
+// always served locally.
+func redirectMiddleware(b Balancer, proxyTLS *tls.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if c.Request.URL.Path == "/metrics" {
+			c.Next()
+			return
+		}
+
+		if isRead(c) && isStale(c) {
+			setReadHeaders(c, b.ReadInfo())
+			c.Next()
+			return
+		}
+
 		if b.IsLeader() {
+			if isRead(c) {
+				if err := b.Barrier(); err != nil {
+					c.Error(err)
+					c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("Barrier() failed: %v", err)})
+					c.Abort()
+					return
+				}
+				setReadHeaders(c, b.ReadInfo())
+			}
 			c.Next()
 		} else {
 			c.Abort()
 
-			host, _, _ := net.SplitHostPort(b.GetLeader())
-			c.Redirect(307, fmt.Sprintf("http://%s:8000%s", host, c.Request.URL))
+			leader := b.GetLeaderAPI()
+			if leader == "" {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no known leader"})
+				return
+			}
+			target := &url.URL{Scheme: "http", Host: leader}
+			if proxyTLS != nil {
+				target.Scheme = "https"
+			}
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			if proxyTLS != nil {
+				proxy.Transport = &http.Transport{TLSClientConfig: proxyTLS}
+			}
+			proxy.ServeHTTP(c.Writer, c.Request)
 		}
 	}
 }
 
-func (as ApiService) registerRedirectMiddleware() {
-	as.Use(redirectMiddleware(as.balancer))
+// authMiddleware rejects the requests without a known token, or whose
+// token role doesn't allow them. Tokens are sent as bearer tokens in the
+// Authorization header. Requests proxied to the leader keep the header, so
+// they're authorized by both balancers.
+func authMiddleware(a *auth.Authorizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		name, role, ok := a.Authenticate(token)
+		if !ok {
+			c.Error(types.ErrUnauthorized)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": types.ErrUnauthorized.Error()})
+			c.Abort()
+			return
+		}
+		if !role.Allows(c.Request.Method, c.Request.URL.Path) {
+			c.Error(fmt.Errorf("token %s: %v", name, types.ErrForbidden))
+			c.JSON(http.StatusForbidden, gin.H{"error": types.ErrForbidden.Error()})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// sheddingMiddleware rejects the writes that aren't critical with 429 while
+// the leader is overloaded, see Balancer.Overloaded. Removals and drains,
+// health reports and the management of the cluster stay allowed, as they
+// relieve or repair it.
+func sheddingMiddleware(b Balancer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isRead(c) || isCritical(c) {
+			c.Next()
+			return
+		}
+		retryAfter, overloaded := b.Overloaded()
+		if !overloaded {
+			c.Next()
+			return
+		}
+		c.Error(types.ErrOverloaded)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": types.ErrOverloaded.Error()})
+		c.Abort()
+	}
+}
+
+func isCritical(c *gin.Context) bool {
+	path := c.Request.URL.Path
+	return c.Request.Method == "DELETE" ||
+		strings.HasSuffix(path, "/health") ||
+		strings.HasPrefix(path, "/cluster") ||
+		strings.HasPrefix(path, "/keys")
+}
+
+// readOnlyMiddleware rejects the writes locally
+func readOnlyMiddleware(c *gin.Context) {
+	if isRead(c) {
+		c.Next()
+		return
+	}
+	c.Error(types.ErrNoWritesOnThisNode)
+	c.JSON(http.StatusForbidden, gin.H{"error": types.ErrNoWritesOnThisNode.Error(), "code": types.ErrCodeNoWrites})
+	c.Abort()
+}
+
+func isRead(c *gin.Context) bool {
+	return c.Request.Method == "GET" || c.Request.Method == "HEAD"
+}
+
+func isStale(c *gin.Context) bool {
+	_, ok := c.Request.URL.Query()["stale"]
+	return ok
 }
 
-func (as ApiService) Serve() {
-	as.Run("0.0.0.0:8000")
+func setReadHeaders(c *gin.Context, info types.ReadInfo) {
+	c.Header("X-Fusis-Index", strconv.FormatUint(info.LastIndex, 10))
+	c.Header("X-Fusis-Known-Leader", strconv.FormatBool(info.KnownLeader))
+	c.Header("X-Fusis-Last-Contact", strconv.FormatInt(int64(info.LastContact/time.Millisecond), 10))
 }
 
 func getEnv() string {
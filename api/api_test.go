@@ -2,12 +2,19 @@ package api_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/luizbafilho/fusis/api"
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/auth"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/metrics"
 	"gopkg.in/check.v1"
 )
 
@@ -16,6 +23,103 @@ func (s *S) TestNewAPI(c *check.C) {
 	c.Assert(apiInst, check.NotNil)
 }
 
+// followerBalancer is a balancer that isn't the leader
+type followerBalancer struct {
+	api.Balancer
+	leaderAPI string
+}
+
+func (b followerBalancer) IsLeader() bool { return false }
+
+func (b followerBalancer) GetLeaderAPI() string { return b.leaderAPI }
+
+func (s *S) TestFollowerProxiesToLeader(c *check.C) {
+	leader, err := url.Parse(s.srv.URL)
+	c.Assert(err, check.IsNil)
+	follower := httptest.NewServer(api.NewAPI(followerBalancer{Balancer: s.bal, leaderAPI: leader.Host}))
+	defer follower.Close()
+
+	resp, err := http.Post(follower.URL+"/services", "application/json", strings.NewReader(`{"name": "myservice", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	_, err = s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+
+	noLeader := httptest.NewServer(api.NewAPI(followerBalancer{Balancer: s.bal}))
+	defer noLeader.Close()
+	resp, err = http.Get(noLeader.URL + "/services")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+}
+
+func (s *S) TestReadOnlyAPI(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	readOnly := httptest.NewServer(api.NewReadOnlyAPI(s.bal))
+	defer readOnly.Close()
+
+	resp, err := http.Get(readOnly.URL + "/services/myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+
+	resp, err = http.Post(readOnly.URL+"/services", "application/json", strings.NewReader(`{"name": "other", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusForbidden)
+	var reply map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	c.Assert(err, check.IsNil)
+	c.Assert(reply["code"], check.Equals, types.ErrCodeNoWrites)
+	_, err = s.bal.GetService("other")
+	c.Assert(err, check.Equals, types.ErrServiceNotFound)
+
+	err = api.NewClient(readOnly.URL).DeleteService("myservice")
+	c.Assert(err, check.Equals, types.ErrNoWritesOnThisNode)
+	_, err = s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestAuthorizedAPI(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	authorizer, err := auth.New(config.Auth{Tokens: []config.Token{
+		{Name: "monitoring", Token: "m0n", Role: "read-only"},
+		{Name: "deploys", Token: "d3p", Role: "operator"},
+	}})
+	c.Assert(err, check.IsNil)
+	srv := httptest.NewServer(api.NewAPIWithOptions(s.bal, api.Options{Auth: authorizer}))
+	defer srv.Close()
+
+	cli := api.NewClient(srv.URL)
+	_, err = cli.GetService("myservice")
+	c.Assert(err, check.Equals, types.ErrUnauthorized)
+	cli.Token = "m0n"
+	_, err = cli.GetService("myservice")
+	c.Assert(err, check.IsNil)
+	_, err = cli.AddDestination(types.Destination{Name: "mydst", Host: "192.168.0.1", Port: 80, Mode: "nat", ServiceId: "myservice"})
+	c.Assert(err, check.Equals, types.ErrForbidden)
+
+	cli.Token = "d3p"
+	_, err = cli.AddDestination(types.Destination{Name: "mydst", Host: "192.168.0.1", Port: 80, Mode: "nat", ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	err = cli.DeleteService("myservice")
+	c.Assert(err, check.Equals, types.ErrForbidden)
+}
+
+func (s *S) TestMetricsServedLocally(c *check.C) {
+	_, err := metrics.Setup()
+	c.Assert(err, check.IsNil)
+	noLeader := httptest.NewServer(api.NewAPI(followerBalancer{Balancer: s.bal}))
+	defer noLeader.Close()
+
+	resp, err := http.Get(noLeader.URL + "/metrics")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var snap metrics.Snapshot
+	err = json.NewDecoder(resp.Body).Decode(&snap)
+	c.Assert(err, check.IsNil)
+	c.Assert(snap.Histograms["raft.commitTime"].Buckets, check.NotNil)
+}
+
 func (s *S) TestServiceList(c *check.C) {
 	err := s.bal.AddService(&types.Service{Name: "myservice"})
 	c.Assert(err, check.IsNil)
@@ -80,6 +184,7 @@ func (s *S) TestServiceCreate(c *check.C) {
 	err = json.Unmarshal(data, &result)
 	c.Assert(err, check.IsNil)
 	c.Assert(result, check.DeepEquals, types.Service{
+		Id:           "ahoy",
 		Name:         "ahoy",
 		Port:         1040,
 		Protocol:     "tcp",
@@ -91,6 +196,41 @@ func (s *S) TestServiceCreate(c *check.C) {
 	c.Assert(resp.Header.Get("Content-Type"), check.Equals, "application/json; charset=utf-8")
 }
 
+func (s *S) TestServiceCreateExplicitId(c *check.C) {
+	body := strings.NewReader(`{"id": "web-1", "name": "Web Frontend", "port": 80, "protocol": "tcp", "scheduler": "rr"}`)
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(resp.Header.Get("Location"), check.Equals, "/services/web-1")
+	svc, err := s.bal.GetService("web-1")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Name, check.Equals, "Web Frontend")
+}
+
+func (s *S) TestServiceCreateDerivedId(c *check.C) {
+	body := strings.NewReader(`{"name": "Web Frontend", "port": 80, "protocol": "tcp", "scheduler": "rr"}`)
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(resp.Header.Get("Location"), check.Equals, "/services/web-frontend")
+}
+
+func (s *S) TestServiceCreateInvalidId(c *check.C) {
+	body := strings.NewReader(`{"id": "Web/1", "name": "web", "port": 80, "protocol": "tcp", "scheduler": "rr"}`)
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestServiceCreateInvalidType(c *check.C) {
+	body := strings.NewReader(`{"name": "web", "port": 53, "protocol": "udp", "scheduler": "rr", "type": "http"}`)
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+	_, err = s.bal.GetService("web")
+	c.Assert(err, check.Equals, types.ErrServiceNotFound)
+}
+
 func (s *S) TestServiceCreateValidationError(c *check.C) {
 	body := strings.NewReader(`{"id": "mysrv"}`)
 	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
@@ -130,6 +270,150 @@ func (s *S) TestServiceCreateConflict(c *check.C) {
 	c.Assert(resp.Header.Get("Content-Type"), check.Equals, "application/json; charset=utf-8")
 }
 
+func (s *S) TestServiceGetVersionHeader(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Version: 3})
+	c.Assert(err, check.IsNil)
+	resp, err := http.Get(s.srv.URL + "/services/myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("ETag"), check.Equals, `"3"`)
+}
+
+func (s *S) TestServiceUpdate(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr"})
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader(`{"port": 8080, "protocol": "tcp", "scheduler": "lc", "host": "10.9.9.9"}`)
+	req, err := http.NewRequest("PUT", s.srv.URL+"/services/myservice", body)
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("ETag"), check.Equals, `"1"`)
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	var result types.Service
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, types.Service{
+		Id:        "myservice",
+		Name:      "myservice",
+		Host:      "10.0.0.1",
+		Port:      8080,
+		Protocol:  "tcp",
+		Scheduler: "lc",
+		Version:   1,
+	})
+}
+
+func (s *S) TestServiceUpdateNotFound(c *check.C) {
+	body := strings.NewReader(`{"port": 8080, "protocol": "tcp", "scheduler": "lc"}`)
+	req, err := http.NewRequest("PUT", s.srv.URL+"/services/myservice", body)
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestServiceUpdateVersionMismatch(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Version: 2})
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader(`{"port": 8080, "protocol": "tcp", "scheduler": "lc"}`)
+	req, err := http.NewRequest("PUT", s.srv.URL+"/services/myservice", body)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("If-Match", `"1"`)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusPreconditionFailed)
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	var result map[string]string
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, map[string]string{"error": "service version mismatch"})
+}
+
+func (s *S) TestServiceRename(c *check.C) {
+	err := s.bal.AddService(&types.Service{Id: "myservice", Name: "myservice", Host: "10.0.0.1", Port: 80})
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader(`{"name": "My Service"}`)
+	resp, err := http.Post(s.srv.URL+"/services/myservice/rename", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	svc, err := s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Name, check.Equals, "My Service")
+	c.Assert(svc.Host, check.Equals, "10.0.0.1")
+}
+
+func (s *S) TestServiceRenameNotFound(c *check.C) {
+	body := strings.NewReader(`{"name": "My Service"}`)
+	resp, err := http.Post(s.srv.URL+"/services/myservice/rename", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestServiceSyncStatus(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Version: 2})
+	c.Assert(err, check.IsNil)
+	resp, err := http.Get(s.srv.URL + "/services/myservice/status")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var result types.SyncStatus
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, types.SyncStatus{Version: 2, SyncedVersion: 2, Synced: true})
+	resp, err = http.Get(s.srv.URL + "/services/unknown/status")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestServiceCreateSyncStatusHeader(c *check.C) {
+	body := strings.NewReader(`{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`)
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(resp.Header.Get("X-Sync-Status"), check.Equals, "/services/ahoy/status")
+}
+
+func (s *S) TestServiceEvents(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	resp, err := http.Get(s.srv.URL + "/services/myservice/events")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var result []types.Event
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, []types.Event{})
+	resp, err = http.Get(s.srv.URL + "/services/unknown/events")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestServiceClientIP(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Type: types.ServiceTypeHTTP})
+	c.Assert(err, check.IsNil)
+	resp, err := http.Get(s.srv.URL + "/services/myservice/client-ip")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var report types.ClientIPReport
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	c.Assert(err, check.IsNil)
+	c.Assert(report, check.DeepEquals, types.ClientIPReport{Forwarding: "http proxy", Header: "X-Forwarded-For"})
+	resp, err = http.Get(s.srv.URL + "/services/unknown/client-ip")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestServiceCreateRequiringClientIP(c *check.C) {
+	body := `{"name": "myservice", "port": 443, "protocol": "tcp", "scheduler": "rr", "type": "sni", "requireclientip": true}`
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+	_, err = s.bal.GetService("myservice")
+	c.Assert(err, check.Equals, types.ErrServiceNotFound)
+}
+
 func (s *S) TestServiceDelete(c *check.C) {
 	err := s.bal.AddService(&types.Service{Name: "myservice"})
 	c.Assert(err, check.IsNil)
@@ -178,6 +462,64 @@ func (s *S) TestDestinationCreate(c *check.C) {
 	c.Assert(resp.Header.Get("Content-Type"), check.Equals, "application/json; charset=utf-8")
 }
 
+func (s *S) TestDestinationCreateGeneratedName(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader(`{"host": "10.0.0.1", "port": 80}`)
+	resp, err := http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(resp.Header.Get("Location"), check.Equals, "/services/myservice/destinations/myservice-10.0.0.1-80")
+	body = strings.NewReader(`{"name": "other", "host": "10.0.0.1", "port": 80}`)
+	resp, err = http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestDestinationList(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "d1", Host: "10.0.0.1", Port: 80, ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "d2", Host: "10.0.0.1", Port: 81, ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	resp, err := http.Get(s.srv.URL + "/services/myservice/destinations?host=10.0.0.1&port=81")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var result []types.Destination
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, []types.Destination{{Name: "d2", Host: "10.0.0.1", Port: 81, ServiceId: "myservice"}})
+	resp, err = http.Get(s.srv.URL + "/services/myservice/destinations?port=abc")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestDestinationHealth(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "mydest", Host: "10.0.0.1", Port: 80, ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader(`{"healthy": false}`)
+	req, err := http.NewRequest("PUT", s.srv.URL+"/services/myservice/destinations/mydest/health", body)
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	resp, err = http.Get(s.srv.URL + "/services/myservice/destinations/mydest/health")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var result types.DestinationHealth
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Healthy, check.Equals, false)
+	resp, err = http.Get(s.srv.URL + "/services/myservice/destinations/unknown/health")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
 func (s *S) TestDestinationCreateValidationError(c *check.C) {
 	err := s.bal.AddService(&types.Service{Name: "myservice"})
 	c.Assert(err, check.IsNil)
@@ -193,7 +535,6 @@ func (s *S) TestDestinationCreateValidationError(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(result, check.DeepEquals, map[string]map[string]string{
 		"errors": {
-			"Name": "non zero value required",
 			"Port": "non zero value required",
 			"Host": "non zero value required",
 		},
@@ -258,6 +599,7 @@ func (s *S) TestDestinationDelete(c *check.C) {
 	err = s.bal.AddDestination(srv, dst)
 	c.Assert(err, check.IsNil)
 	dst.Name = "mydest2"
+	dst.Port = 8080
 	err = s.bal.AddDestination(srv, dst)
 	c.Assert(err, check.IsNil)
 	req, err := http.NewRequest("DELETE", s.srv.URL+"/services/myservice/destinations/mydest", nil)
@@ -269,6 +611,7 @@ func (s *S) TestDestinationDelete(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(srv.Destinations, check.DeepEquals, []types.Destination{{
 		Name:      "mydest2",
+		Port:      8080,
 		ServiceId: "myservice",
 	}})
 	req, err = http.NewRequest("DELETE", s.srv.URL+"/services/myservice/destinations/mydest2", nil)
@@ -281,6 +624,68 @@ func (s *S) TestDestinationDelete(c *check.C) {
 	c.Assert(srv.Destinations, check.DeepEquals, []types.Destination{})
 }
 
+func (s *S) TestDestinationUpdate(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	dst := &types.Destination{
+		Name:      "mydest",
+		Host:      "myhost",
+		Port:      1234,
+		Weight:    1,
+		Mode:      "nat",
+		ServiceId: "myservice",
+	}
+	err = s.bal.AddDestination(srv, dst)
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader(`{"weight": 10}`)
+	req, err := http.NewRequest("PUT", s.srv.URL+"/services/myservice/destinations/mydest", body)
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("ETag"), check.Equals, `"1"`)
+	updated, err := s.bal.GetDestination("mydest")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated, check.DeepEquals, &types.Destination{
+		Name:      "mydest",
+		Host:      "myhost",
+		Port:      1234,
+		Weight:    10,
+		Mode:      "nat",
+		ServiceId: "myservice",
+		Version:   1,
+	})
+
+	req, err = http.NewRequest("PUT", s.srv.URL+"/services/myservice/destinations/mydest", strings.NewReader(`{"weight": 2}`))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("If-Match", `"7"`)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusPreconditionFailed)
+
+	req, err = http.NewRequest("PUT", s.srv.URL+"/services/otherservice/destinations/mydest", strings.NewReader(`{"weight": 2}`))
+	c.Assert(err, check.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestDestinationDrain(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "mydest", ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	req, err := http.NewRequest("DELETE", s.srv.URL+"/services/myservice/destinations/mydest?drain=true", nil)
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusAccepted)
+	_, err = s.bal.GetDestination("mydest")
+	c.Assert(err, check.Equals, types.ErrDestinationNotFound)
+}
+
 func (s *S) TestDestinationDeleteNotFound(c *check.C) {
 	srv := &types.Service{Name: "myservice"}
 	err := s.bal.AddService(srv)
@@ -291,3 +696,369 @@ func (s *S) TestDestinationDeleteNotFound(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
 }
+
+func (s *S) TestServiceListReadHeaders(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	for _, path := range []string{"/services", "/services?stale"} {
+		resp, err := http.Get(s.srv.URL + path)
+		c.Assert(err, check.IsNil)
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("X-Fusis-Index"), check.Equals, "1")
+		c.Assert(resp.Header.Get("X-Fusis-Known-Leader"), check.Equals, "true")
+		c.Assert(resp.Header.Get("X-Fusis-Last-Contact"), check.Equals, "0")
+	}
+}
+
+func (s *S) TestServiceCreateNoReadHeaders(c *check.C) {
+	body := strings.NewReader(`{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`)
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", body)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(resp.Header.Get("X-Fusis-Index"), check.Equals, "")
+}
+
+func (s *S) TestServiceSimulate(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Scheduler: "rr"})
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(&types.Service{Name: "myservice"}, &types.Destination{Name: "dst1", Weight: 1, ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	body := `{"clients": 10, "connections": 100}`
+	resp, err := http.Post(s.srv.URL+"/services/myservice/simulate", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var result types.SimulationResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Destinations, check.HasLen, 1)
+	c.Assert(result.Destinations[0].Connections, check.Equals, 100)
+	resp, err = http.Post(s.srv.URL+"/services/myservice/simulate", "application/json", strings.NewReader(`{"clients": 0}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+	resp, err = http.Post(s.srv.URL+"/services/unknown/simulate", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestDestinationLabels(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	for i, deploy := range []string{"v1", "v1", "v2"} {
+		body := fmt.Sprintf(`{"host": "10.0.0.%d", "port": 80, "labels": {"deploy": %q, "check-port": "8080"}}`, i+1, deploy)
+		resp, err := http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	}
+	resp, err := http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", strings.NewReader(`{"host": "10.0.0.9", "port": 80, "labels": {"check-port": "http"}}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	resp, err = http.Get(s.srv.URL + "/services/myservice/destinations?labels=deploy=v1")
+	c.Assert(err, check.IsNil)
+	var dsts []types.Destination
+	err = json.NewDecoder(resp.Body).Decode(&dsts)
+	c.Assert(err, check.IsNil)
+	c.Assert(dsts, check.HasLen, 2)
+
+	resp, err = http.Get(s.srv.URL + "/services/myservice/destinations/myservice-10.0.0.1-80/health")
+	c.Assert(err, check.IsNil)
+	var health types.DestinationHealth
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	c.Assert(err, check.IsNil)
+	c.Assert(health.CheckPort, check.Equals, uint16(8080))
+
+	req, err := http.NewRequest("DELETE", s.srv.URL+"/services/myservice/destinations", nil)
+	c.Assert(err, check.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	req, err = http.NewRequest("DELETE", s.srv.URL+"/services/myservice/destinations?labels=deploy=v1", nil)
+	c.Assert(err, check.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	dsts = nil
+	err = json.NewDecoder(resp.Body).Decode(&dsts)
+	c.Assert(err, check.IsNil)
+	c.Assert(dsts, check.HasLen, 2)
+	svc, err := s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Destinations, check.HasLen, 1)
+	c.Assert(svc.Destinations[0].Labels["deploy"], check.Equals, "v2")
+}
+
+func (s *S) TestDestinationBatch(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "old", Host: "10.0.0.1", Port: 80, ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+
+	body := `{"add": [{"host": "10.0.0.2", "port": 80}, {"host": "10.0.0.3", "port": 80, "weight": 3}], "drain": ["old"]}`
+	resp, err := http.Post(s.srv.URL+"/services/myservice/destinations/batch", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var dsts []types.Destination
+	err = json.NewDecoder(resp.Body).Decode(&dsts)
+	c.Assert(err, check.IsNil)
+	c.Assert(dsts, check.HasLen, 2)
+	c.Assert(dsts[0].Name, check.Equals, "myservice-10.0.0.2-80")
+	c.Assert(dsts[0].Weight, check.Equals, int32(1))
+	c.Assert(dsts[0].Mode, check.Equals, "route")
+	c.Assert(dsts[1].Weight, check.Equals, int32(3))
+
+	resp, err = http.Post(s.srv.URL+"/services/myservice/destinations/batch", "application/json", strings.NewReader(`{"remove": ["unknown"]}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+	resp, err = http.Post(s.srv.URL+"/services/myservice/destinations/batch", "application/json", strings.NewReader(`{}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+	resp, err = http.Post(s.srv.URL+"/services/myservice/destinations/batch", "application/json", strings.NewReader(`{"add": [{"host": "10.0.0.4"}]}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestServiceCreateFirewallMark(c *check.C) {
+	body := `{"name": "ftp", "port": 21, "protocol": "tcp", "scheduler": "rr", "firewallmark": 1, "markports": ["20", "30000-30100"]}`
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	body = `{"name": "ftp", "port": 21, "protocol": "tcp", "scheduler": "rr", "firewallmark": 1, "markports": ["20", "30000:30100"]}`
+	resp, err = http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	svc, err := s.bal.GetService("ftp")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.FirewallMark, check.Equals, uint32(1))
+	c.Assert(svc.MarkPorts, check.DeepEquals, []string{"20", "30000:30100"})
+}
+
+func (s *S) TestServiceCreatePolicies(c *check.C) {
+	body := `{"name": "web", "port": 80, "protocol": "tcp", "scheduler": "rr", "policies": [{"name": "internal", "sources": ["10.0.0.1"], "destinations": ["canary"], "mark": 10}]}`
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	body = `{"name": "web", "port": 80, "protocol": "tcp", "scheduler": "rr", "policies": [{"name": "internal", "sources": ["10.0.0.0/8"], "destinations": ["canary"], "mark": 10}]}`
+	resp, err = http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	svc, err := s.bal.GetService("web")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Policies, check.DeepEquals, []types.Policy{{Name: "internal", Sources: []string{"10.0.0.0/8"}, Destinations: []string{"canary"}, Mark: 10}})
+}
+
+func waitJob(c *check.C, url string) types.Job {
+	var job types.Job
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url)
+		c.Assert(err, check.IsNil)
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		c.Assert(err, check.IsNil)
+		if job.Status != types.JobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("job %s still running", job.Id)
+	return job
+}
+
+func (s *S) TestDestinationDrainJob(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "mydest", ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	req, err := http.NewRequest("DELETE", s.srv.URL+"/services/myservice/destinations/mydest?drain=true", nil)
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusAccepted)
+	var started types.Job
+	err = json.NewDecoder(resp.Body).Decode(&started)
+	c.Assert(err, check.IsNil)
+	c.Assert(started.Kind, check.Equals, "drain")
+	c.Assert(resp.Header.Get("Location"), check.Equals, "/jobs/"+started.Id)
+
+	job := waitJob(c, s.srv.URL+resp.Header.Get("Location"))
+	c.Assert(job.Status, check.Equals, types.JobSucceeded)
+	c.Assert(job.Done, check.Equals, 1)
+
+	resp, err = http.Get(s.srv.URL + "/jobs/unknown")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestDestinationBatchAsync(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	body := `{"add": [{"host": "10.0.0.2", "port": 80}]}`
+	resp, err := http.Post(s.srv.URL+"/services/myservice/destinations/batch?async=true", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusAccepted)
+	job := waitJob(c, s.srv.URL+resp.Header.Get("Location"))
+	c.Assert(job.Status, check.Equals, types.JobSucceeded)
+	c.Assert(job.Kind, check.Equals, "batch")
+
+	resp, err = http.Post(s.srv.URL+"/services/unknown/destinations/batch?async=true", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusAccepted)
+	job = waitJob(c, s.srv.URL+resp.Header.Get("Location"))
+	c.Assert(job.Status, check.Equals, types.JobFailed)
+	c.Assert(job.Error, check.Equals, types.ErrServiceNotFound.Error())
+}
+
+func (s *S) TestServiceCreatePersistence(c *check.C) {
+	body := `{"name": "sticky", "port": 80, "protocol": "tcp", "scheduler": "rr", "persistencenetmask": 24}`
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	body = `{"name": "sticky", "port": 80, "protocol": "tcp", "scheduler": "rr", "persistencetimeout": 300, "persistencenetmask": 24}`
+	resp, err = http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	svc, err := s.bal.GetService("sticky")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.PersistenceTimeout, check.Equals, uint32(300))
+	c.Assert(svc.PersistenceNetmask, check.Equals, uint8(24))
+}
+
+func (s *S) TestServiceCreateSchedulerFlags(c *check.C) {
+	body := `{"name": "maglev", "port": 80, "protocol": "tcp", "scheduler": "rr", "schedulerflags": ["mh-port"]}`
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestDestinationCreateFullNAT(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", RequireClientIP: true})
+	c.Assert(err, check.IsNil)
+	body := `{"name": "mydst", "host": "192.168.0.1", "port": 8080, "mode": "fullnat"}`
+	resp, err := http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	err = s.bal.AddService(&types.Service{Name: "other"})
+	c.Assert(err, check.IsNil)
+	resp, err = http.Post(s.srv.URL+"/services/other/destinations", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	dst, err := s.bal.GetDestination("mydst")
+	c.Assert(err, check.IsNil)
+	c.Assert(dst.Mode, check.Equals, types.ModeFullNAT)
+}
+
+func (s *S) TestServiceExternalId(c *check.C) {
+	body := `{"name": "web", "port": 80, "protocol": "tcp", "scheduler": "rr", "externalId": "tsuru-web"}`
+	resp, err := http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+
+	body = `{"name": "other", "port": 80, "protocol": "tcp", "scheduler": "rr", "externalId": "tsuru-web"}`
+	resp, err = http.Post(s.srv.URL+"/services", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusConflict)
+
+	resp, err = http.Get(s.srv.URL + "/services?externalId=tsuru-web")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var services []types.Service
+	err = json.NewDecoder(resp.Body).Decode(&services)
+	c.Assert(err, check.IsNil)
+	c.Assert(services, check.HasLen, 1)
+	c.Assert(services[0].GetId(), check.Equals, "web")
+
+	resp, err = http.Get(s.srv.URL + "/services?externalId=unknown")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	services = nil
+	err = json.NewDecoder(resp.Body).Decode(&services)
+	c.Assert(err, check.IsNil)
+	c.Assert(services, check.HasLen, 0)
+}
+
+func (s *S) TestDestinationExternalId(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	body := `{"name": "mydst", "host": "192.168.0.1", "port": 8080, "mode": "nat", "externalId": "pod-1"}`
+	resp, err := http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	body = `{"name": "other", "host": "192.168.0.2", "port": 8080, "mode": "nat"}`
+	resp, err = http.Post(s.srv.URL+"/services/myservice/destinations", "application/json", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+
+	resp, err = http.Get(s.srv.URL + "/services/myservice/destinations?externalId=pod-1")
+	c.Assert(err, check.IsNil)
+	var dsts []types.Destination
+	err = json.NewDecoder(resp.Body).Decode(&dsts)
+	c.Assert(err, check.IsNil)
+	c.Assert(dsts, check.HasLen, 1)
+	c.Assert(dsts[0].Name, check.Equals, "mydst")
+}
+
+// noProbesBalancer is a balancer started without probes
+type noProbesBalancer struct {
+	api.Balancer
+}
+
+func (b noProbesBalancer) GetProbes() ([]types.ProbeResult, error) {
+	return nil, types.ErrProbesDisabled
+}
+
+func (s *S) TestProbeList(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice", Host: "10.0.0.1", Port: 80})
+	c.Assert(err, check.IsNil)
+	resp, err := http.Get(s.srv.URL + "/probes")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var results []types.ProbeResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	c.Assert(results[0].Address, check.Equals, "10.0.0.1:80")
+
+	disabled := httptest.NewServer(api.NewAPI(noProbesBalancer{Balancer: s.bal}))
+	defer disabled.Close()
+	resp, err = http.Get(disabled.URL + "/probes")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
+// overloadedBalancer is a leader shedding writes
+type overloadedBalancer struct {
+	api.Balancer
+}
+
+func (b overloadedBalancer) Overloaded() (time.Duration, bool) {
+	return 5 * time.Second, true
+}
+
+func (s *S) TestShedding(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	overloaded := httptest.NewServer(api.NewAPI(overloadedBalancer{Balancer: s.bal}))
+	defer overloaded.Close()
+
+	resp, err := http.Post(overloaded.URL+"/services", "application/json", strings.NewReader(`{"name": "other", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Header.Get("Retry-After"), check.Equals, "5")
+
+	resp, err = http.Get(overloaded.URL + "/services")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+
+	req, err := http.NewRequest("DELETE", overloaded.URL+"/services/myservice", nil)
+	c.Assert(err, check.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// isCheckMode reports whether the write was sent with ?check=true, to only preview it
+func isCheckMode(c *gin.Context) bool {
+	switch c.Query("check") {
+	case "true", "1":
+		return true
+	}
+	return false
+}
+
+func sameService(current, desired *types.Service) bool {
+	if desired.Host != "" && desired.Host != current.Host {
+		return false
+	}
+	return current.Name == desired.Name &&
+		current.Port == desired.Port &&
+		current.Protocol == desired.Protocol &&
+		current.Scheduler == desired.Scheduler &&
+		current.Type == desired.Type &&
+		current.MaxBandwidth == desired.MaxBandwidth &&
+		current.DSCP == desired.DSCP &&
+		current.MaxConnsPerClient == desired.MaxConnsPerClient &&
+		current.TTL == desired.TTL &&
+		current.RequireClientIP == desired.RequireClientIP &&
+		current.FirewallMark == desired.FirewallMark &&
+		current.PersistenceTimeout == desired.PersistenceTimeout &&
+		current.PersistenceNetmask == desired.PersistenceNetmask &&
+		current.ExternalId == desired.ExternalId &&
+		reflect.DeepEqual(current.MarkPorts, desired.MarkPorts) &&
+		reflect.DeepEqual(current.Policies, desired.Policies) &&
+		reflect.DeepEqual(current.SchedulerFlags, desired.SchedulerFlags) &&
+		reflect.DeepEqual(current.DependsOn, desired.DependsOn) &&
+		reflect.DeepEqual(current.Routes, desired.Routes) &&
+		reflect.DeepEqual(current.SNIRoutes, desired.SNIRoutes) &&
+		sameLabels(current.Labels, desired.Labels)
+}
+
+func sameLabels(current, desired map[string]string) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	for k, v := range desired {
+		if cur, ok := current[k]; !ok || cur != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sameDestination(current, desired *types.Destination) bool {
+	return current.Host == desired.Host &&
+		current.Port == desired.Port &&
+		current.Weight == desired.Weight &&
+		current.Mode == desired.Mode &&
+		current.ServiceId == desired.ServiceId &&
+		sameLabels(current.Labels, desired.Labels)
+}
+
+func (as ApiService) checkServiceUpsert(c *gin.Context, desired *types.Service) {
+	current, err := as.balancer.GetService(desired.GetId())
+	if err == types.ErrServiceNotFound {
+		c.JSON(http.StatusOK, types.CheckResult{Changed: true, After: desired})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	if sameService(current, desired) {
+		c.JSON(http.StatusOK, types.CheckResult{Changed: false, Before: current, After: current})
+		return
+	}
+	c.JSON(http.StatusOK, types.CheckResult{Changed: true, Before: current, After: desired})
+}
+
+func (as ApiService) checkServiceRename(c *gin.Context, id, name string) {
+	current, err := as.balancer.GetService(id)
+	if err == types.ErrServiceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	renamed := *current
+	renamed.Name = name
+	c.JSON(http.StatusOK, types.CheckResult{Changed: current.Name != name, Before: current, After: &renamed})
+}
+
+func (as ApiService) checkServiceDelete(c *gin.Context, id string) {
+	current, err := as.balancer.GetService(id)
+	if err == types.ErrServiceNotFound {
+		c.JSON(http.StatusOK, types.CheckResult{Changed: false})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, types.CheckResult{Changed: true, Before: current})
+}
+
+func (as ApiService) checkDestinationCreate(c *gin.Context, desired *types.Destination) {
+	current, err := as.balancer.GetDestination(desired.GetId())
+	if err == types.ErrDestinationNotFound {
+		c.JSON(http.StatusOK, types.CheckResult{Changed: true, After: desired})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		return
+	}
+	if sameDestination(current, desired) {
+		c.JSON(http.StatusOK, types.CheckResult{Changed: false, Before: current, After: current})
+		return
+	}
+	c.JSON(http.StatusOK, types.CheckResult{Changed: true, Before: current, After: desired})
+}
+
+func (as ApiService) checkDestinationDelete(c *gin.Context, id string) {
+	current, err := as.balancer.GetDestination(id)
+	if err == types.ErrDestinationNotFound {
+		c.JSON(http.StatusOK, types.CheckResult{Changed: false})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, types.CheckResult{Changed: true, Before: current})
+}
+
+// checkDestinationBulkDelete previews the matched destinations, drained or removed
+func checkDestinationBulkDelete(c *gin.Context, matched []types.Destination, drain bool) {
+	result := types.CheckResult{Changed: len(matched) > 0, Before: matched}
+	if drain {
+		drained := make([]types.Destination, len(matched))
+		for i, dst := range matched {
+			dst.Weight = 0
+			drained[i] = dst
+		}
+		result.After = drained
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (as ApiService) checkDestinationBatch(c *gin.Context, serviceId string, batch *types.DestinationBatch) {
+	planned, err := as.balancer.PlanDestinationBatch(serviceId, batch)
+	if err != nil {
+		batchError(c, "PlanDestinationBatch", err)
+		return
+	}
+	current, err := as.balancer.GetService(serviceId)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	changed := len(current.Destinations) != len(planned)
+	for i := 0; !changed && i < len(planned); i++ {
+		changed = current.Destinations[i].GetId() != planned[i].GetId() || !sameDestination(&current.Destinations[i], &planned[i])
+	}
+	c.JSON(http.StatusOK, types.CheckResult{Changed: changed, Before: current.Destinations, After: planned})
+}
@@ -0,0 +1,189 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"gopkg.in/check.v1"
+)
+
+type checkResult struct {
+	Changed bool
+	Before  map[string]interface{}
+	After   map[string]interface{}
+}
+
+func doCheck(c *check.C, method, url, body string) checkResult {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	var result checkResult
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	return result
+}
+
+func (s *S) TestServiceCreateCheckMode(c *check.C) {
+	body := `{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`
+	result := doCheck(c, "POST", s.srv.URL+"/services?check=true", body)
+	c.Assert(result.Changed, check.Equals, true)
+	c.Assert(result.Before, check.IsNil)
+	c.Assert(result.After["Name"], check.Equals, "ahoy")
+	_, err := s.bal.GetService("ahoy")
+	c.Assert(err, check.Equals, types.ErrServiceNotFound)
+}
+
+func (s *S) TestServiceCreateCheckModeUnchanged(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "ahoy", Port: 1040, Protocol: "tcp", Scheduler: "rr"})
+	c.Assert(err, check.IsNil)
+	body := `{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "rr"}`
+	result := doCheck(c, "POST", s.srv.URL+"/services?check=true", body)
+	c.Assert(result.Changed, check.Equals, false)
+	body = `{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "lc"}`
+	result = doCheck(c, "POST", s.srv.URL+"/services?check=true", body)
+	c.Assert(result.Changed, check.Equals, true)
+	c.Assert(result.Before["Scheduler"], check.Equals, "rr")
+	c.Assert(result.After["Scheduler"], check.Equals, "lc")
+}
+
+func (s *S) TestServiceUpdateCheckModeExternalId(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "ahoy", Port: 1040, Protocol: "tcp", Scheduler: "rr", ExternalId: "app-1"})
+	c.Assert(err, check.IsNil)
+	body := `{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "rr", "externalId": "app-1"}`
+	result := doCheck(c, "PUT", s.srv.URL+"/services/ahoy?check=true", body)
+	c.Assert(result.Changed, check.Equals, false)
+	body = `{"name": "ahoy", "port": 1040, "protocol": "tcp", "scheduler": "rr", "externalId": "app-2"}`
+	result = doCheck(c, "PUT", s.srv.URL+"/services/ahoy?check=true", body)
+	c.Assert(result.Changed, check.Equals, true)
+	c.Assert(result.Before["ExternalId"], check.Equals, "app-1")
+	c.Assert(result.After["ExternalId"], check.Equals, "app-2")
+}
+
+func (s *S) TestServiceDeleteCheckMode(c *check.C) {
+	result := doCheck(c, "DELETE", s.srv.URL+"/services/myservice?check=true", "")
+	c.Assert(result.Changed, check.Equals, false)
+	err := s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	result = doCheck(c, "DELETE", s.srv.URL+"/services/myservice?check=true", "")
+	c.Assert(result.Changed, check.Equals, true)
+	_, err = s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDestinationCreateCheckMode(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	body := `{"name": "mydest", "host": "myhost", "port": 1234}`
+	result := doCheck(c, "POST", s.srv.URL+"/services/myservice/destinations?check=true", body)
+	c.Assert(result.Changed, check.Equals, true)
+	err = s.bal.AddDestination(srv, &types.Destination{
+		Name:      "mydest",
+		Host:      "myhost",
+		Port:      1234,
+		Weight:    1,
+		Mode:      "route",
+		ServiceId: "myservice",
+	})
+	c.Assert(err, check.IsNil)
+	result = doCheck(c, "POST", s.srv.URL+"/services/myservice/destinations?check=true", body)
+	c.Assert(result.Changed, check.Equals, false)
+}
+
+func (s *S) TestDestinationDeleteCheckMode(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	result := doCheck(c, "DELETE", s.srv.URL+"/services/myservice/destinations/mydest?check=true", "")
+	c.Assert(result.Changed, check.Equals, false)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "mydest", ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+	result = doCheck(c, "DELETE", s.srv.URL+"/services/myservice/destinations/mydest?check=true", "")
+	c.Assert(result.Changed, check.Equals, true)
+	_, err = s.bal.GetDestination("mydest")
+	c.Assert(err, check.IsNil)
+}
+
+type destinationsCheckResult struct {
+	Changed bool
+	Before  []types.Destination
+	After   []types.Destination
+}
+
+func doDestinationsCheck(c *check.C, method, url, body string) destinationsCheckResult {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var result destinationsCheckResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	return result
+}
+
+func (s *S) TestDestinationBulkDeleteCheckMode(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	for i, deploy := range []string{"v1", "v2"} {
+		err = s.bal.AddDestination(srv, &types.Destination{Name: deploy, Host: fmt.Sprintf("10.0.0.%d", i+1), Port: 80, Weight: 1, ServiceId: "myservice", Labels: map[string]string{"deploy": deploy}})
+		c.Assert(err, check.IsNil)
+	}
+
+	result := doDestinationsCheck(c, "DELETE", s.srv.URL+"/services/myservice/destinations?labels=deploy=v1&check=true", "")
+	c.Assert(result.Changed, check.Equals, true)
+	c.Assert(result.Before, check.HasLen, 1)
+	c.Assert(result.Before[0].Name, check.Equals, "v1")
+	c.Assert(result.After, check.HasLen, 0)
+
+	result = doDestinationsCheck(c, "DELETE", s.srv.URL+"/services/myservice/destinations?labels=deploy=v1&drain=true&check=true", "")
+	c.Assert(result.Changed, check.Equals, true)
+	c.Assert(result.After, check.HasLen, 1)
+	c.Assert(result.After[0].Weight, check.Equals, int32(0))
+
+	result = doDestinationsCheck(c, "DELETE", s.srv.URL+"/services/myservice/destinations?labels=deploy=v3&check=true", "")
+	c.Assert(result.Changed, check.Equals, false)
+
+	svc, err := s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Destinations, check.HasLen, 2)
+	c.Assert(svc.Destinations[0].Weight, check.Equals, int32(1))
+}
+
+func (s *S) TestDestinationBatchCheckMode(c *check.C) {
+	srv := &types.Service{Name: "myservice"}
+	err := s.bal.AddService(srv)
+	c.Assert(err, check.IsNil)
+	err = s.bal.AddDestination(srv, &types.Destination{Name: "old", Host: "10.0.0.1", Port: 80, ServiceId: "myservice"})
+	c.Assert(err, check.IsNil)
+
+	body := `{"add": [{"host": "10.0.0.2", "port": 80}], "remove": ["old"]}`
+	for _, query := range []string{"?check=true", "?check=true&async=true"} {
+		result := doDestinationsCheck(c, "POST", s.srv.URL+"/services/myservice/destinations/batch"+query, body)
+		c.Assert(result.Changed, check.Equals, true)
+		c.Assert(result.Before, check.HasLen, 1)
+		c.Assert(result.After, check.HasLen, 1)
+		c.Assert(result.After[0].Host, check.Equals, "10.0.0.2")
+	}
+
+	// Invalid batches are rejected like when applied
+	req, err := http.NewRequest("POST", s.srv.URL+"/services/myservice/destinations/batch?check=true", strings.NewReader(`{"remove": ["unknown"]}`))
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	svc, err := s.bal.GetService("myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Destinations, check.HasLen, 1)
+	c.Assert(svc.Destinations[0].Name, check.Equals, "old")
+}
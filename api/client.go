@@ -2,12 +2,15 @@ package api
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +20,9 @@ import (
 type Client struct {
 	Addr       string
 	HttpClient *http.Client
+	// Stale reads are served from the local state of the balancer
+	Stale bool
+	Token string
 }
 
 func NewClient(addr string) *Client {
@@ -40,8 +46,15 @@ func NewClient(addr string) *Client {
 	}
 }
 
+// NewTLSClient returns a client of an API served over HTTPS
+func NewTLSClient(addr string, config *tls.Config) *Client {
+	c := NewClient(addr)
+	c.HttpClient.Transport.(*http.Transport).TLSClientConfig = config
+	return c
+}
+
 func (c *Client) GetServices() ([]*types.Service, error) {
-	resp, err := c.HttpClient.Get(c.path("services"))
+	resp, err := c.get(c.path("services"))
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +72,7 @@ func (c *Client) GetServices() ([]*types.Service, error) {
 }
 
 func (c *Client) GetService(id string) (*types.Service, error) {
-	resp, err := c.HttpClient.Get(c.path("services", id))
+	resp, err := c.get(c.path("services", id))
 	if err != nil {
 		return nil, err
 	}
@@ -76,12 +89,36 @@ func (c *Client) GetService(id string) (*types.Service, error) {
 	return svc, err
 }
 
+// FindServiceByExternalId looks up a service by its external id
+func (c *Client) FindServiceByExternalId(ref string) (*types.Service, error) {
+	query := url.Values{"externalId": {ref}}
+	resp, err := c.get(c.path("services") + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var services []types.Service
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &services)
+	default:
+		return nil, formatError(resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, types.ErrServiceNotFound
+	}
+	return &services[0], nil
+}
+
 func (c *Client) CreateService(svc types.Service) (string, error) {
 	json, err := encode(svc)
 	if err != nil {
 		return "", err
 	}
-	resp, err := c.HttpClient.Post(c.path("services"), "application/json", json)
+	resp, err := c.post(c.path("services"), "application/json", json)
 	if err != nil {
 		return "", err
 	}
@@ -98,12 +135,148 @@ func (c *Client) CreateService(svc types.Service) (string, error) {
 	return id, err
 }
 
+// GetSyncStatus returns the kernel sync status of a service
+func (c *Client) GetSyncStatus(id string) (*types.SyncStatus, error) {
+	resp, err := c.get(c.path("services", id, "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var status *types.SyncStatus
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &status)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return status, err
+}
+
+// GetServiceEvents returns the recent lifecycle events of a service
+func (c *Client) GetServiceEvents(id string) ([]types.Event, error) {
+	resp, err := c.get(c.path("services", id, "events"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var evts []types.Event
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &evts)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return evts, err
+}
+
+// GetClientIP returns the client IP semantics of a service
+func (c *Client) GetClientIP(id string) (*types.ClientIPReport, error) {
+	resp, err := c.get(c.path("services", id, "client-ip"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var report *types.ClientIPReport
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &report)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return report, err
+}
+
+// Simulate runs a scheduling simulation of a service
+func (c *Client) Simulate(id string, params types.SimulationParams) (*types.SimulationResult, error) {
+	json, err := encode(params)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(c.path("services", id, "simulate"), "application/json", json)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result *types.SimulationResult
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &result)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return result, err
+}
+
+// UpdateService updates a service, at svc.Version if set
+func (c *Client) UpdateService(svc types.Service) (*types.Service, error) {
+	json, err := encode(svc)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", c.path("services", svc.GetId()), json)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if svc.Version != 0 {
+		req.Header.Set("If-Match", fmt.Sprintf("%q", strconv.FormatUint(svc.Version, 10)))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var updated *types.Service
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &updated)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	case http.StatusPreconditionFailed:
+		return nil, types.ErrServiceVersionMismatch
+	default:
+		return nil, formatError(resp)
+	}
+	return updated, err
+}
+
+// RenameService changes the name of a service
+func (c *Client) RenameService(id, name string) (*types.Service, error) {
+	json, err := encode(map[string]string{"Name": name})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(c.path("services", id, "rename"), "application/json", json)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var renamed *types.Service
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &renamed)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return renamed, err
+}
+
 func (c *Client) DeleteService(id string) error {
 	req, err := http.NewRequest("DELETE", c.path("services", id), nil)
 	if err != nil {
 		return err
 	}
-	resp, err := c.HttpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -123,7 +296,7 @@ func (c *Client) AddDestination(dst types.Destination) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	resp, err := c.HttpClient.Post(c.path("services", dst.ServiceId, "destinations"), "application/json", json)
+	resp, err := c.post(c.path("services", dst.ServiceId, "destinations"), "application/json", json)
 	if err != nil {
 		return "", err
 	}
@@ -142,12 +315,135 @@ func (c *Client) AddDestination(dst types.Destination) (string, error) {
 	return id, err
 }
 
+// FindDestination looks up a destination of a service by its address.
+func (c *Client) FindDestination(serviceId, host string, port uint16) (*types.Destination, error) {
+	query := url.Values{"host": {host}, "port": {strconv.FormatUint(uint64(port), 10)}}
+	resp, err := c.get(c.path("services", serviceId, "destinations") + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var dsts []types.Destination
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &dsts)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(dsts) == 0 {
+		return nil, types.ErrDestinationNotFound
+	}
+	return &dsts[0], nil
+}
+
+// GetDestinationHealth returns the health state of a destination
+func (c *Client) GetDestinationHealth(serviceId, destinationId string) (*types.DestinationHealth, error) {
+	resp, err := c.get(c.path("services", serviceId, "destinations", destinationId, "health"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeHealth(resp)
+}
+
+// ReportDestinationHealth sends the result of a health check
+func (c *Client) ReportDestinationHealth(serviceId, destinationId string, healthy bool) (*types.DestinationHealth, error) {
+	json, err := encode(map[string]bool{"Healthy": healthy})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", c.path("services", serviceId, "destinations", destinationId, "health"), json)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeHealth(resp)
+}
+
+func decodeHealth(resp *http.Response) (*types.DestinationHealth, error) {
+	var health *types.DestinationHealth
+	var err error
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &health)
+	case http.StatusNotFound:
+		return nil, types.ErrDestinationNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return health, err
+}
+
+// UpdateDestination updates a destination, at dst.Version if set
+func (c *Client) UpdateDestination(dst types.Destination) (*types.Destination, error) {
+	json, err := encode(dst)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", c.path("services", dst.ServiceId, "destinations", dst.GetId()), json)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if dst.Version != 0 {
+		req.Header.Set("If-Match", fmt.Sprintf("%q", strconv.FormatUint(dst.Version, 10)))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var updated *types.Destination
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &updated)
+	case http.StatusNotFound:
+		return nil, types.ErrDestinationNotFound
+	case http.StatusPreconditionFailed:
+		return nil, types.ErrDestinationVersionMismatch
+	default:
+		return nil, formatError(resp)
+	}
+	return updated, err
+}
+
 func (c *Client) DeleteDestination(serviceId, destinationId string) error {
 	req, err := http.NewRequest("DELETE", c.path("services", serviceId, "destinations", destinationId), nil)
 	if err != nil {
 		return err
 	}
-	resp, err := c.HttpClient.Do(req)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = types.ErrDestinationNotFound
+	case http.StatusNoContent:
+	default:
+		err = formatError(resp)
+	}
+	return err
+}
+
+// DrainDestination removes a destination once its connections are done
+func (c *Client) DrainDestination(serviceId, destinationId string) error {
+	req, err := http.NewRequest("DELETE", c.path("services", serviceId, "destinations", destinationId)+"?drain=true", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -155,6 +451,167 @@ func (c *Client) DeleteDestination(serviceId, destinationId string) error {
 	switch resp.StatusCode {
 	case http.StatusNotFound:
 		err = types.ErrDestinationNotFound
+	case http.StatusAccepted:
+	default:
+		err = formatError(resp)
+	}
+	return err
+}
+
+// DeleteDestinations removes, or drains, the destinations matching selector
+func (c *Client) DeleteDestinations(serviceId string, selector map[string]string, drain bool) ([]types.Destination, error) {
+	query := url.Values{"labels": {types.FormatSelector(selector)}}
+	if drain {
+		query.Set("drain", "true")
+	}
+	req, err := http.NewRequest("DELETE", c.path("services", serviceId, "destinations")+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var dsts []types.Destination
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		err = decode(resp.Body, &dsts)
+	case http.StatusNotFound:
+		return nil, types.ErrServiceNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return dsts, err
+}
+
+// ApplyDestinationBatch applies batch, returning the resulting destinations
+func (c *Client) ApplyDestinationBatch(serviceId string, batch types.DestinationBatch) ([]types.Destination, error) {
+	json, err := encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(c.path("services", serviceId, "destinations", "batch"), "application/json", json)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var dsts []types.Destination
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &dsts)
+	case http.StatusNotFound:
+		// Either the service or a removed destination is missing
+		var body struct{ Error string }
+		if decode(resp.Body, &body) == nil && body.Error == types.ErrDestinationNotFound.Error() {
+			return nil, types.ErrDestinationNotFound
+		}
+		return nil, types.ErrServiceNotFound
+	case http.StatusConflict:
+		return nil, types.ErrDestinationAlreadyExists
+	default:
+		return nil, formatError(resp)
+	}
+	return dsts, err
+}
+
+// GetCluster returns the members of the cluster and its leader
+func (c *Client) GetCluster() (*types.Cluster, error) {
+	resp, err := c.get(c.path("cluster"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var cluster *types.Cluster
+	err = decode(resp.Body, &cluster)
+	return cluster, err
+}
+
+// ForceLeave makes a failed member of the cluster leave
+func (c *Client) ForceLeave(name string) error {
+	req, err := http.NewRequest("DELETE", c.path("cluster", "members", name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = types.ErrMemberNotFound
+	case http.StatusNoContent:
+	default:
+		err = formatError(resp)
+	}
+	return err
+}
+
+// GetClusterHealth returns the health of the raft servers of the cluster
+func (c *Client) GetClusterHealth() (*types.ClusterHealth, error) {
+	resp, err := c.get(c.path("cluster", "health"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var health *types.ClusterHealth
+	err = decode(resp.Body, &health)
+	return health, err
+}
+
+// GetPeers returns the raft servers of the cluster
+func (c *Client) GetPeers() ([]types.Peer, error) {
+	resp, err := c.get(c.path("cluster", "peers"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var peers []types.Peer
+	err = decode(resp.Body, &peers)
+	return peers, err
+}
+
+// AddPeer adds a balancer to raft
+func (c *Client) AddPeer(peer types.Peer) error {
+	json, err := encode(peer)
+	if err != nil {
+		return err
+	}
+	resp, err := c.post(c.path("cluster", "peers"), "application/json", json)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// RemovePeer removes a balancer from raft, by name or raft address
+func (c *Client) RemovePeer(peer string) error {
+	req, err := http.NewRequest("DELETE", c.path("cluster", "peers", peer), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = types.ErrPeerNotFound
 	case http.StatusNoContent:
 	default:
 		err = formatError(resp)
@@ -162,6 +619,103 @@ func (c *Client) DeleteDestination(serviceId, destinationId string) error {
 	return err
 }
 
+// GetProbes returns the last probe of each service through its VIP
+func (c *Client) GetProbes() ([]types.ProbeResult, error) {
+	resp, err := c.get(c.path("probes"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var results []types.ProbeResult
+	err = decode(resp.Body, &results)
+	return results, err
+}
+
+// ListKeys lists the gossip encryption keys installed across the cluster
+func (c *Client) ListKeys() (*types.Keyring, error) {
+	resp, err := c.get(c.path("keys"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var keyring *types.Keyring
+	err = decode(resp.Body, &keyring)
+	return keyring, err
+}
+
+// InstallKey adds a gossip encryption key to every member
+func (c *Client) InstallKey(key string) error {
+	return c.changeKeyring("", key)
+}
+
+// UseKey makes an installed key the one every member encrypts gossip with
+func (c *Client) UseKey(key string) error {
+	return c.changeKeyring("use", key)
+}
+
+// RemoveKey removes a gossip encryption key from every member
+func (c *Client) RemoveKey(key string) error {
+	return c.changeKeyring("remove", key)
+}
+
+func (c *Client) changeKeyring(op, key string) error {
+	json, err := encode(map[string]string{"Key": key})
+	if err != nil {
+		return err
+	}
+	path := c.path("keys")
+	if op != "" {
+		path = c.path("keys", op)
+	}
+	resp, err := c.post(path, "application/json", json)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// RotateCertificates makes every balancer reload its TLS certificates
+func (c *Client) RotateCertificates() error {
+	resp, err := c.post(c.path("certificates", "rotate"), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// GetJob returns the status and progress of a job
+func (c *Client) GetJob(id string) (*types.Job, error) {
+	resp, err := c.get(c.path("jobs", id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var job *types.Job
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &job)
+	case http.StatusNotFound:
+		return nil, types.ErrJobNotFound
+	default:
+		return nil, formatError(resp)
+	}
+	return job, err
+}
+
 func encode(obj interface{}) (io.Reader, error) {
 	b, err := json.Marshal(obj)
 	if err != nil {
@@ -182,8 +736,50 @@ func decode(body io.Reader, obj interface{}) error {
 	return nil
 }
 
+func (c *Client) get(url string) (*http.Response, error) {
+	if c.Stale {
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		url += sep + "stale"
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+func (c *Client) post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.do(req)
+}
+
+// do sends the request along with the token, if any
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.HttpClient.Do(req)
+}
+
 func formatError(resp *http.Response) error {
 	body, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return types.ErrUnauthorized
+	case http.StatusForbidden:
+		var reply struct{ Code string }
+		if json.Unmarshal(body, &reply) == nil && reply.Code == types.ErrCodeNoWrites {
+			return types.ErrNoWritesOnThisNode
+		}
+		return types.ErrForbidden
+	}
 	return fmt.Errorf("Request failed. Status Code: %v. Body: %q", resp.StatusCode, string(body))
 }
 
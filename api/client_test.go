@@ -5,8 +5,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/luizbafilho/fusis/api"
+	apiTesting "github.com/luizbafilho/fusis/api/testing"
 	"github.com/luizbafilho/fusis/api/types"
 	"gopkg.in/check.v1"
 )
@@ -36,6 +38,25 @@ func (s *S) TestClientGetServices(c *check.C) {
 	c.Assert(req.URL.Path, check.Equals, "/services")
 }
 
+func (s *S) TestClientGetServicesStale(c *check.C) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	cli.Stale = true
+	_, err := cli.GetServices()
+	c.Assert(err, check.IsNil)
+	c.Assert(req.URL.RawQuery, check.Equals, "stale")
+
+	_, err = cli.FindDestination("svc", "10.0.0.1", 80)
+	c.Assert(err, check.Equals, types.ErrDestinationNotFound)
+	c.Assert(req.URL.Query()["stale"], check.NotNil)
+	c.Assert(req.URL.Query().Get("host"), check.Equals, "10.0.0.1")
+}
+
 func (s *S) TestClientGetServicesEmpty(c *check.C) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
@@ -170,6 +191,165 @@ func (s *S) TestClientCreateServiceInvalidStatus(c *check.C) {
 	c.Assert(id, check.Equals, "")
 }
 
+func (s *S) TestClientUpdateService(c *check.C) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"name": "name1", "scheduler": "lc", "version": 8}`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	result, err := cli.UpdateService(types.Service{Name: "name1", Scheduler: "lc", Version: 7})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &types.Service{Name: "name1", Scheduler: "lc", Version: 8})
+	c.Assert(req.Method, check.Equals, "PUT")
+	c.Assert(req.URL.Path, check.Equals, "/services/name1")
+	c.Assert(req.Header.Get("If-Match"), check.Equals, `"7"`)
+	var sent types.Service
+	err = json.Unmarshal(body, &sent)
+	c.Assert(err, check.IsNil)
+	c.Assert(sent.Scheduler, check.Equals, "lc")
+}
+
+func (s *S) TestClientUpdateServiceVersionMismatch(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	result, err := cli.UpdateService(types.Service{Name: "name1", Version: 7})
+	c.Assert(err, check.Equals, types.ErrServiceVersionMismatch)
+	c.Assert(result, check.IsNil)
+}
+
+func (s *S) TestClientUpdateDestination(c *check.C) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"name": "dst1", "serviceid": "name1", "weight": 5, "version": 8}`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	result, err := cli.UpdateDestination(types.Destination{Name: "dst1", ServiceId: "name1", Weight: 5, Version: 7})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &types.Destination{Name: "dst1", ServiceId: "name1", Weight: 5, Version: 8})
+	c.Assert(req.Method, check.Equals, "PUT")
+	c.Assert(req.URL.Path, check.Equals, "/services/name1/destinations/dst1")
+	c.Assert(req.Header.Get("If-Match"), check.Equals, `"7"`)
+	var sent types.Destination
+	err = json.Unmarshal(body, &sent)
+	c.Assert(err, check.IsNil)
+	c.Assert(sent.Weight, check.Equals, int32(5))
+}
+
+func (s *S) TestClientRenameService(c *check.C) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"id": "id1", "name": "new name"}`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	result, err := cli.RenameService("id1", "new name")
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &types.Service{Id: "id1", Name: "new name"})
+	c.Assert(req.Method, check.Equals, "POST")
+	c.Assert(req.URL.Path, check.Equals, "/services/id1/rename")
+	c.Assert(string(body), check.Equals, `{"Name":"new name"}`)
+}
+
+func (s *S) TestClientFindDestination(c *check.C) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.Write([]byte(`[{"name": "d1", "host": "10.0.0.1", "port": 80, "serviceid": "svc1"}]`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	dst, err := cli.FindDestination("svc1", "10.0.0.1", 80)
+	c.Assert(err, check.IsNil)
+	c.Assert(dst, check.DeepEquals, &types.Destination{Name: "d1", Host: "10.0.0.1", Port: 80, ServiceId: "svc1"})
+	c.Assert(req.URL.Path, check.Equals, "/services/svc1/destinations")
+	c.Assert(req.URL.Query().Get("host"), check.Equals, "10.0.0.1")
+	c.Assert(req.URL.Query().Get("port"), check.Equals, "80")
+}
+
+func (s *S) TestClientFindDestinationNotFound(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	dst, err := cli.FindDestination("svc1", "10.0.0.1", 80)
+	c.Assert(err, check.Equals, types.ErrDestinationNotFound)
+	c.Assert(dst, check.IsNil)
+}
+
+func (s *S) TestClientGetSyncStatus(c *check.C) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.Write([]byte(`{"version": 3, "syncedversion": 2, "synced": false, "error": "boom"}`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	status, err := cli.GetSyncStatus("svc1")
+	c.Assert(err, check.IsNil)
+	c.Assert(status, check.DeepEquals, &types.SyncStatus{Version: 3, SyncedVersion: 2, Error: "boom"})
+	c.Assert(req.URL.Path, check.Equals, "/services/svc1/status")
+}
+
+func (s *S) TestClientGetServiceEvents(c *check.C) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.Write([]byte(`[{"time": "2016-01-01T00:00:00Z", "type": "ServiceCreated", "message": "created"}]`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	evts, err := cli.GetServiceEvents("svc1")
+	c.Assert(err, check.IsNil)
+	c.Assert(evts, check.DeepEquals, []types.Event{
+		{Time: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), Type: "ServiceCreated", Message: "created"},
+	})
+	c.Assert(req.URL.Path, check.Equals, "/services/svc1/events")
+}
+
+func (s *S) TestClientReportDestinationHealth(c *check.C) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"healthy": false, "flapping": true}`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	health, err := cli.ReportDestinationHealth("svc1", "dst1", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(health.Flapping, check.Equals, true)
+	c.Assert(req.Method, check.Equals, "PUT")
+	c.Assert(req.URL.Path, check.Equals, "/services/svc1/destinations/dst1/health")
+	c.Assert(string(body), check.Equals, `{"Healthy":false}`)
+}
+
+func (s *S) TestClientGetDestinationHealthNotFound(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	health, err := cli.GetDestinationHealth("svc1", "dst1")
+	c.Assert(err, check.Equals, types.ErrDestinationNotFound)
+	c.Assert(health, check.IsNil)
+}
+
 func (s *S) TestClientDeleteService(c *check.C) {
 	var req *http.Request
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -297,3 +477,111 @@ func (s *S) TestClientDeleteDestinationNotFound(c *check.C) {
 	err := cli.DeleteDestination("svid1", "dstid1")
 	c.Assert(err, check.Equals, types.ErrDestinationNotFound)
 }
+
+func (s *S) TestClientDeleteDestinations(c *check.C) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`[{"Name": "dst1", "Labels": {"deploy": "v1"}}]`))
+	}))
+	defer srv.Close()
+	cli := api.NewClient(srv.URL)
+	dsts, err := cli.DeleteDestinations("svid1", map[string]string{"deploy": "v1", "zone": "a"}, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(dsts, check.DeepEquals, []types.Destination{{Name: "dst1", Labels: map[string]string{"deploy": "v1"}}})
+	c.Assert(req.Method, check.Equals, "DELETE")
+	c.Assert(req.URL.Path, check.Equals, "/services/svid1/destinations")
+	c.Assert(req.URL.Query().Get("labels"), check.Equals, "deploy=v1,zone=a")
+	c.Assert(req.URL.Query().Get("drain"), check.Equals, "true")
+}
+
+func (s *S) TestClientGetCluster(c *check.C) {
+	cli := api.NewClient(s.srv.URL)
+	cluster, err := cli.GetCluster()
+	c.Assert(err, check.IsNil)
+	c.Assert(cluster.Leader, check.Equals, "localhost:4382")
+	c.Assert(cluster.Members, check.HasLen, 2)
+	c.Assert(cluster.Members[0].Leader, check.Equals, true)
+}
+
+func (s *S) TestClientForceLeave(c *check.C) {
+	cli := api.NewClient(s.srv.URL)
+	c.Assert(cli.ForceLeave("agent-1"), check.IsNil)
+	cluster, err := cli.GetCluster()
+	c.Assert(err, check.IsNil)
+	c.Assert(cluster.Members[1].Status, check.Equals, "left")
+	c.Assert(cli.ForceLeave("agent-2"), check.Equals, types.ErrMemberNotFound)
+	err = cli.ForceLeave("balancer-1")
+	c.Assert(err, check.ErrorMatches, `.*Status Code: 400.*member alive.*`)
+}
+
+func (s *S) TestClientGetClusterHealth(c *check.C) {
+	health, err := api.NewClient(s.srv.URL).GetClusterHealth()
+	c.Assert(err, check.IsNil)
+	c.Assert(health.Healthy, check.Equals, true)
+	c.Assert(health.Servers, check.HasLen, 1)
+	c.Assert(health.Servers[0].Leader, check.Equals, true)
+}
+
+func (s *S) TestClientPeers(c *check.C) {
+	cli := api.NewClient(s.srv.URL)
+	c.Assert(cli.AddPeer(types.Peer{Name: "balancer-2", Address: "10.0.0.2:4382", NonVoter: true}), check.IsNil)
+	peers, err := cli.GetPeers()
+	c.Assert(err, check.IsNil)
+	c.Assert(peers, check.DeepEquals, []types.Peer{
+		{Name: "balancer-1", Address: "localhost:4382"},
+		{Name: "balancer-2", Address: "10.0.0.2:4382", NonVoter: true},
+	})
+	err = cli.AddPeer(types.Peer{Name: "balancer-3"})
+	c.Assert(err, check.ErrorMatches, `.*Status Code: 400.*invalid peer.*`)
+
+	c.Assert(cli.RemovePeer("balancer-2"), check.IsNil)
+	c.Assert(cli.RemovePeer("balancer-2"), check.Equals, types.ErrPeerNotFound)
+	c.Assert(cli.RemovePeer("localhost:4382"), check.IsNil)
+	peers, err = cli.GetPeers()
+	c.Assert(err, check.IsNil)
+	c.Assert(peers, check.HasLen, 0)
+}
+
+func (s *S) TestClientFindServiceByExternalId(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "web", ExternalId: "tsuru-web"})
+	c.Assert(err, check.IsNil)
+	cli := api.NewClient(s.srv.URL)
+	svc, err := cli.FindServiceByExternalId("tsuru-web")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Name, check.Equals, "web")
+	_, err = cli.FindServiceByExternalId("unknown")
+	c.Assert(err, check.Equals, types.ErrServiceNotFound)
+}
+
+func (s *S) TestClientKeyring(c *check.C) {
+	key := "ZmVkY2JhOTg3NjU0MzIxMA=="
+	cli := api.NewClient(s.srv.URL)
+	c.Assert(cli.InstallKey(key), check.IsNil)
+	c.Assert(cli.UseKey(key), check.IsNil)
+	c.Assert(cli.RemoveKey(apiTesting.EncryptKey), check.IsNil)
+	keyring, err := cli.ListKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(keyring.Keys, check.DeepEquals, map[string]int{key: 1})
+	c.Assert(keyring.Members, check.Equals, 1)
+
+	err = cli.RemoveKey(key)
+	c.Assert(err, check.ErrorMatches, `.*removing the primary key is not allowed.*`)
+	err = cli.InstallKey("c2hvcnQ=")
+	c.Assert(err, check.ErrorMatches, `.*Status Code: 400.*invalid encryption key.*`)
+}
+
+func (s *S) TestClientRotateCertificates(c *check.C) {
+	c.Assert(api.NewClient(s.srv.URL).RotateCertificates(), check.IsNil)
+}
+
+func (s *S) TestClientGetProbes(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "web", Host: "10.0.0.1", Port: 80})
+	c.Assert(err, check.IsNil)
+	results, err := api.NewClient(s.srv.URL).GetProbes()
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	c.Assert(results[0].Service, check.Equals, "web")
+	c.Assert(results[0].Success, check.Equals, true)
+}
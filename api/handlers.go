@@ -1,16 +1,26 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/gin-gonic/gin"
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/jobs"
+	"github.com/luizbafilho/fusis/metrics"
+	"github.com/luizbafilho/fusis/simulation"
 )
 
 func (as ApiService) serviceList(c *gin.Context) {
 	fmt.Println("testando redirect")
+	if ref := c.Query("externalId"); ref != "" {
+		as.serviceListByExternalId(c, ref)
+		return
+	}
 	services := as.balancer.GetServices()
 	if len(services) == 0 {
 		c.Status(http.StatusNoContent)
@@ -19,6 +29,48 @@ func (as ApiService) serviceList(c *gin.Context) {
 	c.JSON(http.StatusOK, services)
 }
 
+// serviceListByExternalId lists the service with the external id ref, if any
+func (as ApiService) serviceListByExternalId(c *gin.Context, ref string) {
+	service, err := as.balancer.GetServiceByExternalId(ref)
+	if err == types.ErrServiceNotFound {
+		c.JSON(http.StatusOK, []types.Service{})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetServiceByExternalId() failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, []types.Service{*service})
+}
+
+func (as ApiService) metricsGet(c *gin.Context) {
+	sink := metrics.Global()
+	if sink == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "metrics aren't collected"})
+		return
+	}
+	c.JSON(http.StatusOK, sink.Snapshot())
+}
+
+func (as ApiService) quarantineList(c *gin.Context) {
+	c.JSON(http.StatusOK, as.balancer.GetQuarantined())
+}
+
+func (as ApiService) probeList(c *gin.Context) {
+	results, err := as.balancer.GetProbes()
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrProbesDisabled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetProbes() failed: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
 func (as ApiService) serviceGet(c *gin.Context) {
 	serviceId := c.Param("service_name")
 	service, err := as.balancer.GetService(serviceId)
@@ -31,9 +83,218 @@ func (as ApiService) serviceGet(c *gin.Context) {
 		}
 		return
 	}
+	setVersionHeader(c, service.Version)
 	c.JSON(http.StatusOK, service)
 }
 
+// serviceSyncStatus is the endpoint of the X-Sync-Status header
+func (as ApiService) serviceSyncStatus(c *gin.Context) {
+	status, err := as.balancer.GetSyncStatus(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetSyncStatus() failed: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (as ApiService) clusterGet(c *gin.Context) {
+	c.JSON(http.StatusOK, as.balancer.GetCluster())
+}
+
+func (as ApiService) clusterHealth(c *gin.Context) {
+	health, err := as.balancer.GetClusterHealth()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetClusterHealth() failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, health)
+}
+
+func (as ApiService) peerList(c *gin.Context) {
+	peers, err := as.balancer.GetPeers()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetPeers() failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, peers)
+}
+
+func (as ApiService) peerAdd(c *gin.Context) {
+	var peer types.Peer
+	if err := c.BindJSON(&peer); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := as.balancer.AddPeer(peer); err != nil {
+		c.Error(err)
+		if err == types.ErrInvalidPeer {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("AddPeer() failed: %v", err)})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// peerRemove takes a name or a raft address
+func (as ApiService) peerRemove(c *gin.Context) {
+	if err := as.balancer.RemovePeer(c.Param("peer")); err != nil {
+		c.Error(err)
+		if err == types.ErrPeerNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("RemovePeer() failed: %v", err)})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (as ApiService) memberForceLeave(c *gin.Context) {
+	if err := as.balancer.ForceLeave(c.Param("member_name")); err != nil {
+		c.Error(err)
+		switch err {
+		case types.ErrMemberNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case types.ErrMemberAlive:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("ForceLeave() failed: %v", err)})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (as ApiService) keyList(c *gin.Context) {
+	keyring, err := as.balancer.ListKeys()
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrGossipNotEncrypted {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("ListKeys() failed: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, keyring)
+}
+
+func (as ApiService) keyInstall(c *gin.Context) {
+	as.keyChange(c, "InstallKey", as.balancer.InstallKey)
+}
+
+func (as ApiService) keyUse(c *gin.Context) {
+	as.keyChange(c, "UseKey", as.balancer.UseKey)
+}
+
+func (as ApiService) keyRemove(c *gin.Context) {
+	as.keyChange(c, "RemoveKey", as.balancer.RemoveKey)
+}
+
+// keyChange changes the keyring with the key in the request body
+func (as ApiService) keyChange(c *gin.Context, name string, change func(key string) error) {
+	var params struct {
+		Key string
+	}
+	if err := c.BindJSON(&params); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !types.ValidEncryptKey(params.Key) {
+		c.Error(types.ErrInvalidEncryptKey)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidEncryptKey.Error()})
+		return
+	}
+
+	if err := change(params.Key); err != nil {
+		c.Error(err)
+		if err == types.ErrGossipNotEncrypted || err == types.ErrInvalidEncryptKey {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s() failed: %v", name, err)})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (as ApiService) certificatesRotate(c *gin.Context) {
+	if err := as.balancer.RotateCertificates(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("RotateCertificates() failed: %v", err)})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// serviceEvents lists the events of a service, oldest first
+func (as ApiService) serviceEvents(c *gin.Context) {
+	evts, err := as.balancer.GetServiceEvents(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetServiceEvents() failed: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, evts)
+}
+
+func (as ApiService) serviceClientIP(c *gin.Context) {
+	service, err := as.balancer.GetService(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, service.ClientIP())
+}
+
+func (as ApiService) serviceSimulate(c *gin.Context) {
+	service, err := as.balancer.GetService(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+
+	var params types.SimulationParams
+	if err := c.BindJSON(&params); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := simulation.Run(*service, params)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func (as ApiService) serviceCreate(c *gin.Context) {
 	var newService types.Service
 	if err := c.BindJSON(&newService); err != nil {
@@ -50,24 +311,227 @@ func (as ApiService) serviceCreate(c *gin.Context) {
 		return
 	}
 
+	if newService.Id == "" {
+		newService.Id = as.balancer.GenerateServiceId(newService)
+	}
+	if !types.ValidServiceId(newService.Id) {
+		c.Error(types.ErrInvalidServiceId)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidServiceId.Error()})
+		return
+	}
+	if !newService.ValidServiceType() {
+		c.Error(types.ErrInvalidServiceType)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidServiceType.Error()})
+		return
+	}
+	if !newService.ValidDSCP() {
+		c.Error(types.ErrInvalidDSCP)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidDSCP.Error()})
+		return
+	}
+	if !newService.ValidClientIP() {
+		c.Error(types.ErrClientIPNotPreserved)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrClientIPNotPreserved.Error()})
+		return
+	}
+	if !newService.ValidFirewallMark() {
+		c.Error(types.ErrInvalidFirewallMark)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidFirewallMark.Error()})
+		return
+	}
+	if !newService.ValidPolicies() {
+		c.Error(types.ErrInvalidPolicies)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidPolicies.Error()})
+		return
+	}
+	if !newService.ValidPersistence() {
+		c.Error(types.ErrInvalidPersistence)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidPersistence.Error()})
+		return
+	}
+	if !newService.ValidSchedulerFlags() {
+		c.Error(types.ErrInvalidSchedulerFlags)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidSchedulerFlags.Error()})
+		return
+	}
+
+	if isCheckMode(c) {
+		as.checkServiceUpsert(c, &newService)
+		return
+	}
+
 	// If everthing is ok send it to Raft
 	err := as.balancer.AddService(&newService)
 	if err != nil {
 		c.Error(err)
-		if err == types.ErrServiceAlreadyExists {
+		if err == types.ErrServiceAlreadyExists || err == types.ErrFirewallMarkInUse || err == types.ErrExternalIdInUse || err == types.ErrVIPInUse {
 			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else if err == types.ErrInvalidDependency || err == types.ErrSchedulerUnavailable || err == types.ErrUnknownPool || err == types.ErrUnknownProvider || err == types.ErrInvalidVIP || err == types.ErrInvalidPersistence {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("UpsertService() failed: %v", err)})
 		}
 		return
 	}
 
-	c.Header("Location", fmt.Sprintf("/services/%s", newService.Name))
+	c.Header("Location", fmt.Sprintf("/services/%s", newService.GetId()))
+	setSyncStatusHeader(c, newService.GetId())
 	c.JSON(http.StatusCreated, newService)
 }
 
+func (as ApiService) serviceUpdate(c *gin.Context) {
+	serviceId := c.Param("service_name")
+	var service types.Service
+	if err := c.BindJSON(&service); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	service.Id = serviceId
+	if service.Name == "" {
+		current, err := as.balancer.GetService(serviceId)
+		if err != nil {
+			c.Error(err)
+			if err == types.ErrServiceNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+			}
+			return
+		}
+		service.Name = current.Name
+	}
+
+	version, err := versionFromHeader(c)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if version != 0 {
+		service.Version = version
+	}
+
+	if _, errs := govalidator.ValidateStruct(service); errs != nil {
+		c.Error(errs)
+		c.JSON(http.StatusBadRequest, gin.H{"errors": govalidator.ErrorsByField(errs)})
+		return
+	}
+	if !service.ValidServiceType() {
+		c.Error(types.ErrInvalidServiceType)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidServiceType.Error()})
+		return
+	}
+	if !service.ValidDSCP() {
+		c.Error(types.ErrInvalidDSCP)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidDSCP.Error()})
+		return
+	}
+	if !service.ValidClientIP() {
+		c.Error(types.ErrClientIPNotPreserved)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrClientIPNotPreserved.Error()})
+		return
+	}
+	if !service.ValidFirewallMark() {
+		c.Error(types.ErrInvalidFirewallMark)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidFirewallMark.Error()})
+		return
+	}
+	if !service.ValidPolicies() {
+		c.Error(types.ErrInvalidPolicies)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidPolicies.Error()})
+		return
+	}
+	if !service.ValidPersistence() {
+		c.Error(types.ErrInvalidPersistence)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidPersistence.Error()})
+		return
+	}
+	if !service.ValidSchedulerFlags() {
+		c.Error(types.ErrInvalidSchedulerFlags)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidSchedulerFlags.Error()})
+		return
+	}
+
+	if isCheckMode(c) {
+		as.checkServiceUpsert(c, &service)
+		return
+	}
+
+	err = as.balancer.UpdateService(&service)
+	if err != nil {
+		c.Error(err)
+		switch err {
+		case types.ErrServiceNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case types.ErrServiceVersionMismatch:
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		case types.ErrFirewallMarkInUse, types.ErrExternalIdInUse:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case types.ErrInvalidDependency, types.ErrSchedulerUnavailable, types.ErrInvalidPersistence:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("UpdateService() failed: %v", err)})
+		}
+		return
+	}
+
+	updated, err := as.balancer.GetService(serviceId)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	setVersionHeader(c, updated.Version)
+	setSyncStatusHeader(c, updated.GetId())
+	c.JSON(http.StatusOK, updated)
+}
+
+func (as ApiService) serviceRename(c *gin.Context) {
+	serviceId := c.Param("service_name")
+	var params struct {
+		Name string `valid:"required"`
+	}
+	if err := c.BindJSON(&params); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, errs := govalidator.ValidateStruct(params); errs != nil {
+		c.Error(errs)
+		c.JSON(http.StatusBadRequest, gin.H{"errors": govalidator.ErrorsByField(errs)})
+		return
+	}
+
+	if isCheckMode(c) {
+		as.checkServiceRename(c, serviceId, params.Name)
+		return
+	}
+
+	service, err := as.balancer.RenameService(serviceId, params.Name)
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("RenameService() failed: %v", err)})
+		}
+		return
+	}
+
+	setVersionHeader(c, service.Version)
+	setSyncStatusHeader(c, service.GetId())
+	c.JSON(http.StatusOK, service)
+}
+
 func (as ApiService) serviceDelete(c *gin.Context) {
 	serviceId := c.Param("service_name")
+	if isCheckMode(c) {
+		as.checkServiceDelete(c, serviceId)
+		return
+	}
+
 	_, err := as.balancer.GetService(serviceId)
 	if err != nil {
 		c.Error(err)
@@ -115,10 +579,33 @@ func (as ApiService) destinationCreate(c *gin.Context) {
 		return
 	}
 
+	if !destination.ValidLabels() {
+		c.Error(types.ErrInvalidLabels)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidLabels.Error()})
+		return
+	}
+	if !service.ValidDestinationMode(destination.Mode) {
+		c.Error(types.ErrClientIPNotPreserved)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrClientIPNotPreserved.Error()})
+		return
+	}
+
+	destination.ServiceId = service.GetId()
+	if destination.Name == "" {
+		destination.Name = types.DestinationName(destination.ServiceId, destination.Host, destination.Port)
+	}
+
+	if isCheckMode(c) {
+		as.checkDestinationCreate(c, destination)
+		return
+	}
+
 	err = as.balancer.AddDestination(service, destination)
 	if err != nil {
 		c.Error(err)
-		if err == types.ErrDestinationAlreadyExists {
+		if _, ok := err.(types.ErrDestinationUnreachable); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else if err == types.ErrDestinationAlreadyExists || err == types.ErrExternalIdInUse {
 			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("UpsertDestination() failed: %v\n", err)})
@@ -127,11 +614,134 @@ func (as ApiService) destinationCreate(c *gin.Context) {
 	}
 
 	c.Header("Location", fmt.Sprintf("/services/%s/destinations/%s", serviceName, destination.Name))
+	setSyncStatusHeader(c, destination.ServiceId)
 	c.JSON(http.StatusCreated, destination)
 }
 
+// destinationList filters by the host and port query params, if any
+func (as ApiService) destinationList(c *gin.Context) {
+	service, err := as.balancer.GetService(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+
+	selector, ok := selectorFromQuery(c)
+	if !ok {
+		return
+	}
+	host := c.Query("host")
+	var port uint64
+	if p := c.Query("port"); p != "" {
+		if port, err = strconv.ParseUint(p, 10, 16); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid port: %q", p)})
+			return
+		}
+	}
+
+	candidates := service.Destinations
+	if ref := c.Query("externalId"); ref != "" {
+		candidates = nil
+		if dst, err := as.balancer.GetDestinationByExternalId(ref); err == nil && dst.ServiceId == service.GetId() {
+			candidates = []types.Destination{*dst}
+		}
+	}
+
+	destinations := []types.Destination{}
+	for _, dst := range candidates {
+		if host != "" && dst.Host != host {
+			continue
+		}
+		if port != 0 && dst.Port != uint16(port) {
+			continue
+		}
+		if !dst.MatchLabels(selector) {
+			continue
+		}
+		destinations = append(destinations, dst)
+	}
+	c.JSON(http.StatusOK, destinations)
+}
+
+// destinationUpdate keeps the attributes missing from the body
+func (as ApiService) destinationUpdate(c *gin.Context) {
+	current, err := as.balancer.GetDestination(c.Param("destination_name"))
+	if err == nil && current.ServiceId != c.Param("service_name") {
+		err = types.ErrDestinationNotFound
+	}
+	if err != nil {
+		c.Error(err)
+		if _, ok := err.(types.ErrNotFound); ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		}
+		return
+	}
+
+	destination := *current
+	destination.Version = 0
+	if err := c.BindJSON(&destination); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	version, err := versionFromHeader(c)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if version != 0 {
+		destination.Version = version
+	}
+
+	if !destination.ValidLabels() {
+		c.Error(types.ErrInvalidLabels)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidLabels.Error()})
+		return
+	}
+
+	if isCheckMode(c) {
+		as.checkDestinationCreate(c, &destination)
+		return
+	}
+
+	err = as.balancer.UpdateDestination(&destination)
+	if err != nil {
+		c.Error(err)
+		switch err {
+		case types.ErrDestinationNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case types.ErrDestinationVersionMismatch:
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		case types.ErrClientIPNotPreserved:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("UpdateDestination() failed: %v", err)})
+		}
+		return
+	}
+
+	setVersionHeader(c, destination.Version)
+	setSyncStatusHeader(c, destination.ServiceId)
+	c.JSON(http.StatusOK, destination)
+}
+
 func (as ApiService) destinationDelete(c *gin.Context) {
 	destinationId := c.Param("destination_name")
+	if isCheckMode(c) {
+		as.checkDestinationDelete(c, destinationId)
+		return
+	}
+
 	dst, err := as.balancer.GetDestination(destinationId)
 	if err != nil {
 		c.Error(err)
@@ -143,15 +753,253 @@ func (as ApiService) destinationDelete(c *gin.Context) {
 		return
 	}
 
+	// Drains are tracked by a job
+	if c.Query("drain") == "true" {
+		if err := as.balancer.DrainDestination(dst); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("DrainDestination() failed: %v", err)})
+			return
+		}
+		job := as.startDrainJob([]string{dst.GetId()})
+		setSyncStatusHeader(c, dst.ServiceId)
+		setJobLocation(c, job)
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+
 	err = as.balancer.DeleteDestination(dst)
 	if err != nil {
 		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("DeleteDestination() failed: %v\n", err)})
 	}
 
+	setSyncStatusHeader(c, dst.ServiceId)
 	c.Status(http.StatusNoContent)
 }
 
+// selectorFromQuery parses the labels query param, replying when it's invalid
+func selectorFromQuery(c *gin.Context) (map[string]string, bool) {
+	q := c.Query("labels")
+	if q == "" {
+		return nil, true
+	}
+	selector, err := types.ParseSelector(q)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return selector, true
+}
+
+// destinationBulkDelete requires a selector, not to remove everything by mistake
+func (as ApiService) destinationBulkDelete(c *gin.Context) {
+	if c.Query("labels") == "" {
+		c.Error(types.ErrInvalidSelector)
+		c.JSON(http.StatusBadRequest, gin.H{"error": types.ErrInvalidSelector.Error()})
+		return
+	}
+	selector, ok := selectorFromQuery(c)
+	if !ok {
+		return
+	}
+
+	service, err := as.balancer.GetService(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrServiceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+
+	matched := []types.Destination{}
+	for _, dst := range service.Destinations {
+		if dst.MatchLabels(selector) {
+			matched = append(matched, dst)
+		}
+	}
+
+	drain := c.Query("drain") == "true"
+	if isCheckMode(c) {
+		checkDestinationBulkDelete(c, matched, drain)
+		return
+	}
+	for i := range matched {
+		if drain {
+			err = as.balancer.DrainDestination(&matched[i])
+		} else {
+			err = as.balancer.DeleteDestination(&matched[i])
+		}
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("removing destination %s failed: %v", matched[i].Name, err), "removed": matched[:i]})
+			return
+		}
+	}
+
+	setSyncStatusHeader(c, service.GetId())
+	if drain {
+		names := make([]string, len(matched))
+		for i, dst := range matched {
+			names[i] = dst.GetId()
+		}
+		setJobLocation(c, as.startDrainJob(names))
+		c.JSON(http.StatusAccepted, matched)
+		return
+	}
+	c.JSON(http.StatusOK, matched)
+}
+
+// destinationBatch replies with the job tracking the drains with ?async=true
+func (as ApiService) destinationBatch(c *gin.Context) {
+	var req struct {
+		Add    []json.RawMessage
+		Remove []string
+		Drain  []string
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	batch := &types.DestinationBatch{Remove: req.Remove, Drain: req.Drain}
+	for _, raw := range req.Add {
+		destination := types.Destination{Weight: 1, Mode: "route", ServiceId: c.Param("service_name")}
+		if err := json.Unmarshal(raw, &destination); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, errs := govalidator.ValidateStruct(destination); errs != nil {
+			c.Error(errs)
+			c.JSON(http.StatusBadRequest, gin.H{"errors": govalidator.ErrorsByField(errs)})
+			return
+		}
+		batch.Add = append(batch.Add, destination)
+	}
+
+	serviceId := c.Param("service_name")
+	if isCheckMode(c) {
+		as.checkDestinationBatch(c, serviceId, batch)
+		return
+	}
+	if isAsync(c) {
+		job := as.jobs.Start("batch", len(batch.Drain)+1, func(p *jobs.Progress) (interface{}, error) {
+			if err := as.balancer.ApplyDestinationBatch(serviceId, batch); err != nil {
+				return nil, err
+			}
+			p.Step(1)
+			if err := as.waitDrained(p, batch.Drain); err != nil {
+				return nil, err
+			}
+			service, err := as.balancer.GetService(serviceId)
+			if err != nil {
+				return nil, err
+			}
+			return service.Destinations, nil
+		})
+		setJobLocation(c, job)
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+
+	err := as.balancer.ApplyDestinationBatch(serviceId, batch)
+	if err != nil {
+		batchError(c, "ApplyDestinationBatch", err)
+		return
+	}
+
+	service, err := as.balancer.GetService(c.Param("service_name"))
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	setSyncStatusHeader(c, service.GetId())
+	if len(batch.Drain) > 0 {
+		setJobLocation(c, as.startDrainJob(batch.Drain))
+	}
+	c.JSON(http.StatusOK, service.Destinations)
+}
+
+// batchError replies with the status of an error validating a batch
+func batchError(c *gin.Context, op string, err error) {
+	c.Error(err)
+	switch err {
+	case types.ErrServiceNotFound, types.ErrDestinationNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case types.ErrDestinationAlreadyExists, types.ErrExternalIdInUse:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case types.ErrInvalidBatch, types.ErrInvalidLabels, types.ErrClientIPNotPreserved:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s() failed: %v", op, err)})
+	}
+}
+
+func (as ApiService) destinationHealth(c *gin.Context) {
+	health, err := as.balancer.GetDestinationHealth(c.Param("destination_name"))
+	if err != nil {
+		c.Error(err)
+		if err == types.ErrDestinationNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("GetDestinationHealth() failed: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, health)
+}
+
+func (as ApiService) destinationReportHealth(c *gin.Context) {
+	destinationId := c.Param("destination_name")
+	var report struct {
+		Healthy bool
+	}
+	if err := c.BindJSON(&report); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := as.balancer.ReportDestinationHealth(destinationId, report.Healthy); err != nil {
+		c.Error(err)
+		if err == types.ErrDestinationNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("ReportDestinationHealth() failed: %v", err)})
+		}
+		return
+	}
+
+	as.destinationHealth(c)
+}
+
+// setVersionHeader sets the ETag clients send back in If-Match
+func setVersionHeader(c *gin.Context, version uint64) {
+	c.Header("ETag", fmt.Sprintf("%q", strconv.FormatUint(version, 10)))
+}
+
+func setSyncStatusHeader(c *gin.Context, serviceId string) {
+	c.Header("X-Sync-Status", fmt.Sprintf("/services/%s/status", serviceId))
+}
+
+func versionFromHeader(c *gin.Context) (uint64, error) {
+	match := strings.Trim(c.Request.Header.Get("If-Match"), `"`)
+	if match == "" || match == "*" {
+		return 0, nil
+	}
+	version, err := strconv.ParseUint(match, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid If-Match header: %q", match)
+	}
+	return version, nil
+}
+
 func (as ApiService) flush(c *gin.Context) {
 	// err := as.types.Flush()
 	// if err != nil {
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/jobs"
+)
+
+// drainPollInterval is how often drain jobs check whether the drained
+// destinations were removed
+var drainPollInterval = time.Second
+
+func (as ApiService) jobList(c *gin.Context) {
+	c.JSON(http.StatusOK, as.jobs.List())
+}
+
+func (as ApiService) jobGet(c *gin.Context) {
+	job, err := as.jobs.Get(c.Param("job_id"))
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// isAsync reports whether the request asked for the operation to run as a
+// job, replying right away.
+func isAsync(c *gin.Context) bool {
+	switch c.Query("async") {
+	case "true", "1":
+		return true
+	}
+	return false
+}
+
+func setJobLocation(c *gin.Context, job types.Job) {
+	c.Header("Location", fmt.Sprintf("/jobs/%s", job.Id))
+}
+
+// startDrainJob starts a job waiting for the removal of destinations
+// already draining
+func (as ApiService) startDrainJob(ids []string) types.Job {
+	return as.jobs.Start("drain", len(ids), func(p *jobs.Progress) (interface{}, error) {
+		return nil, as.waitDrained(p, ids)
+	})
+}
+
+// waitDrained waits for the balancer to remove the drained destinations,
+// recording each removal as a step of the job. It fails when a drain is
+// cancelled by the destination weight being changed, or when this
+// balancer loses the leadership, as the drains are watched by the leader.
+func (as ApiService) waitDrained(p *jobs.Progress, ids []string) error {
+	pending := append([]string{}, ids...)
+	for {
+		var left []string
+		for _, id := range pending {
+			dst, err := as.balancer.GetDestination(id)
+			if err == types.ErrDestinationNotFound {
+				p.Step(1)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if dst.Weight != 0 {
+				return fmt.Errorf("drain of destination %s cancelled, its weight changed", id)
+			}
+			left = append(left, id)
+		}
+		if len(left) == 0 {
+			return nil
+		}
+		if !as.balancer.IsLeader() {
+			return fmt.Errorf("leadership lost while draining %d destinations", len(left))
+		}
+		pending = left
+		time.Sleep(drainPollInterval)
+	}
+}
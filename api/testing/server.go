@@ -1,14 +1,27 @@
 package testing
 
 import (
+	"errors"
+	"fmt"
 	"net/http/httptest"
+	"time"
 
 	"github.com/luizbafilho/fusis/api"
 	"github.com/luizbafilho/fusis/api/types"
 )
 
+// EncryptKey is the gossip encryption key of the fake balancer
+const EncryptKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+
 type testBalancer struct {
 	services []types.Service
+	peers    []types.Peer
+	members  []types.Member
+	events   map[string][]types.Event
+	health   map[string]bool
+	watchers []chan struct{}
+	// keys holds the gossip keyring, primary key first
+	keys []string
 }
 
 type FakeFusisServer struct {
@@ -29,34 +42,253 @@ func NewFakeFusisServer() *FakeFusisServer {
 }
 
 func newTestBalancer() *testBalancer {
-	return &testBalancer{}
+	return &testBalancer{
+		keys:  []string{EncryptKey},
+		peers: []types.Peer{{Name: "balancer-1", Address: "localhost:4382"}},
+		members: []types.Member{
+			{Name: "balancer-1", Addr: "127.0.0.1", Role: "balancer", Status: "alive", Leader: true},
+			{Name: "agent-1", Addr: "127.0.0.2", Role: "agent", Status: "failed"},
+		},
+	}
 }
 
 func (b *testBalancer) GetLeader() string {
 	return "localhost:8000"
 }
 
+func (b *testBalancer) GetLeaderAPI() string {
+	return "localhost:8000"
+}
+
 func (b *testBalancer) IsLeader() bool {
 	return true
 }
 
+func (b *testBalancer) GetCluster() types.Cluster {
+	return types.Cluster{
+		Leader:    "localhost:4382",
+		LeaderAPI: "localhost:8000",
+		Members:   b.members,
+	}
+}
+
+func (b *testBalancer) Overloaded() (time.Duration, bool) {
+	return 0, false
+}
+
+func (b *testBalancer) ForceLeave(name string) error {
+	for i, m := range b.members {
+		if m.Name != name {
+			continue
+		}
+		if m.Status == "alive" {
+			return types.ErrMemberAlive
+		}
+		b.members[i].Status = "left"
+		return nil
+	}
+	return types.ErrMemberNotFound
+}
+
+func (b *testBalancer) GetClusterHealth() (*types.ClusterHealth, error) {
+	return &types.ClusterHealth{
+		Healthy: true,
+		Servers: []types.ServerHealth{{Name: "balancer-1", Addr: "localhost:4382", Status: "alive", Voter: true, Leader: true, Healthy: true}},
+	}, nil
+}
+
+func (b *testBalancer) GetPeers() ([]types.Peer, error) {
+	return b.peers, nil
+}
+
+func (b *testBalancer) AddPeer(peer types.Peer) error {
+	if peer.Name == "" || peer.Address == "" {
+		return types.ErrInvalidPeer
+	}
+	b.peers = append(b.peers, peer)
+	return nil
+}
+
+func (b *testBalancer) RemovePeer(peer string) error {
+	for i, p := range b.peers {
+		if p.Name == peer || p.Address == peer {
+			b.peers = append(b.peers[:i], b.peers[i+1:]...)
+			return nil
+		}
+	}
+	return types.ErrPeerNotFound
+}
+
+func (b *testBalancer) ListKeys() (*types.Keyring, error) {
+	keyring := &types.Keyring{Keys: map[string]int{}, Members: 1}
+	for _, k := range b.keys {
+		keyring.Keys[k] = 1
+	}
+	return keyring, nil
+}
+
+func (b *testBalancer) InstallKey(key string) error {
+	if !types.ValidEncryptKey(key) {
+		return types.ErrInvalidEncryptKey
+	}
+	if b.keyIndex(key) < 0 {
+		b.keys = append(b.keys, key)
+	}
+	return nil
+}
+
+func (b *testBalancer) UseKey(key string) error {
+	i := b.keyIndex(key)
+	if i < 0 {
+		return errors.New("1/1 nodes reported failure: balancer-1: key not installed")
+	}
+	b.keys[0], b.keys[i] = b.keys[i], b.keys[0]
+	return nil
+}
+
+func (b *testBalancer) RemoveKey(key string) error {
+	i := b.keyIndex(key)
+	if i == 0 {
+		return errors.New("1/1 nodes reported failure: balancer-1: removing the primary key is not allowed")
+	}
+	if i > 0 {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	}
+	return nil
+}
+
+func (b *testBalancer) RotateCertificates() error {
+	return nil
+}
+
+func (b *testBalancer) keyIndex(key string) int {
+	for i, k := range b.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *testBalancer) Barrier() error {
+	return nil
+}
+
+func (b *testBalancer) ReadInfo() types.ReadInfo {
+	return types.ReadInfo{LastIndex: uint64(len(b.services)), KnownLeader: true}
+}
+
+func (b *testBalancer) GetQuarantined() []types.QuarantinedEntry {
+	return []types.QuarantinedEntry{}
+}
+
+// GetProbes reports every service with a VIP as reachable
+func (b *testBalancer) GetProbes() ([]types.ProbeResult, error) {
+	results := []types.ProbeResult{}
+	for _, svc := range b.services {
+		if svc.Host == "" {
+			continue
+		}
+		results = append(results, types.ProbeResult{
+			Service: svc.GetId(),
+			Address: fmt.Sprintf("%s:%d", svc.Host, svc.Port),
+			Success: true,
+		})
+	}
+	return results, nil
+}
+
 func (b *testBalancer) GetServices() []types.Service {
 	return b.services
 }
 
+func (b *testBalancer) GenerateServiceId(srv types.Service) string {
+	return types.ServiceId(srv.Name)
+}
+
 func (b *testBalancer) AddService(srv *types.Service) error {
 	for i := range b.services {
-		if b.services[i].Name == srv.Name {
+		if b.services[i].GetId() == srv.GetId() {
 			return types.ErrServiceAlreadyExists
 		}
+		if srv.ExternalId != "" && b.services[i].ExternalId == srv.ExternalId {
+			return types.ErrExternalIdInUse
+		}
 	}
 	b.services = append(b.services, *srv)
+	b.notify()
 	return nil
 }
 
+func (b *testBalancer) UpdateService(srv *types.Service) error {
+	for i := range b.services {
+		if b.services[i].GetId() == srv.GetId() {
+			if srv.Version != 0 && srv.Version != b.services[i].Version {
+				return types.ErrServiceVersionMismatch
+			}
+			if srv.Name == "" {
+				srv.Name = b.services[i].Name
+			}
+			srv.Host = b.services[i].Host
+			srv.Destinations = b.services[i].Destinations
+			srv.Version = b.services[i].Version + 1
+			b.services[i] = *srv
+			b.notify()
+			return nil
+		}
+	}
+	return types.ErrServiceNotFound
+}
+
+func (b *testBalancer) RenameService(id, name string) (*types.Service, error) {
+	for i := range b.services {
+		if b.services[i].GetId() == id {
+			b.services[i].Id = b.services[i].GetId()
+			b.services[i].Name = name
+			b.services[i].Version++
+			return &b.services[i], nil
+		}
+	}
+	return nil, types.ErrServiceNotFound
+}
+
+func (b *testBalancer) GetSyncStatus(id string) (*types.SyncStatus, error) {
+	svc, err := b.GetService(id)
+	if err != nil {
+		return nil, err
+	}
+	return &types.SyncStatus{Version: svc.Version, SyncedVersion: svc.Version, Synced: true}, nil
+}
+
+func (b *testBalancer) GetServiceEvents(id string) ([]types.Event, error) {
+	if _, err := b.GetService(id); err != nil {
+		return nil, err
+	}
+	evts := b.events[id]
+	if evts == nil {
+		evts = []types.Event{}
+	}
+	return evts, nil
+}
+
+func (b *testBalancer) WatchState() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	b.watchers = append(b.watchers, ch)
+	return ch, func() {}
+}
+
+func (b *testBalancer) notify() {
+	for _, ch := range b.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (b *testBalancer) GetService(id string) (*types.Service, error) {
 	for i := range b.services {
-		if b.services[i].Name == id {
+		if b.services[i].GetId() == id {
 			return &b.services[i], nil
 		}
 	}
@@ -65,8 +297,9 @@ func (b *testBalancer) GetService(id string) (*types.Service, error) {
 
 func (b *testBalancer) DeleteService(id string) error {
 	for i := range b.services {
-		if b.services[i].Name == id {
+		if b.services[i].GetId() == id {
 			b.services = append(b.services[:i], b.services[i+1:]...)
+			b.notify()
 			return nil
 		}
 	}
@@ -77,7 +310,7 @@ func (b *testBalancer) AddDestination(srv *types.Service, dest *types.Destinatio
 	var foundSrv *types.Service
 	for i := range b.services {
 		curSrv := b.services[i]
-		if b.services[i].Name == srv.Name {
+		if b.services[i].GetId() == srv.GetId() {
 			foundSrv = &b.services[i]
 		}
 		for j := range curSrv.Destinations {
@@ -89,10 +322,34 @@ func (b *testBalancer) AddDestination(srv *types.Service, dest *types.Destinatio
 	if foundSrv == nil {
 		return types.ErrServiceNotFound
 	}
+	if _, ok := foundSrv.FindDestination(dest.Host, dest.Port); ok {
+		return types.ErrDestinationAlreadyExists
+	}
 	foundSrv.Destinations = append(foundSrv.Destinations, *dest)
 	return nil
 }
 
+func (b *testBalancer) GetServiceByExternalId(ref string) (*types.Service, error) {
+	for i := range b.services {
+		if ref != "" && b.services[i].ExternalId == ref {
+			return &b.services[i], nil
+		}
+	}
+	return nil, types.ErrServiceNotFound
+}
+
+func (b *testBalancer) GetDestinationByExternalId(ref string) (*types.Destination, error) {
+	for i := range b.services {
+		srv := &b.services[i]
+		for j := range srv.Destinations {
+			if ref != "" && srv.Destinations[j].ExternalId == ref {
+				return &srv.Destinations[j], nil
+			}
+		}
+	}
+	return nil, types.ErrDestinationNotFound
+}
+
 func (b *testBalancer) GetDestination(id string) (*types.Destination, error) {
 	for i := range b.services {
 		srv := &b.services[i]
@@ -105,6 +362,114 @@ func (b *testBalancer) GetDestination(id string) (*types.Destination, error) {
 	return nil, types.ErrDestinationNotFound
 }
 
+func (b *testBalancer) GetDestinationHealth(id string) (*types.DestinationHealth, error) {
+	dst, err := b.GetDestination(id)
+	if err != nil {
+		return nil, err
+	}
+	healthy, ok := b.health[id]
+	return &types.DestinationHealth{CheckPort: dst.CheckPort(), Healthy: !ok || healthy, Transitions: []types.HealthTransition{}}, nil
+}
+
+func (b *testBalancer) ReportDestinationHealth(id string, healthy bool) error {
+	if _, err := b.GetDestination(id); err != nil {
+		return err
+	}
+	if b.health == nil {
+		b.health = make(map[string]bool)
+	}
+	b.health[id] = healthy
+	return nil
+}
+
+func (b *testBalancer) UpdateDestination(dest *types.Destination) error {
+	for i := range b.services {
+		srv := &b.services[i]
+		for j := range srv.Destinations {
+			current := &srv.Destinations[j]
+			if current.Name != dest.Name {
+				continue
+			}
+			if dest.Version != 0 && dest.Version != current.Version {
+				return types.ErrDestinationVersionMismatch
+			}
+			current.Weight = dest.Weight
+			if dest.Mode != "" {
+				current.Mode = dest.Mode
+			}
+			current.Version++
+			*dest = *current
+			return nil
+		}
+	}
+	return types.ErrDestinationNotFound
+}
+
+// DrainDestination removes the destination right away, as there are no
+// connections to wait for
+func (b *testBalancer) DrainDestination(dest *types.Destination) error {
+	return b.DeleteDestination(dest)
+}
+
+func (b *testBalancer) ApplyDestinationBatch(serviceId string, batch *types.DestinationBatch) error {
+	svc, err := b.GetService(serviceId)
+	if err != nil {
+		return err
+	}
+	if len(batch.Add)+len(batch.Remove)+len(batch.Drain) == 0 {
+		return types.ErrInvalidBatch
+	}
+	names := append(append([]string{}, batch.Remove...), batch.Drain...)
+	for _, name := range names {
+		if _, err := b.GetDestination(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		b.DeleteDestination(&types.Destination{Name: name})
+	}
+	for i := range batch.Add {
+		dst := batch.Add[i]
+		if dst.Name == "" {
+			dst.Name = types.DestinationName(serviceId, dst.Host, dst.Port)
+		}
+		if err := b.AddDestination(svc, &dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *testBalancer) PlanDestinationBatch(serviceId string, batch *types.DestinationBatch) ([]types.Destination, error) {
+	svc, err := b.GetService(serviceId)
+	if err != nil {
+		return nil, err
+	}
+	if len(batch.Add)+len(batch.Remove)+len(batch.Drain) == 0 {
+		return nil, types.ErrInvalidBatch
+	}
+	gone := make(map[string]bool)
+	for _, name := range append(append([]string{}, batch.Remove...), batch.Drain...) {
+		if _, err := b.GetDestination(name); err != nil {
+			return nil, err
+		}
+		gone[name] = true
+	}
+	result := []types.Destination{}
+	for _, dst := range svc.Destinations {
+		if !gone[dst.Name] {
+			result = append(result, dst)
+		}
+	}
+	for _, dst := range batch.Add {
+		if dst.Name == "" {
+			dst.Name = types.DestinationName(serviceId, dst.Host, dst.Port)
+		}
+		result = append(result, dst)
+	}
+	return result, nil
+}
+
 func (b *testBalancer) DeleteDestination(dest *types.Destination) error {
 	for i := range b.services {
 		srv := &b.services[i]
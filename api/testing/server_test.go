@@ -139,6 +139,7 @@ func (s *S) TestTestBalancerDeleteDestination(c *check.C) {
 	c.Assert(err, check.IsNil)
 	dst = &types.Destination{
 		Name:      "dst2",
+		Port:      8080,
 		ServiceId: "srv1",
 	}
 	err = bal.AddDestination(srv, dst)
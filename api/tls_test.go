@@ -0,0 +1,115 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	"gopkg.in/check.v1"
+)
+
+// writeCert writes a certificate for 127.0.0.1, valid for servers and
+// clients, and its key to dir. It's signed by parent, or self-signed as a
+// CA when parent is nil.
+func writeCert(c *check.C, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, check.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, check.IsNil)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600), check.IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600), check.IsNil)
+	return cert, key
+}
+
+// startTLS serves handler with config, whose certificate StartTLS would
+// replace with its own
+func startTLS(handler http.Handler, config *tls.Config) *httptest.Server {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = tls.NewListener(srv.Listener, config)
+	srv.Start()
+	srv.URL = strings.Replace(srv.URL, "http://", "https://", 1)
+	return srv
+}
+
+func (s *S) TestMutualTLS(c *check.C) {
+	dir, err := ioutil.TempDir("", "fusis-tls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(c, dir, "ca", nil, nil)
+	writeCert(c, dir, "balancer", ca, caKey)
+	writeCert(c, dir, "client", ca, caKey)
+	conf := config.TLS{
+		CertFile:      filepath.Join(dir, "balancer.pem"),
+		KeyFile:       filepath.Join(dir, "balancer-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		VerifyClients: true,
+	}
+	serverTLS, err := conf.ServerConfig()
+	c.Assert(err, check.IsNil)
+	proxyTLS, err := conf.ClientConfig()
+	c.Assert(err, check.IsNil)
+
+	err = s.bal.AddService(&types.Service{Name: "myservice"})
+	c.Assert(err, check.IsNil)
+	leader := startTLS(api.NewAPI(s.bal), serverTLS)
+	defer leader.Close()
+	leaderURL, err := url.Parse(leader.URL)
+	c.Assert(err, check.IsNil)
+	follower := startTLS(api.NewAPIWithOptions(followerBalancer{Balancer: s.bal, leaderAPI: leaderURL.Host}, api.Options{ProxyTLS: proxyTLS}), serverTLS)
+	defer follower.Close()
+
+	clientTLS, err := config.TLS{
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}.ClientConfig()
+	c.Assert(err, check.IsNil)
+	svc, err := api.NewTLSClient(follower.URL, clientTLS).GetService("myservice")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc.Name, check.Equals, "myservice")
+
+	// Clients without a certificate are rejected
+	anonTLS, err := config.TLS{CAFile: filepath.Join(dir, "ca.pem")}.ClientConfig()
+	c.Assert(err, check.IsNil)
+	_, err = api.NewTLSClient(leader.URL, anonTLS).GetService("myservice")
+	c.Assert(err, check.NotNil)
+}
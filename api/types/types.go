@@ -1,15 +1,76 @@
 package types
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
-	ErrServiceNotFound          error = ErrNotFound("service not found")
-	ErrDestinationNotFound      error = ErrNotFound("destination not found")
-	ErrServiceAlreadyExists           = errors.New("service already exists")
-	ErrDestinationAlreadyExists       = errors.New("destination already exists")
+	ErrServiceNotFound            error = ErrNotFound("service not found")
+	ErrDestinationNotFound        error = ErrNotFound("destination not found")
+	ErrJobNotFound                error = ErrNotFound("job not found")
+	ErrPeerNotFound               error = ErrNotFound("peer not found")
+	ErrMemberNotFound             error = ErrNotFound("member not found")
+	ErrServiceAlreadyExists             = errors.New("service already exists")
+	ErrDestinationAlreadyExists         = errors.New("destination already exists")
+	ErrServiceVersionMismatch           = errors.New("service version mismatch")
+	ErrDestinationVersionMismatch       = errors.New("destination version mismatch")
+	ErrInvalidServiceId                 = errors.New("invalid service id: must contain only lowercase letters, digits, '-', '_' and '.'")
+	ErrInvalidDSCP                      = errors.New("invalid dscp: must be between 0 and 63")
+	ErrInvalidServiceType               = errors.New("invalid service type: must be empty, http or sni, with protocol tcp; routes require a matching type")
+	ErrInvalidDependency                = errors.New("invalid dependency: services must depend on existing services, without cycles")
+	ErrUnsupportedScheduler             = errors.New("unsupported scheduler: simulations support rr, wrr, lc, wlc, sed, nq, sh, dh and mh")
+	ErrInvalidSimulation                = errors.New("invalid simulation: clients and connections must be between 1 and 1000000, distribution uniform or zipf, and subnet a valid IPv4 CIDR")
+	ErrInvalidLabels                    = errors.New("invalid labels: keys must contain only letters, digits, '-', '_', '.' and '/', and check-port must be a port number")
+	ErrInvalidFirewallMark              = errors.New("invalid firewall mark: proxied services can't be marked, and mark ports must be ports or first:last ranges, at most 15")
+	ErrFirewallMarkInUse                = errors.New("firewall mark already used by another service or policy")
+	ErrInvalidPolicies                  = errors.New("invalid policies: proxied and fwmark services can't have policies, which need a unique name and mark, IPv4 source networks and destinations")
+	ErrInvalidPersistence               = errors.New("invalid persistence: proxied services can't be persistent, and the netmask must be a prefix length of the service address family, set along with the timeout")
+	ErrInvalidSchedulerFlags            = errors.New("invalid scheduler flags: mh-fallback and mh-port only apply to the mh scheduler, each at most once")
+	ErrSchedulerUnavailable             = errors.New("scheduler unavailable: the kernel lacks its IPVS module")
+	ErrInvalidBatch                     = errors.New("invalid batch: must change at least one destination, each at most once")
+	ErrInvalidSelector                  = errors.New("invalid label selector: must be a comma separated list of key=value pairs")
+	ErrExternalIdInUse                  = errors.New("external id already used by another service or destination")
+	ErrUnknownIdGenerator               = errors.New("unknown id generator: must be name, external or random")
+	ErrUnauthorized                     = errors.New("unauthorized: missing or unknown API token")
+	ErrForbidden                        = errors.New("forbidden: the role of the API token doesn't allow this operation")
+	ErrNoWritesOnThisNode               = errors.New("no writes on this node: its API is read-only, send writes to another balancer")
+	ErrGossipNotEncrypted               = errors.New("gossip not encrypted: start the balancers with an encryption key to manage the keyring")
+	ErrInvalidPeer                      = errors.New("invalid peer: must have a name, and a host:port raft address unless it's a balancer of the cluster")
+	ErrMemberAlive                      = errors.New("member alive: only failed members can be forced to leave")
+	ErrInvalidEncryptKey                = errors.New("invalid encryption key: must be 16, 24 or 32 bytes, base64 encoded")
+	ErrOverloaded                       = errors.New("overloaded: the leader is shedding the writes that aren't critical, retry later")
+	ErrProbesDisabled                   = errors.New("probes disabled: start the balancers with a probe interval to enable them")
+	ErrUnknownProvider                  = errors.New("unknown provider: must be one of the providers of the balancer config")
+	ErrInvalidVIP                       = errors.New("invalid vip: must be an address of the VIP pools of the provider")
+	ErrVIPInUse                         = errors.New("vip already used by another service")
+	ErrUnknownPool                      = errors.New("unknown pool: must be one of the VIP pools of the provider config")
+	ErrClientIPNotPreserved             = errors.New("client ip not preserved: proxied services and fullnat destinations hide it, use the X-Forwarded-For header of http services instead")
+)
+
+// ErrCodeNoWrites is the code of ErrNoWritesOnThisNode replies
+const ErrCodeNoWrites = "NO_WRITES_ON_THIS_NODE"
+
+// Service types, http and sni ones are served by the embedded proxy
+const (
+	ServiceTypeL4   = ""
+	ServiceTypeHTTP = "http"
+	ServiceTypeSNI  = "sni"
+)
+
+var (
+	validServiceId = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+	invalidIdChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+	validLabelKey  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_./-]*$`)
 )
 
 type ErrNotFound string
@@ -18,7 +79,19 @@ func (e ErrNotFound) Error() string {
 	return string(e)
 }
 
+// ErrDestinationUnreachable is returned when the destination check fails
+type ErrDestinationUnreachable struct {
+	Addr string
+	Err  string
+}
+
+func (e ErrDestinationUnreachable) Error() string {
+	return fmt.Sprintf("destination unreachable: connecting to %s failed: %s", e.Addr, e.Err)
+}
+
 type Service struct {
+	// Id never changes, see IdGenerators
+	Id           string
 	Name         string `valid:"required"`
 	Host         string
 	Port         uint16 `valid:"required"`
@@ -26,18 +99,90 @@ type Service struct {
 	Scheduler    string `valid:"required"`
 	Destinations []Destination
 	Stats        *ServiceStats
+
+	// Labels configure integrations, e.g. "dns.name"
+	Labels     map[string]string
+	ExternalId string `json:",omitempty"`
+	// Pool and Provider pick where the VIP comes from, the default ones when empty
+	Pool     string `json:",omitempty"`
+	Provider string `json:",omitempty"`
+
+	Type      string      `json:",omitempty"`
+	Routes    []HTTPRoute `json:",omitempty"`
+	SNIRoutes []SNIRoute  `json:",omitempty"`
+
+	// MaxBandwidth is in bits per second, enforced on the leader
+	MaxBandwidth      uint64 `json:",omitempty"`
+	DSCP              uint8  `json:",omitempty"`
+	MaxConnsPerClient uint32 `json:",omitempty"`
+
+	// TTL is in seconds, ExpiresAt is computed from it
+	TTL       uint32     `json:",omitempty"`
+	ExpiresAt *time.Time `json:",omitempty"`
+
+	// DependsOn lists the services whose VIPs are brought up first
+	DependsOn       []string `json:",omitempty"`
+	RequireClientIP bool     `json:",omitempty"`
+
+	// FirewallMark makes an IPVS fwmark service of the VIP, on Port and MarkPorts
+	FirewallMark uint32   `json:",omitempty"`
+	MarkPorts    []string `json:",omitempty"`
+	Policies     []Policy `json:",omitempty"`
+
+	// PersistenceTimeout is in seconds, PersistenceNetmask a prefix length
+	PersistenceTimeout uint32   `json:",omitempty"`
+	PersistenceNetmask uint8    `json:",omitempty"`
+	SchedulerFlags     []string `json:",omitempty"`
+
+	// Version is the raft index of the last change to the service
+	Version uint64
+}
+
+// HTTPRoute sends the requests having Header set to Value to the named destinations
+type HTTPRoute struct {
+	Header       string `valid:"required"`
+	Value        string
+	Destinations []string `valid:"required"`
+}
+
+// SNIRoute sends the connections requesting ServerName to the named destinations
+type SNIRoute struct {
+	ServerName   string   `valid:"required"`
+	Destinations []string `valid:"required"`
+}
+
+// Policy sends the clients of the Sources networks to the named destinations
+type Policy struct {
+	Name         string   `valid:"required"`
+	Sources      []string `valid:"required"`
+	Destinations []string `valid:"required"`
+	Mark         uint32   `valid:"required"`
 }
 
+// Destination is a backend of a service, unique by address in it
 type Destination struct {
-	Name      string `valid:"required"`
+	Name      string
 	Host      string `valid:"required"`
 	Port      uint16 `valid:"required"`
 	Weight    int32
 	Mode      string `valid:"required"`
 	ServiceId string `valid:"required"`
 	Stats     *DestinationStats
+
+	Labels     map[string]string `json:",omitempty"`
+	ExternalId string            `json:",omitempty"`
+	Version    uint64
 }
 
+// CheckPortLabel holds the port health checkers probe, if not the balanced one
+const CheckPortLabel = "check-port"
+
+// InstanceLabel holds the fingerprint of the agent that registered the destination
+const InstanceLabel = "instance"
+
+// ModeFullNAT is nat with the source rewritten to the balancer address
+const ModeFullNAT = "fullnat"
+
 type ServiceStats struct {
 	Connections uint32
 	PacketsIn   uint32
@@ -57,15 +202,538 @@ type DestinationStats struct {
 	PersistConns  uint32
 }
 
+// DestinationBatch holds destination changes applied at once, removals first
+type DestinationBatch struct {
+	Add    []Destination `json:",omitempty"`
+	Remove []string      `json:",omitempty"`
+	Drain  []string      `json:",omitempty"`
+}
+
+// SyncStatus tells whether a service was synced to the kernel of the balancer
+type SyncStatus struct {
+	Version       uint64
+	SyncedVersion uint64
+	Synced        bool
+	Error         string `json:",omitempty"`
+}
+
+// SimulationParams describe the synthetic traffic of a simulation
+type SimulationParams struct {
+	Clients      int
+	Connections  int
+	Distribution string
+	Subnet       string
+	Concurrency  int
+	Persistent   bool
+	Seed         int64
+}
+
+// SimulationResult is how the scheduler spread the simulated connections
+type SimulationResult struct {
+	Scheduler    string
+	Destinations []SimulatedDestination
+}
+
+type SimulatedDestination struct {
+	Name        string
+	Weight      int32
+	Connections int
+	Share       float64
+	Clients     int
+}
+
+// Event is a lifecycle event of a service
+type Event struct {
+	Time    time.Time
+	Type    string
+	Message string
+}
+
+// HealthTransition records a destination becoming healthy or unhealthy
+type HealthTransition struct {
+	Time    time.Time
+	Healthy bool
+}
+
+// DestinationHealth is the health state of a destination
+type DestinationHealth struct {
+	CheckPort   uint16
+	Healthy     bool
+	Flapping    bool
+	HeldUntil   time.Time
+	Transitions []HealthTransition
+}
+
+// Job statuses
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is a long running operation started by an API request
+type Job struct {
+	Id         string
+	Kind       string
+	Status     string
+	Done       int
+	Total      int
+	Error      string      `json:",omitempty"`
+	Result     interface{} `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// QuarantinedEntry is a raft log entry the FSM was unable to apply
+type QuarantinedEntry struct {
+	Index  uint64
+	Term   uint64
+	Reason string
+	Data   []byte
+}
+
+// SummaryStatus reports how fresh the gossiped services of a member are
+type SummaryStatus struct {
+	Index      uint64
+	Stale      bool
+	LastDigest time.Time
+}
+
+// ReadInfo describes how fresh the state served by a balancer is
+type ReadInfo struct {
+	LastIndex   uint64
+	KnownLeader bool
+	LastContact time.Duration
+}
+
+// Cluster describes the members of a cluster as seen by a balancer
+type Cluster struct {
+	Leader    string
+	LeaderAPI string
+	Members   []Member
+}
+
+// Member is a balancer or agent of the cluster
+type Member struct {
+	Name   string
+	Addr   string
+	Role   string
+	Status string
+	Leader bool `json:",omitempty"`
+}
+
+// Peer is a raft server of the cluster, named after its balancer
+type Peer struct {
+	Name     string
+	Address  string
+	NonVoter bool `json:",omitempty"`
+}
+
+// ClusterHealth reports the health of the raft servers of a cluster
+type ClusterHealth struct {
+	Healthy          bool
+	FailureTolerance int
+	Servers          []ServerHealth
+}
+
+// ServerHealth describes a raft server and its serf status
+type ServerHealth struct {
+	Name        string
+	Addr        string
+	Status      string
+	Voter       bool
+	Leader      bool `json:",omitempty"`
+	Healthy     bool
+	StableSince time.Time
+}
+
+// Keyring maps the gossip keys to the number of members having them
+type Keyring struct {
+	Keys    map[string]int
+	Members int
+}
+
+// ProbeResult is the outcome of the last probe of a service VIP
+type ProbeResult struct {
+	Service  string
+	Address  string
+	Time     time.Time
+	Success  bool
+	Latency  time.Duration
+	Error    string `json:",omitempty"`
+	Failures int
+}
+
+// ValidEncryptKey reports whether key is a base64 encoded AES key
+func ValidEncryptKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return false
+	}
+	return len(b) == 16 || len(b) == 24 || len(b) == 32
+}
+
+// FailoverTiming breaks down how long taking over from a lost leader took
+type FailoverTiming struct {
+	LostAt    time.Time
+	Election  time.Duration
+	StateSync time.Duration
+	IPVS      time.Duration
+	IPAdd     time.Duration
+	ARP       time.Duration
+	Total     time.Duration
+}
+
+// CheckResult is what a write sent in check mode would change
+type CheckResult struct {
+	Changed bool
+	Before  interface{} `json:",omitempty"`
+	After   interface{} `json:",omitempty"`
+}
+
+// GetId returns the service ID, or the name of services predating IDs
 func (svc Service) GetId() string {
+	if svc.Id != "" {
+		return svc.Id
+	}
 	return svc.Name
 }
 
+// ServiceId derives the canonical service ID from a name
+func ServiceId(name string) string {
+	id := invalidIdChars.ReplaceAllString(strings.ToLower(name), "-")
+	return strings.Trim(id, "-_.")
+}
+
+// IdGenerator derives the ID of a service created without one
+type IdGenerator func(svc Service) string
+
+// IdGenerators are the service ID generators, by name, "name" being the default
+var IdGenerators = map[string]IdGenerator{
+	"name": func(svc Service) string {
+		return ServiceId(svc.Name)
+	},
+	"external": func(svc Service) string {
+		if id := ServiceId(svc.ExternalId); id != "" {
+			return id
+		}
+		return ServiceId(svc.Name)
+	},
+	"random": func(svc Service) string {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		return hex.EncodeToString(b)
+	},
+}
+
+// GetIdGenerator returns the IdGenerator registered with name
+func GetIdGenerator(name string) (IdGenerator, error) {
+	if name == "" {
+		name = "name"
+	}
+	gen, ok := IdGenerators[name]
+	if !ok {
+		return nil, ErrUnknownIdGenerator
+	}
+	return gen, nil
+}
+
+// ValidServiceId reports whether id can be used as a service ID.
+func ValidServiceId(id string) bool {
+	return validServiceId.MatchString(id)
+}
+
 func (dst Destination) GetId() string {
 	return dst.Name
 }
 
+// CheckPort returns the port health checkers probe
+func (dst Destination) CheckPort() uint16 {
+	if port, err := strconv.ParseUint(dst.Labels[CheckPortLabel], 10, 16); err == nil && port > 0 {
+		return uint16(port)
+	}
+	return dst.Port
+}
+
+// ValidLabels reports whether the destination labels are well formed
+func (dst Destination) ValidLabels() bool {
+	for k := range dst.Labels {
+		if !validLabelKey.MatchString(k) {
+			return false
+		}
+	}
+	if p, ok := dst.Labels[CheckPortLabel]; ok {
+		if port, err := strconv.ParseUint(p, 10, 16); err != nil || port == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchLabels reports whether the destination has every label of selector.
+func (dst Destination) MatchLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := dst.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses a label selector in the key=value,key=value form.
+func ParseSelector(s string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !validLabelKey.MatchString(kv[0]) {
+			return nil, ErrInvalidSelector
+		}
+		selector[kv[0]] = kv[1]
+	}
+	return selector, nil
+}
+
+// FormatSelector formats a label selector as parsed by ParseSelector
+func FormatSelector(selector map[string]string) string {
+	pairs := make([]string, 0, len(selector))
+	for k, v := range selector {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// DestinationName generates the name of a destination from its address.
+func DestinationName(serviceId, host string, port uint16) string {
+	return fmt.Sprintf("%s-%s-%d", serviceId, host, port)
+}
+
+// FindDestination returns the destination of svc with the given address.
+func (svc Service) FindDestination(host string, port uint16) (*Destination, bool) {
+	for i := range svc.Destinations {
+		if svc.Destinations[i].Host == host && svc.Destinations[i].Port == port {
+			return &svc.Destinations[i], true
+		}
+	}
+	return nil, false
+}
+
+// IsProxied reports whether the service is served by the embedded proxy
+func (svc Service) IsProxied() bool {
+	return svc.Type == ServiceTypeHTTP || svc.Type == ServiceTypeSNI
+}
+
+// ValidServiceType reports whether the type, protocol and routes match
+func (svc Service) ValidServiceType() bool {
+	switch svc.Type {
+	case ServiceTypeL4:
+		return len(svc.Routes) == 0 && len(svc.SNIRoutes) == 0
+	case ServiceTypeHTTP:
+		return svc.Protocol == "tcp" && len(svc.SNIRoutes) == 0
+	case ServiceTypeSNI:
+		return svc.Protocol == "tcp" && len(svc.Routes) == 0
+	}
+	return false
+}
+
+// ValidDSCP reports whether the service DSCP fits in 6 bits
+func (svc Service) ValidDSCP() bool {
+	return svc.DSCP <= 63
+}
+
+// ValidClientIP reports whether the service preserves the client IP if required
+func (svc Service) ValidClientIP() bool {
+	return !svc.RequireClientIP || svc.ClientIP().Preserved
+}
+
+// ValidDestinationMode reports whether mode suits the service
+func (svc Service) ValidDestinationMode(mode string) bool {
+	return !svc.RequireClientIP || mode != ModeFullNAT
+}
+
+// ValidFirewallMark reports whether the mark and mark ports can be used
+func (svc Service) ValidFirewallMark() bool {
+	if svc.FirewallMark == 0 {
+		return len(svc.MarkPorts) == 0
+	}
+	if svc.IsProxied() || len(svc.MarkPorts) > 15 {
+		return false
+	}
+	for _, p := range svc.MarkPorts {
+		bounds := strings.SplitN(p, ":", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil || first == 0 {
+			return false
+		}
+		if len(bounds) == 2 {
+			last, err := strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || last < first {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidPolicies reports whether the policies of the service can be programmed
+func (svc Service) ValidPolicies() bool {
+	if len(svc.Policies) == 0 {
+		return true
+	}
+	if svc.IsProxied() || svc.FirewallMark > 0 {
+		return false
+	}
+	names := make(map[string]bool)
+	marks := make(map[uint32]bool)
+	for _, p := range svc.Policies {
+		if p.Name == "" || p.Mark == 0 || len(p.Sources) == 0 || len(p.Destinations) == 0 {
+			return false
+		}
+		if names[p.Name] || marks[p.Mark] {
+			return false
+		}
+		names[p.Name], marks[p.Mark] = true, true
+		for _, src := range p.Sources {
+			ip, _, err := net.ParseCIDR(src)
+			if err != nil || ip.To4() == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FirewallMarks returns the marks of the service and of its policies
+func (svc Service) FirewallMarks() []uint32 {
+	var marks []uint32
+	if svc.FirewallMark > 0 {
+		marks = append(marks, svc.FirewallMark)
+	}
+	for _, p := range svc.Policies {
+		marks = append(marks, p.Mark)
+	}
+	return marks
+}
+
+// PolicyServices returns the fwmark services of the policies in rotation
+func (svc Service) PolicyServices() []Service {
+	var services []Service
+	for _, p := range svc.Policies {
+		names := make(map[string]bool)
+		for _, name := range p.Destinations {
+			names[name] = true
+		}
+		policySvc := svc
+		policySvc.FirewallMark = p.Mark
+		policySvc.MarkPorts = nil
+		policySvc.Policies = nil
+		policySvc.Destinations = nil
+		inRotation := false
+		for _, dst := range svc.Destinations {
+			if names[dst.Name] {
+				policySvc.Destinations = append(policySvc.Destinations, dst)
+				inRotation = inRotation || dst.Weight > 0
+			}
+		}
+		if inRotation {
+			services = append(services, policySvc)
+		}
+	}
+	return services
+}
+
+// ValidPersistence reports whether the persistence fits the VIP, if known
+func (svc Service) ValidPersistence() bool {
+	if svc.PersistenceTimeout == 0 {
+		return svc.PersistenceNetmask == 0
+	}
+	if svc.IsProxied() {
+		return false
+	}
+	if svc.FirewallMark == 0 && (svc.Host == "" || net.ParseIP(svc.Host).To4() == nil) {
+		return svc.PersistenceNetmask <= 128
+	}
+	return svc.PersistenceNetmask <= 32
+}
+
+// SchedulerMaglev is the Maglev hashing scheduler, since Linux 4.18
+const SchedulerMaglev = "mh"
+
+// Maglev scheduler flags
+const (
+	SchedulerFlagMHFallback = "mh-fallback"
+	SchedulerFlagMHPort     = "mh-port"
+)
+
+// ValidSchedulerFlags reports whether the flags apply to the scheduler
+func (svc Service) ValidSchedulerFlags() bool {
+	seen := make(map[string]bool)
+	for _, flag := range svc.SchedulerFlags {
+		switch flag {
+		case SchedulerFlagMHFallback, SchedulerFlagMHPort:
+			if svc.Scheduler != SchedulerMaglev {
+				return false
+			}
+		default:
+			return false
+		}
+		if seen[flag] {
+			return false
+		}
+		seen[flag] = true
+	}
+	return true
+}
+
+// ClientIPReport tells whether the destinations of a service see the client IP
+type ClientIPReport struct {
+	Preserved  bool
+	Forwarding string
+	Header     string   `json:",omitempty"`
+	Notes      []string `json:",omitempty"`
+}
+
+var modeNotes = map[string]string{
+	"nat":     "destinations in nat mode must route their replies through the balancer",
+	"fullnat": "destinations in fullnat mode see the balancer address as source instead of the client one",
+	"route":   "destinations in route mode must own the VIP on an interface not answering ARP",
+	"tunnel":  "destinations in tunnel mode must decapsulate IPIP packets and own the VIP",
+}
+
+// ClientIP reports the client IP semantics of the service
+func (svc Service) ClientIP() ClientIPReport {
+	switch svc.Type {
+	case ServiceTypeHTTP:
+		return ClientIPReport{Forwarding: "http proxy", Header: "X-Forwarded-For"}
+	case ServiceTypeSNI:
+		return ClientIPReport{Forwarding: "sni proxy"}
+	}
+
+	report := ClientIPReport{Preserved: true, Forwarding: "ipvs"}
+	seen := make(map[string]bool)
+	for _, dst := range svc.Destinations {
+		if dst.Mode == ModeFullNAT {
+			report.Preserved = false
+		}
+		if note, ok := modeNotes[dst.Mode]; ok && !seen[dst.Mode] {
+			seen[dst.Mode] = true
+			report.Notes = append(report.Notes, note)
+		}
+	}
+	return report
+}
+
+// Expired reports whether the service TTL is over at the given time.
+func (svc Service) Expired(now time.Time) bool {
+	return svc.ExpiresAt != nil && !now.Before(*svc.ExpiresAt)
+}
+
 func (svc Service) KernelKey() string {
+	if svc.FirewallMark > 0 {
+		return fmt.Sprintf("fwm-%d", svc.FirewallMark)
+	}
 	return fmt.Sprintf("%s-%d-%s", svc.Host, svc.Port, svc.Protocol)
 }
 
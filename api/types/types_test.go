@@ -17,14 +17,196 @@ func (s *S) TestServiceGetId(c *check.C) {
 	c.Assert(srv.GetId(), check.Equals, "myname")
 }
 
+func (s *S) TestServiceGetIdExplicit(c *check.C) {
+	srv := Service{Id: "myid", Name: "myname"}
+	c.Assert(srv.GetId(), check.Equals, "myid")
+}
+
+func (s *S) TestServiceId(c *check.C) {
+	c.Assert(ServiceId("myname"), check.Equals, "myname")
+	c.Assert(ServiceId("My Web  Service!"), check.Equals, "my-web-service")
+	c.Assert(ServiceId("_api.v2_"), check.Equals, "api.v2")
+	c.Assert(ValidServiceId("api.v2"), check.Equals, true)
+	c.Assert(ValidServiceId("Api"), check.Equals, false)
+	c.Assert(ValidServiceId(""), check.Equals, false)
+}
+
+func (s *S) TestServiceValidServiceType(c *check.C) {
+	c.Assert(Service{Protocol: "udp"}.ValidServiceType(), check.Equals, true)
+	c.Assert(Service{Protocol: "tcp", Type: ServiceTypeHTTP}.ValidServiceType(), check.Equals, true)
+	c.Assert(Service{Protocol: "udp", Type: ServiceTypeHTTP}.ValidServiceType(), check.Equals, false)
+	c.Assert(Service{Protocol: "tcp", Type: "grpc"}.ValidServiceType(), check.Equals, false)
+	c.Assert(Service{Protocol: "tcp", Routes: []HTTPRoute{{Header: "X-Canary"}}}.ValidServiceType(), check.Equals, false)
+	c.Assert(Service{Protocol: "tcp", Type: ServiceTypeSNI, SNIRoutes: []SNIRoute{{ServerName: "a.com"}}}.ValidServiceType(), check.Equals, true)
+	c.Assert(Service{Protocol: "tcp", Type: ServiceTypeSNI, Routes: []HTTPRoute{{Header: "X-Canary"}}}.ValidServiceType(), check.Equals, false)
+	c.Assert(Service{Protocol: "tcp", Type: ServiceTypeHTTP, SNIRoutes: []SNIRoute{{ServerName: "a.com"}}}.ValidServiceType(), check.Equals, false)
+}
+
+func (s *S) TestServiceValidDSCP(c *check.C) {
+	c.Assert(Service{}.ValidDSCP(), check.Equals, true)
+	c.Assert(Service{DSCP: 46}.ValidDSCP(), check.Equals, true)
+	c.Assert(Service{DSCP: 64}.ValidDSCP(), check.Equals, false)
+}
+
+func (s *S) TestServiceClientIP(c *check.C) {
+	svc := Service{Destinations: []Destination{{Mode: "nat"}, {Mode: "route"}, {Mode: "nat"}}}
+	report := svc.ClientIP()
+	c.Assert(report.Preserved, check.Equals, true)
+	c.Assert(report.Forwarding, check.Equals, "ipvs")
+	c.Assert(report.Notes, check.DeepEquals, []string{modeNotes["nat"], modeNotes["route"]})
+	c.Assert(Service{Type: ServiceTypeSNI}.ClientIP(), check.DeepEquals, ClientIPReport{Forwarding: "sni proxy"})
+
+	c.Assert(Service{RequireClientIP: true}.ValidClientIP(), check.Equals, true)
+	c.Assert(Service{RequireClientIP: true, Type: ServiceTypeHTTP}.ValidClientIP(), check.Equals, false)
+	c.Assert(Service{Type: ServiceTypeHTTP}.ValidClientIP(), check.Equals, true)
+}
+
 func (s *S) TestDestinationGetId(c *check.C) {
 	dst := Destination{Name: "myname"}
 	c.Assert(dst.GetId(), check.Equals, "myname")
 }
 
+func (s *S) TestServiceFindDestination(c *check.C) {
+	srv := Service{Destinations: []Destination{
+		{Name: "d1", Host: "10.0.0.1", Port: 80},
+		{Name: "d2", Host: "10.0.0.1", Port: 81},
+	}}
+	dst, ok := srv.FindDestination("10.0.0.1", 81)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(dst.Name, check.Equals, "d2")
+	_, ok = srv.FindDestination("10.0.0.2", 80)
+	c.Assert(ok, check.Equals, false)
+}
+
 func (s *S) TestErrors(c *check.C) {
 	c.Assert(ErrServiceNotFound, check.FitsTypeOf, ErrNotFound(""))
 	c.Assert(ErrDestinationNotFound, check.FitsTypeOf, ErrNotFound(""))
 	c.Assert(ErrServiceNotFound.Error(), check.Equals, "service not found")
 	c.Assert(ErrDestinationNotFound.Error(), check.Equals, "destination not found")
 }
+
+func (s *S) TestDestinationLabels(c *check.C) {
+	dst := Destination{Port: 80, Labels: map[string]string{"deploy": "v1", CheckPortLabel: "8080"}}
+	c.Assert(dst.ValidLabels(), check.Equals, true)
+	c.Assert(dst.CheckPort(), check.Equals, uint16(8080))
+	c.Assert(dst.MatchLabels(nil), check.Equals, true)
+	c.Assert(dst.MatchLabels(map[string]string{"deploy": "v1"}), check.Equals, true)
+	c.Assert(dst.MatchLabels(map[string]string{"deploy": "v2"}), check.Equals, false)
+	c.Assert(dst.MatchLabels(map[string]string{"zone": ""}), check.Equals, false)
+	c.Assert(Destination{Port: 80}.CheckPort(), check.Equals, uint16(80))
+	c.Assert(Destination{Labels: map[string]string{CheckPortLabel: "0"}}.ValidLabels(), check.Equals, false)
+	c.Assert(Destination{Labels: map[string]string{"bad key": "v"}}.ValidLabels(), check.Equals, false)
+}
+
+func (s *S) TestParseSelector(c *check.C) {
+	selector, err := ParseSelector("deploy=v1, zone=a")
+	c.Assert(err, check.IsNil)
+	c.Assert(selector, check.DeepEquals, map[string]string{"deploy": "v1", "zone": "a"})
+	c.Assert(FormatSelector(selector), check.Equals, "deploy=v1,zone=a")
+	_, err = ParseSelector("deploy")
+	c.Assert(err, check.Equals, ErrInvalidSelector)
+	_, err = ParseSelector("=v1")
+	c.Assert(err, check.Equals, ErrInvalidSelector)
+}
+
+func (s *S) TestServiceFirewallMark(c *check.C) {
+	svc := Service{Host: "10.0.0.1", Port: 21, Protocol: "tcp", FirewallMark: 7, MarkPorts: []string{"20", "30000:30100"}}
+	c.Assert(svc.ValidFirewallMark(), check.Equals, true)
+	c.Assert(svc.KernelKey(), check.Equals, "fwm-7")
+	c.Assert(Service{Host: "10.0.0.1", Port: 21, Protocol: "tcp"}.KernelKey(), check.Equals, "10.0.0.1-21-tcp")
+
+	c.Assert(Service{MarkPorts: []string{"20"}}.ValidFirewallMark(), check.Equals, false)
+	c.Assert(Service{FirewallMark: 1, Type: ServiceTypeHTTP}.ValidFirewallMark(), check.Equals, false)
+	c.Assert(Service{FirewallMark: 1, MarkPorts: []string{"100:20"}}.ValidFirewallMark(), check.Equals, false)
+	c.Assert(Service{FirewallMark: 1, MarkPorts: []string{"0"}}.ValidFirewallMark(), check.Equals, false)
+	c.Assert(Service{FirewallMark: 1, MarkPorts: []string{"ftp"}}.ValidFirewallMark(), check.Equals, false)
+}
+
+func (s *S) TestServicePolicies(c *check.C) {
+	canary := Policy{Name: "internal", Sources: []string{"10.0.0.0/8"}, Destinations: []string{"canary"}, Mark: 10}
+	svc := Service{Host: "10.0.0.1", Port: 80, Protocol: "tcp", Policies: []Policy{canary}}
+	c.Assert(svc.ValidPolicies(), check.Equals, true)
+	c.Assert(svc.FirewallMarks(), check.DeepEquals, []uint32{10})
+	c.Assert(Service{}.ValidPolicies(), check.Equals, true)
+
+	invalid := []Service{
+		{Policies: []Policy{canary}, FirewallMark: 1},
+		{Policies: []Policy{canary}, Type: ServiceTypeHTTP},
+		{Policies: []Policy{canary, canary}},
+		{Policies: []Policy{canary, {Name: "other", Sources: []string{"10.0.0.0/8"}, Destinations: []string{"canary"}, Mark: 10}}},
+		{Policies: []Policy{{Name: "internal", Sources: []string{"10.0.0.1"}, Destinations: []string{"canary"}, Mark: 10}}},
+		{Policies: []Policy{{Name: "internal", Sources: []string{"2001:db8::/32"}, Destinations: []string{"canary"}, Mark: 10}}},
+		{Policies: []Policy{{Name: "internal", Sources: []string{"10.0.0.0/8"}, Mark: 10}}},
+		{Policies: []Policy{{Name: "internal", Sources: []string{"10.0.0.0/8"}, Destinations: []string{"canary"}}}},
+	}
+	for _, svc := range invalid {
+		c.Assert(svc.ValidPolicies(), check.Equals, false, check.Commentf("%+v", svc.Policies))
+	}
+}
+
+func (s *S) TestServicePolicyServices(c *check.C) {
+	svc := Service{
+		Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr",
+		Destinations: []Destination{
+			{Name: "stable", Host: "192.168.0.1", Port: 80, Weight: 1},
+			{Name: "canary", Host: "192.168.0.2", Port: 80, Weight: 1},
+			{Name: "drained", Host: "192.168.0.3", Port: 80},
+		},
+		Policies: []Policy{
+			{Name: "internal", Sources: []string{"10.0.0.0/8"}, Destinations: []string{"canary"}, Mark: 10},
+			{Name: "drained", Sources: []string{"172.16.0.0/12"}, Destinations: []string{"drained"}, Mark: 11},
+		},
+	}
+	services := svc.PolicyServices()
+	c.Assert(services, check.HasLen, 1)
+	c.Assert(services[0].KernelKey(), check.Equals, "fwm-10")
+	c.Assert(services[0].Scheduler, check.Equals, "rr")
+	c.Assert(services[0].Policies, check.IsNil)
+	c.Assert(services[0].Destinations, check.DeepEquals, []Destination{svc.Destinations[1]})
+	c.Assert(svc.Destinations, check.HasLen, 3)
+}
+
+func (s *S) TestServicePersistence(c *check.C) {
+	c.Assert(Service{Host: "10.0.0.1"}.ValidPersistence(), check.Equals, true)
+	c.Assert(Service{Host: "10.0.0.1", PersistenceTimeout: 300, PersistenceNetmask: 24}.ValidPersistence(), check.Equals, true)
+	c.Assert(Service{Host: "10.0.0.1", PersistenceTimeout: 300, PersistenceNetmask: 33}.ValidPersistence(), check.Equals, false)
+	c.Assert(Service{Host: "2001:db8::1", PersistenceTimeout: 300, PersistenceNetmask: 64}.ValidPersistence(), check.Equals, true)
+	c.Assert(Service{Host: "10.0.0.1", PersistenceNetmask: 24}.ValidPersistence(), check.Equals, false)
+	c.Assert(Service{PersistenceTimeout: 300, PersistenceNetmask: 64}.ValidPersistence(), check.Equals, true)
+	c.Assert(Service{Type: ServiceTypeHTTP, PersistenceTimeout: 300}.ValidPersistence(), check.Equals, false)
+}
+
+func (s *S) TestServiceSchedulerFlags(c *check.C) {
+	c.Assert(Service{Scheduler: "rr"}.ValidSchedulerFlags(), check.Equals, true)
+	c.Assert(Service{Scheduler: SchedulerMaglev, SchedulerFlags: []string{SchedulerFlagMHFallback, SchedulerFlagMHPort}}.ValidSchedulerFlags(), check.Equals, true)
+	c.Assert(Service{Scheduler: "sh", SchedulerFlags: []string{SchedulerFlagMHFallback}}.ValidSchedulerFlags(), check.Equals, false)
+	c.Assert(Service{Scheduler: SchedulerMaglev, SchedulerFlags: []string{SchedulerFlagMHPort, SchedulerFlagMHPort}}.ValidSchedulerFlags(), check.Equals, false)
+	c.Assert(Service{Scheduler: SchedulerMaglev, SchedulerFlags: []string{"unknown"}}.ValidSchedulerFlags(), check.Equals, false)
+}
+
+func (s *S) TestServiceClientIPFullNAT(c *check.C) {
+	svc := Service{Destinations: []Destination{{Mode: "nat"}, {Mode: ModeFullNAT}}}
+	report := svc.ClientIP()
+	c.Assert(report.Preserved, check.Equals, false)
+	c.Assert(report.Notes, check.HasLen, 2)
+	c.Assert(Service{}.ValidDestinationMode(ModeFullNAT), check.Equals, true)
+	c.Assert(Service{RequireClientIP: true}.ValidDestinationMode(ModeFullNAT), check.Equals, false)
+	c.Assert(Service{RequireClientIP: true}.ValidDestinationMode("nat"), check.Equals, true)
+}
+
+func (s *S) TestIdGenerators(c *check.C) {
+	gen, err := GetIdGenerator("")
+	c.Assert(err, check.IsNil)
+	c.Assert(gen(Service{Name: "Web Frontend", ExternalId: "app-1"}), check.Equals, "web-frontend")
+	gen, err = GetIdGenerator("external")
+	c.Assert(err, check.IsNil)
+	c.Assert(gen(Service{Name: "Web Frontend", ExternalId: "App 1"}), check.Equals, "app-1")
+	c.Assert(gen(Service{Name: "Web Frontend"}), check.Equals, "web-frontend")
+	gen, err = GetIdGenerator("random")
+	c.Assert(err, check.IsNil)
+	id := gen(Service{Name: "web"})
+	c.Assert(ValidServiceId(id), check.Equals, true)
+	c.Assert(gen(Service{Name: "web"}), check.Not(check.Equals), id)
+	_, err = GetIdGenerator("unknown")
+	c.Assert(err, check.Equals, ErrUnknownIdGenerator)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/statediff"
+)
+
+// stateWatch streams the changes of the services as server-sent events,
+// for dashboards and controllers to follow the state without polling. The
+// stream starts with a state event holding every service, followed by a
+// diff event, as computed by statediff, whenever they change.
+func (as ApiService) stateWatch(c *gin.Context) {
+	changes, cancel := as.balancer.WatchState()
+	defer cancel()
+
+	gone := c.Writer.CloseNotify()
+	services := as.balancer.GetServices()
+	c.SSEvent("state", services)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-changes:
+		case <-gone:
+			return false
+		}
+		current := as.balancer.GetServices()
+		diff := statediff.Compare(services, current)
+		services = current
+		if !diff.Empty() {
+			c.SSEvent("diff", diff)
+		}
+		return true
+	})
+}
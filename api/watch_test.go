@@ -0,0 +1,56 @@
+package api_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/statediff"
+	"gopkg.in/check.v1"
+)
+
+// readEvent reads a server-sent event, returning its name and data
+func readEvent(c *check.C, r *bufio.Reader) (string, string) {
+	var name, data string
+	for {
+		line, err := r.ReadString('\n')
+		c.Assert(err, check.IsNil)
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return name, data
+		}
+		if strings.HasPrefix(line, "event:") {
+			name = strings.TrimPrefix(line, "event:")
+		} else if strings.HasPrefix(line, "data:") {
+			data = strings.TrimPrefix(line, "data:")
+		}
+	}
+}
+
+func (s *S) TestStateWatch(c *check.C) {
+	err := s.bal.AddService(&types.Service{Name: "first", Port: 80, Protocol: "tcp", Scheduler: "rr"})
+	c.Assert(err, check.IsNil)
+
+	resp, err := http.Get(s.srv.URL + "/watch")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	body := bufio.NewReader(resp.Body)
+
+	name, data := readEvent(c, body)
+	c.Assert(name, check.Equals, "state")
+	var services []types.Service
+	c.Assert(json.Unmarshal([]byte(data), &services), check.IsNil)
+	c.Assert(services, check.HasLen, 1)
+
+	err = s.bal.AddService(&types.Service{Name: "second", Port: 80, Protocol: "tcp", Scheduler: "rr"})
+	c.Assert(err, check.IsNil)
+	name, data = readEvent(c, body)
+	c.Assert(name, check.Equals, "diff")
+	var diff statediff.Diff
+	c.Assert(json.Unmarshal([]byte(data), &diff), check.IsNil)
+	c.Assert(diff.Added, check.HasLen, 1)
+	c.Assert(diff.Added[0].Name, check.Equals, "second")
+}
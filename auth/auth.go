@@ -0,0 +1,113 @@
+// Package auth authorizes the API requests. Requests carry a token, which
+// maps to a role, and the role tells which endpoints may be called, so
+// several teams can share a cluster without all of them being able to
+// change its services.
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/secrets"
+)
+
+// Role is the set of API operations allowed to a token
+type Role string
+
+const (
+	// RoleReadOnly only reads the state, e.g. monitoring
+	RoleReadOnly Role = "read-only"
+	// RoleOperator also manages the destinations of the services, e.g.
+	// deployment pipelines adding and draining backends
+	RoleOperator Role = "operator"
+	// RoleAdmin may change everything, including the services
+	RoleAdmin Role = "admin"
+)
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return r == RoleReadOnly || r == RoleOperator || r == RoleAdmin
+}
+
+// Allows reports whether r may send a request with method to path. The
+// gossip keyring is only managed by admins, reading it included, as the
+// listing holds the keys.
+func (r Role) Allows(method, path string) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleOperator:
+		return !isKeyring(path) && (isRead(method, path) || isDestinationWrite(path))
+	case RoleReadOnly:
+		return !isKeyring(path) && isRead(method, path)
+	}
+	return false
+}
+
+// isRead reports whether the request doesn't change the state. Simulations
+// are posted, but only compute the spread of synthetic clients.
+func isRead(method, path string) bool {
+	return method == "GET" || method == "HEAD" || (method == "POST" && strings.HasSuffix(path, "/simulate"))
+}
+
+// isDestinationWrite reports whether path is a destination endpoint,
+// /services/{id}/destinations and below
+func isDestinationWrite(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	return len(parts) >= 3 && parts[0] == "services" && parts[2] == "destinations"
+}
+
+// isKeyring reports whether path is a keyring endpoint, /keys and below
+func isKeyring(path string) bool {
+	return path == "/keys" || strings.HasPrefix(path, "/keys/")
+}
+
+type token struct {
+	name  string
+	value string
+	role  Role
+}
+
+// Authorizer maps the API tokens to their roles
+type Authorizer struct {
+	tokens []token
+}
+
+// New returns an Authorizer of the configured tokens, whose values may be
+// secret references. It returns nil when there are no tokens, in which
+// case the API is open.
+func New(conf config.Auth) (*Authorizer, error) {
+	if len(conf.Tokens) == 0 {
+		return nil, nil
+	}
+	a := &Authorizer{}
+	for _, t := range conf.Tokens {
+		role := Role(t.Role)
+		if !role.Valid() {
+			return nil, fmt.Errorf("auth: invalid role %q of token %s: must be read-only, operator or admin", t.Role, t.Name)
+		}
+		value, err := secrets.Resolve(t.Token)
+		if err != nil {
+			return nil, fmt.Errorf("auth: error resolving token %s: %v", t.Name, err)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("auth: empty token %s", t.Name)
+		}
+		a.tokens = append(a.tokens, token{name: t.Name, value: value, role: role})
+	}
+	return a, nil
+}
+
+// Authenticate returns the name and role of value, and false if it isn't a
+// known token. Every token is compared in constant time, so the time taken
+// doesn't tell how close value is to any of them.
+func (a *Authorizer) Authenticate(value string) (name string, role Role, ok bool) {
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.value), []byte(value)) == 1 {
+			name, role, ok = t.name, t.role, true
+		}
+	}
+	return name, role, ok
+}
@@ -0,0 +1,67 @@
+package auth_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/luizbafilho/fusis/auth"
+	"github.com/luizbafilho/fusis/config"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+func (s *AuthSuite) TestRoles(c *C) {
+	c.Assert(auth.RoleReadOnly.Allows("GET", "/services"), Equals, true)
+	c.Assert(auth.RoleReadOnly.Allows("POST", "/services/web/simulate"), Equals, true)
+	c.Assert(auth.RoleReadOnly.Allows("POST", "/services"), Equals, false)
+	c.Assert(auth.RoleReadOnly.Allows("DELETE", "/services/web/destinations/web-1"), Equals, false)
+
+	c.Assert(auth.RoleOperator.Allows("POST", "/services/web/destinations"), Equals, true)
+	c.Assert(auth.RoleOperator.Allows("DELETE", "/services/web/destinations/web-1"), Equals, true)
+	c.Assert(auth.RoleOperator.Allows("POST", "/services/web/destinations/batch"), Equals, true)
+	c.Assert(auth.RoleOperator.Allows("POST", "/services"), Equals, false)
+	c.Assert(auth.RoleOperator.Allows("DELETE", "/services/web"), Equals, false)
+	c.Assert(auth.RoleOperator.Allows("POST", "/services/destinations/rename"), Equals, false)
+
+	c.Assert(auth.RoleReadOnly.Allows("GET", "/keys"), Equals, false)
+	c.Assert(auth.RoleOperator.Allows("POST", "/keys/use"), Equals, false)
+
+	c.Assert(auth.RoleAdmin.Allows("DELETE", "/services/web"), Equals, true)
+	c.Assert(auth.RoleAdmin.Allows("GET", "/keys"), Equals, true)
+	c.Assert(auth.Role("unknown").Allows("GET", "/services"), Equals, false)
+}
+
+func (s *AuthSuite) TestAuthenticate(c *C) {
+	os.Setenv("FUSIS_TEST_TOKEN", "s3cr3t")
+	defer os.Unsetenv("FUSIS_TEST_TOKEN")
+	a, err := auth.New(config.Auth{Tokens: []config.Token{
+		{Name: "monitoring", Token: "m0n", Role: "read-only"},
+		{Name: "deploys", Token: "env:FUSIS_TEST_TOKEN", Role: "operator"},
+	}})
+	c.Assert(err, IsNil)
+
+	name, role, ok := a.Authenticate("s3cr3t")
+	c.Assert(ok, Equals, true)
+	c.Assert(name, Equals, "deploys")
+	c.Assert(role, Equals, auth.RoleOperator)
+	_, _, ok = a.Authenticate("m0")
+	c.Assert(ok, Equals, false)
+	_, _, ok = a.Authenticate("")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *AuthSuite) TestNew(c *C) {
+	a, err := auth.New(config.Auth{})
+	c.Assert(err, IsNil)
+	c.Assert(a, IsNil)
+	_, err = auth.New(config.Auth{Tokens: []config.Token{{Name: "x", Token: "t", Role: "root"}}})
+	c.Assert(err, ErrorMatches, `auth: invalid role "root".*`)
+	_, err = auth.New(config.Auth{Tokens: []config.Token{{Name: "x", Role: "admin"}}})
+	c.Assert(err, ErrorMatches, "auth: empty token x")
+}
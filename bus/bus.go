@@ -0,0 +1,93 @@
+// Package bus is the internal event bus of a balancer. Modules publish
+// typed events to it instead of calling each other, and the ones interested
+// subscribe to their topics, so new subscribers (webhooks, metrics) can be
+// added without touching the publishers.
+package bus
+
+import (
+	"strings"
+	"sync"
+)
+
+// Event is published on the bus. Its topic is usually the name of its type.
+type Event interface {
+	Topic() string
+}
+
+// Handler receives the events of a topic. Errors are returned to the
+// publisher, which decides what they mean.
+type Handler func(Event) error
+
+type subscription struct {
+	id      int
+	handler Handler
+}
+
+// Bus delivers the published events to the handlers of their topic.
+type Bus struct {
+	sync.RWMutex
+	handlers map[string][]subscription
+	nextId   int
+}
+
+func New() *Bus {
+	return &Bus{handlers: make(map[string][]subscription)}
+}
+
+// Subscribe registers a handler for the events of a topic. The returned
+// function removes it.
+func (b *Bus) Subscribe(topic string, h Handler) (unsubscribe func()) {
+	b.Lock()
+	defer b.Unlock()
+	b.nextId++
+	id := b.nextId
+	b.handlers[topic] = append(b.handlers[topic], subscription{id: id, handler: h})
+
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		subs := b.handlers[topic]
+		for i, s := range subs {
+			if s.id == id {
+				b.handlers[topic] = append(subs[:i:i], subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers an event to the handlers of its topic, synchronously
+// and in subscription order, so publishers may rely on the handlers being
+// done when it returns. Handlers wanting to do slow work should hand it over
+// to their own goroutines. The error of a single failed handler is returned
+// as is, and the ones of several are returned as Errors.
+func (b *Bus) Publish(e Event) error {
+	b.RLock()
+	subs := b.handlers[e.Topic()]
+	b.RUnlock()
+
+	var errs Errors
+	for _, s := range subs {
+		if err := s.handler(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// Errors are the errors returned by several handlers of an event
+type Errors []error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return "multiple errors: " + strings.Join(msgs, " | ")
+}
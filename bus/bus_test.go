@@ -0,0 +1,56 @@
+package bus_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/luizbafilho/fusis/bus"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type BusSuite struct{}
+
+var _ = Suite(&BusSuite{})
+
+func (s *BusSuite) TestPublish(c *C) {
+	b := bus.New()
+	var got []string
+	b.Subscribe("ServiceDeleted", func(e bus.Event) error {
+		got = append(got, "first "+e.(bus.ServiceDeleted).ServiceId)
+		return nil
+	})
+	unsubscribe := b.Subscribe("ServiceDeleted", func(e bus.Event) error {
+		got = append(got, "second "+e.(bus.ServiceDeleted).ServiceId)
+		return nil
+	})
+	b.Subscribe("StateChanged", func(e bus.Event) error {
+		got = append(got, "state")
+		return nil
+	})
+
+	c.Assert(b.Publish(bus.ServiceDeleted{ServiceId: "web"}), IsNil)
+	c.Assert(got, DeepEquals, []string{"first web", "second web"})
+
+	unsubscribe()
+	got = nil
+	c.Assert(b.Publish(bus.ServiceDeleted{ServiceId: "api"}), IsNil)
+	c.Assert(got, DeepEquals, []string{"first api"})
+
+	c.Assert(b.Publish(bus.LeadershipChanged{Leader: true}), IsNil)
+}
+
+func (s *BusSuite) TestPublishErrors(c *C) {
+	b := bus.New()
+	errFirst := errors.New("first failed")
+	b.Subscribe("StateChanged", func(bus.Event) error { return errFirst })
+
+	c.Assert(b.Publish(bus.StateChanged{}), Equals, errFirst)
+
+	b.Subscribe("StateChanged", func(bus.Event) error { return errors.New("second failed") })
+	err := b.Publish(bus.StateChanged{})
+	c.Assert(err, FitsTypeOf, bus.Errors{})
+	c.Assert(err, ErrorMatches, "multiple errors: first failed | second failed")
+}
@@ -0,0 +1,82 @@
+package bus
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// StateChanged is published by the engine once the routing state was
+// changed by a command or a snapshot restore. Errors returned by the
+// handlers are recorded as kernel sync failures. Restored is set when the
+// state was replaced by a snapshot.
+type StateChanged struct {
+	Index    uint64
+	Restored bool
+}
+
+func (StateChanged) Topic() string { return "StateChanged" }
+
+// LeadershipChanged is published when the balancer gains or loses the raft
+// leadership. Failover is set when the balancer took over from a lost
+// leader, once the VIPs are announced.
+type LeadershipChanged struct {
+	Leader   bool
+	Failover *types.FailoverTiming
+}
+
+func (LeadershipChanged) Topic() string { return "LeadershipChanged" }
+
+// CertificatesRotated is published by the engine when the TLS certificates
+// are rotated, so every balancer loads them again.
+type CertificatesRotated struct {
+	Index uint64
+}
+
+func (CertificatesRotated) Topic() string { return "CertificatesRotated" }
+
+// ServiceEvent is a lifecycle event of a service, whose types are listed in
+// the events package.
+type ServiceEvent struct {
+	ServiceId string
+	Type      string
+	Message   string
+}
+
+func (ServiceEvent) Topic() string { return "ServiceEvent" }
+
+// ServiceDeleted is published by the engine once a service is deleted
+type ServiceDeleted struct {
+	ServiceId string
+}
+
+func (ServiceDeleted) Topic() string { return "ServiceDeleted" }
+
+// DestinationRemoved is published by the engine once a destination is
+// removed from its service.
+type DestinationRemoved struct {
+	Destination types.Destination
+}
+
+func (DestinationRemoved) Topic() string { return "DestinationRemoved" }
+
+// StatsCollected is published by the engine when the stats aggregation
+// window of a service is complete. Fields are the aggregated stats, as
+// returned by stats.Window.Fields, along with the connections of the
+// destinations.
+type StatsCollected struct {
+	Service types.Service
+	Time    time.Time
+	Fields  map[string]interface{}
+}
+
+func (StatsCollected) Topic() string { return "StatsCollected" }
+
+// LoadShedding is published when the leader starts or stops rejecting the
+// writes that aren't critical, because of Reason.
+type LoadShedding struct {
+	Shedding bool
+	Reason   string
+}
+
+func (LoadShedding) Topic() string { return "LoadShedding" }
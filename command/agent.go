@@ -15,10 +15,12 @@
 package command
 
 import (
+	"net/http"
 	"os"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/luizbafilho/fusis/api"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/fusis"
 	"github.com/spf13/cobra"
@@ -55,6 +57,13 @@ func runAgentCmd(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
+	if agentConfig.APIAddr != "" {
+		go func() {
+			err := http.ListenAndServe(agentConfig.APIAddr, api.NewAgentAPI(agent))
+			log.Errorf("agent API stopped: %v", err)
+		}()
+	}
+
 	waitSignals(agent)
 }
 
@@ -70,9 +79,12 @@ func setupConfig() {
 	agentCmd.Flags().StringVar(&agentConfig.Host, "host", "", "host IP address")
 	agentCmd.Flags().Uint16VarP(&agentConfig.Port, "port", "p", 80, "port number")
 	agentCmd.Flags().Int32VarP(&agentConfig.Weight, "weight", "w", 1, "host weigth")
-	agentCmd.Flags().StringVarP(&agentConfig.Mode, "mode", "m", "nat", "host IP address")
+	agentCmd.Flags().StringVarP(&agentConfig.Mode, "mode", "m", "nat", "forwarding mode of the destination: nat, route (direct routing), tunnel or fullnat")
 	agentCmd.Flags().StringVar(&agentConfig.Service, "service", "", "service id")
 	agentCmd.Flags().StringVar(&agentConfig.Interface, "iface", "eth0", "Network interface")
+	agentCmd.Flags().StringVar(&agentConfig.EncryptKey, "encrypt", "", "Base64 encoded gossip encryption key, may be a secret reference (file:, env: or vault:)")
+	agentCmd.Flags().StringVar(&agentConfig.KeyringFile, "keyring-file", "", "File where rotated gossip encryption keys are stored")
+	agentCmd.Flags().StringVar(&agentConfig.APIAddr, "api-addr", "127.0.0.1:8001", "Address of the read-only agent API (empty disables it)")
 
 	err := viper.BindPFlags(agentCmd.Flags())
 	if err != nil {
@@ -1,16 +1,25 @@
 package command
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/auth"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/fusis"
-	"github.com/luizbafilho/fusis/net"
+	"github.com/luizbafilho/fusis/metrics"
+	fusis_net "github.com/luizbafilho/fusis/net"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/net/context"
 )
 
 var conf config.BalancerConfig
@@ -43,9 +52,50 @@ func setupBalancerCmdFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&conf.Name, "name", "n", hostname, "node name (unique in the cluster)")
 	cmd.Flags().StringVarP(&conf.Interface, "interface", "", "eth0", "Network interface")
 	cmd.Flags().StringVarP(&conf.ConfigPath, "config-path", "", "/etc/fusis", "Configuration directory")
+	cmd.Flags().StringVar(&conf.RestoreFrom, "restore-from", "", "Snapshot file, or services exported by \"fusis state export\", a new cluster is started with")
 	cmd.Flags().BoolVar(&conf.Bootstrap, "bootstrap", false, "starts balancer in boostrap mode")
 	cmd.Flags().BoolVar(&conf.DevMode, "dev", false, "Initialize balancer in dev mode")
+	cmd.Flags().BoolVar(&conf.FastApply, "dev-fast-apply", false, "Apply changes locally without the raft round-trip (dev mode only)")
 	cmd.Flags().StringSliceVarP(&conf.Join, "join", "j", []string{}, "Join balancer pool")
+	cmd.Flags().StringSliceVar(&conf.RaftPeers, "raft-peers", []string{}, "Initial balancers, as name=address, a new cluster is bootstrapped with")
+	cmd.Flags().BoolVar(&conf.NonVoter, "non-voter", false, "Replicate the raft log without voting")
+	cmd.Flags().StringVar(&conf.SerfSnapshotPath, "serf-snapshot", "", "Serf snapshot file used to rejoin the pool after restarts (default: <config-path>/serf.snapshot)")
+	cmd.Flags().Uint16Var(&conf.LeaderWarmup, "leader-warmup", 0, "Number in seconds a restarted balancer hands the leadership over to the running ones")
+	cmd.Flags().Uint16Var(&conf.Autopilot.DeadServerCleanup, "dead-server-cleanup", 0, "Number in seconds a failed balancer is kept as raft peer before being removed (0 removes it right away)")
+	cmd.Flags().Uint16Var(&conf.Autopilot.ServerStabilization, "server-stabilization", 0, "Number in seconds a new balancer must be alive before being added as raft peer (0 adds it right away)")
+	cmd.Flags().BoolVar(&conf.ManualPeers, "manual-peers", false, "Manage the raft peers through the API only, instead of following the balancers joining and leaving the cluster")
+	cmd.Flags().Uint16Var(&conf.Autopilot.MinQuorum, "min-quorum", 0, "Number of voters dead balancers are never removed below")
+	cmd.Flags().BoolVar(&conf.Autopilot.RedundancyZones, "redundancy-zones", false, "Keep a single balancer of each zone as raft peer, the others standing by")
+	cmd.Flags().StringVar(&conf.Zone, "zone", "", "Redundancy zone of the balancer")
+	cmd.Flags().Uint16Var(&conf.Drain.Timeout, "drain-timeout", 30, "Number in seconds a draining destination is kept before being removed with active connections")
+	cmd.Flags().Uint32Var(&conf.Drain.Threshold, "drain-threshold", 0, "Active connections under which a draining destination is removed")
+	cmd.Flags().BoolVar(&conf.Drain.Agents, "drain-agents", false, "Drain the destinations of agents leaving the cluster instead of removing them right away")
+	cmd.Flags().Uint16Var(&conf.SecretsRefresh, "secrets-refresh", 0, "Number in seconds of the frequency secret params are resolved again (0 disables it)")
+	cmd.Flags().StringVar(&conf.EncryptKey, "encrypt", "", "Base64 encoded gossip encryption key, may be a secret reference (file:, env: or vault:)")
+	cmd.Flags().Uint16Var(&conf.KeyRotation, "key-rotation", 0, "Number in seconds of the frequency the leader checks the encryption key for rotations (0 disables it)")
+	cmd.Flags().Uint16Var(&conf.IpvsSlowOp, "ipvs-slow-op", 100, "Number in milliseconds over which IPVS operations are logged as slow (0 disables it)")
+	cmd.Flags().StringVar(&conf.TLS.CertFile, "tls-cert", "", "Certificate the API is served with over HTTPS")
+	cmd.Flags().StringVar(&conf.TLS.KeyFile, "tls-key", "", "Key of the API certificate")
+	cmd.Flags().StringVar(&conf.TLS.CAFile, "tls-ca", "", "CA verifying the certificates of the API clients and of the other balancers")
+	cmd.Flags().BoolVar(&conf.TLS.VerifyClients, "tls-verify-clients", false, "Require API clients to present a certificate signed by the CA (mutual TLS)")
+	cmd.Flags().StringVar(&conf.TLS.ServerName, "tls-server-name", "", "Name verified in the API certificate of the leader instead of its address")
+	cmd.Flags().StringVar(&conf.RaftTLS.CertFile, "raft-tls-cert", "", "Certificate encrypting the raft traffic, valid as both server and client certificate")
+	cmd.Flags().StringVar(&conf.RaftTLS.KeyFile, "raft-tls-key", "", "Key of the raft certificate")
+	cmd.Flags().StringVar(&conf.RaftTLS.CAFile, "raft-tls-ca", "", "CA verifying the raft certificates of the other balancers")
+	cmd.Flags().StringVar(&conf.RaftTLS.ServerName, "raft-tls-server-name", "", "Name verified in the raft certificates of the other balancers instead of their address")
+	cmd.Flags().BoolVar(&conf.ReadOnlyAPI, "read-only-api", false, "Serve only the read endpoints of the API, rejecting writes")
+	cmd.Flags().StringVar(&conf.ServiceIds, "service-ids", "name", "How the ids of services created without one are generated: name, external or random")
+	cmd.Flags().StringVar(&conf.DestinationCheck.Mode, "destination-check", "", "Connect to the destinations before adding them: warn adds the unreachable ones anyway, reject refuses them (empty disables it)")
+	cmd.Flags().Uint16Var(&conf.DestinationCheck.Timeout, "destination-check-timeout", 1, "Number in seconds the connection to a destination being added may take")
+	cmd.Flags().Uint16Var(&conf.Shedding.ApplyLatency, "shed-apply-latency", 0, "Number in milliseconds of average raft apply latency over which the leader rejects the writes that aren't critical (0 disables it)")
+	cmd.Flags().Uint32Var(&conf.Shedding.PendingSyncs, "shed-pending-syncs", 0, "Number of raft entries waiting to be applied over which the leader rejects the writes that aren't critical (0 disables it)")
+	cmd.Flags().Uint16Var(&conf.Shedding.RetryAfter, "shed-retry-after", 5, "Number in seconds clients of an overloaded leader are told to wait before retrying")
+	cmd.Flags().Uint32Var(&conf.CatchUp.Rate, "catch-up-rate", 0, "Number of IPVS operations per second applied when syncing a restored snapshot (0 disables the pacing)")
+	cmd.Flags().Uint16Var(&conf.CatchUp.Chunk, "catch-up-chunk", 100, "Number of IPVS operations applied at once when syncing a restored snapshot")
+	cmd.Flags().Uint16Var(&conf.Probe.Interval, "probe-interval", 0, "Number in seconds of the frequency the leader connects to the services through their VIPs (0 disables it)")
+	cmd.Flags().Uint16Var(&conf.Probe.Timeout, "probe-timeout", 1, "Number in seconds a probe waits for a connection")
+	cmd.Flags().Uint16Var(&conf.IpvsWatch, "ipvs-watch", 5, "Number in seconds of the frequency the IPVS table is checked for changes made by other tools (0 disables it)")
+	cmd.Flags().Uint16Var(&conf.ReconcileInterval, "reconcile-interval", 60, "Number in seconds of the frequency the leader reconciles the VIPs and the IPVS table with the routing state (0 disables it)")
 	cmd.Flags().Uint16VarP(&conf.LogInterval, "log-interval", "i", 60, "Number in seconds of the frequency of statistics collection from ip_vs")
 	err := viper.BindPFlags(cmd.Flags())
 	if err != nil {
@@ -54,24 +104,91 @@ func setupBalancerCmdFlags(cmd *cobra.Command) {
 }
 
 func balancerCommandFunc(cmd *cobra.Command, args []string) error {
-	if err := net.SetIpForwarding(); err != nil {
+	if err := fusis_net.SetIpForwarding(); err != nil {
 		log.Warn("Fusis couldn't set net.ipv4.ip_forward=1")
 		log.Fatal(err)
 	}
 
+	if isHandover() {
+		if err := waitHandover(); err != nil {
+			log.Fatal(err)
+		}
+		conf.Handover = true
+	}
+
+	if _, err := metrics.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
 	balancer, err := fusis.NewBalancer(&conf)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if len(conf.Join) > 0 {
-		balancer.JoinPool()
+	listener, err := apiListener(fmt.Sprintf("0.0.0.0:%d", conf.APIPort()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := api.Options{ReadOnly: conf.ReadOnlyAPI}
+	if opts.Auth, err = auth.New(conf.Auth); err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{}
+	if conf.TLS.Enabled() {
+		cert, err := conf.TLS.LoadCertificate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if server.TLSConfig, err = cert.ServerConfig(); err != nil {
+			log.Fatal(err)
+		}
+		if opts.ProxyTLS, err = cert.ClientConfig(); err != nil {
+			log.Fatal(err)
+		}
+		balancer.AddCertificate(cert)
+	}
+	server.Handler = api.NewAPIWithOptions(balancer, opts)
+	if server.TLSConfig != nil {
+		// The plain listener is kept for handovers
+		go server.Serve(tls.NewListener(listener, server.TLSConfig))
+	} else {
+		go server.Serve(listener)
 	}
 
-	apiService := api.NewAPI(balancer)
-	go apiService.Serve()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, handoverSignals...)...)
+		for sig := range sigs {
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				cancel()
+				return
+			}
+			if err := handover(server, listener, balancer); err != nil {
+				log.Errorf("Error handing over to new balancer: %v", err)
+				continue
+			}
+			return
+		}
+	}()
+
+	return balancer.Run(ctx)
+}
 
-	waitSignals(balancer)
+// handover starts the new balancer process and stops this one without
+// leaving the cluster. Run returns once the balancer is stopped.
+func handover(server *http.Server, listener net.Listener, balancer *fusis.Balancer) error {
+	ready, err := startHandover(listener)
+	if err != nil {
+		return err
+	}
+	defer ready()
 
+	// Stop accepting requests, the new process will accept them from the
+	// same listener
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Errorf("Error shutting down API: %v", err)
+	}
+	balancer.Handover()
 	return nil
 }
@@ -0,0 +1,7 @@
+package command
+
+import "github.com/luizbafilho/fusis/ctl"
+
+func init() {
+	FusisCmd.AddCommand(ctl.NewCommand("ctl"))
+}
@@ -0,0 +1,56 @@
+package command
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/luizbafilho/fusis/doctor"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	FusisCmd.AddCommand(NewDoctorCommand())
+}
+
+func NewDoctorCommand() *cobra.Command {
+	var path string
+	var asJSON bool
+	var opts doctor.Options
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "checks and repairs the raft data of a stopped balancer",
+		Long: `fusis doctor inspects raft.db, the snapshots and peers.json in the config path
+	of a stopped balancer. It reports corrupted data, gaps in the raft log and
+	entries written by newer releases. With --repair it fixes what can be fixed
+	without losing state, keeping the files it replaces. It exits with status 1
+	when errors are left.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := doctor.Check(path, opts)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(report); err != nil {
+					return err
+				}
+			} else {
+				report.Write(os.Stdout)
+			}
+
+			if !report.Healthy() {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&path, "config-path", "/etc/fusis", "Configuration directory of the balancer")
+	cmd.Flags().BoolVar(&opts.Repair, "repair", false, "Fix the issues that can be fixed without losing state")
+	cmd.Flags().BoolVar(&opts.Compact, "compact", false, "Rewrite raft.db, reclaiming the space of truncated log entries")
+	cmd.Flags().DurationVar(&opts.Timeout, "timeout", time.Second, "How long to wait for a balancer to release raft.db")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the report as JSON")
+	return cmd
+}
@@ -0,0 +1,96 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// In-place upgrades are triggered sending SIGUSR2 to a running balancer. It
+// starts the fusis binary currently installed in its place, handing over
+// the API listener, and stops without leaving the cluster. The new process
+// waits for the old one to release the raft database and ports, and starts
+// with the IPVS table and VIPs untouched. API requests arriving meanwhile
+// wait in the listener backlog.
+const handoverEnv = "FUSIS_HANDOVER"
+
+// File descriptors inherited by the new process
+const (
+	handoverReadyFd = 3 + iota
+	handoverApiFd
+)
+
+// isHandover reports whether this process was started by a balancer handing
+// over to it.
+func isHandover() bool {
+	return os.Getenv(handoverEnv) == "1"
+}
+
+// waitHandover blocks until the previous process is done with the resources
+// this one is going to use. It's signaled by the previous process closing
+// its end of the ready pipe.
+func waitHandover() error {
+	ready := os.NewFile(handoverReadyFd, "handover-ready")
+	defer ready.Close()
+
+	log.Infof("Waiting for previous balancer to hand over")
+	_, err := io.Copy(ioutil.Discard, ready)
+	return err
+}
+
+// apiListener returns the listener inherited from the previous process, or
+// a new one bound to addr.
+func apiListener(addr string) (net.Listener, error) {
+	if !isHandover() {
+		return net.Listen("tcp", addr)
+	}
+
+	f := os.NewFile(handoverApiFd, "handover-api")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// startHandover starts a new fusis process that will take over the given API
+// listener. The returned function must be called once the current balancer
+// has stopped, allowing the new process to continue.
+func startHandover(l net.Listener) (func(), error) {
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("handover: unsupported listener %T", l)
+	}
+	apiFile, err := tcpListener.File()
+	if err != nil {
+		return nil, err
+	}
+	defer apiFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	binary, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), handoverEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{readyR, apiFile}
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return nil, fmt.Errorf("handover: error starting %s: %v", binary, err)
+	}
+	log.Infof("Handing over to new balancer process %d", cmd.Process.Pid)
+
+	return func() { readyW.Close() }, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package command
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoverSignals start an in-place upgrade, see handover
+var handoverSignals = []os.Signal{syscall.SIGUSR2}
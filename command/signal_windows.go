@@ -0,0 +1,6 @@
+package command
+
+import "os"
+
+// Windows has no user signals, so in-place upgrades are unavailable
+var handoverSignals []os.Signal
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/statediff"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	FusisCmd.AddCommand(NewStateCommand())
+}
+
+func NewStateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "exports and compares cluster states",
+	}
+	cmd.AddCommand(newStateExportCommand(), newStateDiffCommand())
+	return cmd
+}
+
+func newStateExportCommand() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "export <api address>",
+		Short: "exports the services of a cluster as JSON",
+		Long: `fusis state export writes the services of a cluster, along with their
+	destinations, as JSON, e.g. "fusis state export http://10.0.0.1:8000".`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the API address of the cluster")
+			}
+			services, err := loadState(args[0])
+			if err != nil {
+				return err
+			}
+
+			data, err := json.MarshalIndent(services, "", "  ")
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+			if output == "" {
+				_, err = os.Stdout.Write(data)
+				return err
+			}
+			return ioutil.WriteFile(output, data, 0644)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File the state is written to (default: stdout)")
+	return cmd
+}
+
+func newStateDiffCommand() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "diff <before> <after>",
+		Short: "compares the services of two clusters",
+		Long: `fusis state diff compares the services of two clusters, or of a cluster and
+	an exported state file. Each side is either an API address or a file written
+	by "fusis state export". It exits with status 1 when there are differences.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected two API addresses or state files to compare")
+			}
+			before, err := loadState(args[0])
+			if err != nil {
+				return err
+			}
+			after, err := loadState(args[1])
+			if err != nil {
+				return err
+			}
+
+			diff := statediff.Compare(before, after)
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(diff); err != nil {
+					return err
+				}
+			} else if diff.Empty() {
+				fmt.Println("No differences found")
+			} else {
+				diff.Write(os.Stdout)
+			}
+
+			if !diff.Empty() {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the differences as JSON")
+	return cmd
+}
+
+// loadState reads the services from a cluster API, when source is an HTTP
+// address, or from a file written by state export otherwise.
+func loadState(source string) ([]types.Service, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		services, err := api.NewClient(source).GetServices()
+		if err != nil {
+			return nil, fmt.Errorf("error reading state from %s: %v", source, err)
+		}
+		state := make([]types.Service, len(services))
+		for i, svc := range services {
+			state[i] = *svc
+		}
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	var state []types.Service
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %v", source, err)
+	}
+	return state, nil
+}
@@ -1,37 +1,158 @@
 package config
 
-import "github.com/luizbafilho/fusis/net"
-
-// {
-// 	"provider": {
-// 		"type": "cloudstack",
-// 		"params": {
-// 			"apiKey": "seila",
-// 			"secretKey": "testando",
-//		  "vipRange":"192.168.0.1/24"
-// 		}
-// 	}
-// "Stats": {
-//   "Interval": 5,
-//   "Type": "syslog"
-//   "params": {
-//	   "protocol": "udp",
-//     "host": "logstash_ip_or_domain_address",
-//     "port": "8515"
-//   }
-//  }
-//}
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/net"
+)
+
+//	{
+//		"provider": {
+//			"type": "cloudstack",
+//			"params": {
+//				"apiKey": "seila",
+//				"secretKey": "testando",
+//			  "vipRange":"192.168.0.1/24"
+//			}
+//		}
+//
+//	"Stats": {
+//	  "Interval": 5,
+//	  "Type": "syslog"
+//	  "params": {
+//		   "protocol": "udp",
+//	    "host": "logstash_ip_or_domain_address",
+//	    "port": "8515"
+//	  }
+//	 }
+//	}
 type Provider struct {
 	Type   string
 	Params map[string]string
+	// Pools are named VIP ranges, e.g. "public" or "internal", services
+	// may allocate their VIP from instead of vipRange
+	Pools map[string]string
 }
 
+// Stats configures the collection of the service stats, sampled from IPVS
+// every Interval seconds and logged aggregated over windows of Window
+// seconds, which defaults to Interval. Buckets are the upper bounds of the
+// histogram of connections per interval. When FullDump is set, the windows
+// of services whose counters didn't change are only logged every FullDump
+// seconds.
 type Stats struct {
 	Type     string
 	Interval uint16
+	Window   uint16
+	FullDump uint16
+	Buckets  []uint32
 	Params   map[string]string
 }
 
+// DNS configures the integration that keeps DNS A records pointing to
+// service VIPs. Supported types are "route53" and "designate".
+type DNS struct {
+	Type   string
+	Params map[string]string
+}
+
+// Health configures flap detection of destinations. A destination changing
+// its health FlapThreshold times within FlapWindow seconds is held out of
+// rotation until it stays stable for FlapWindow seconds.
+type Health struct {
+	FlapThreshold int
+	FlapWindow    uint16
+}
+
+// Probe configures the connections the leader makes to the TCP services
+// through their VIPs every Interval seconds, reporting the ones IPVS doesn't
+// carry traffic for. Zero disables them. Timeout is the number of seconds
+// a connection may take, one by default.
+type Probe struct {
+	Interval uint16
+	Timeout  uint16
+}
+
+// DestinationCheck configures the connection the balancer opens to the
+// destinations added, on their check port, before committing them. Mode is
+// empty to skip it, warn to add the unreachable destinations anyway,
+// recording an event, or reject to refuse them. Timeout is the number of
+// seconds a connection may take, one by default.
+type DestinationCheck struct {
+	Mode    string
+	Timeout uint16
+}
+
+// Destination check modes, see DestinationCheck
+const (
+	DestinationCheckWarn   = "warn"
+	DestinationCheckReject = "reject"
+)
+
+// ValidMode reports whether Mode is empty or a known mode
+func (c DestinationCheck) ValidMode() bool {
+	return c.Mode == "" || c.Mode == DestinationCheckWarn || c.Mode == DestinationCheckReject
+}
+
+// CatchUp paces the IPVS operations syncing a restored snapshot, e.g. on a
+// follower catching up with the leader, so they don't saturate netlink and
+// starve the data plane. They're applied in chunks of Chunk operations, at
+// Rate operations per second. Zero Rate disables it.
+type CatchUp struct {
+	Rate  uint32
+	Chunk uint16
+}
+
+// Shedding makes the leader reject the writes that aren't critical while
+// it's overloaded: when the average raft apply latency exceeds ApplyLatency
+// milliseconds, or more than PendingSyncs raft entries wait to be applied
+// and synced to the kernel. Zero disables each threshold. Clients are told
+// to retry after RetryAfter seconds, which is also how long the apply
+// latency is trusted without new writes.
+type Shedding struct {
+	ApplyLatency uint16
+	PendingSyncs uint32
+	RetryAfter   uint16
+}
+
+// Autopilot configures the management of the raft peers by the leader.
+// Balancers failed for DeadServerCleanup seconds are removed from raft, and
+// new balancers are added only after being alive for ServerStabilization
+// seconds. Zero disables each of them. With RedundancyZones, a single
+// balancer of each zone (see BalancerConfig.Zone) is kept in raft, the
+// others standing by to replace it when it fails. Dead voters aren't
+// removed below MinQuorum voters.
+type Autopilot struct {
+	DeadServerCleanup   uint16
+	ServerStabilization uint16
+	RedundancyZones     bool
+	MinQuorum           uint16
+}
+
+// Drain configures the connection draining of destinations. Draining
+// destinations are taken out of rotation, and only removed once their
+// active connections fall to Threshold, or after Timeout seconds. Agents
+// leaving the cluster are drained when Agents is set, while failed ones are
+// always removed right away.
+type Drain struct {
+	Timeout   uint16
+	Threshold uint32
+	Agents    bool
+}
+
+// Auth configures the authorization of the API requests, open to anyone
+// when there are no tokens. See package auth.
+type Auth struct {
+	Tokens []Token
+}
+
+// Token grants a role to the API requests carrying it. Token may be a
+// secret reference.
+type Token struct {
+	Name  string
+	Token string
+	Role  string
+}
+
 type BalancerConfig struct {
 	Interface string
 
@@ -40,10 +161,117 @@ type BalancerConfig struct {
 	Join        []string
 	Provider    Provider
 	Stats       Stats
+	DNS         DNS
+	Health      Health
+	Probe       Probe
+	Autopilot   Autopilot
+	Drain       Drain
 	ConfigPath  string
 	Ports       map[string]int
 	DevMode     bool
 	LogInterval uint16
+
+	// IpvsSlowOp is the number of milliseconds over which IPVS operations
+	// are logged as slow. Zero disables it.
+	IpvsSlowOp uint16
+	// IpvsWatch is the number of seconds between checks of the IPVS table
+	// for external changes, which are reverted. Zero disables it.
+	IpvsWatch uint16
+	// ReconcileInterval is the number of seconds between the reconciliations
+	// of the VIPs and the IPVS table with the routing state by the leader,
+	// undoing the changes made out of band. Zero disables them.
+	ReconcileInterval uint16 `mapstructure:"reconcile_interval"`
+
+	// DestinationCheck connects to the destinations before adding them
+	DestinationCheck DestinationCheck `mapstructure:"destination_check"`
+	// Shedding rejects the writes that aren't critical on overload
+	Shedding Shedding
+	// CatchUp paces the sync of restored snapshots
+	CatchUp CatchUp `mapstructure:"catch_up"`
+	// Providers are more providers, by name, handling the VIPs of the
+	// services selecting them, e.g. bgp for the public VIPs while Provider
+	// handles the internal ones
+	Providers map[string]Provider
+
+	// TLS configures the HTTPS of the API
+	TLS TLS
+	// RaftTLS, when enabled, encrypts the raft traffic between balancers.
+	// Both ends must present a certificate signed by its CA file.
+	RaftTLS TLS
+	// Auth configures the tokens and roles allowed to use the API
+	Auth Auth
+
+	// ReadOnlyAPI makes the API of the balancer serve only reads, rejecting
+	// the writes instead of proxying them to the leader
+	ReadOnlyAPI bool `mapstructure:"read_only_api"`
+
+	// ServiceIds names the types.IdGenerators used for the services
+	// created without an ID: name, the default, external or random.
+	ServiceIds string `mapstructure:"service_ids"`
+
+	// FastApply makes a dev mode balancer apply commands straight to its
+	// FSM, skipping the raft round-trip. It's ignored outside dev mode.
+	FastApply bool
+
+	// LeaderWarmup is the number of seconds a restarted balancer hands the
+	// leadership it wins over to the balancers already running, before
+	// taking over the VIPs. It keeps the nodes that were already running
+	// leading during rolling restarts, avoiding repeated failovers and VIP
+	// flaps.
+	LeaderWarmup uint16
+
+	// SerfSnapshotPath is the file where the known gossip members are
+	// stored, so a restarted balancer rejoins them without being given
+	// join targets. Defaults to serf.snapshot inside ConfigPath, and it's
+	// disabled in dev mode.
+	SerfSnapshotPath string
+
+	// SecretsRefresh is the interval in seconds in which params referencing
+	// secrets (see package secrets) are resolved again, so rotated
+	// credentials are picked up without a restart. Zero disables it.
+	SecretsRefresh uint16
+
+	// EncryptKey is the base64 encoded key used to encrypt gossip
+	// messages. It may be a secret reference, and the leader rotates it on
+	// every member whenever it changes, checking it every KeyRotation
+	// seconds. Zero disables the rotation.
+	EncryptKey  string
+	KeyRotation uint16
+
+	// Zone is the redundancy zone of the balancer, e.g. its availability
+	// zone or rack. It's only used when Autopilot.RedundancyZones is set.
+	Zone string
+
+	// RaftPeers are the initial balancers, as name=address. A new cluster
+	// is bootstrapped with them, so every initial balancer may be started
+	// with the same list. The raft port is used for addresses without a
+	// port.
+	RaftPeers []string `mapstructure:"raft_peers"`
+
+	// NonVoter makes the balancer replicate the raft log without voting,
+	// so it doesn't count towards the quorum nor becomes the leader.
+	NonVoter bool `mapstructure:"non_voter"`
+
+	// ManualPeers leaves the raft membership to the peers API, instead of
+	// adding and removing the balancers joining and leaving serf. The
+	// autopilot only reports the health of the peers then.
+	ManualPeers bool `mapstructure:"manual_peers"`
+
+	// Logger is used by every balancer component. Programs embedding Fusis
+	// may set it to integrate with their own logging, otherwise a new
+	// logger is created.
+	Logger *logrus.Logger `json:"-" mapstructure:"-"`
+
+	// Handover is set when the balancer takes over from a previous process
+	// during an in-place upgrade. The IPVS table and VIPs left by that
+	// process are kept instead of flushed, and are synced from the raft
+	// state as usual.
+	Handover bool `json:"-" mapstructure:"-"`
+
+	// RestoreFrom is a snapshot file, or services exported from the API,
+	// the balancer starts a new cluster with. It's ignored when the config
+	// path already holds raft data, so restarts keep the current state.
+	RestoreFrom string `json:"-" mapstructure:"-"`
 }
 
 type AgentConfig struct {
@@ -56,12 +284,33 @@ type AgentConfig struct {
 	Weight   int32
 	Mode     string
 	Service  string
+
+	// EncryptKey is the initial gossip encryption key, see
+	// BalancerConfig.EncryptKey. Rotated keys are stored in KeyringFile, if
+	// set, so they survive restarts.
+	EncryptKey  string
+	KeyringFile string
+
+	// APIAddr is the address the read-only agent API listens on, if set
+	APIAddr string
 }
 
 func (c *BalancerConfig) GetIpByInterface() (string, error) {
 	return net.GetIpByInterface(c.Interface)
 }
 
+// DefaultAPIPort is the port the balancer API listens on, unless the api
+// port is set in Ports.
+const DefaultAPIPort = 8000
+
+// APIPort returns the port the balancer API listens on
+func (c *BalancerConfig) APIPort() int {
+	if port := c.Ports["api"]; port != 0 {
+		return port
+	}
+	return DefaultAPIPort
+}
+
 func (c *AgentConfig) GetIpByInterface() (string, error) {
 	return net.GetIpByInterface(c.Interface)
 }
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/luizbafilho/fusis/secrets"
+)
+
+// TLS configures the HTTPS of the management API, served when CertFile and
+// KeyFile are set, or the TLS of the raft transport. With VerifyClients,
+// the clients must present a certificate signed by CAFile (mutual TLS).
+// Balancers present their own certificate when proxying requests to the
+// leader, so it must be valid as a client certificate too. The certificates
+// of the other balancers are verified against their address, or against
+// ServerName when set, e.g. when they share a certificate. CertFile and
+// KeyFile may also be secret references to the PEM encoded certificate and
+// key, see package secrets.
+type TLS struct {
+	CertFile      string
+	KeyFile       string
+	CAFile        string
+	VerifyClients bool
+	ServerName    string
+}
+
+// Enabled reports whether TLS is used, over HTTPS in the case of the API
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// ServerConfig returns the TLS config of the server
+func (t TLS) ServerConfig() (*tls.Config, error) {
+	cert, err := t.LoadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return cert.ServerConfig()
+}
+
+// ClientConfig returns the TLS config used to reach the server, trusting
+// CAFile and presenting the certificate, if set. Balancers use it to proxy
+// requests to the leader.
+func (t TLS) ClientConfig() (*tls.Config, error) {
+	if !t.Enabled() {
+		return t.clientConfig()
+	}
+	cert, err := t.LoadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return cert.ClientConfig()
+}
+
+func (t TLS) clientConfig() (*tls.Config, error) {
+	pool, err := t.caPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		RootCAs:    pool,
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// LoadCertificate loads the certificate of t, to be reloaded while in use
+func (t TLS) LoadCertificate() (*Certificate, error) {
+	c := &Certificate{tls: t}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Certificate is the certificate of a TLS config. The configs it returns
+// present the last one loaded, so rotated certificates are picked up by
+// Reload without restarting the servers.
+type Certificate struct {
+	tls TLS
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Reload loads the certificate again, reporting whether it changed
+func (c *Certificate) Reload() (bool, error) {
+	certPEM, err := readPEM(c.tls.CertFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading certificate: %v", err)
+	}
+	keyPEM, err := readPEM(c.tls.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("error loading certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.cert == nil || len(c.cert.Certificate) != len(cert.Certificate)
+	for i := 0; !changed && i < len(cert.Certificate); i++ {
+		changed = !bytes.Equal(c.cert.Certificate[i], cert.Certificate[i])
+	}
+	c.cert = &cert
+	return changed, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (c *Certificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// ServerConfig returns the TLS config of the server presenting c
+func (c *Certificate) ServerConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if c.tls.VerifyClients {
+		pool, err := c.tls.caPool()
+		if err != nil {
+			return nil, err
+		}
+		if pool == nil {
+			return nil, fmt.Errorf("verifying clients requires a CA file")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS config of the clients presenting c
+func (c *Certificate) ClientConfig() (*tls.Config, error) {
+	config, err := c.tls.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.GetClientCertificate = c.GetClientCertificate
+	return config, nil
+}
+
+// readPEM reads the PEM data of a file, or of the secret value refers to
+func readPEM(value string) ([]byte, error) {
+	if secrets.IsRef(value) {
+		data, err := secrets.Resolve(value)
+		return []byte(data), err
+	}
+	return ioutil.ReadFile(value)
+}
+
+// caPool returns the certificates of CAFile, or nil to use the system ones
+func (t TLS) caPool() (*x509.CertPool, error) {
+	if t.CAFile == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(t.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+	}
+	return pool, nil
+}
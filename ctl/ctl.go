@@ -0,0 +1,581 @@
+// Package ctl is the client of the management API, the ctl command of fusis
+// and the fusisctl binary. It only depends on the api package, so fusisctl
+// is built without the balancer.
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// ctlOptions are the flags shared by the ctl commands
+type ctlOptions struct {
+	addr   string
+	output string
+	stale  bool
+	token  string
+	tls    config.TLS
+	api    *api.Client
+}
+
+func (o *ctlOptions) client() *api.Client {
+	return o.api
+}
+
+// connect creates the API client, over HTTPS if a CA or a client
+// certificate is given
+func (o *ctlOptions) connect() error {
+	o.api = api.NewClient(o.addr)
+	if o.tls.CAFile != "" || o.tls.Enabled() {
+		tlsConfig, err := o.tls.ClientConfig()
+		if err != nil {
+			return err
+		}
+		o.api = api.NewTLSClient(o.addr, tlsConfig)
+	}
+	o.api.Stale = o.stale
+	o.api.Token = o.token
+	return nil
+}
+
+// print writes v in the output format, using table for the default one
+func (o *ctlOptions) print(v interface{}, table func(w io.Writer)) error {
+	switch o.output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		// Round trip through JSON, so the keys are the API ones
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var obj interface{}
+		if err := yaml.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case "", "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		table(w)
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown output format: %s", o.output)
+}
+
+// NewCommand returns the client of the management API, named use. It's
+// both the ctl command of fusis and the root of fusisctl.
+func NewCommand(use string) *cobra.Command {
+	opts := &ctlOptions{}
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: "manages a cluster through its API",
+		Long: `Manages the services and destinations of a cluster through the API of any
+	of its balancers, e.g. "fusisctl services list --addr http://10.0.0.1:8000".`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return opts.connect()
+		},
+	}
+	addr := os.Getenv("FUSIS_ADDR")
+	if addr == "" {
+		addr = "http://localhost:8000"
+	}
+	cmd.PersistentFlags().StringVar(&opts.addr, "addr", addr, "API address of a balancer, defaults to $FUSIS_ADDR")
+	cmd.PersistentFlags().StringVarP(&opts.output, "output", "o", "table", "Output format: table, json or yaml")
+	cmd.PersistentFlags().StringVar(&opts.token, "token", os.Getenv("FUSIS_TOKEN"), "API token, for balancers authorizing the requests, defaults to $FUSIS_TOKEN")
+	cmd.PersistentFlags().StringVar(&opts.tls.CAFile, "tls-ca", "", "CA verifying the certificate of the API, for https addresses")
+	cmd.PersistentFlags().StringVar(&opts.tls.CertFile, "tls-cert", "", "Client certificate, for balancers verifying their clients")
+	cmd.PersistentFlags().StringVar(&opts.tls.KeyFile, "tls-key", "", "Key of the client certificate")
+	cmd.PersistentFlags().BoolVar(&opts.stale, "stale", false, "Read from the local state of the balancer instead of the leader one")
+
+	cmd.AddCommand(
+		newCtlServicesCommand(opts),
+		newCtlDestinationsCommand(opts),
+		newCtlClusterCommand(opts),
+		newCtlProbesCommand(opts),
+		newCtlKeysCommand(opts),
+		newCtlCertificatesCommand(opts),
+		newCtlDumpCommand(opts),
+	)
+	return cmd
+}
+
+func newCtlServicesCommand(opts *ctlOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "services",
+		Short: "lists, adds and deletes services",
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "lists the services",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			services, err := opts.client().GetServices()
+			if err != nil {
+				return err
+			}
+			return opts.print(services, func(w io.Writer) {
+				fmt.Fprintln(w, "ID\tNAME\tADDRESS\tSCHEDULER\tDESTINATIONS")
+				for _, svc := range services {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", svc.GetId(), svc.Name, serviceAddress(svc), svc.Scheduler, len(svc.Destinations))
+				}
+			})
+		},
+	}
+
+	get := &cobra.Command{
+		Use:   "get <service>",
+		Short: "shows a service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the service id")
+			}
+			svc, err := opts.client().GetService(args[0])
+			if err != nil {
+				return err
+			}
+			return opts.print(svc, func(w io.Writer) {
+				fmt.Fprintf(w, "ID:\t%s\n", svc.GetId())
+				fmt.Fprintf(w, "Name:\t%s\n", svc.Name)
+				fmt.Fprintf(w, "Address:\t%s\n", serviceAddress(svc))
+				fmt.Fprintf(w, "Scheduler:\t%s\n", svc.Scheduler)
+				fmt.Fprintf(w, "Version:\t%d\n", svc.Version)
+				fmt.Fprintf(w, "Destinations:\t%d\n", len(svc.Destinations))
+			})
+		},
+	}
+
+	var svc types.Service
+	add := &cobra.Command{
+		Use:   "add <name>",
+		Short: "adds a service, allocating its VIP unless --host is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the service name")
+			}
+			svc.Name = args[0]
+			id, err := opts.client().CreateService(svc)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Service %s added\n", id)
+			return nil
+		},
+	}
+	add.Flags().StringVar(&svc.Host, "host", "", "VIP of the service, allocated from its pool when empty")
+	add.Flags().Uint16Var(&svc.Port, "port", 80, "Port of the service")
+	add.Flags().StringVar(&svc.Protocol, "protocol", "tcp", "Protocol of the service: tcp or udp")
+	add.Flags().StringVar(&svc.Scheduler, "scheduler", "rr", "IPVS scheduler of the service")
+	add.Flags().StringVar(&svc.ExternalId, "external-id", "", "Id of the service in another system, e.g. an app name")
+	add.Flags().StringVar(&svc.Pool, "pool", "", "VIP pool the VIP is allocated from, defaults to the vipRange of the provider")
+	add.Flags().StringVar(&svc.Provider, "provider", "", "Provider handling the VIP, defaults to the default provider")
+
+	var changes types.Service
+	update := &cobra.Command{
+		Use:   "update <service>",
+		Short: "changes the settings of a service, keeping its VIP and destinations",
+		Long: `Changes the settings of a service, keeping its VIP and destinations. The
+	scheduler and persistence are edited in place, while a new port or protocol
+	replaces the IPVS service, dropping its connections.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the service id")
+			}
+			cli := opts.client()
+			svc, err := cli.GetService(args[0])
+			if err != nil {
+				return err
+			}
+			flags := cmd.Flags()
+			if flags.Changed("port") {
+				svc.Port = changes.Port
+			}
+			if flags.Changed("protocol") {
+				svc.Protocol = changes.Protocol
+			}
+			if flags.Changed("scheduler") {
+				svc.Scheduler = changes.Scheduler
+			}
+			if flags.Changed("persistence-timeout") {
+				svc.PersistenceTimeout = changes.PersistenceTimeout
+			}
+			if flags.Changed("persistence-netmask") {
+				svc.PersistenceNetmask = changes.PersistenceNetmask
+			}
+			// Updates racing with this one are rejected
+			if _, err := cli.UpdateService(*svc); err != nil {
+				return err
+			}
+			fmt.Printf("Service %s updated\n", svc.GetId())
+			return nil
+		},
+	}
+	update.Flags().Uint16Var(&changes.Port, "port", 0, "Port of the service")
+	update.Flags().StringVar(&changes.Protocol, "protocol", "", "Protocol of the service: tcp or udp")
+	update.Flags().StringVar(&changes.Scheduler, "scheduler", "", "IPVS scheduler of the service")
+	update.Flags().Uint32Var(&changes.PersistenceTimeout, "persistence-timeout", 0, "Number in seconds the connections of a client stick to the same destination (0 disables it)")
+	update.Flags().Uint8Var(&changes.PersistenceNetmask, "persistence-netmask", 0, "Prefix length grouping the clients sharing a destination")
+
+	del := &cobra.Command{
+		Use:   "delete <service>",
+		Short: "deletes a service along with its destinations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the service id")
+			}
+			if err := opts.client().DeleteService(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Service %s deleted\n", args[0])
+			return nil
+		},
+	}
+
+	cmd.AddCommand(list, get, add, update, del)
+	return cmd
+}
+
+func newCtlDestinationsCommand(opts *ctlOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "destinations",
+		Short: "lists, adds, deletes and drains the destinations of a service",
+	}
+
+	list := &cobra.Command{
+		Use:   "list <service>",
+		Short: "lists the destinations of a service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the service id")
+			}
+			svc, err := opts.client().GetService(args[0])
+			if err != nil {
+				return err
+			}
+			return opts.print(svc.Destinations, func(w io.Writer) {
+				fmt.Fprintln(w, "NAME\tADDRESS\tWEIGHT\tMODE")
+				for _, dst := range svc.Destinations {
+					fmt.Fprintf(w, "%s\t%s:%d\t%d\t%s\n", dst.Name, dst.Host, dst.Port, dst.Weight, dst.Mode)
+				}
+			})
+		},
+	}
+
+	var dst types.Destination
+	add := &cobra.Command{
+		Use:   "add <service> <name>",
+		Short: "adds a destination to a service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected the service id and the destination name")
+			}
+			dst.ServiceId = args[0]
+			dst.Name = args[1]
+			id, err := opts.client().AddDestination(dst)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Destination %s added\n", id)
+			return nil
+		},
+	}
+	add.Flags().StringVar(&dst.Host, "host", "", "Address of the destination")
+	add.Flags().Uint16Var(&dst.Port, "port", 80, "Port of the destination")
+	add.Flags().Int32Var(&dst.Weight, "weight", 1, "Weight of the destination")
+	add.Flags().StringVar(&dst.Mode, "mode", "route", "Forwarding mode: route, nat, tunnel or fullnat")
+	add.Flags().StringVar(&dst.ExternalId, "external-id", "", "Id of the destination in another system, e.g. a pod UID")
+
+	del := &cobra.Command{
+		Use:   "delete <service> <name>",
+		Short: "removes a destination right away",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected the service id and the destination name")
+			}
+			if err := opts.client().DeleteDestination(args[0], args[1]); err != nil {
+				return err
+			}
+			fmt.Printf("Destination %s deleted\n", args[1])
+			return nil
+		},
+	}
+
+	drain := &cobra.Command{
+		Use:   "drain <service> <name>",
+		Short: "takes a destination out of rotation, removing it once its connections are done",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected the service id and the destination name")
+			}
+			if err := opts.client().DrainDestination(args[0], args[1]); err != nil {
+				return err
+			}
+			fmt.Printf("Destination %s draining\n", args[1])
+			return nil
+		},
+	}
+
+	cmd.AddCommand(list, add, del, drain)
+	return cmd
+}
+
+func newCtlClusterCommand(opts *ctlOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cluster",
+		Short: "shows the members of the cluster and the raft leader",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cluster, err := opts.client().GetCluster()
+			if err != nil {
+				return err
+			}
+			return opts.print(cluster, func(w io.Writer) {
+				fmt.Fprintln(w, "NAME\tADDRESS\tROLE\tSTATUS\tLEADER")
+				for _, m := range cluster.Members {
+					leader := ""
+					if m.Leader {
+						leader = "*"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Name, m.Addr, m.Role, m.Status, leader)
+				}
+			})
+		},
+	}
+
+	health := &cobra.Command{
+		Use:   "health",
+		Short: "shows the health of the raft servers and the failures the cluster tolerates",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			health, err := opts.client().GetClusterHealth()
+			if err != nil {
+				return err
+			}
+			return opts.print(health, func(w io.Writer) {
+				fmt.Fprintf(w, "Healthy:\t%t\n", health.Healthy)
+				fmt.Fprintf(w, "Failure tolerance:\t%d\n\n", health.FailureTolerance)
+				fmt.Fprintln(w, "NAME\tADDRESS\tSTATUS\tVOTER\tLEADER\tHEALTHY\tSTABLE SINCE")
+				for _, s := range health.Servers {
+					leader := ""
+					if s.Leader {
+						leader = "*"
+					}
+					since := ""
+					if !s.StableSince.IsZero() {
+						since = s.StableSince.Format(time.RFC3339)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%t\t%s\n", s.Name, s.Addr, s.Status, s.Voter, leader, s.Healthy, since)
+				}
+			})
+		},
+	}
+	forceLeave := &cobra.Command{
+		Use:   "force-leave <name>",
+		Short: "makes a failed member leave the cluster, instead of waiting for it to be reaped",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the member name")
+			}
+			if err := opts.client().ForceLeave(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Member %s left\n", args[0])
+			return nil
+		},
+	}
+	cmd.AddCommand(health, newCtlPeersCommand(opts), forceLeave)
+	return cmd
+}
+
+func newCtlPeersCommand(opts *ctlOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "peers",
+		Short: "lists, adds and removes the raft peers",
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "lists the raft peers",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peers, err := opts.client().GetPeers()
+			if err != nil {
+				return err
+			}
+			return opts.print(peers, func(w io.Writer) {
+				fmt.Fprintln(w, "NAME\tADDRESS\tVOTER")
+				for _, p := range peers {
+					fmt.Fprintf(w, "%s\t%s\t%t\n", p.Name, p.Address, !p.NonVoter)
+				}
+			})
+		},
+	}
+
+	var peer types.Peer
+	add := &cobra.Command{
+		Use:   "add <name>",
+		Short: "adds a balancer to raft, at the address it advertises unless --address is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the balancer name")
+			}
+			peer.Name = args[0]
+			if err := opts.client().AddPeer(peer); err != nil {
+				return err
+			}
+			fmt.Printf("Peer %s added\n", peer.Name)
+			return nil
+		},
+	}
+	add.Flags().StringVar(&peer.Address, "address", "", "Raft address of the balancer, as host:port")
+	add.Flags().BoolVar(&peer.NonVoter, "non-voter", false, "Add the balancer without voting rights")
+
+	remove := &cobra.Command{
+		Use:   "remove <name|address>",
+		Short: "removes a balancer from raft, by name or raft address",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected the balancer name or raft address")
+			}
+			if err := opts.client().RemovePeer(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Peer %s removed\n", args[0])
+			return nil
+		},
+	}
+
+	cmd.AddCommand(list, add, remove)
+	return cmd
+}
+
+func newCtlProbesCommand(opts *ctlOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "probes",
+		Short: "shows the last probe of each service through its VIP",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			results, err := opts.client().GetProbes()
+			if err != nil {
+				return err
+			}
+			return opts.print(results, func(w io.Writer) {
+				fmt.Fprintln(w, "SERVICE\tADDRESS\tSUCCESS\tLATENCY\tFAILURES\tERROR")
+				for _, r := range results {
+					fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%d\t%s\n", r.Service, r.Address, r.Success, r.Latency, r.Failures, r.Error)
+				}
+			})
+		},
+	}
+}
+
+func newCtlKeysCommand(opts *ctlOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "manages the gossip encryption keys of every member of the cluster",
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "lists the installed keys and how many members have each of them",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyring, err := opts.client().ListKeys()
+			if err != nil {
+				return err
+			}
+			return opts.print(keyring, func(w io.Writer) {
+				keys := make([]string, 0, len(keyring.Keys))
+				for key := range keyring.Keys {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				fmt.Fprintln(w, "KEY\tMEMBERS")
+				for _, key := range keys {
+					fmt.Fprintf(w, "%s\t%d/%d\n", key, keyring.Keys[key], keyring.Members)
+				}
+			})
+		},
+	}
+
+	change := func(use, short, done string, change func(c *api.Client, key string) error) *cobra.Command {
+		return &cobra.Command{
+			Use:   use + " <key>",
+			Short: short,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("expected the base64 encoded key")
+				}
+				if err := change(opts.client(), args[0]); err != nil {
+					return err
+				}
+				fmt.Printf("Key %s\n", done)
+				return nil
+			},
+		}
+	}
+
+	cmd.AddCommand(
+		list,
+		change("install", "installs a key, members decrypt gossip with any installed key", "installed", (*api.Client).InstallKey),
+		change("use", "makes an installed key the one members encrypt gossip with", "in use", (*api.Client).UseKey),
+		change("remove", "removes a key that is no longer in use", "removed", (*api.Client).RemoveKey),
+	)
+	return cmd
+}
+
+func newCtlCertificatesCommand(opts *ctlOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "certificates",
+		Short: "manages the TLS certificates of the balancers",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rotate",
+		Short: "makes every balancer reload its certificates",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.client().RotateCertificates(); err != nil {
+				return err
+			}
+			fmt.Println("Certificates rotated")
+			return nil
+		},
+	})
+	return cmd
+}
+
+func newCtlDumpCommand(opts *ctlOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "dump",
+		Short: "dumps the services and their destinations, as JSON unless -o yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			services, err := opts.client().GetServices()
+			if err != nil {
+				return err
+			}
+			if opts.output == "table" {
+				opts.output = "json"
+			}
+			return opts.print(services, nil)
+		},
+	}
+}
+
+func serviceAddress(svc *types.Service) string {
+	if svc.FirewallMark > 0 {
+		return fmt.Sprintf("fwmark %d", svc.FirewallMark)
+	}
+	return fmt.Sprintf("%s:%d/%s", svc.Host, svc.Port, strings.ToLower(svc.Protocol))
+}
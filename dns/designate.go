@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Designate maintains records in an OpenStack Designate (v2 API) zone
+type Designate struct {
+	Endpoint string
+	ZoneId   string
+	Token    string
+
+	client *http.Client
+}
+
+func NewDesignate(params map[string]string) (*Designate, error) {
+	for _, p := range []string{"endpoint", "zoneId", "token"} {
+		if params[p] == "" {
+			return nil, fmt.Errorf("designate: missing %s param", p)
+		}
+	}
+
+	return &Designate{
+		Endpoint: strings.TrimRight(params["endpoint"], "/"),
+		ZoneId:   params["zoneId"],
+		Token:    params["token"],
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+type designateRecordSet struct {
+	Id      string   `json:"id,omitempty"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	Records []string `json:"records"`
+}
+
+func (d *Designate) UpsertRecord(rec Record) error {
+	existing, err := d.find(rec.Name)
+	if err != nil {
+		return err
+	}
+
+	rs := designateRecordSet{
+		Name:    rec.Name,
+		Type:    "A",
+		TTL:     rec.TTL,
+		Records: []string{rec.IP},
+	}
+
+	if existing == nil {
+		return d.do("POST", d.path(), rs, nil)
+	}
+
+	// Name and type can't be changed on updates
+	update := map[string]interface{}{"ttl": rs.TTL, "records": rs.Records}
+	return d.do("PUT", d.path(existing.Id), update, nil)
+}
+
+func (d *Designate) DeleteRecord(rec Record) error {
+	existing, err := d.find(rec.Name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return nil
+	}
+	return d.do("DELETE", d.path(existing.Id), nil, nil)
+}
+
+func (d *Designate) find(name string) (*designateRecordSet, error) {
+	var result struct {
+		Recordsets []designateRecordSet `json:"recordsets"`
+	}
+
+	query := url.Values{"name": {name}, "type": {"A"}}
+	if err := d.do("GET", d.path()+"?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+
+	if len(result.Recordsets) == 0 {
+		return nil, nil
+	}
+	return &result.Recordsets[0], nil
+}
+
+func (d *Designate) path(parts ...string) string {
+	return strings.Join(append([]string{d.Endpoint, "v2/zones", d.ZoneId, "recordsets"}, parts...), "/")
+}
+
+func (d *Designate) do(method, url string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", d.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("designate: %s %s failed. Status Code: %v. Body: %q", method, url, resp.StatusCode, string(data))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("designate: unable to unmarshal body %q: %s", string(data), err)
+		}
+	}
+	return nil
+}
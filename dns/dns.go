@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/secrets"
+)
+
+const (
+	// NameLabel is the service label holding the DNS name that should point
+	// to the service VIP.
+	NameLabel = "dns.name"
+	// TTLLabel optionally overrides the record TTL, in seconds.
+	TTLLabel = "dns.ttl"
+
+	defaultTTL = 60
+)
+
+// Record represents a DNS A record managed by Fusis
+type Record struct {
+	Name string
+	IP   string
+	TTL  int
+}
+
+// Updater is implemented by DNS backends able to maintain A records
+type Updater interface {
+	UpsertRecord(r Record) error
+	DeleteRecord(r Record) error
+}
+
+// New creates the DNS updater configured in the balancer config. It returns
+// nil if no DNS integration is configured.
+func New(config *config.BalancerConfig) (*Syncer, error) {
+	if config.DNS.Type == "" {
+		return nil, nil
+	}
+
+	updater, err := newUpdater(config.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSyncer(updater), nil
+}
+
+func newUpdater(conf config.DNS) (Updater, error) {
+	params, err := secrets.ResolveParams(conf.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.Type {
+	case "route53":
+		return NewRoute53(params)
+	case "designate":
+		return NewDesignate(params)
+	}
+	return nil, fmt.Errorf("unknown dns type: %s", conf.Type)
+}
+
+// Syncer keeps the DNS records in sync with the services VIPs, only sending
+// to the backend the records that changed since the last sync.
+type Syncer struct {
+	sync.Mutex
+	updater Updater
+	records map[string]Record
+}
+
+func NewSyncer(updater Updater) *Syncer {
+	return &Syncer{
+		updater: updater,
+		records: make(map[string]Record),
+	}
+}
+
+// Reload recreates the backend updater, resolving its secret params again,
+// so rotated credentials are used without restarting the balancer.
+func (s *Syncer) Reload(conf config.DNS) error {
+	updater, err := newUpdater(conf)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.updater = updater
+	return nil
+}
+
+// Sync creates, moves or removes the records of the given services.
+func (s *Syncer) Sync(services []types.Service) error {
+	s.Lock()
+	defer s.Unlock()
+
+	desired := make(map[string]Record)
+	for _, svc := range services {
+		r, ok := recordFor(svc)
+		if ok {
+			desired[r.Name] = r
+		}
+	}
+
+	var errors []string
+	for name, r := range desired {
+		if old, ok := s.records[name]; ok && old == r {
+			continue
+		}
+		if err := s.updater.UpsertRecord(r); err != nil {
+			errors = append(errors, fmt.Sprintf("error upserting record %s: %s", name, err))
+			continue
+		}
+		s.records[name] = r
+	}
+	for name, r := range s.records {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := s.updater.DeleteRecord(r); err != nil {
+			errors = append(errors, fmt.Sprintf("error deleting record %s: %s", name, err))
+			continue
+		}
+		delete(s.records, name)
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+func recordFor(svc types.Service) (Record, bool) {
+	name := svc.Labels[NameLabel]
+	if name == "" || svc.Host == "" {
+		return Record{}, false
+	}
+
+	ttl := defaultTTL
+	if v, err := strconv.Atoi(svc.Labels[TTLLabel]); err == nil && v > 0 {
+		ttl = v
+	}
+
+	return Record{
+		Name: strings.TrimSuffix(name, ".") + ".",
+		IP:   svc.Host,
+		TTL:  ttl,
+	}, true
+}
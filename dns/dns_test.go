@@ -0,0 +1,191 @@
+package dns_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/dns"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DNSSuite struct{}
+
+var _ = Suite(&DNSSuite{})
+
+type fakeUpdater struct {
+	upserts []dns.Record
+	deletes []dns.Record
+}
+
+func (f *fakeUpdater) UpsertRecord(r dns.Record) error {
+	f.upserts = append(f.upserts, r)
+	return nil
+}
+
+func (f *fakeUpdater) DeleteRecord(r dns.Record) error {
+	f.deletes = append(f.deletes, r)
+	return nil
+}
+
+func (s *DNSSuite) TestSyncerSync(c *C) {
+	updater := &fakeUpdater{}
+	syncer := dns.NewSyncer(updater)
+
+	services := []types.Service{
+		{Name: "api", Host: "10.0.0.1", Labels: map[string]string{dns.NameLabel: "api.example.com"}},
+		{Name: "web", Host: "10.0.0.2", Labels: map[string]string{dns.NameLabel: "web.example.com.", dns.TTLLabel: "300"}},
+		{Name: "nodns", Host: "10.0.0.3"},
+	}
+	err := syncer.Sync(services)
+	c.Assert(err, IsNil)
+	c.Assert(updater.upserts, HasLen, 2)
+	c.Assert(updater.deletes, HasLen, 0)
+
+	// Nothing changed, nothing is sent
+	updater.upserts = nil
+	err = syncer.Sync(services)
+	c.Assert(err, IsNil)
+	c.Assert(updater.upserts, HasLen, 0)
+
+	// VIP moved and service removed
+	services[0].Host = "10.0.0.9"
+	err = syncer.Sync(services[:1])
+	c.Assert(err, IsNil)
+	c.Assert(updater.upserts, DeepEquals, []dns.Record{{Name: "api.example.com.", IP: "10.0.0.9", TTL: 60}})
+	c.Assert(updater.deletes, DeepEquals, []dns.Record{{Name: "web.example.com.", IP: "10.0.0.2", TTL: 300}})
+}
+
+func (s *DNSSuite) TestRoute53Upsert(c *C) {
+	var req *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer srv.Close()
+
+	r53, err := dns.NewRoute53(map[string]string{
+		"endpoint":     srv.URL,
+		"hostedZoneId": "Z123",
+		"accessKey":    "AKID",
+		"secretKey":    "secret",
+	})
+	c.Assert(err, IsNil)
+
+	err = r53.UpsertRecord(dns.Record{Name: "api.example.com.", IP: "10.0.0.1", TTL: 60})
+	c.Assert(err, IsNil)
+	c.Assert(req.Method, Equals, "POST")
+	c.Assert(req.URL.Path, Equals, "/2013-04-01/hostedzone/Z123/rrset")
+	c.Assert(req.Header.Get("Authorization"), Matches, "AWS4-HMAC-SHA256 Credential=AKID/[0-9]{8}/us-east-1/route53/aws4_request, SignedHeaders=host;x-amz-date, Signature=[0-9a-f]{64}")
+	c.Assert(strings.Contains(body, "<Action>UPSERT</Action>"), Equals, true)
+	c.Assert(strings.Contains(body, "<Value>10.0.0.1</Value>"), Equals, true)
+}
+
+func (s *DNSSuite) TestRoute53MissingParams(c *C) {
+	_, err := dns.NewRoute53(map[string]string{})
+	c.Assert(err, ErrorMatches, "route53: missing hostedZoneId param")
+}
+
+func (s *DNSSuite) TestDesignateUpsert(c *C) {
+	var methods []string
+	var created map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		c.Check(r.Header.Get("X-Auth-Token"), Equals, "tok")
+		switch r.Method {
+		case "GET":
+			c.Check(r.URL.Query().Get("name"), Equals, "api.example.com.")
+			w.Write([]byte(`{"recordsets": []}`))
+		case "POST":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	d, err := dns.NewDesignate(map[string]string{
+		"endpoint": srv.URL,
+		"zoneId":   "zone1",
+		"token":    "tok",
+	})
+	c.Assert(err, IsNil)
+
+	err = d.UpsertRecord(dns.Record{Name: "api.example.com.", IP: "10.0.0.1", TTL: 60})
+	c.Assert(err, IsNil)
+	c.Assert(methods, DeepEquals, []string{"GET", "POST"})
+	c.Assert(created["records"], DeepEquals, []interface{}{"10.0.0.1"})
+}
+
+func (s *DNSSuite) TestDesignateDelete(c *C) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Method == "GET" {
+			w.Write([]byte(`{"recordsets": [{"id": "rs1", "name": "api.example.com.", "type": "A"}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	d, err := dns.NewDesignate(map[string]string{
+		"endpoint": srv.URL,
+		"zoneId":   "zone1",
+		"token":    "tok",
+	})
+	c.Assert(err, IsNil)
+
+	err = d.DeleteRecord(dns.Record{Name: "api.example.com.", IP: "10.0.0.1", TTL: 60})
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{
+		"GET /v2/zones/zone1/recordsets",
+		"DELETE /v2/zones/zone1/recordsets/rs1",
+	})
+}
+
+func (s *DNSSuite) TestReloadResolvesSecrets(c *C) {
+	var token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Auth-Token")
+		w.Write([]byte(`{"recordsets": []}`))
+	}))
+	defer srv.Close()
+
+	os.Setenv("FUSIS_TEST_DESIGNATE_TOKEN", "tok1")
+	defer os.Unsetenv("FUSIS_TEST_DESIGNATE_TOKEN")
+
+	conf := config.DNS{
+		Type: "designate",
+		Params: map[string]string{
+			"endpoint": srv.URL,
+			"zoneId":   "zone1",
+			"token":    "env:FUSIS_TEST_DESIGNATE_TOKEN",
+		},
+	}
+	syncer, err := dns.New(&config.BalancerConfig{DNS: conf})
+	c.Assert(err, IsNil)
+
+	err = syncer.Sync(nil)
+	c.Assert(err, IsNil)
+	err = syncer.Sync([]types.Service{{Name: "api", Host: "10.0.0.1", Labels: map[string]string{dns.NameLabel: "api.example.com"}}})
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "tok1")
+
+	os.Setenv("FUSIS_TEST_DESIGNATE_TOKEN", "tok2")
+	err = syncer.Reload(conf)
+	c.Assert(err, IsNil)
+	err = syncer.Sync(nil)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "tok2")
+}
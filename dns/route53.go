@@ -0,0 +1,166 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	route53Endpoint = "https://route53.amazonaws.com"
+	route53Version  = "2013-04-01"
+)
+
+// Route53 maintains records in an AWS Route53 hosted zone
+type Route53 struct {
+	Endpoint     string
+	HostedZoneId string
+	AccessKey    string
+	SecretKey    string
+
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewRoute53(params map[string]string) (*Route53, error) {
+	for _, p := range []string{"hostedZoneId", "accessKey", "secretKey"} {
+		if params[p] == "" {
+			return nil, fmt.Errorf("route53: missing %s param", p)
+		}
+	}
+
+	endpoint := params["endpoint"]
+	if endpoint == "" {
+		endpoint = route53Endpoint
+	}
+
+	return &Route53{
+		Endpoint:     strings.TrimRight(endpoint, "/"),
+		HostedZoneId: params["hostedZoneId"],
+		AccessKey:    params["accessKey"],
+		SecretKey:    params["secretKey"],
+		client:       &http.Client{Timeout: 30 * time.Second},
+		now:          time.Now,
+	}, nil
+}
+
+type route53ResourceRecord struct {
+	Value string
+}
+
+type route53RecordSet struct {
+	Name            string
+	Type            string
+	TTL             int
+	ResourceRecords []route53ResourceRecord `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Change struct {
+	Action            string
+	ResourceRecordSet route53RecordSet
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+func (r *Route53) UpsertRecord(rec Record) error {
+	return r.change("UPSERT", rec)
+}
+
+func (r *Route53) DeleteRecord(rec Record) error {
+	return r.change("DELETE", rec)
+}
+
+func (r *Route53) change(action string, rec Record) error {
+	body, err := xml.Marshal(route53ChangeRequest{
+		Xmlns: fmt.Sprintf("https://route53.amazonaws.com/doc/%s/", route53Version),
+		Changes: []route53Change{{
+			Action: action,
+			ResourceRecordSet: route53RecordSet{
+				Name:            rec.Name,
+				Type:            "A",
+				TTL:             rec.TTL,
+				ResourceRecords: []route53ResourceRecord{{Value: rec.IP}},
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	path := fmt.Sprintf("/%s/hostedzone/%s/rrset", route53Version, r.HostedZoneId)
+	req, err := http.NewRequest("POST", r.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	r.sign(req, body)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("route53: %s %s failed. Status Code: %v. Body: %q", action, rec.Name, resp.StatusCode, string(data))
+	}
+	return nil
+}
+
+// sign signs the request using AWS Signature Version 4
+func (r *Route53) sign(req *http.Request, body []byte) {
+	now := r.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/us-east-1/route53/aws4_request", date)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		fmt.Sprintf("host:%s\nx-amz-date:%s\n", req.URL.Host, amzDate),
+		"host;x-amz-date",
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+r.SecretKey), date)
+	key = hmacSHA256(key, "us-east-1")
+	key = hmacSHA256(key, "route53")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-date, Signature=%s",
+		r.AccessKey, scope, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,534 @@
+// Package doctor inspects the raft data a balancer keeps in its config path,
+// raft.db, the snapshots and the peers.json recovery file, while the
+// balancer is stopped. It
+// reports corruption and entries written by newer releases, and repairs the
+// problems that can be fixed without losing state.
+package doctor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/engine"
+)
+
+// ErrInUse is returned when raft.db is locked by a running balancer
+var ErrInUse = errors.New("raft.db is in use, stop the balancer before running the doctor")
+
+// Buckets and keys of raft.db, as written by raft-boltdb
+var (
+	logsBucket  = []byte("logs")
+	confBucket  = []byte("conf")
+	currentTerm = []byte("CurrentTerm")
+)
+
+// Severity tells how bad an issue is
+type Severity string
+
+const (
+	// Warning issues don't keep the balancer from starting with its state
+	Warning Severity = "warning"
+	// Error issues lose or corrupt the state of the balancer
+	Error Severity = "error"
+)
+
+// Issue is a problem found in the raft data
+type Issue struct {
+	Path     string
+	Severity Severity
+	Problem  string
+	// Repair describes how Options.Repair fixes the issue. It's empty when
+	// it can't be fixed safely.
+	Repair   string `json:",omitempty"`
+	Repaired bool
+}
+
+// Snapshot describes a snapshot of the snapshot store
+type Snapshot struct {
+	Id      string
+	Index   uint64
+	Term    uint64
+	Version int
+	Valid   bool
+}
+
+// Report is the outcome of a check
+type Report struct {
+	Path       string
+	Term       uint64
+	FirstIndex uint64
+	LastIndex  uint64
+	// Snapshots are sorted from newest to oldest
+	Snapshots []Snapshot
+	// Peers are the servers of the latest raft configuration, as
+	// name=address
+	Peers []string
+	// Size of raft.db and, when compacted, the space compacting it freed
+	Size      int64
+	Reclaimed int64
+	Issues    []Issue
+}
+
+// Healthy reports whether no errors are left in the raft data
+func (r *Report) Healthy() bool {
+	for _, i := range r.Issues {
+		if i.Severity == Error && !i.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Write prints the report in a human readable form
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Config path: %s\n", r.Path)
+	if r.LastIndex > 0 {
+		fmt.Fprintf(w, "Raft log: entries %d to %d, term %d\n", r.FirstIndex, r.LastIndex, r.Term)
+	} else {
+		fmt.Fprintf(w, "Raft log: empty\n")
+	}
+	fmt.Fprintf(w, "raft.db size: %d bytes", r.Size)
+	if r.Reclaimed > 0 {
+		fmt.Fprintf(w, ", %d bytes reclaimed", r.Reclaimed)
+	}
+	fmt.Fprintln(w)
+	for _, s := range r.Snapshots {
+		state := "ok"
+		if !s.Valid {
+			state = "unusable"
+		}
+		fmt.Fprintf(w, "Snapshot %s: index %d, term %d, version %d, %s\n", s.Id, s.Index, s.Term, s.Version, state)
+	}
+	fmt.Fprintf(w, "Peers: %s\n", strings.Join(r.Peers, ", "))
+
+	if len(r.Issues) == 0 {
+		fmt.Fprintln(w, "No issues found")
+		return
+	}
+	for _, i := range r.Issues {
+		fmt.Fprintf(w, "%s: %s: %s\n", i.Severity, i.Path, i.Problem)
+		switch {
+		case i.Repaired:
+			fmt.Fprintf(w, "    repaired: %s\n", i.Repair)
+		case i.Repair != "":
+			fmt.Fprintf(w, "    repair: %s\n", i.Repair)
+		}
+	}
+}
+
+// Options change what Check does besides inspecting the raft data
+type Options struct {
+	// Repair fixes the issues that can be fixed without losing state.
+	// Files replaced are kept with the .bak extension and unusable
+	// snapshots are moved to the snapshots.corrupt directory.
+	Repair bool
+	// Compact rewrites raft.db, reclaiming the space of the entries raft
+	// truncated after taking snapshots.
+	Compact bool
+	// Timeout is how long to wait for a balancer to release raft.db.
+	// Defaults to one second.
+	Timeout time.Duration
+}
+
+type checker struct {
+	dir    string
+	opts   Options
+	report *Report
+
+	// configuration is the latest raft configuration found, either in the
+	// log or in a snapshot, written at configurationIndex
+	configuration      *raft.Configuration
+	configurationIndex uint64
+}
+
+// Check inspects the raft data in dir, the config path of a stopped
+// balancer. It returns ErrInUse while the balancer is running.
+func Check(dir string, opts Options) (*Report, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	c := &checker{dir: dir, opts: opts, report: &Report{Path: dir}}
+
+	consistent, err := c.checkLog()
+	if err != nil {
+		return nil, err
+	}
+	c.checkSnapshots()
+	c.checkCoverage()
+	c.checkPeers()
+	if opts.Compact && consistent {
+		if err := c.compact(); err != nil {
+			return nil, fmt.Errorf("error compacting raft.db: %v", err)
+		}
+	}
+	return c.report, nil
+}
+
+// add records an issue, fixing it with fix when repairing
+func (c *checker) add(issue Issue, fix func() error) {
+	if fix != nil && c.opts.Repair {
+		if err := fix(); err != nil {
+			issue.Problem = fmt.Sprintf("%s (repair failed: %v)", issue.Problem, err)
+		} else {
+			issue.Repaired = true
+		}
+	}
+	c.report.Issues = append(c.report.Issues, issue)
+}
+
+// checkLog walks the raft log, reporting whether raft.db is consistent
+// enough to be compacted.
+func (c *checker) checkLog() (consistent bool, err error) {
+	path := filepath.Join(c.dir, "raft.db")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		c.add(Issue{Path: path, Severity: Warning, Problem: "missing, the balancer has no raft log yet"}, nil)
+		return false, nil
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: c.opts.Timeout})
+	if err == bolt.ErrTimeout {
+		return false, ErrInUse
+	}
+	if err != nil {
+		c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("can't be opened: %v", err)}, nil)
+		return false, nil
+	}
+	defer db.Close()
+	if info, err := os.Stat(path); err == nil {
+		c.report.Size = info.Size()
+	}
+
+	consistent = true
+	corrupt := func(problem string) {
+		consistent = false
+		c.add(Issue{Path: path, Severity: Error, Problem: problem}, nil)
+	}
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		// Bolt panics on some corrupted pages
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		for err := range tx.Check() {
+			corrupt(fmt.Sprintf("corrupted: %v", err))
+		}
+		if !consistent {
+			return nil
+		}
+
+		if conf := tx.Bucket(confBucket); conf != nil {
+			if v := conf.Get(currentTerm); len(v) == 8 {
+				c.report.Term = binary.BigEndian.Uint64(v)
+			}
+		}
+		logs := tx.Bucket(logsBucket)
+		if logs == nil {
+			return nil
+		}
+		cursor := logs.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if len(k) != 8 {
+				corrupt(fmt.Sprintf("invalid log key %x", k))
+				continue
+			}
+			index := binary.BigEndian.Uint64(k)
+			if c.report.FirstIndex == 0 {
+				c.report.FirstIndex = index
+			} else if index != c.report.LastIndex+1 {
+				corrupt(fmt.Sprintf("log entries %d to %d are missing", c.report.LastIndex+1, index-1))
+			}
+			c.report.LastIndex = index
+			c.checkEntry(path, index, v)
+		}
+		return nil
+	})
+	if err != nil {
+		corrupt(fmt.Sprintf("corrupted: %v", err))
+	}
+	return consistent, nil
+}
+
+// checkEntry decodes a log entry, along with the command it holds, as the
+// balancer would apply it
+func (c *checker) checkEntry(path string, index uint64, data []byte) {
+	var l raft.Log
+	if err := codec.NewDecoder(bytes.NewReader(data), &codec.MsgpackHandle{}).Decode(&l); err != nil {
+		c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("log entry %d can't be decoded: %v", index, err)}, nil)
+		return
+	}
+	if l.Index != index {
+		c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("log entry %d is stored as entry %d", l.Index, index)}, nil)
+	}
+	if l.Type == raft.LogConfiguration {
+		var conf raft.Configuration
+		if err := codec.NewDecoder(bytes.NewReader(l.Data), &codec.MsgpackHandle{}).Decode(&conf); err != nil {
+			c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("log entry %d holds an invalid raft configuration: %v", index, err)}, nil)
+		} else {
+			c.configuration, c.configurationIndex = &conf, index
+		}
+	}
+	if l.Type != raft.LogCommand {
+		return
+	}
+
+	// Commands that can't be applied are quarantined by the balancer, the
+	// rest of the log is still applied.
+	var version struct{ Version int }
+	json.Unmarshal(l.Data, &version)
+	if version.Version > engine.CommandVersion {
+		c.add(Issue{Path: path, Severity: Warning, Problem: fmt.Sprintf("log entry %d holds a command of version %d, newer than %d: upgrade the balancer or it's quarantined when applied", index, version.Version, engine.CommandVersion)}, nil)
+	} else if _, err := engine.DecodeCommand(l.Data); err != nil {
+		c.add(Issue{Path: path, Severity: Warning, Problem: fmt.Sprintf("log entry %d holds an invalid command, quarantined when applied: %v", index, err)}, nil)
+	}
+}
+
+// checkSnapshots verifies the checksum and format of the snapshots
+func (c *checker) checkSnapshots() {
+	dir := filepath.Join(c.dir, "snapshots")
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		c.add(Issue{Path: dir, Severity: Error, Problem: fmt.Sprintf("can't be read: %v", err)}, nil)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		// Left behind by a balancer stopped while taking a snapshot
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			c.add(Issue{Path: path, Severity: Warning, Problem: "unfinished snapshot", Repair: "removed"}, func() error {
+				return os.RemoveAll(path)
+			})
+			continue
+		}
+
+		snap, meta, err := readSnapshot(path)
+		if err == nil {
+			snap.Valid = true
+			// The log holds the configurations changed after the snapshot
+			if meta.ConfigurationIndex > c.configurationIndex {
+				c.configuration, c.configurationIndex = &meta.Configuration, meta.ConfigurationIndex
+			}
+		} else if snap.Version > engine.SnapshotVersion {
+			c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("snapshot of version %d, newer than %d: upgrade the balancer", snap.Version, engine.SnapshotVersion)}, nil)
+		} else {
+			corrupt := filepath.Join(c.dir, "snapshots.corrupt", entry.Name())
+			c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("unusable snapshot: %v", err), Repair: "moved to " + corrupt}, func() error {
+				if err := os.MkdirAll(filepath.Dir(corrupt), 0755); err != nil {
+					return err
+				}
+				return os.Rename(path, corrupt)
+			})
+		}
+		c.report.Snapshots = append(c.report.Snapshots, snap)
+	}
+	sort.Slice(c.report.Snapshots, func(i, j int) bool {
+		return c.report.Snapshots[i].Index > c.report.Snapshots[j].Index
+	})
+}
+
+// readSnapshot reads a snapshot written by the raft file snapshot store,
+// along with its metadata. The version is set whenever the snapshot data
+// could be read.
+func readSnapshot(path string) (Snapshot, raft.SnapshotMeta, error) {
+	snap := Snapshot{Id: filepath.Base(path)}
+	data, err := ioutil.ReadFile(filepath.Join(path, "meta.json"))
+	if err != nil {
+		return snap, raft.SnapshotMeta{}, err
+	}
+	var meta struct {
+		raft.SnapshotMeta
+		CRC []byte
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return snap, meta.SnapshotMeta, fmt.Errorf("invalid meta.json: %v", err)
+	}
+	snap.Index, snap.Term = meta.Index, meta.Term
+
+	state, err := ioutil.ReadFile(filepath.Join(path, "state.bin"))
+	if err != nil {
+		return snap, meta.SnapshotMeta, err
+	}
+	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	hash.Write(state)
+	if !bytes.Equal(hash.Sum(nil), meta.CRC) {
+		return snap, meta.SnapshotMeta, errors.New("checksum mismatch")
+	}
+	snap.Version, err = engine.CheckSnapshot(bytes.NewReader(state))
+	return snap, meta.SnapshotMeta, err
+}
+
+// checkCoverage verifies the state truncated from the log is in a usable
+// snapshot
+func (c *checker) checkCoverage() {
+	if c.report.FirstIndex <= 1 {
+		return
+	}
+	var covered uint64
+	for _, s := range c.report.Snapshots {
+		if s.Valid {
+			covered = s.Index
+			break
+		}
+	}
+	if c.report.FirstIndex > covered+1 {
+		c.add(Issue{
+			Path:     filepath.Join(c.dir, "raft.db"),
+			Severity: Error,
+			Problem:  fmt.Sprintf("the log starts at entry %d but no usable snapshot covers the entries before it: rejoin the balancer with an empty config path", c.report.FirstIndex),
+		}, nil)
+	}
+}
+
+// recoveryEntry is a server of peers.json, as read by raft
+type recoveryEntry struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	NonVoter bool   `json:"non_voter,omitempty"`
+}
+
+// checkPeers reports the latest raft configuration, and verifies
+// peers.json, when it exists, lists each server once by id and address.
+// The file replaces the configuration on the next start, to recover a
+// cluster that lost its quorum.
+func (c *checker) checkPeers() {
+	if c.configuration != nil {
+		for _, s := range c.configuration.Servers {
+			peer := fmt.Sprintf("%s=%s", s.ID, s.Address)
+			if s.Suffrage != raft.Voter {
+				peer += " (" + strings.ToLower(s.Suffrage.String()) + ")"
+			}
+			c.report.Peers = append(c.report.Peers, peer)
+		}
+	}
+
+	path := filepath.Join(c.dir, "peers.json")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("can't be read: %v", err)}, nil)
+		return
+	}
+	var peers []recoveryEntry
+	if err := json.Unmarshal(data, &peers); err != nil {
+		var legacy []string
+		if json.Unmarshal(data, &legacy) == nil {
+			c.add(Issue{Path: path, Severity: Error, Problem: "lists raft addresses, as written by releases before server IDs: remove it or list the balancers by id and address"}, nil)
+			return
+		}
+		c.add(Issue{Path: path, Severity: Error, Problem: fmt.Sprintf("invalid JSON, it must list the id and address of the balancers: %v", err)}, nil)
+		return
+	}
+
+	var valid []recoveryEntry
+	var invalid []string
+	seen := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		if _, port, err := net.SplitHostPort(p.Address); err != nil || port == "" || p.ID == "" || seen[p.ID] || seen[p.Address] {
+			invalid = append(invalid, fmt.Sprintf("%q", p.ID+"="+p.Address))
+			continue
+		}
+		seen[p.ID], seen[p.Address] = true, true
+		valid = append(valid, p)
+	}
+	if len(invalid) > 0 {
+		c.add(Issue{Path: path, Severity: Error, Problem: "invalid or duplicated peers " + strings.Join(invalid, ", "), Repair: "removed them"}, func() error {
+			data, err := json.Marshal(valid)
+			if err != nil {
+				return err
+			}
+			return replaceFile(path, data)
+		})
+	}
+	c.add(Issue{Path: path, Severity: Warning, Problem: fmt.Sprintf("the raft configuration is replaced by its %d peers on the next start", len(valid))}, nil)
+}
+
+// compact copies raft.db into a new file, leaving out the pages freed by
+// the truncated entries, and replaces the original with it
+func (c *checker) compact() error {
+	path := filepath.Join(c.dir, "raft.db")
+	src, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: c.opts.Timeout})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				copied, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return b.ForEach(func(k, v []byte) error {
+					return copied.Put(k, v)
+				})
+			})
+		})
+	})
+	dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	// Bolt grows files in chunks, nothing is gained from small ones
+	if info.Size() >= c.report.Size {
+		return os.Remove(tmp)
+	}
+	if err := os.Rename(path, path+".bak"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	c.report.Reclaimed = c.report.Size - info.Size()
+	c.report.Size = info.Size()
+	return nil
+}
+
+// replaceFile writes data to path, keeping the original with the .bak
+// extension
+func replaceFile(path string, data []byte) error {
+	if err := os.Rename(path, path+".bak"); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
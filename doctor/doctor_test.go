@@ -0,0 +1,236 @@
+package doctor_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/doctor"
+	"github.com/luizbafilho/fusis/engine"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DoctorSuite struct {
+	dir string
+}
+
+var _ = Suite(&DoctorSuite{})
+
+func (s *DoctorSuite) SetUpTest(c *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("", "fusis-doctor")
+	c.Assert(err, IsNil)
+}
+
+func (s *DoctorSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+// writeLog stores a command for each of the indexes in raft.db
+func (s *DoctorSuite) writeLog(c *C, cmd engine.Command, indexes ...uint64) {
+	store, err := raftboltdb.NewBoltStore(filepath.Join(s.dir, "raft.db"))
+	c.Assert(err, IsNil)
+	defer store.Close()
+	data, err := json.Marshal(cmd)
+	c.Assert(err, IsNil)
+	for _, i := range indexes {
+		err = store.StoreLog(&raft.Log{Index: i, Term: 2, Type: raft.LogCommand, Data: data})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(store.SetUint64([]byte("CurrentTerm"), 2), IsNil)
+}
+
+// writeConfiguration stores a raft configuration entry at index
+func (s *DoctorSuite) writeConfiguration(c *C, index uint64, servers ...raft.Server) {
+	store, err := raftboltdb.NewBoltStore(filepath.Join(s.dir, "raft.db"))
+	c.Assert(err, IsNil)
+	defer store.Close()
+	var buf bytes.Buffer
+	err = codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(raft.Configuration{Servers: servers})
+	c.Assert(err, IsNil)
+	err = store.StoreLog(&raft.Log{Index: index, Term: 2, Type: raft.LogConfiguration, Data: buf.Bytes()})
+	c.Assert(err, IsNil)
+}
+
+func (s *DoctorSuite) writeSnapshot(c *C, index uint64, data string) string {
+	store, err := raft.NewFileSnapshotStore(s.dir, 3, ioutil.Discard)
+	c.Assert(err, IsNil)
+	servers := []raft.Server{{Suffrage: raft.Voter, ID: "b1", Address: "10.0.0.1:4382"}}
+	_, trans := raft.NewInmemTransport("")
+	sink, err := store.Create(raft.SnapshotVersionMax, index, 2, raft.Configuration{Servers: servers}, index, trans)
+	c.Assert(err, IsNil)
+	_, err = sink.Write([]byte(data))
+	c.Assert(err, IsNil)
+	c.Assert(sink.Close(), IsNil)
+	return filepath.Join(s.dir, "snapshots", sink.ID())
+}
+
+var addService = engine.Command{Op: engine.AddServiceOp, Service: &types.Service{Id: "web", Name: "web"}}
+
+func (s *DoctorSuite) TestHealthy(c *C) {
+	s.writeSnapshot(c, 3, `{"Version":2,"Data":{}}`)
+	s.writeLog(c, addService, 2, 3, 4)
+
+	report, err := doctor.Check(s.dir, doctor.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Issues, HasLen, 0)
+	c.Assert(report.Healthy(), Equals, true)
+	c.Assert(report.Term, Equals, uint64(2))
+	c.Assert(report.FirstIndex, Equals, uint64(2))
+	c.Assert(report.LastIndex, Equals, uint64(4))
+	c.Assert(report.Snapshots, HasLen, 1)
+	c.Assert(report.Snapshots[0].Valid, Equals, true)
+	c.Assert(report.Snapshots[0].Version, Equals, engine.SnapshotVersion)
+	c.Assert(report.Peers, DeepEquals, []string{"b1=10.0.0.1:4382"})
+
+	// Configurations in the log are newer than the snapshot ones
+	s.writeConfiguration(c, 5,
+		raft.Server{Suffrage: raft.Voter, ID: "b1", Address: "10.0.0.1:4382"},
+		raft.Server{Suffrage: raft.Nonvoter, ID: "b2", Address: "10.0.0.2:4382"})
+	report, err = doctor.Check(s.dir, doctor.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Issues, HasLen, 0)
+	c.Assert(report.Peers, DeepEquals, []string{"b1=10.0.0.1:4382", "b2=10.0.0.2:4382 (nonvoter)"})
+}
+
+func (s *DoctorSuite) TestLogIssues(c *C) {
+	s.writeLog(c, addService, 1, 2, 5)
+	newer := addService
+	newer.Version = engine.CommandVersion + 1
+	s.writeLog(c, newer, 6)
+
+	report, err := doctor.Check(s.dir, doctor.Options{Repair: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, false)
+	c.Assert(report.Issues, HasLen, 2)
+	c.Assert(report.Issues[0].Severity, Equals, doctor.Error)
+	c.Assert(report.Issues[0].Problem, Equals, "log entries 3 to 4 are missing")
+	c.Assert(report.Issues[0].Repaired, Equals, false)
+	c.Assert(report.Issues[1].Severity, Equals, doctor.Warning)
+	c.Assert(report.Issues[1].Problem, Matches, "log entry 6 holds a command of version .*")
+}
+
+func (s *DoctorSuite) TestUncoveredLog(c *C) {
+	s.writeLog(c, addService, 10, 11)
+
+	report, err := doctor.Check(s.dir, doctor.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, false)
+	c.Assert(report.Issues, HasLen, 1)
+	c.Assert(report.Issues[0].Problem, Matches, "the log starts at entry 10 but no usable snapshot .*")
+}
+
+func (s *DoctorSuite) TestRepairSnapshots(c *C) {
+	s.writeSnapshot(c, 5, `{"Version":2,"Data":{}}`)
+	corrupt := s.writeSnapshot(c, 8, `{"Version":2,"Data":{}}`)
+	err := ioutil.WriteFile(filepath.Join(corrupt, "state.bin"), []byte(`{"Version":2,"Data":{"Services":1}}`), 0644)
+	c.Assert(err, IsNil)
+	newer := s.writeSnapshot(c, 9, `{"Version":99,"Data":{}}`)
+	s.writeLog(c, addService, 6, 7, 8, 9, 10)
+
+	report, err := doctor.Check(s.dir, doctor.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, false)
+	c.Assert(report.Snapshots, HasLen, 3)
+	c.Assert(report.Snapshots[0].Index, Equals, uint64(9))
+	c.Assert(report.Snapshots[0].Valid, Equals, false)
+	c.Assert(report.Snapshots[1].Valid, Equals, false)
+	c.Assert(report.Snapshots[2].Valid, Equals, true)
+
+	report, err = doctor.Check(s.dir, doctor.Options{Repair: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Issues, HasLen, 2)
+	for _, issue := range report.Issues {
+		if issue.Path == newer {
+			c.Assert(issue.Problem, Matches, "snapshot of version 99, .*")
+			c.Assert(issue.Repaired, Equals, false)
+		} else {
+			c.Assert(issue.Path, Equals, corrupt)
+			c.Assert(issue.Problem, Equals, "unusable snapshot: checksum mismatch")
+			c.Assert(issue.Repaired, Equals, true)
+		}
+	}
+	_, err = os.Stat(filepath.Join(s.dir, "snapshots.corrupt", filepath.Base(corrupt), "meta.json"))
+	c.Assert(err, IsNil)
+	_, err = os.Stat(corrupt)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *DoctorSuite) TestRepairPeers(c *C) {
+	path := filepath.Join(s.dir, "peers.json")
+	original := `[{"id":"b1","address":"10.0.0.1:4382"},{"id":"b2","address":"10.0.0.2"},{"id":"b1","address":"10.0.0.3:4382"}]`
+	err := ioutil.WriteFile(path, []byte(original), 0644)
+	c.Assert(err, IsNil)
+
+	report, err := doctor.Check(s.dir, doctor.Options{Repair: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, true)
+	c.Assert(report.Issues, HasLen, 3)
+	c.Assert(report.Issues[1].Problem, Equals, `invalid or duplicated peers "b2=10.0.0.2", "b1=10.0.0.3:4382"`)
+	c.Assert(report.Issues[1].Repaired, Equals, true)
+	c.Assert(report.Issues[2].Problem, Equals, "the raft configuration is replaced by its 1 peers on the next start")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `[{"id":"b1","address":"10.0.0.1:4382"}]`)
+	data, err = ioutil.ReadFile(path + ".bak")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, original)
+
+	err = ioutil.WriteFile(path, []byte(`["10.0.0.1:4382"]`), 0644)
+	c.Assert(err, IsNil)
+	report, err = doctor.Check(s.dir, doctor.Options{Repair: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, false)
+	c.Assert(report.Issues[1].Problem, Matches, "lists raft addresses, .*")
+
+	err = ioutil.WriteFile(path, []byte(`{"peers"`), 0644)
+	c.Assert(err, IsNil)
+	report, err = doctor.Check(s.dir, doctor.Options{Repair: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Healthy(), Equals, false)
+}
+
+func (s *DoctorSuite) TestCompact(c *C) {
+	indexes := make([]uint64, 2000)
+	for i := range indexes {
+		indexes[i] = uint64(i + 1)
+	}
+	s.writeLog(c, addService, indexes...)
+	store, err := raftboltdb.NewBoltStore(filepath.Join(s.dir, "raft.db"))
+	c.Assert(err, IsNil)
+	c.Assert(store.DeleteRange(1, 1990), IsNil)
+	store.Close()
+	s.writeSnapshot(c, 1990, `{"Version":2,"Data":{}}`)
+
+	report, err := doctor.Check(s.dir, doctor.Options{Compact: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Issues, HasLen, 0)
+	c.Assert(report.Reclaimed > 0, Equals, true)
+	_, err = os.Stat(filepath.Join(s.dir, "raft.db.bak"))
+	c.Assert(err, IsNil)
+
+	report, err = doctor.Check(s.dir, doctor.Options{})
+	c.Assert(err, IsNil)
+	c.Assert(report.FirstIndex, Equals, uint64(1991))
+	c.Assert(report.LastIndex, Equals, uint64(2000))
+}
+
+func (s *DoctorSuite) TestInUse(c *C) {
+	store, err := raftboltdb.NewBoltStore(filepath.Join(s.dir, "raft.db"))
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	_, err = doctor.Check(s.dir, doctor.Options{Timeout: 10 * time.Millisecond})
+	c.Assert(err, Equals, doctor.ErrInUse)
+}
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
+	"github.com/luizbafilho/fusis/stats"
+)
+
+// statsQueueSize is the number of collected stats waiting to be published
+const statsQueueSize = 256
+
+// StatsCollector samples the stats of the services from IPVS every
+// interval on its own goroutine, working on a copy of the state, so neither
+// a slow kernel nor a slow stats sink holds back the FSM. Collected stats
+// are published on the engine bus by another goroutine, through a bounded
+// queue: when the subscribers can't keep up, new stats are dropped instead
+// of piling up.
+type StatsCollector struct {
+	engine   *Engine
+	interval time.Duration
+	queue    chan bus.StatsCollected
+}
+
+func NewStatsCollector(e *Engine, interval time.Duration) *StatsCollector {
+	return &StatsCollector{
+		engine:   e,
+		interval: interval,
+		queue:    make(chan bus.StatsCollected, statsQueueSize),
+	}
+}
+
+// Run collects the stats every interval until stop is closed. Ticks
+// arriving while a collection is still running are dropped.
+func (c *StatsCollector) Run(stop <-chan struct{}) {
+	go c.publish(stop)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case tick := <-ticker.C:
+			c.Collect(tick)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Collect samples the stats of every service. Collections are bounded by
+// the interval: the services left once it's over are skipped until the
+// next one, so collections never overlap. Errors, and even panics, only
+// affect the service being sampled.
+func (c *StatsCollector) Collect(tick time.Time) {
+	defer metrics.MeasureSince([]string{"fusis", "stats", "collect"}, time.Now())
+	deadline := time.Now().Add(c.interval)
+
+	// Services opted out are neither sampled nor retained
+	services := []types.Service{}
+	ids := make(map[string]bool)
+	for _, s := range c.engine.State.GetServices() {
+		if stats.Disabled(s) {
+			continue
+		}
+		services = append(services, s)
+		ids[s.GetId()] = true
+	}
+	for i, s := range services {
+		if i > 0 && time.Now().After(deadline) {
+			skipped := len(services) - i
+			c.engine.Logger.Warnf("Stats collection took longer than %v, skipping %d services", c.interval, skipped)
+			metrics.IncrCounter([]string{"fusis", "stats", "skipped"}, float32(skipped))
+			break
+		}
+		collected, err := c.collectService(s, tick)
+		if err != nil {
+			c.engine.Logger.Errorf("Error collecting stats for service %s: %v", s.Name, err)
+			continue
+		}
+		if collected != nil {
+			c.enqueue(*collected)
+		}
+	}
+	c.engine.stats.Retain(ids)
+}
+
+func (c *StatsCollector) collectService(s types.Service, tick time.Time) (collected *bus.StatsCollected, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic collecting stats: %v", r)
+		}
+	}()
+	return c.engine.serviceStats(s, tick)
+}
+
+func (c *StatsCollector) enqueue(collected bus.StatsCollected) {
+	select {
+	case c.queue <- collected:
+	default:
+		c.engine.Logger.Warnf("Stats queue full, dropping the stats of service %s", collected.Service.Name)
+		metrics.IncrCounter([]string{"fusis", "stats", "dropped"}, 1)
+	}
+}
+
+func (c *StatsCollector) publish(stop <-chan struct{}) {
+	for {
+		select {
+		case collected := <-c.queue:
+			if err := c.engine.Bus.Publish(collected); err != nil {
+				c.engine.Logger.Errorf("Error publishing the stats of service %s: %v", collected.Service.Name, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
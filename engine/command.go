@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// opProtocol holds the protocol version that introduced each op. Ops not
+// listed here are understood by every balancer.
+var opProtocol = map[CommandOp]int{
+	UpdateServiceOp:      1,
+	ExtensionOp:          1,
+	UpdateDestinationOp:  8,
+	BatchDestinationsOp:  12,
+	AllocateServiceOp:    19,
+	RotateCertificatesOp: 22,
+}
+
+// serviceProtocol holds the protocol version that introduced each optional
+// service feature, along with a check of whether a service uses it.
+var serviceProtocol = []struct {
+	version int
+	uses    func(svc *types.Service) bool
+}{
+	{2, func(svc *types.Service) bool { return svc.Type == types.ServiceTypeHTTP }},
+	{3, func(svc *types.Service) bool { return svc.Type == types.ServiceTypeSNI }},
+	{4, func(svc *types.Service) bool { return svc.MaxBandwidth > 0 }},
+	{5, func(svc *types.Service) bool { return svc.DSCP > 0 }},
+	{6, func(svc *types.Service) bool { return svc.MaxConnsPerClient > 0 }},
+	{7, func(svc *types.Service) bool { return svc.TTL > 0 || svc.ExpiresAt != nil }},
+	{9, func(svc *types.Service) bool { return len(svc.DependsOn) > 0 }},
+	{10, func(svc *types.Service) bool { return svc.RequireClientIP }},
+	{13, func(svc *types.Service) bool { return svc.FirewallMark > 0 }},
+	{14, func(svc *types.Service) bool { return svc.PersistenceTimeout > 0 }},
+	{16, func(svc *types.Service) bool { return len(svc.SchedulerFlags) > 0 }},
+	{17, func(svc *types.Service) bool { return svc.ExternalId != "" }},
+	{18, func(svc *types.Service) bool { return len(svc.Policies) > 0 }},
+	{20, func(svc *types.Service) bool { return svc.Pool != "" }},
+	{21, func(svc *types.Service) bool { return svc.Provider != "" }},
+}
+
+// destinationProtocol is like serviceProtocol, for destination features
+var destinationProtocol = []struct {
+	version int
+	uses    func(dst *types.Destination) bool
+}{
+	{11, func(dst *types.Destination) bool { return len(dst.Labels) > 0 }},
+	{15, func(dst *types.Destination) bool { return dst.Mode == types.ModeFullNAT }},
+	{17, func(dst *types.Destination) bool { return dst.ExternalId != "" }},
+}
+
+// RequiredProtocol returns the protocol version a balancer must support to
+// apply the command.
+func (c *Command) RequiredProtocol() int {
+	version := opProtocol[c.Op]
+	if c.Service != nil {
+		for _, p := range serviceProtocol {
+			if p.version > version && p.uses(c.Service) {
+				version = p.version
+			}
+		}
+	}
+	if c.Destination != nil {
+		for _, p := range destinationProtocol {
+			if p.version > version && p.uses(c.Destination) {
+				version = p.version
+			}
+		}
+	}
+	return version
+}
+
+// DecodeCommand strictly decodes a command from the raft log. Unknown
+// fields are rejected instead of being silently dropped, so a command
+// written by a newer release is caught before it is half applied on a
+// balancer that doesn't understand it.
+func DecodeCommand(data []byte) (*Command, error) {
+	var c Command
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after command")
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// validate checks the fields required by the command operation are present.
+func (c *Command) validate() error {
+	switch c.Op {
+	case AddServiceOp, UpdateServiceOp, DelServiceOp:
+		if c.Service == nil {
+			return fmt.Errorf("%v: missing Service", c.Op)
+		}
+		if c.Service.GetId() == "" {
+			return fmt.Errorf("%v: missing Service id", c.Op)
+		}
+	case AllocateServiceOp:
+		if c.Service == nil {
+			return fmt.Errorf("%v: missing Service", c.Op)
+		}
+		if c.Service.GetId() == "" {
+			return fmt.Errorf("%v: missing Service id", c.Op)
+		}
+		if c.VIPRange == "" {
+			return fmt.Errorf("%v: missing VIPRange", c.Op)
+		}
+	case AddDestinationOp, UpdateDestinationOp, DelDestinationOp:
+		if c.Destination == nil {
+			return fmt.Errorf("%v: missing Destination", c.Op)
+		}
+		if c.Destination.ServiceId == "" {
+			return fmt.Errorf("%v: missing Destination ServiceId", c.Op)
+		}
+	case BatchDestinationsOp:
+		if c.Batch == nil {
+			return fmt.Errorf("%v: missing Batch", c.Op)
+		}
+		for _, dsts := range [][]types.Destination{c.Batch.Add, c.Batch.Update, c.Batch.Remove} {
+			for _, dst := range dsts {
+				if dst.ServiceId == "" {
+					return fmt.Errorf("%v: missing Destination ServiceId", c.Op)
+				}
+			}
+		}
+	case ExtensionOp:
+		if c.Extension == "" {
+			return fmt.Errorf("%v: missing Extension", c.Op)
+		}
+	case RotateCertificatesOp:
+	default:
+		return fmt.Errorf("unknown command op: %v", c.Op)
+	}
+	return nil
+}
@@ -4,22 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"log/syslog"
 	"strings"
 	"sync"
 	"time"
 
-	gipvs "github.com/google/seesaw/ipvs"
-
 	"github.com/Sirupsen/logrus"
-	"github.com/Sirupsen/logrus/hooks/syslog"
 	"github.com/bshuster-repo/logrus-logstash-hook"
 	"github.com/hashicorp/raft"
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
 	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/events"
 	"github.com/luizbafilho/fusis/ipvs"
 	"github.com/luizbafilho/fusis/provider"
+	"github.com/luizbafilho/fusis/secrets"
+	"github.com/luizbafilho/fusis/stats"
 )
 
 //go:generate stringer -type=CommandOp
@@ -31,9 +30,19 @@ type Engine struct {
 	Ipvs     *ipvs.Ipvs
 	State    ipvs.State
 	Provider provider.Provider
-	StateCh  chan chan error
+	// Bus is where the engine publishes the state changes, shared with the
+	// other modules of the balancer
+	Bus *bus.Bus
 
 	StatsLogger *logrus.Logger
+	stats       *stats.Aggregator
+	Logger      *logrus.Logger
+	Events      *events.Recorder
+
+	extensions map[string]Extension
+	syncStatus map[string]syncRecord
+	quarantine []types.QuarantinedEntry
+	lastIndex  uint64
 }
 
 // Represents possible actions on engine
@@ -42,16 +51,43 @@ const (
 	DelServiceOp
 	AddDestinationOp
 	DelDestinationOp
+	UpdateServiceOp
+	ExtensionOp
+	UpdateDestinationOp
+	BatchDestinationsOp
+	AllocateServiceOp
+	RotateCertificatesOp
 )
 
 type CommandOp int
 
+// CommandVersion is the newest command protocol version understood by this
+// release. Commands with a newer version are quarantined instead of being
+// applied, as they may rely on semantics this release doesn't know. It is
+// also advertised to the other balancers, see Command.RequiredProtocol.
+const CommandVersion = 22
+
 // Command represents a command in raft log
 type Command struct {
+	// Version is the protocol version required to apply the command.
+	// Commands written before versioning was introduced have version 0.
+	Version     int `json:",omitempty"`
 	Op          CommandOp
 	Service     *types.Service
 	Destination *types.Destination
 	Response    chan interface{} `json:"-"`
+
+	// Batch holds the destination changes of BatchDestinationsOp commands
+	Batch *DestinationBatch `json:",omitempty"`
+
+	// VIPRange is the range AllocateServiceOp commands allocate the VIP of
+	// the service from.
+	VIPRange string `json:",omitempty"`
+
+	// Extension and Data are used by ExtensionOp commands to carry the
+	// payload of a registered extension.
+	Extension string `json:",omitempty"`
+	Data      []byte `json:",omitempty"`
 }
 
 func (c Command) String() string {
@@ -60,147 +96,362 @@ func (c Command) String() string {
 
 // New creates a new Engine
 func New(config *config.BalancerConfig) (*Engine, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = logrus.New()
+	}
+
 	state := ipvs.NewFusisState()
-	ipvsInstance, err := ipvs.New()
+	ipvs.SetSlowOpThreshold(time.Duration(config.IpvsSlowOp) * time.Millisecond)
+	logger.Infof("Initialising IPVS Module...")
+	newIpvs := ipvs.New
+	if config.Handover {
+		// Keep serving the connections routed by the previous process
+		newIpvs = ipvs.Init
+	}
+	ipvsInstance, err := newIpvs()
 	if err != nil {
 		return nil, err
 	}
 
-	statsLogger := NewStatsLogger(config)
+	statsLogger, err := NewStatsLogger(config)
+	if err != nil {
+		return nil, err
+	}
+	window := config.Stats.Window
+	if window == 0 {
+		window = config.Stats.Interval
+	}
 
-	return &Engine{
-		StateCh:     make(chan chan error),
+	e := &Engine{
+		Bus:         bus.New(),
 		State:       state,
 		Ipvs:        ipvsInstance,
 		StatsLogger: statsLogger,
-	}, nil
+		stats:       stats.NewAggregator(time.Duration(window)*time.Second, config.Stats.Buckets),
+		Logger:      logger,
+		Events:      events.NewRecorder(events.DefaultMaxEvents),
+		extensions:  make(map[string]Extension),
+		syncStatus:  make(map[string]syncRecord),
+	}
+	e.stats.SetFullDump(time.Duration(config.Stats.FullDump) * time.Second)
+	e.Events.Subscribe(e.Bus)
+	if statsLogger != nil {
+		e.Bus.Subscribe(bus.StatsCollected{}.Topic(), e.logStats)
+	}
+	return e, nil
 }
 
-func NewStatsLogger(config *config.BalancerConfig) *logrus.Logger {
+func NewStatsLogger(config *config.BalancerConfig) (*logrus.Logger, error) {
 	logger := logrus.New()
 
 	if config.Stats.Type == "" {
-		return nil
+		return nil, nil
+	}
+
+	params, err := secrets.ResolveParams(config.Stats.Params)
+	if err != nil {
+		return nil, err
 	}
 
 	switch config.Stats.Type {
 	case "logstash":
-		addLogstashLoggerHook(logger, config)
+		err = addLogstashLoggerHook(logger, params)
 	case "syslog":
-		addSyslogLoggerHook(logger, config)
+		err = addSyslogLoggerHook(logger, params)
 	default:
-		log.Fatal("Unknown stats logger. Please configure properly logstash or syslog.")
+		err = fmt.Errorf("Unknown stats logger. Please configure properly logstash or syslog.")
 	}
-
-	return logger
-}
-
-func addSyslogLoggerHook(logger *logrus.Logger, config *config.BalancerConfig) {
-
-	protocol := config.Stats.Params["protocol"]
-	address := config.Stats.Params["address"]
-
-	hook, err := logrus_syslog.NewSyslogHook(protocol, address, syslog.LOG_INFO, "")
 	if err != nil {
-		log.Fatalf("Unable to connect to local syslog daemon. Err: %v", err)
+		return nil, err
 	}
 
-	logger.Hooks.Add(hook)
+	return logger, nil
 }
 
-func addLogstashLoggerHook(logger *logrus.Logger, config *config.BalancerConfig) {
-	url := fmt.Sprintf("%s:%v", config.Stats.Params["host"], config.Stats.Params["port"])
-	hook, err := logrus_logstash.NewHook(config.Stats.Params["protocol"], url, "Fusis")
+func addLogstashLoggerHook(logger *logrus.Logger, params map[string]string) error {
+	url := fmt.Sprintf("%s:%v", params["host"], params["port"])
+	hook, err := logrus_logstash.NewHook(params["protocol"], url, "Fusis")
 	if err != nil {
-		log.Fatalf("unable to connect to logstash. Err: %v", err)
+		return fmt.Errorf("unable to connect to logstash. Err: %v", err)
 	}
 
 	logger.Hooks.Add(hook)
+	return nil
 }
 
-// Apply actions to fsm
-func (e *Engine) Apply(l *raft.Log) interface{} {
-	var c Command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+// Apply actions to fsm. Entries that can't be applied are quarantined
+// instead of crashing the process, which would happen again on every
+// balancer replaying the same log.
+func (e *Engine) Apply(l *raft.Log) (rsp interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			rsp = e.quarantineEntry(l, fmt.Sprintf("panic applying command: %v", r))
+		}
+	}()
+
+	if !e.advanceIndex(l.Index) {
+		e.Logger.Warnf("Skipping log entry %d, already applied up to %d", l.Index, e.LastApplied())
+		return nil
+	}
+
+	c, err := DecodeCommand(l.Data)
+	if err != nil {
+		return e.quarantineEntry(l, fmt.Sprintf("invalid command: %v", err))
+	}
+	if c.Version > CommandVersion {
+		return e.quarantineEntry(l, fmt.Sprintf("unsupported command version: %d", c.Version))
 	}
-	logrus.Infof("Actions received to be aplied to fsm: %v", c)
+	e.Logger.Infof("Actions received to be aplied to fsm: %v", c)
 	switch c.Op {
-	case AddServiceOp:
+	case AddServiceOp, AllocateServiceOp:
+		if c.Op == AllocateServiceOp {
+			// Allocating at apply time, from the state built by the log,
+			// makes every balancer pick the same VIP and no two services
+			// get the same one, whoever leads when they're added.
+			host, err := provider.AllocateFrom(c.VIPRange, e.State)
+			if err != nil {
+				return e.quarantineEntry(l, fmt.Sprintf("error allocating VIP: %v", err))
+			}
+			c.Service.Host = host
+		}
+		c.Service.Version = l.Index
 		e.State.AddService(c.Service)
+		events.Publish(e.Bus, c.Service.GetId(), events.ServiceCreated, "Service %s created at version %d", c.Service.Name, l.Index)
+		if c.Service.Host != "" {
+			events.Publish(e.Bus, c.Service.GetId(), events.VIPAllocated, "VIP %s allocated", c.Service.Host)
+		}
+	case UpdateServiceOp:
+		c.Service.Version = l.Index
+		e.State.UpdateService(c.Service)
+		events.Publish(e.Bus, c.Service.GetId(), events.ServiceUpdated, "Service %s updated to version %d", c.Service.Name, l.Index)
 	case DelServiceOp:
 		e.State.DeleteService(c.Service)
+		e.Bus.Publish(bus.ServiceDeleted{ServiceId: c.Service.GetId()})
 	case AddDestinationOp:
+		c.Destination.Version = l.Index
 		e.State.AddDestination(c.Destination)
+		events.Publish(e.Bus, c.Destination.ServiceId, events.DestinationAdded, "Destination %s (%s:%d) added", c.Destination.Name, c.Destination.Host, c.Destination.Port)
+	case UpdateDestinationOp:
+		c.Destination.Version = l.Index
+		e.State.UpdateDestination(c.Destination)
+		events.Publish(e.Bus, c.Destination.ServiceId, events.DestinationUpdated, "Destination %s updated to weight %d, mode %s", c.Destination.Name, c.Destination.Weight, c.Destination.Mode)
 	case DelDestinationOp:
 		e.State.DeleteDestination(c.Destination)
+		events.Publish(e.Bus, c.Destination.ServiceId, events.DestinationRemoved, "Destination %s (%s:%d) removed", c.Destination.Name, c.Destination.Host, c.Destination.Port)
+		e.Bus.Publish(bus.DestinationRemoved{Destination: *c.Destination})
+	case BatchDestinationsOp:
+		e.applyBatch(c.Batch, l.Index)
+	case ExtensionOp:
+		// Extensions don't touch the routing state, no need to sync it
+		return e.applyExtension(c)
+	case RotateCertificatesOp:
+		e.Bus.Publish(bus.CertificatesRotated{Index: l.Index})
+		return nil
+	}
+	// The command is already committed at this point, failing it would only
+	// make the caller retry a change every balancer has applied. Kernel sync
+	// failures are reported per service through SyncStatus instead.
+	err = e.Bus.Publish(bus.StateChanged{Index: l.Index})
+	if err != nil {
+		e.Logger.Errorf("Error syncing IPVS state at index %d: %v", l.Index, err)
+	}
+	e.recordSync(err)
+	return nil
+}
+
+// DestinationBatch holds the destination changes of a service applied by a
+// single command. Removals are applied first, then updates and additions.
+type DestinationBatch struct {
+	Add    []types.Destination `json:",omitempty"`
+	Update []types.Destination `json:",omitempty"`
+	Remove []types.Destination `json:",omitempty"`
+}
+
+func (e *Engine) applyBatch(batch *DestinationBatch, index uint64) {
+	for i := range batch.Remove {
+		dst := &batch.Remove[i]
+		e.State.DeleteDestination(dst)
+		events.Publish(e.Bus, dst.ServiceId, events.DestinationRemoved, "Destination %s (%s:%d) removed", dst.Name, dst.Host, dst.Port)
+		e.Bus.Publish(bus.DestinationRemoved{Destination: *dst})
+	}
+	for i := range batch.Update {
+		dst := &batch.Update[i]
+		dst.Version = index
+		e.State.UpdateDestination(dst)
+		events.Publish(e.Bus, dst.ServiceId, events.DestinationUpdated, "Destination %s updated to weight %d, mode %s", dst.Name, dst.Weight, dst.Mode)
 	}
-	rsp := make(chan error)
-	e.StateCh <- rsp
-	return <-rsp
+	for i := range batch.Add {
+		dst := &batch.Add[i]
+		dst.Version = index
+		e.State.AddDestination(dst)
+		events.Publish(e.Bus, dst.ServiceId, events.DestinationAdded, "Destination %s (%s:%d) added", dst.Name, dst.Host, dst.Port)
+	}
+}
+
+// LastApplied returns the index of the last log entry applied to the FSM.
+func (e *Engine) LastApplied() uint64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.lastIndex
+}
+
+// advanceIndex records index as the last applied entry. It returns false
+// if the entry was already applied, which may happen when the log is
+// replayed over a restored snapshot. Applying it again would bump versions
+// and record events twice.
+func (e *Engine) advanceIndex(index uint64) bool {
+	e.Lock()
+	defer e.Unlock()
+	if index <= e.lastIndex {
+		return false
+	}
+	e.lastIndex = index
+	return true
 }
 
 type fusisSnapshot struct {
-	Services []types.Service
+	Index        uint64 `json:",omitempty"`
+	Services     []types.Service
+	Destinations []types.Destination `json:",omitempty"`
+	// IPAM holds the VIP allocated to each service, by service id
+	IPAM       map[string]string        `json:",omitempty"`
+	Extensions map[string][]byte        `json:",omitempty"`
+	Quarantine []types.QuarantinedEntry `json:",omitempty"`
+
+	logger *logrus.Logger
 }
 
 func (e *Engine) Snapshot() (raft.FSMSnapshot, error) {
-	logrus.Info("Snapshotting Fusis State")
+	e.Logger.Info("Snapshotting Fusis State")
 	e.Lock()
 	defer e.Unlock()
 
+	// Destinations are persisted on their own, so the ones applied apart
+	// from their services are kept as they are
 	services := e.State.GetServices()
+	ipam := make(map[string]string)
+	for i := range services {
+		services[i].Destinations = nil
+		if services[i].Host != "" {
+			ipam[services[i].GetId()] = services[i].Host
+		}
+	}
 
-	return &fusisSnapshot{services}, nil
+	extensions, err := e.snapshotExtensions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fusisSnapshot{
+		Index:        e.lastIndex,
+		Services:     services,
+		Destinations: e.State.GetDestinations(),
+		IPAM:         ipam,
+		Extensions:   extensions,
+		Quarantine:   append([]types.QuarantinedEntry(nil), e.quarantine...),
+		logger:       e.Logger,
+	}, nil
 }
 
 // Restore stores the key-value store to a previous state.
 func (e *Engine) Restore(rc io.ReadCloser) error {
-	logrus.Info("Restoring Fusis state")
-	var services []types.Service
-	if err := json.NewDecoder(rc).Decode(&services); err != nil {
+	e.Logger.Info("Restoring Fusis state")
+	var raw json.RawMessage
+	if err := json.NewDecoder(rc).Decode(&raw); err != nil {
+		return err
+	}
+
+	data, err := decodeSnapshot(raw)
+	if err != nil {
+		return err
+	}
+	var snap fusisSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	if err := e.restoreExtensions(snap.Extensions); err != nil {
 		return err
 	}
+	e.Lock()
+	e.quarantine = snap.Quarantine
+	e.lastIndex = snap.Index
+	e.Unlock()
 
 	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	for _, s := range services {
-		e.State.AddService(&s)
-		for _, d := range s.Destinations {
-			e.State.AddDestination(&d)
+	// Hashicorp docs. The snapshot replaces the current state entirely,
+	// services missing from it must not survive the restore.
+	e.State.Reset()
+	for _, s := range snap.Services {
+		if vip, ok := snap.IPAM[s.GetId()]; ok {
+			s.Host = vip
 		}
+		e.State.AddService(&s)
+	}
+	for _, d := range snap.Destinations {
+		e.State.AddDestination(&d)
 	}
-	rsp := make(chan error)
-	e.StateCh <- rsp
-	return <-rsp
+	err = e.Bus.Publish(bus.StateChanged{Index: snap.Index, Restored: true})
+	e.recordSync(err)
+	return err
 }
 
-func (e *Engine) CollectStats(tick time.Time) {
-	e.StatsLogger.Info("logging stats")
-	for _, s := range e.State.GetServices() {
-		srv := e.syncService(&s)
+// serviceStats samples the stats of a service from IPVS, returning the
+// ones to publish once its aggregation window is complete.
+func (e *Engine) serviceStats(s types.Service, tick time.Time) (*bus.StatsCollected, error) {
+	srv, err := e.syncService(&s)
+	if err != nil {
+		return nil, err
+	}
 
-		hosts := []string{}
-		for _, dst := range srv.Destinations {
-			hosts = append(hosts, dst.Host)
+	window := e.stats.Add(s.GetId(), srv.Stats, tick)
+	if window == nil {
+		return nil, nil
+	}
+
+	hosts := []string{}
+	var active, inactive uint32
+	for _, dst := range srv.Destinations {
+		hosts = append(hosts, dst.Host)
+		if dst.Stats != nil {
+			active += dst.Stats.ActiveConns
+			inactive += dst.Stats.InactiveConns
 		}
+	}
 
-		e.StatsLogger.WithFields(logrus.Fields{
-			"time":     tick,
-			"service":  s.Name,
-			"Protocol": s.Protocol,
-			"Port":     s.Port,
-			"hosts":    strings.Join(hosts, ","),
-			"client":   "fusis",
-		}).Info("Fusis router stats")
+	fields := window.Fields()
+	fields["hosts"] = strings.Join(hosts, ",")
+	fields["active_conns"] = active
+	fields["inactive_conns"] = inactive
+	for k, v := range stats.LabelFields(s, srv) {
+		fields[k] = v
 	}
+	return &bus.StatsCollected{Service: s, Time: tick, Fields: fields}, nil
+}
+
+// logStats sends the collected stats to the stats logger
+func (e *Engine) logStats(evt bus.Event) error {
+	collected := evt.(bus.StatsCollected)
+	fields := logrus.Fields(collected.Fields)
+	fields["time"] = collected.Time
+	fields["service"] = collected.Service.Name
+	fields["Protocol"] = collected.Service.Protocol
+	fields["Port"] = collected.Service.Port
+	fields["client"] = "fusis"
+	e.StatsLogger.WithFields(fields).Info("Fusis router stats")
+	return nil
 }
 
 func (f *fusisSnapshot) Persist(sink raft.SnapshotSink) error {
-	logrus.Infoln("Persisting Fusis state")
+	f.logger.Infoln("Persisting Fusis state")
 	err := func() error {
 		// Encode data.
-		b, err := json.Marshal(f.Services)
+		data, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(snapshotEnvelope{Version: SnapshotVersion, Data: data})
 		if err != nil {
 			return err
 		}
@@ -227,13 +478,27 @@ func (f *fusisSnapshot) Persist(sink raft.SnapshotSink) error {
 }
 
 func (f *fusisSnapshot) Release() {
-	logrus.Info("Calling release")
+	f.logger.Info("Calling release")
 }
 
-func (e *Engine) syncService(svc *types.Service) types.Service {
-	service, err := gipvs.GetService(ipvs.ToIpvsService(svc))
+// ActiveConns returns the active connections of a destination in IPVS
+func (e *Engine) ActiveConns(dst *types.Destination) (uint32, error) {
+	svc, err := e.State.GetService(dst.ServiceId)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	return ipvs.FromService(service)
+	srv, err := e.syncService(svc)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range srv.Destinations {
+		if d.KernelKey() == dst.KernelKey() && d.Stats != nil {
+			return d.Stats.ActiveConns, nil
+		}
+	}
+	return 0, nil
+}
+
+func (e *Engine) syncService(svc *types.Service) (types.Service, error) {
+	return ipvs.GetService(svc)
 }
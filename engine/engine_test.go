@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hashicorp/raft"
 	"github.com/luizbafilho/fusis/api/types"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/events"
 	"github.com/luizbafilho/fusis/ipvs"
 	"github.com/spf13/viper"
 
@@ -42,6 +44,7 @@ func (s *EngineSuite) SetUpSuite(c *C) {
 		Scheduler:    "lc",
 		Protocol:     "tcp",
 		Destinations: []types.Destination{},
+		Version:      1,
 	}
 
 	s.destination = &types.Destination{
@@ -51,16 +54,17 @@ func (s *EngineSuite) SetUpSuite(c *C) {
 		Mode:      "nat",
 		Weight:    1,
 		ServiceId: "test",
+		Version:   2,
 	}
 }
 
 func (s *EngineSuite) SetUpTest(c *C) {
+	logIndex = 0
+
 	eng, err := engine.New(s.config)
 	c.Assert(err, IsNil)
 
 	s.engine = eng
-
-	go watchStateCh(eng)
 }
 
 func (s *EngineSuite) TearDownTest(c *C) {
@@ -104,25 +108,22 @@ func (s *EngineSuite) readConfig() {
 	viper.Unmarshal(&s.config)
 }
 
+// logIndex is the index of the last log created by makeLog
+var logIndex uint64
+
 func makeLog(cmd *engine.Command, c *C) *raft.Log {
 	bytes, err := json.Marshal(cmd)
 	c.Assert(err, IsNil)
 
+	logIndex++
 	return &raft.Log{
-		Index: 1,
+		Index: logIndex,
 		Term:  1,
 		Type:  raft.LogCommand,
 		Data:  bytes,
 	}
 }
 
-func watchStateCh(engine *engine.Engine) {
-	for {
-		errCh := <-engine.StateCh
-		errCh <- nil
-	}
-}
-
 func (s *EngineSuite) addService(c *C) {
 	cmd := &engine.Command{
 		Op:      engine.AddServiceOp,
@@ -160,6 +161,65 @@ func (s *EngineSuite) TestApplyAddService(c *C) {
 	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{*s.service})
 }
 
+func (s *EngineSuite) TestApplyAllocateService(c *C) {
+	s.addService(c)
+
+	var hosts []string
+	for _, name := range []string{"first", "second"} {
+		cmd := &engine.Command{
+			Op:       engine.AllocateServiceOp,
+			Service:  &types.Service{Name: name, Port: 80, Protocol: "tcp", Scheduler: "rr"},
+			VIPRange: "10.0.1.0/30",
+		}
+		resp := s.engine.Apply(makeLog(cmd, c))
+		c.Assert(resp, IsNil)
+
+		svc, err := s.engine.State.GetService(name)
+		c.Assert(err, IsNil)
+		hosts = append(hosts, svc.Host)
+	}
+	c.Assert(hosts, DeepEquals, []string{"10.0.1.2", "10.0.1.3"})
+
+	// The range is exhausted
+	cmd := &engine.Command{
+		Op:       engine.AllocateServiceOp,
+		Service:  &types.Service{Name: "third", Port: 80, Protocol: "tcp", Scheduler: "rr"},
+		VIPRange: "10.0.1.0/30",
+	}
+	c.Assert(s.engine.Apply(makeLog(cmd, c)), IsNil)
+	svc, err := s.engine.State.GetService("third")
+	c.Assert(err, IsNil)
+	c.Assert(svc.Host, Equals, "")
+
+	cmd = &engine.Command{
+		Op:       engine.AllocateServiceOp,
+		Service:  &types.Service{Name: "fourth", Port: 80, Protocol: "tcp", Scheduler: "rr"},
+		VIPRange: "invalid",
+	}
+	c.Assert(s.engine.Apply(makeLog(cmd, c)), FitsTypeOf, engine.ErrQuarantined{})
+}
+
+func (s *EngineSuite) TestApplyUpdateService(c *C) {
+	s.addService(c)
+
+	updated := *s.service
+	updated.Scheduler = "rr"
+	cmd := &engine.Command{
+		Op:      engine.UpdateServiceOp,
+		Service: &updated,
+	}
+	log := makeLog(cmd, c)
+	log.Index = 2
+
+	resp := s.engine.Apply(log)
+	c.Assert(resp, IsNil)
+
+	svc, err := s.engine.State.GetService(s.service.Name)
+	c.Assert(err, IsNil)
+	c.Assert(svc.Scheduler, Equals, "rr")
+	c.Assert(svc.Version, Equals, uint64(2))
+}
+
 func (s *EngineSuite) TestApplyDelService(c *C) {
 	s.addService(c)
 	s.delService(c)
@@ -176,6 +236,57 @@ func (s *EngineSuite) TestApplyAddDestination(c *C) {
 	c.Assert(dst, DeepEquals, s.destination)
 }
 
+func (s *EngineSuite) TestApplyUpdateDestination(c *C) {
+	s.addService(c)
+	s.addDestination(c)
+
+	updated := *s.destination
+	updated.Weight = 5
+	cmd := &engine.Command{
+		Op:          engine.UpdateDestinationOp,
+		Service:     s.service,
+		Destination: &updated,
+	}
+	log := makeLog(cmd, c)
+	log.Index = 3
+
+	resp := s.engine.Apply(log)
+	c.Assert(resp, IsNil)
+
+	dst, err := s.engine.State.GetDestination(s.destination.Name)
+	c.Assert(err, IsNil)
+	c.Assert(dst.Weight, Equals, int32(5))
+	c.Assert(dst.Version, Equals, uint64(3))
+}
+
+func (s *EngineSuite) TestApplyBatchDestinations(c *C) {
+	s.addService(c)
+	s.addDestination(c)
+
+	replacement := *s.destination
+	replacement.Name = "replacement"
+	replacement.Host = "192.168.1.2"
+	cmd := &engine.Command{
+		Op:      engine.BatchDestinationsOp,
+		Service: s.service,
+		Batch: &engine.DestinationBatch{
+			Remove: []types.Destination{*s.destination},
+			Add:    []types.Destination{replacement},
+		},
+	}
+	log := makeLog(cmd, c)
+
+	resp := s.engine.Apply(log)
+	c.Assert(resp, IsNil)
+
+	_, err := s.engine.State.GetDestination(s.destination.Name)
+	c.Assert(err, Equals, types.ErrDestinationNotFound)
+	dst, err := s.engine.State.GetDestination("replacement")
+	c.Assert(err, IsNil)
+	c.Assert(dst.Host, Equals, "192.168.1.2")
+	c.Assert(dst.Version, Equals, log.Index)
+}
+
 func (s *EngineSuite) TestApplyDelDestination(c *C) {
 	s.addService(c)
 	s.addDestination(c)
@@ -208,7 +319,6 @@ func (s *EngineSuite) TestSnapshotRestore(c *C) {
 
 	eng, err := engine.New(s.config)
 	c.Assert(err, IsNil)
-	go watchStateCh(eng)
 
 	err = eng.Restore(sink)
 	c.Assert(err, IsNil)
@@ -217,3 +327,292 @@ func (s *EngineSuite) TestSnapshotRestore(c *C) {
 
 	c.Assert(eng.State.GetServices(), DeepEquals, []types.Service{*s.service})
 }
+
+type counterExtension struct {
+	count int
+}
+
+func (e *counterExtension) Name() string {
+	return "counter"
+}
+
+func (e *counterExtension) Apply(data []byte) interface{} {
+	e.count += len(data)
+	return e.count
+}
+
+func (e *counterExtension) Snapshot() ([]byte, error) {
+	return json.Marshal(e.count)
+}
+
+func (e *counterExtension) Restore(data []byte) error {
+	return json.Unmarshal(data, &e.count)
+}
+
+func (s *EngineSuite) TestApplyExtension(c *C) {
+	ext := &counterExtension{}
+	err := s.engine.RegisterExtension(ext)
+	c.Assert(err, IsNil)
+	err = s.engine.RegisterExtension(ext)
+	c.Assert(err, ErrorMatches, "extension already registered: counter")
+
+	cmd := &engine.Command{
+		Op:        engine.ExtensionOp,
+		Extension: "counter",
+		Data:      []byte("abc"),
+	}
+	resp := s.engine.Apply(makeLog(cmd, c))
+	c.Assert(resp, Equals, 3)
+
+	cmd.Extension = "unknown"
+	resp = s.engine.Apply(makeLog(cmd, c))
+	c.Assert(resp, ErrorMatches, "unknown extension: unknown")
+}
+
+func (s *EngineSuite) TestSnapshotRestoreExtension(c *C) {
+	ext := &counterExtension{count: 42}
+	err := s.engine.RegisterExtension(ext)
+	c.Assert(err, IsNil)
+
+	snap, err := s.engine.Snapshot()
+	c.Assert(err, IsNil)
+	defer snap.Release()
+
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	err = snap.Persist(sink)
+	c.Assert(err, IsNil)
+
+	eng, err := engine.New(s.config)
+	c.Assert(err, IsNil)
+
+	restored := &counterExtension{}
+	err = eng.RegisterExtension(restored)
+	c.Assert(err, IsNil)
+
+	err = eng.Restore(sink)
+	c.Assert(err, IsNil)
+	c.Assert(restored.count, Equals, 42)
+}
+
+func (s *EngineSuite) TestRestoreLegacySnapshot(c *C) {
+	s.service.Destinations = []types.Destination{*s.destination}
+	data, err := json.Marshal([]types.Service{*s.service})
+	c.Assert(err, IsNil)
+
+	err = s.engine.Restore(ioutil.NopCloser(bytes.NewReader(data)))
+	c.Assert(err, IsNil)
+	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{*s.service})
+}
+
+func (s *EngineSuite) TestSnapshotRestoreDetachedDestinations(c *C) {
+	s.addService(c)
+	orphan := *s.destination
+	orphan.Name = "orphan"
+	orphan.ServiceId = "deleted"
+	s.engine.State.AddDestination(&orphan)
+
+	snap, err := s.engine.Snapshot()
+	c.Assert(err, IsNil)
+	defer snap.Release()
+
+	sink := &MockSink{bytes.NewBuffer(nil), false}
+	err = snap.Persist(sink)
+	c.Assert(err, IsNil)
+
+	var persisted struct {
+		Version int
+		Data    struct{ IPAM map[string]string }
+	}
+	err = json.Unmarshal(sink.Bytes(), &persisted)
+	c.Assert(err, IsNil)
+	c.Assert(persisted.Version, Equals, engine.SnapshotVersion)
+	c.Assert(persisted.Data.IPAM, DeepEquals, map[string]string{"test": "10.0.1.1"})
+
+	eng, err := engine.New(s.config)
+	c.Assert(err, IsNil)
+	err = eng.Restore(sink)
+	c.Assert(err, IsNil)
+
+	dst, err := eng.State.GetDestination("orphan")
+	c.Assert(err, IsNil)
+	c.Assert(dst, DeepEquals, &orphan)
+	c.Assert(eng.State.GetDestinations(), HasLen, 1)
+}
+
+func (s *EngineSuite) TestRestoreNewerSnapshotVersion(c *C) {
+	data := []byte(`{"Version": 99, "Data": {"Services": []}}`)
+	err := s.engine.Restore(ioutil.NopCloser(bytes.NewReader(data)))
+	c.Assert(err, ErrorMatches, "unsupported snapshot version: 99")
+}
+
+func (s *EngineSuite) TestRestoreUnversionedSnapshot(c *C) {
+	s.service.Destinations = []types.Destination{*s.destination}
+	data, err := json.Marshal(map[string]interface{}{
+		"Index":    5,
+		"Services": []types.Service{*s.service},
+	})
+	c.Assert(err, IsNil)
+
+	err = s.engine.Restore(ioutil.NopCloser(bytes.NewReader(data)))
+	c.Assert(err, IsNil)
+	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{*s.service})
+	c.Assert(s.engine.LastApplied(), Equals, uint64(5))
+}
+
+func (s *EngineSuite) TestSyncStatus(c *C) {
+	s.addService(c)
+
+	status, err := s.engine.SyncStatus(s.service.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(status, DeepEquals, &types.SyncStatus{Version: 1, SyncedVersion: 1, Synced: true})
+
+	_, err = s.engine.SyncStatus("unknown")
+	c.Assert(err, Equals, types.ErrServiceNotFound)
+}
+
+func (s *EngineSuite) TestServiceEvents(c *C) {
+	s.addService(c)
+	s.addDestination(c)
+
+	evts := s.engine.Events.Events(s.service.GetId())
+	c.Assert(evts, HasLen, 3)
+	c.Assert(evts[0].Type, Equals, events.ServiceCreated)
+	c.Assert(evts[1].Type, Equals, events.VIPAllocated)
+	c.Assert(evts[2].Type, Equals, events.DestinationAdded)
+}
+
+func (s *EngineSuite) TestApplyQuarantinesUndecodableEntry(c *C) {
+	resp := s.engine.Apply(&raft.Log{Index: 7, Term: 1, Type: raft.LogCommand, Data: []byte("{garbage")})
+	c.Assert(resp, FitsTypeOf, engine.ErrQuarantined{})
+
+	entries := s.engine.Quarantined()
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Index, Equals, uint64(7))
+	c.Assert(entries[0].Data, DeepEquals, []byte("{garbage"))
+}
+
+func (s *EngineSuite) TestApplyQuarantinesNewerCommandVersion(c *C) {
+	cmd := &engine.Command{
+		Version: engine.CommandVersion + 1,
+		Op:      engine.AddServiceOp,
+		Service: s.service,
+	}
+
+	resp := s.engine.Apply(makeLog(cmd, c))
+	c.Assert(resp, FitsTypeOf, engine.ErrQuarantined{})
+	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{})
+}
+
+type panicExtension struct{ counterExtension }
+
+func (e *panicExtension) Apply(data []byte) interface{} {
+	panic("boom")
+}
+
+func (s *EngineSuite) TestApplyRecoversFromPanic(c *C) {
+	err := s.engine.RegisterExtension(&panicExtension{})
+	c.Assert(err, IsNil)
+
+	cmd := &engine.Command{Op: engine.ExtensionOp, Extension: "counter"}
+	resp := s.engine.Apply(makeLog(cmd, c))
+	c.Assert(resp, FitsTypeOf, engine.ErrQuarantined{})
+
+	entries := s.engine.Quarantined()
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Reason, Equals, "panic applying command: boom")
+}
+
+func (s *EngineSuite) TestApplyRejectsInvalidCommands(c *C) {
+	invalid := []string{
+		`{"Op": 0, "Service": {"Name": "test"}, "Unknown": true}`,
+		`{"Op": 0, "Service": {"Name": "test", "Unknown": true}}`,
+		`{"Op": 0}`,
+		`{"Op": 2, "Destination": {"Name": "test"}}`,
+		`{"Op": 5}`,
+		`{"Op": 8, "Service": {"Name": "test"}}`,
+		`{"Op": 42}`,
+	}
+	for i, data := range invalid {
+		resp := s.engine.Apply(&raft.Log{Index: uint64(i + 1), Data: []byte(data)})
+		c.Check(resp, FitsTypeOf, engine.ErrQuarantined{}, Commentf("%s", data))
+	}
+
+	c.Assert(s.engine.Quarantined(), HasLen, len(invalid))
+	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{})
+}
+
+func (s *EngineSuite) TestApplySkipsAppliedEntries(c *C) {
+	s.service.Destinations = []types.Destination{}
+	s.addService(c)
+
+	cmd := &engine.Command{
+		Op:      engine.DelServiceOp,
+		Service: s.service,
+	}
+	log := makeLog(cmd, c)
+	log.Index = 1
+
+	resp := s.engine.Apply(log)
+	c.Assert(resp, IsNil)
+	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{*s.service})
+	c.Assert(s.engine.LastApplied(), Equals, uint64(1))
+	c.Assert(s.engine.Events.Events(s.service.GetId()), HasLen, 2)
+}
+
+func (s *EngineSuite) TestRestoreReplacesState(c *C) {
+	s.service.Destinations = []types.Destination{}
+	s.addService(c)
+
+	snap, err := s.engine.Snapshot()
+	c.Assert(err, IsNil)
+	defer snap.Release()
+
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	err = snap.Persist(sink)
+	c.Assert(err, IsNil)
+
+	other := *s.service
+	other.Name = "other"
+	cmd := &engine.Command{
+		Op:      engine.AddServiceOp,
+		Service: &other,
+	}
+	resp := s.engine.Apply(makeLog(cmd, c))
+	c.Assert(resp, IsNil)
+	c.Assert(s.engine.State.GetServices(), HasLen, 2)
+
+	err = s.engine.Restore(sink)
+	c.Assert(err, IsNil)
+	c.Assert(s.engine.State.GetServices(), DeepEquals, []types.Service{*s.service})
+	c.Assert(s.engine.LastApplied(), Equals, uint64(1))
+}
+
+func (s *EngineSuite) TestCollectStatsSkipsFailedServices(c *C) {
+	missing := *s.service
+	missing.Name = "missing"
+	missing.Host = "10.0.1.2"
+	s.engine.State.AddService(&missing)
+	s.addService(c)
+
+	collector := engine.NewStatsCollector(s.engine, time.Second)
+	collector.Collect(time.Now())
+}
+
+func (s *EngineSuite) TestCollectStatsWhileApplying(c *C) {
+	collector := engine.NewStatsCollector(s.engine, time.Second)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			collector.Collect(time.Now())
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		s.addService(c)
+		s.delService(c)
+	}
+	<-done
+}
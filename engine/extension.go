@@ -0,0 +1,73 @@
+package engine
+
+import "fmt"
+
+// Extension allows programs embedding Fusis to replicate their own data
+// through the Fusis FSM. Commands sent with ExtensionOp are dispatched to
+// the extension matching Command.Extension, and each extension gets its own
+// section in the raft snapshots.
+//
+// As any FSM code, extensions must be deterministic: applying the same
+// sequence of payloads must produce the same state on every balancer.
+type Extension interface {
+	// Name identifies the extension in commands and snapshots.
+	Name() string
+	// Apply applies a replicated payload. The returned value is handed back
+	// to the caller of Balancer.ApplyExtension on the leader.
+	Apply(data []byte) interface{}
+	// Snapshot returns the serialized extension state.
+	Snapshot() ([]byte, error)
+	// Restore replaces the extension state with a previous snapshot.
+	Restore(data []byte) error
+}
+
+// RegisterExtension adds an extension to the engine. Extensions must be
+// registered before raft is started, so snapshots are restored into them.
+func (e *Engine) RegisterExtension(ext Extension) error {
+	e.Lock()
+	defer e.Unlock()
+
+	if _, ok := e.extensions[ext.Name()]; ok {
+		return fmt.Errorf("extension already registered: %s", ext.Name())
+	}
+	e.extensions[ext.Name()] = ext
+	return nil
+}
+
+func (e *Engine) applyExtension(c *Command) interface{} {
+	ext, ok := e.extensions[c.Extension]
+	if !ok {
+		return fmt.Errorf("unknown extension: %s", c.Extension)
+	}
+	return ext.Apply(c.Data)
+}
+
+func (e *Engine) snapshotExtensions() (map[string][]byte, error) {
+	if len(e.extensions) == 0 {
+		return nil, nil
+	}
+
+	sections := make(map[string][]byte)
+	for name, ext := range e.extensions {
+		data, err := ext.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting extension %s: %v", name, err)
+		}
+		sections[name] = data
+	}
+	return sections, nil
+}
+
+func (e *Engine) restoreExtensions(sections map[string][]byte) error {
+	for name, data := range sections {
+		ext, ok := e.extensions[name]
+		if !ok {
+			e.Logger.Warnf("Ignoring snapshot section of unknown extension: %s", name)
+			continue
+		}
+		if err := ext.Restore(data); err != nil {
+			return fmt.Errorf("error restoring extension %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// maxQuarantined is the number of quarantined entries kept for inspection
+const maxQuarantined = 100
+
+// ErrQuarantined is returned by Apply for entries that were quarantined
+type ErrQuarantined struct {
+	Index  uint64
+	Reason string
+}
+
+func (e ErrQuarantined) Error() string {
+	return fmt.Sprintf("log entry %d quarantined: %s", e.Index, e.Reason)
+}
+
+// Quarantined returns the log entries the FSM was unable to apply
+func (e *Engine) Quarantined() []types.QuarantinedEntry {
+	e.Lock()
+	defer e.Unlock()
+
+	entries := make([]types.QuarantinedEntry, len(e.quarantine))
+	copy(entries, e.quarantine)
+	return entries
+}
+
+func (e *Engine) quarantineEntry(l *raft.Log, reason string) error {
+	e.Logger.Errorf("Quarantining raft log entry %d: %s", l.Index, reason)
+	metrics.IncrCounter([]string{"fusis", "fsm", "quarantined"}, 1)
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.quarantine = append(e.quarantine, types.QuarantinedEntry{
+		Index:  l.Index,
+		Term:   l.Term,
+		Reason: reason,
+		Data:   l.Data,
+	})
+	if len(e.quarantine) > maxQuarantined {
+		e.quarantine = e.quarantine[len(e.quarantine)-maxQuarantined:]
+	}
+
+	return ErrQuarantined{Index: l.Index, Reason: reason}
+}
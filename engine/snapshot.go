@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// SnapshotVersion is the newest snapshot format understood by this release.
+// Bump it along with a migration from the previous version whenever the
+// state persisted in the snapshots changes.
+const SnapshotVersion = 2
+
+// snapshotEnvelope wraps the persisted state with the version of its format
+type snapshotEnvelope struct {
+	Version int
+	Data    json.RawMessage
+}
+
+// snapshotMigration turns the data of a snapshot into the format of the next
+// version
+type snapshotMigration func(data json.RawMessage) (json.RawMessage, error)
+
+// snapshotMigrations holds the migration from each snapshot version to the
+// next one. Snapshots taken by older releases are migrated one version at a
+// time up to SnapshotVersion before being restored.
+var snapshotMigrations = map[int]snapshotMigration{
+	0: migrateServicesList,
+	1: migrateNestedDestinations,
+}
+
+// decodeSnapshot unwraps a persisted snapshot, migrating it to the current
+// format. Snapshots taken before the envelope existed are either a list of
+// services, version 0, or the state itself, holding its version inline
+// since version 2.
+func decodeSnapshot(raw json.RawMessage) (json.RawMessage, error) {
+	env, err := unwrapSnapshot(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Version > SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", env.Version)
+	}
+	data := env.Data
+	for v := env.Version; v < SnapshotVersion; v++ {
+		migrate, ok := snapshotMigrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from snapshot version %d", v)
+		}
+		if data, err = migrate(data); err != nil {
+			return nil, fmt.Errorf("error migrating snapshot from version %d: %v", v, err)
+		}
+	}
+	return data, nil
+}
+
+// unwrapSnapshot returns the envelope of a persisted snapshot, wrapping the
+// ones taken before it existed.
+func unwrapSnapshot(raw json.RawMessage) (snapshotEnvelope, error) {
+	var env snapshotEnvelope
+	if len(raw) > 0 && raw[0] == '[' {
+		env.Data = raw
+	} else if err := json.Unmarshal(raw, &env); err != nil {
+		return env, err
+	} else if env.Data == nil {
+		env.Data = raw
+		if env.Version == 0 {
+			env.Version = 1
+		}
+	}
+	return env, nil
+}
+
+// CheckSnapshot reads a persisted snapshot from r and decodes it as Restore
+// would, without touching any state. It returns the format version the
+// snapshot was written with, known even when it can't be restored.
+func CheckSnapshot(r io.Reader) (int, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return 0, err
+	}
+	env, err := unwrapSnapshot(raw)
+	if err != nil {
+		return 0, err
+	}
+	data, err := decodeSnapshot(raw)
+	if err != nil {
+		return env.Version, err
+	}
+	var snap fusisSnapshot
+	return env.Version, json.Unmarshal(data, &snap)
+}
+
+// ImportSnapshot reads a state to seed a new cluster with, either a
+// snapshot persisted by a balancer or the services exported from the API,
+// which are the version 0 format. It returns the state as a snapshot of the
+// current version, along with the index of the last command applied to it,
+// zero for exported services.
+func ImportSnapshot(r io.Reader) ([]byte, uint64, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, 0, err
+	}
+	data, err := decodeSnapshot(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	var snap fusisSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, 0, err
+	}
+	b, err := json.Marshal(snapshotEnvelope{Version: SnapshotVersion, Data: data})
+	return b, snap.Index, err
+}
+
+// migrateServicesList wraps the services of the snapshots taken before
+// extensions existed.
+func migrateServicesList(data json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(map[string]json.RawMessage{"Services": data})
+}
+
+// migrateNestedDestinations moves the destinations out of their services,
+// and records the VIPs of the services as allocated.
+func migrateNestedDestinations(data json.RawMessage) (json.RawMessage, error) {
+	var snap map[string]json.RawMessage
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	var services []types.Service
+	if err := json.Unmarshal(snap["Services"], &services); err != nil {
+		return nil, err
+	}
+
+	dsts := []types.Destination{}
+	ipam := make(map[string]string)
+	for i, s := range services {
+		dsts = append(dsts, s.Destinations...)
+		services[i].Destinations = nil
+		if s.Host != "" {
+			ipam[s.GetId()] = s.Host
+		}
+	}
+
+	var err error
+	if snap["Services"], err = json.Marshal(services); err != nil {
+		return nil, err
+	}
+	if snap["Destinations"], err = json.Marshal(dsts); err != nil {
+		return nil, err
+	}
+	if snap["IPAM"], err = json.Marshal(ipam); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snap)
+}
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"strings"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/events"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+type syncRecord struct {
+	version uint64
+	err     string
+}
+
+// SyncStatus returns whether the last version of a service was synced
+func (e *Engine) SyncStatus(serviceId string) (*types.SyncStatus, error) {
+	svc, err := e.State.GetService(serviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	e.Lock()
+	rec := e.syncStatus[serviceId]
+	e.Unlock()
+
+	return &types.SyncStatus{
+		Version:       svc.Version,
+		SyncedVersion: rec.version,
+		Synced:        rec.err == "" && rec.version == svc.Version,
+		Error:         rec.err,
+	}, nil
+}
+
+// recordSync stores the outcome of a state sync for every service. Failed
+// services keep the last version that was synced successfully.
+func (e *Engine) recordSync(err error) {
+	syncErr, partial := err.(*ipvs.SyncError)
+
+	e.Lock()
+	defer e.Unlock()
+
+	status := make(map[string]syncRecord)
+	for _, svc := range e.State.GetServices() {
+		id := svc.GetId()
+		rec := syncRecord{version: svc.Version}
+		if partial {
+			if errs, ok := syncErr.Services[id]; ok {
+				rec = syncRecord{version: e.syncStatus[id].version, err: strings.Join(errs, " | ")}
+			}
+		} else if err != nil {
+			rec = syncRecord{version: e.syncStatus[id].version, err: err.Error()}
+		}
+		if rec.err != "" && rec.err != e.syncStatus[id].err {
+			events.Publish(e.Bus, id, events.SyncFailed, "Error syncing service to the kernel: %s", rec.err)
+		}
+		status[id] = rec
+	}
+	e.syncStatus = status
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package engine
+
+import (
+	"fmt"
+	"log/syslog"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus/hooks/syslog"
+)
+
+func addSyslogLoggerHook(logger *logrus.Logger, params map[string]string) error {
+
+	protocol := params["protocol"]
+	address := params["address"]
+
+	hook, err := logrus_syslog.NewSyslogHook(protocol, address, syslog.LOG_INFO, "")
+	if err != nil {
+		return fmt.Errorf("Unable to connect to local syslog daemon. Err: %v", err)
+	}
+
+	logger.Hooks.Add(hook)
+	return nil
+}
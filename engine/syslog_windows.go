@@ -0,0 +1,11 @@
+package engine
+
+import (
+	"github.com/Sirupsen/logrus"
+	fusis_net "github.com/luizbafilho/fusis/net"
+)
+
+// Windows has no syslog
+func addSyslogLoggerHook(logger *logrus.Logger, params map[string]string) error {
+	return fusis_net.ErrUnsupportedPlatform
+}
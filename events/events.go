@@ -0,0 +1,108 @@
+// Package events keeps the recent lifecycle events of each service, so
+// operators can inspect what happened to it.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
+)
+
+// Event types
+const (
+	ServiceCreated         = "ServiceCreated"
+	ServiceUpdated         = "ServiceUpdated"
+	VIPAllocated           = "VIPAllocated"
+	DestinationAdded       = "DestinationAdded"
+	DestinationRemoved     = "DestinationRemoved"
+	DestinationUpdated     = "DestinationUpdated"
+	DestinationDraining    = "DestinationDraining"
+	HealthChanged          = "HealthChanged"
+	SyncFailed             = "SyncFailed"
+	TableDrifted           = "TableDrifted"
+	ProbeFailed            = "ProbeFailed"
+	ProbeRecovered         = "ProbeRecovered"
+	DestinationUnreachable = "DestinationUnreachable"
+)
+
+// DefaultMaxEvents is the number of events kept per service by default
+const DefaultMaxEvents = 50
+
+// Recorder stores the last events of each service in memory. The oldest
+// events are dropped once a service reaches the maximum.
+type Recorder struct {
+	sync.Mutex
+	max    int
+	events map[string][]types.Event
+	now    func() time.Time
+}
+
+func NewRecorder(max int) *Recorder {
+	if max <= 0 {
+		max = DefaultMaxEvents
+	}
+	return &Recorder{
+		max:    max,
+		events: make(map[string][]types.Event),
+		now:    time.Now,
+	}
+}
+
+// Record adds an event to a service.
+func (r *Recorder) Record(serviceId, eventType, format string, args ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+
+	evts := append(r.events[serviceId], types.Event{
+		Time:    r.now(),
+		Type:    eventType,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if len(evts) > r.max {
+		evts = evts[len(evts)-r.max:]
+	}
+	r.events[serviceId] = evts
+}
+
+// Events returns the events of a service, oldest first.
+func (r *Recorder) Events(serviceId string) []types.Event {
+	r.Lock()
+	defer r.Unlock()
+
+	evts := make([]types.Event, len(r.events[serviceId]))
+	copy(evts, r.events[serviceId])
+	return evts
+}
+
+// Forget drops every event of a service.
+func (r *Recorder) Forget(serviceId string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.events, serviceId)
+}
+
+// Publish publishes a service event on b
+func Publish(b *bus.Bus, serviceId, eventType, format string, args ...interface{}) {
+	b.Publish(bus.ServiceEvent{
+		ServiceId: serviceId,
+		Type:      eventType,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// Subscribe records the service events published on b, forgetting the
+// events of deleted services.
+func (r *Recorder) Subscribe(b *bus.Bus) {
+	b.Subscribe(bus.ServiceEvent{}.Topic(), func(e bus.Event) error {
+		evt := e.(bus.ServiceEvent)
+		r.Record(evt.ServiceId, evt.Type, "%s", evt.Message)
+		return nil
+	})
+	b.Subscribe(bus.ServiceDeleted{}.Topic(), func(e bus.Event) error {
+		r.Forget(e.(bus.ServiceDeleted).ServiceId)
+		return nil
+	})
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type EventsSuite struct{}
+
+var _ = Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestRecord(c *C) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewRecorder(2)
+	r.now = func() time.Time { return now }
+
+	r.Record("svc1", ServiceCreated, "service created")
+	r.Record("svc1", VIPAllocated, "vip %s allocated", "10.0.0.1")
+	r.Record("svc1", DestinationAdded, "destination %s added", "dst1")
+	r.Record("svc2", ServiceCreated, "service created")
+
+	c.Assert(r.Events("svc1"), DeepEquals, []types.Event{
+		{Time: now, Type: VIPAllocated, Message: "vip 10.0.0.1 allocated"},
+		{Time: now, Type: DestinationAdded, Message: "destination dst1 added"},
+	})
+	c.Assert(r.Events("svc2"), HasLen, 1)
+	c.Assert(r.Events("unknown"), DeepEquals, []types.Event{})
+
+	r.Forget("svc1")
+	c.Assert(r.Events("svc1"), DeepEquals, []types.Event{})
+}
+
+func (s *EventsSuite) TestSubscribe(c *C) {
+	b := bus.New()
+	r := NewRecorder(0)
+	r.Subscribe(b)
+
+	Publish(b, "svc1", ServiceCreated, "Service %s created", "svc1")
+	evts := r.Events("svc1")
+	c.Assert(evts, HasLen, 1)
+	c.Assert(evts[0].Type, Equals, ServiceCreated)
+	c.Assert(evts[0].Message, Equals, "Service svc1 created")
+
+	b.Publish(bus.ServiceDeleted{ServiceId: "svc1"})
+	c.Assert(r.Events("svc1"), DeepEquals, []types.Event{})
+}
@@ -2,34 +2,75 @@ package fusis
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hashicorp/serf/serf"
 	"github.com/luizbafilho/fusis/api/types"
 	"github.com/luizbafilho/fusis/config"
+	fusis_net "github.com/luizbafilho/fusis/net"
+	"github.com/pborman/uuid"
 )
 
+// maxRegisterBackoff caps the interval between the registration attempts
+// of an agent
+const maxRegisterBackoff = 30 * time.Second
+
+var errNotRegistered = errors.New("no balancer answered the registration, the cluster may have no leader")
+
 type Agent struct {
 	serf *serf.Serf
 	// eventCh is used for Serf to deliver events on
 	eventCh chan serf.Event
 	config  *config.AgentConfig
+	// instance fingerprints this run of the agent, see types.InstanceLabel
+	instance string
+	// summaries holds the services and destinations gossiped by the leader
+	summaries *summaryCache
+	// registerCh triggers a registration to the leader
+	registerCh chan struct{}
+	shutdownCh chan struct{}
+
+	// vip is the service VIP brought up on the loopback interface
+	vipLock sync.Mutex
+	vip     string
 }
 
 func NewAgent(config *config.AgentConfig) (*Agent, error) {
 	log.Infof("Fusis Agent: Config ==> %+v", config)
 	agent := &Agent{
-		eventCh: make(chan serf.Event, 64),
-		config:  config,
+		eventCh:    make(chan serf.Event, 64),
+		config:     config,
+		instance:   fmt.Sprintf("%d-%s", time.Now().Unix(), uuid.New()),
+		summaries:  newSummaryCache(),
+		registerCh: make(chan struct{}, 1),
+		shutdownCh: make(chan struct{}),
 	}
 
 	return agent, nil
 }
 
+// GetServices returns the services known from the summaries gossiped by
+// the leader
+func (a *Agent) GetServices() []types.Service {
+	return a.summaries.GetServices()
+}
+
+// GetService returns a service known from the summaries gossiped by the
+// leader
+func (a *Agent) GetService(id string) (*types.Service, error) {
+	return a.summaries.GetService(id)
+}
+
 func (a *Agent) Shutdown() {
+	close(a.shutdownCh)
 	if err := a.serf.Leave(); err != nil {
-		log.Fatalf("Graceful shutdown failed: %s", err)
+		log.Errorf("Graceful shutdown failed: %s", err)
 	}
+	a.setLoopbackVip("")
 }
 
 func (a *Agent) Join(existing []string, ignoreOld bool) (n int, err error) {
@@ -48,6 +89,7 @@ func (a *Agent) Start() error {
 	conf := serf.DefaultConfig()
 	conf.Init()
 	conf.Tags["role"] = "agent"
+	conf.Tags["instance"] = a.instance
 
 	bindAddr, err := a.config.GetIpByInterface()
 	if err != nil {
@@ -59,6 +101,10 @@ func (a *Agent) Start() error {
 	conf.MemberlistConfig.BindAddr = bindAddr
 	conf.EventCh = a.eventCh
 
+	if _, err := setupKeyring(conf, a.config.EncryptKey, a.config.KeyringFile); err != nil {
+		return err
+	}
+
 	serf, err := serf.Create(conf)
 	if err != nil {
 		return err
@@ -66,7 +112,14 @@ func (a *Agent) Start() error {
 
 	a.serf = serf
 
+	if a.config.Mode == "route" {
+		if err := fusis_net.SetArpIsolation(a.config.Interface); err != nil {
+			log.Errorf("Fusis Agent: error isolating ARP, the VIP may be answered by the agent: %v", err)
+		}
+	}
+
 	go a.handleEvents()
+	go a.watchRegistration()
 	return nil
 }
 
@@ -80,48 +133,191 @@ func (a *Agent) handleEvents() {
 
 				for _, m := range memberEvent.Members {
 					if m.Name == a.serf.LocalMember().Name {
-						a.broadcastToBalancers()
+						a.triggerRegistration()
 					}
 				}
+			case serf.EventUser:
+				a.handleUserEvent(e.(serf.UserEvent))
 			default:
 				log.Warnf("Fusis Agent: unhandled Serf Event: %#v", e)
 			}
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+func (a *Agent) handleUserEvent(e serf.UserEvent) {
+	switch e.Name {
+	case summaryEvent:
+		if err := a.summaries.handle(e.Payload); err != nil {
+			log.Errorf("Fusis Agent: invalid summary: %v", err)
+		}
+		a.syncLoopbackVip()
+	case digestEvent:
+		since, stale, err := a.summaries.checkDigest(e.Payload)
+		if err != nil {
+			log.Errorf("Fusis Agent: invalid digest: %v", err)
+			return
+		}
+		if stale {
+			a.requestDelta(since)
 		}
 	}
 }
 
-func (a *Agent) broadcastToBalancers() {
-	host, err := a.config.GetIpByInterface()
+// requestDelta asks the leader to gossip again the changes applied after
+// the since index
+func (a *Agent) requestDelta(since uint64) {
+	log.Infof("Fusis Agent: services summary is stale, requesting changes since %d", since)
+	payload, err := json.Marshal(delta{Since: since})
 	if err != nil {
-		panic(err)
+		log.Errorf("Fusis Agent: delta marshaling failed: %v", err)
+		return
 	}
+	params := serf.QueryParam{
+		FilterTags: map[string]string{"role": "balancer"},
+	}
+	if _, err := a.serf.Query(deltaQuery, payload, &params); err != nil {
+		log.Errorf("Fusis Agent: delta query error: %v", err)
+	}
+}
+
+// SummaryStatus reports how fresh the services known from gossip are
+func (a *Agent) SummaryStatus() types.SummaryStatus {
+	return a.summaries.Status()
+}
 
-	if a.config.Host != "" {
-		host = a.config.Host
+// destination is the destination the agent registers itself as
+func (a *Agent) destination() (types.Destination, error) {
+	host := a.config.Host
+	if host == "" {
+		var err error
+		if host, err = a.config.GetIpByInterface(); err != nil {
+			return types.Destination{}, err
+		}
+	}
+	weight := a.config.Weight
+	if weight == 0 {
+		weight = 1
 	}
 
-	dst := types.Destination{
+	return types.Destination{
 		Name:      a.config.Name,
 		Host:      host,
 		Port:      a.config.Port,
-		Weight:    1,
+		Weight:    weight,
 		Mode:      a.config.Mode,
 		ServiceId: a.config.Service,
+		Labels:    map[string]string{types.InstanceLabel: a.instance},
+	}, nil
+}
+
+func (a *Agent) triggerRegistration() {
+	select {
+	case a.registerCh <- struct{}{}:
+	default:
 	}
+}
 
-	params := serf.QueryParam{
-		FilterTags: map[string]string{"role": "balancer"},
+// watchRegistration registers the agent every time it's triggered, retrying
+// with backoff until the leader acknowledges it, e.g. after an election.
+func (a *Agent) watchRegistration() {
+	for {
+		select {
+		case <-a.registerCh:
+		case <-a.shutdownCh:
+			return
+		}
+
+		backoff := time.Second
+		for {
+			err := a.register()
+			if err == nil {
+				break
+			}
+			log.Warnf("Fusis Agent: registration failed, retrying in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-a.shutdownCh:
+				return
+			}
+			if backoff *= 2; backoff > maxRegisterBackoff {
+				backoff = maxRegisterBackoff
+			}
+		}
 	}
+}
 
+// register asks the leader to add the agent as a destination of its
+// service, waiting for the answer.
+func (a *Agent) register() error {
+	dst, err := a.destination()
+	if err != nil {
+		return err
+	}
 	payload, err := json.Marshal(dst)
 	if err != nil {
-		log.Errorf("Fusis Agent: Destination Marshaling failed: %v", err)
-		return
+		return err
 	}
 
-	log.Infof("Fusis Agent: broadcasting agent join to balancers. Host: %v", host)
-	_, err = a.serf.Query("add-destination", payload, &params)
+	params := serf.QueryParam{
+		FilterTags: map[string]string{"role": "balancer"},
+	}
+	log.Infof("Fusis Agent: registering to balancers. Host: %v", dst.Host)
+	resp, err := a.serf.Query(registerQuery, payload, &params)
 	if err != nil {
-		log.Errorf("Fusis Agent: add-balancer event error: %v", err)
+		return err
+	}
+	for r := range resp.ResponseCh() {
+		var reg registration
+		if err := json.Unmarshal(r.Payload, &reg); err != nil {
+			log.Errorf("Fusis Agent: invalid registration answer from %s: %v", r.From, err)
+			continue
+		}
+		if reg.Error != "" {
+			return errors.New(reg.Error)
+		}
+		log.Infof("Fusis Agent: registered by %s", r.From)
+		return nil
+	}
+	return errNotRegistered
+}
+
+// syncLoopbackVip brings the VIP of the service up on the loopback
+// interface in route mode, where the balancer forwards the packets without
+// rewriting their destination, so the agent must accept them as its own.
+func (a *Agent) syncLoopbackVip() {
+	if a.config.Mode != "route" {
+		return
+	}
+	vip := ""
+	if svc, err := a.summaries.GetService(a.config.Service); err == nil {
+		vip = svc.Host
+	}
+	a.setLoopbackVip(vip)
+}
+
+func (a *Agent) setLoopbackVip(vip string) {
+	a.vipLock.Lock()
+	defer a.vipLock.Unlock()
+
+	if vip == a.vip {
+		return
+	}
+	if a.vip != "" {
+		if err := fusis_net.DelIp(a.vip+"/32", "lo"); err != nil {
+			log.Errorf("Fusis Agent: error removing VIP %s from loopback: %v", a.vip, err)
+		}
+		a.vip = ""
+	}
+	if vip == "" {
+		return
+	}
+	if err := fusis_net.AddIp(vip+"/32", "lo"); err != nil {
+		log.Errorf("Fusis Agent: error adding VIP %s to loopback: %v", vip, err)
+		return
 	}
+	log.Infof("Fusis Agent: VIP %s up on loopback", vip)
+	a.vip = vip
 }
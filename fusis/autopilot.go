@@ -0,0 +1,325 @@
+package fusis
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+)
+
+// zoneTag is the serf tag used by balancers to advertise their redundancy
+// zone.
+const zoneTag = "zone"
+
+// nonvoterTag is the serf tag set by balancers replicating the raft log
+// without voting.
+const nonvoterTag = "nonvoter"
+
+// autopilotInterval is how often the leader reviews the raft peers
+var autopilotInterval = time.Second
+
+// autopilot decides which balancers the leader adds to and removes from
+// raft. Balancers failed in serf for longer than cleanup are removed, and
+// new ones are only added after being alive for stabilization, so a flapping
+// node doesn't change the quorum size. Zero disables each of them, making
+// the membership events change the peers right away. The peers that left,
+// or failed without cleanup, are removed by the autopilot too, as their
+// membership events are missed when no balancer leads at the time. Dead
+// voters are kept as long as removing them would leave fewer than
+// minQuorum voters.
+//
+// With redundancy zones, a single balancer of each zone is kept in raft,
+// and the others are standbys, added once the balancer in raft fails.
+// Standbys don't replicate the log until then. Nonvoters are left out of
+// the zones, as they never take part in the quorum.
+type autopilot struct {
+	sync.Mutex
+	cleanup       time.Duration
+	stabilization time.Duration
+	zones         bool
+	minQuorum     int
+
+	// local is the raft address of this balancer, never removed to make
+	// room for a standby
+	local string
+
+	// since is when each balancer was first seen in its current status
+	since map[string]memberSince
+}
+
+type memberSince struct {
+	status serf.MemberStatus
+	time   time.Time
+}
+
+func newAutopilot(conf config.Autopilot) *autopilot {
+	return &autopilot{
+		cleanup:       time.Duration(conf.DeadServerCleanup) * time.Second,
+		stabilization: time.Duration(conf.ServerStabilization) * time.Second,
+		zones:         conf.RedundancyZones,
+		minQuorum:     int(conf.MinQuorum),
+		since:         make(map[string]memberSince),
+	}
+}
+
+// managesJoins reports whether the autopilot decides when new balancers
+// are added to raft, instead of the membership events
+func (a *autopilot) managesJoins() bool {
+	return a.stabilization > 0 || a.zones
+}
+
+// zoneMember is an alive balancer of a redundancy zone
+type zoneMember struct {
+	name   string
+	addr   string
+	peer   bool
+	stable bool
+}
+
+// review records the status of the balancers and returns the raft
+// addresses of the stable ones missing from the raft servers, and of the
+// ones to be removed: dead peers and the extra ones of each redundancy
+// zone. See removable for the dead peers kept.
+func (a *autopilot) review(members []serf.Member, servers []raft.Server, now time.Time) (add, remove []string) {
+	a.Lock()
+	defer a.Unlock()
+
+	isPeer := make(map[string]bool, len(servers))
+	isVoter := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		isPeer[string(s.Address)] = true
+		isVoter[string(s.Address)] = s.Suffrage == raft.Voter
+	}
+
+	current := make(map[string]memberSince)
+	zones := make(map[string][]zoneMember)
+	var dead []string
+	for _, m := range members {
+		if !isBalancer(m) {
+			continue
+		}
+		addr, err := raftPeerAddr(m)
+		if err != nil {
+			continue
+		}
+
+		s, ok := a.since[m.Name]
+		if !ok || s.status != m.Status {
+			s = memberSince{status: m.Status, time: now}
+		}
+		current[m.Name] = s
+
+		switch m.Status {
+		case serf.StatusAlive:
+			stable := now.Sub(s.time) >= a.stabilization
+			if zone := m.Tags[zoneTag]; a.zones && zone != "" && !isNonvoter(m) {
+				zones[zone] = append(zones[zone], zoneMember{name: m.Name, addr: addr, peer: isPeer[addr], stable: stable})
+			} else if a.stabilization > 0 && !isPeer[addr] && stable {
+				add = append(add, addr)
+			}
+		case serf.StatusFailed:
+			if isPeer[addr] && now.Sub(s.time) >= a.cleanup {
+				dead = append(dead, addr)
+			}
+		case serf.StatusLeft:
+			// The leader leaving steps down on its own
+			if isPeer[addr] && addr != a.local {
+				dead = append(dead, addr)
+			}
+		}
+	}
+	a.since = current
+
+	names := make([]string, 0, len(zones))
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+	for _, zone := range names {
+		zoneAdd, zoneRemove := a.reviewZone(zones[zone])
+		add = append(add, zoneAdd...)
+		remove = append(remove, zoneRemove...)
+	}
+
+	remove = append(remove, a.removable(dead, isVoter)...)
+	return add, remove
+}
+
+// removable returns the dead peers that can be removed. They're all kept
+// while the dead voters are half of the voters or more, as removing them
+// wouldn't restore the quorum anyway and a network partition is more likely
+// than so many dead balancers. Voters are also kept when removing them
+// would leave fewer than minQuorum voters, while nonvoters never count.
+func (a *autopilot) removable(dead []string, isVoter map[string]bool) []string {
+	voters, deadVoters := 0, 0
+	for _, voter := range isVoter {
+		if voter {
+			voters++
+		}
+	}
+	for _, addr := range dead {
+		if isVoter[addr] {
+			deadVoters++
+		}
+	}
+	if deadVoters > 0 && deadVoters >= (voters+1)/2 {
+		return nil
+	}
+
+	var remove []string
+	for _, addr := range dead {
+		if isVoter[addr] {
+			if voters-1 < a.minQuorum {
+				continue
+			}
+			voters--
+		}
+		remove = append(remove, addr)
+	}
+	return remove
+}
+
+// health reports the raft servers as healthy when they're alive in serf,
+// along with since when they're in their current status. leader is the
+// raft address of the leader.
+func (a *autopilot) health(members []serf.Member, servers []raft.Server, leader string) *types.ClusterHealth {
+	a.Lock()
+	defer a.Unlock()
+
+	byName := make(map[string]serf.Member, len(members))
+	for _, m := range members {
+		if isBalancer(m) {
+			byName[m.Name] = m
+		}
+	}
+
+	health := &types.ClusterHealth{Healthy: true, Servers: []types.ServerHealth{}}
+	voters, healthyVoters := 0, 0
+	for _, s := range servers {
+		server := types.ServerHealth{
+			Name:   string(s.ID),
+			Addr:   string(s.Address),
+			Status: "unknown",
+			Voter:  s.Suffrage == raft.Voter,
+			Leader: leader != "" && string(s.Address) == leader,
+		}
+		if m, ok := byName[server.Name]; ok {
+			server.Status = m.Status.String()
+			server.Healthy = m.Status == serf.StatusAlive
+			if since, ok := a.since[m.Name]; ok && since.status == m.Status {
+				server.StableSince = since.time
+			}
+		}
+		if server.Voter {
+			voters++
+			if server.Healthy {
+				healthyVoters++
+			}
+		}
+		health.Healthy = health.Healthy && server.Healthy
+		health.Servers = append(health.Servers, server)
+	}
+	if tolerance := healthyVoters - (voters/2 + 1); tolerance > 0 {
+		health.FailureTolerance = tolerance
+	}
+	return health
+}
+
+// reviewZone keeps a single alive balancer of the zone in raft. When none
+// is, the first stable standby is added. Extra balancers in raft, left by
+// zones being enabled or by a failed balancer coming back, become standbys.
+func (a *autopilot) reviewZone(alive []zoneMember) (add, remove []string) {
+	sort.Slice(alive, func(i, j int) bool {
+		// Prefer keeping this balancer, then the first by name
+		if (alive[i].addr == a.local) != (alive[j].addr == a.local) {
+			return alive[i].addr == a.local
+		}
+		return alive[i].name < alive[j].name
+	})
+
+	var voter *zoneMember
+	for i, m := range alive {
+		if !m.peer {
+			continue
+		}
+		if voter == nil {
+			voter = &alive[i]
+		} else {
+			remove = append(remove, m.addr)
+		}
+	}
+	if voter != nil {
+		return nil, remove
+	}
+
+	for _, m := range alive {
+		if m.stable {
+			return []string{m.addr}, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetClusterHealth reports the health of the raft servers and how many
+// voters may fail before the quorum is lost
+func (b *Balancer) GetClusterHealth() (*types.ClusterHealth, error) {
+	servers, err := b.raftServers()
+	if err != nil {
+		return nil, err
+	}
+	return b.autopilot.health(b.serf.Members(), servers, b.GetLeader()), nil
+}
+
+// watchAutopilot applies the autopilot decisions while the balancer leads
+func (b *Balancer) watchAutopilot() {
+	b.autopilot.local = string(b.raftTransport.LocalAddr())
+
+	ticker := time.NewTicker(autopilotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		servers, err := b.raftServers()
+		if err != nil {
+			b.logger.Errorf("autopilot: error reading raft peers: %v", err)
+			continue
+		}
+		ids := make(map[string]raft.ServerID, len(servers))
+		for _, s := range servers {
+			ids[string(s.Address)] = s.ID
+		}
+		members := b.serf.Members()
+		byAddr := make(map[string]serf.Member, len(members))
+		for _, m := range members {
+			if addr, err := raftPeerAddr(m); err == nil && isBalancer(m) {
+				byAddr[addr] = m
+			}
+		}
+
+		add, remove := b.autopilot.review(members, servers, time.Now())
+		if !b.IsLeader() || b.config.ManualPeers {
+			continue
+		}
+
+		for _, addr := range add {
+			b.logger.Infof("autopilot: adding stable balancer %s to raft", addr)
+			if err := b.addRaftServer(byAddr[addr]); err != nil {
+				b.logger.Errorf("autopilot: error adding raft peer %s: %v", addr, err)
+			}
+		}
+		for _, addr := range remove {
+			b.logger.Infof("autopilot: removing balancer %s from raft", addr)
+			if err := b.removeRaftPeer(ids[addr], 0); err != nil {
+				b.logger.Errorf("autopilot: error removing raft peer %s: %v", addr, err)
+			}
+		}
+	}
+}
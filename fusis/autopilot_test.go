@@ -0,0 +1,180 @@
+package fusis
+
+import (
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/config"
+	. "gopkg.in/check.v1"
+)
+
+func balancerMember(name, ip string, status serf.MemberStatus) serf.Member {
+	return serf.Member{
+		Name:   name,
+		Addr:   net.ParseIP(ip),
+		Tags:   map[string]string{"role": "balancer", "raft-port": "4382"},
+		Status: status,
+	}
+}
+
+// voters returns the raft servers of the addresses, as voters named after
+// them
+func voters(addrs ...string) []raft.Server {
+	servers := make([]raft.Server, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(addr), Address: raft.ServerAddress(addr)})
+	}
+	return servers
+}
+
+func (s *FusisSuite) TestAutopilotReview(c *C) {
+	a := newAutopilot(config.Autopilot{DeadServerCleanup: 30, ServerStabilization: 10})
+	now := time.Now()
+	peers := voters("10.0.0.1:4382", "10.0.0.2:4382", "10.0.0.3:4382")
+	members := []serf.Member{
+		balancerMember("b1", "10.0.0.1", serf.StatusAlive),
+		balancerMember("b2", "10.0.0.2", serf.StatusAlive),
+		balancerMember("b3", "10.0.0.3", serf.StatusFailed),
+		balancerMember("b4", "10.0.0.4", serf.StatusAlive),
+		{Name: "agent", Addr: net.ParseIP("10.0.0.5"), Tags: map[string]string{"role": "agent"}, Status: serf.StatusFailed},
+	}
+
+	add, remove := a.review(members, peers, now)
+	c.Assert(add, IsNil)
+	c.Assert(remove, IsNil)
+
+	add, remove = a.review(members, peers, now.Add(10*time.Second))
+	c.Assert(add, DeepEquals, []string{"10.0.0.4:4382"})
+	c.Assert(remove, IsNil)
+
+	// A flapping balancer starts over
+	members[3].Status = serf.StatusFailed
+	a.review(members, peers, now.Add(11*time.Second))
+	members[3].Status = serf.StatusAlive
+	add, _ = a.review(members, peers, now.Add(12*time.Second))
+	c.Assert(add, IsNil)
+
+	add, remove = a.review(members, peers, now.Add(30*time.Second))
+	c.Assert(add, DeepEquals, []string{"10.0.0.4:4382"})
+	c.Assert(remove, DeepEquals, []string{"10.0.0.3:4382"})
+}
+
+func (s *FusisSuite) TestAutopilotReviewKeepsQuorum(c *C) {
+	a := newAutopilot(config.Autopilot{DeadServerCleanup: 30})
+	now := time.Now()
+	peers := voters("10.0.0.1:4382", "10.0.0.2:4382", "10.0.0.3:4382")
+	members := []serf.Member{
+		balancerMember("b1", "10.0.0.1", serf.StatusAlive),
+		balancerMember("b2", "10.0.0.2", serf.StatusFailed),
+		balancerMember("b3", "10.0.0.3", serf.StatusFailed),
+	}
+
+	a.review(members, peers, now)
+	add, remove := a.review(members, peers, now.Add(time.Minute))
+	c.Assert(add, IsNil)
+	c.Assert(remove, IsNil)
+}
+
+func (s *FusisSuite) TestAutopilotReviewLeft(c *C) {
+	a := newAutopilot(config.Autopilot{DeadServerCleanup: 30})
+	a.local = "10.0.0.1:4382"
+	now := time.Now()
+	peers := voters("10.0.0.1:4382", "10.0.0.2:4382", "10.0.0.3:4382", "10.0.0.4:4382", "10.0.0.5:4382")
+	members := []serf.Member{
+		balancerMember("b1", "10.0.0.1", serf.StatusLeft),
+		balancerMember("b2", "10.0.0.2", serf.StatusAlive),
+		balancerMember("b3", "10.0.0.3", serf.StatusLeft),
+		balancerMember("b4", "10.0.0.4", serf.StatusAlive),
+		balancerMember("b5", "10.0.0.5", serf.StatusAlive),
+	}
+
+	// Balancers that left are removed at once, even when their leave was
+	// missed, except for the local one
+	_, remove := a.review(members, peers, now)
+	c.Assert(remove, DeepEquals, []string{"10.0.0.3:4382"})
+}
+
+func (s *FusisSuite) TestAutopilotReviewMinQuorum(c *C) {
+	a := newAutopilot(config.Autopilot{DeadServerCleanup: 30, MinQuorum: 4})
+	now := time.Now()
+	peers := voters("10.0.0.1:4382", "10.0.0.2:4382", "10.0.0.3:4382", "10.0.0.4:4382", "10.0.0.5:4382")
+	peers = append(peers, raft.Server{Suffrage: raft.Nonvoter, ID: "b6", Address: "10.0.0.6:4382"})
+	members := []serf.Member{
+		balancerMember("b1", "10.0.0.1", serf.StatusAlive),
+		balancerMember("b2", "10.0.0.2", serf.StatusAlive),
+		balancerMember("b3", "10.0.0.3", serf.StatusAlive),
+		balancerMember("b4", "10.0.0.4", serf.StatusFailed),
+		balancerMember("b5", "10.0.0.5", serf.StatusFailed),
+		balancerMember("b6", "10.0.0.6", serf.StatusFailed),
+	}
+
+	a.review(members, peers, now)
+	_, remove := a.review(members, peers, now.Add(time.Minute))
+	c.Assert(remove, DeepEquals, []string{"10.0.0.4:4382", "10.0.0.6:4382"})
+}
+
+func (s *FusisSuite) TestAutopilotHealth(c *C) {
+	a := newAutopilot(config.Autopilot{})
+	now := time.Now()
+	peers := voters("10.0.0.1:4382", "10.0.0.2:4382", "10.0.0.3:4382")
+	peers = append(peers, raft.Server{Suffrage: raft.Nonvoter, ID: "10.0.0.9:4382", Address: "10.0.0.9:4382"})
+	members := []serf.Member{
+		balancerMember("10.0.0.1:4382", "10.0.0.1", serf.StatusAlive),
+		balancerMember("10.0.0.2:4382", "10.0.0.2", serf.StatusAlive),
+		balancerMember("10.0.0.3:4382", "10.0.0.3", serf.StatusAlive),
+		balancerMember("10.0.0.9:4382", "10.0.0.9", serf.StatusAlive),
+	}
+	a.review(members, peers, now)
+
+	health := a.health(members, peers, "10.0.0.1:4382")
+	c.Assert(health.Healthy, Equals, true)
+	c.Assert(health.FailureTolerance, Equals, 1)
+	c.Assert(health.Servers, HasLen, 4)
+	c.Assert(health.Servers[0].Leader, Equals, true)
+	c.Assert(health.Servers[0].StableSince.Equal(now), Equals, true)
+	c.Assert(health.Servers[3].Voter, Equals, false)
+
+	members[2].Status = serf.StatusFailed
+	health = a.health(members[:2], peers, "10.0.0.1:4382")
+	c.Assert(health.Healthy, Equals, false)
+	c.Assert(health.FailureTolerance, Equals, 0)
+	c.Assert(health.Servers[2].Status, Equals, "unknown")
+	c.Assert(health.Servers[2].Healthy, Equals, false)
+}
+
+func zonedMember(name, ip, zone string, status serf.MemberStatus) serf.Member {
+	m := balancerMember(name, ip, status)
+	m.Tags[zoneTag] = zone
+	return m
+}
+
+func (s *FusisSuite) TestAutopilotReviewZones(c *C) {
+	a := newAutopilot(config.Autopilot{RedundancyZones: true})
+	a.local = "10.0.0.2:4382"
+	now := time.Now()
+	peers := voters("10.0.0.1:4382", "10.0.0.2:4382", "10.0.0.3:4382")
+	members := []serf.Member{
+		zonedMember("a1", "10.0.0.1", "a", serf.StatusAlive),
+		zonedMember("a2", "10.0.0.2", "a", serf.StatusAlive),
+		zonedMember("b1", "10.0.0.3", "b", serf.StatusAlive),
+		zonedMember("b2", "10.0.0.4", "b", serf.StatusAlive),
+		zonedMember("c1", "10.0.0.5", "c", serf.StatusAlive),
+		zonedMember("c2", "10.0.0.6", "c", serf.StatusAlive),
+	}
+
+	// The local balancer is kept in its zone, and zone c gets its first
+	// balancer
+	add, remove := a.review(members, peers, now)
+	c.Assert(add, DeepEquals, []string{"10.0.0.5:4382"})
+	c.Assert(remove, DeepEquals, []string{"10.0.0.1:4382"})
+
+	// The standby replaces the failed balancer
+	peers = voters("10.0.0.2:4382", "10.0.0.3:4382", "10.0.0.5:4382")
+	members[2].Status = serf.StatusFailed
+	add, remove = a.review(members, peers, now)
+	c.Assert(add, DeepEquals, []string{"10.0.0.4:4382"})
+	// Without cleanup, the failed balancer is removed right away
+	c.Assert(remove, DeepEquals, []string{"10.0.0.3:4382"})
+}
@@ -1,27 +1,37 @@
 package fusis
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
 	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/dns"
 	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/health"
+	"github.com/luizbafilho/fusis/ipvs"
 	fusis_net "github.com/luizbafilho/fusis/net"
+	"github.com/luizbafilho/fusis/probe"
 	"github.com/luizbafilho/fusis/provider"
+	"github.com/luizbafilho/fusis/proxy"
+	"github.com/luizbafilho/fusis/secrets"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -36,22 +46,60 @@ type Balancer struct {
 	eventCh chan serf.Event
 
 	serf          *serf.Serf
+	keyring       *memberlist.Keyring
 	raft          *raft.Raft // The consensus mechanism
-	raftPeers     raft.PeerStore
 	raftStore     *raftboltdb.BoltStore
 	raftInmem     *raft.InmemStore
 	raftTransport *raft.NetworkTransport
+	warmupUntil   time.Time
+	failover      failoverClock
+	fastApplyLock sync.Mutex
 	logger        *logrus.Logger
+	logWriter     *io.PipeWriter
 	config        *config.BalancerConfig
+	serviceIds    types.IdGenerator
 
 	engine     *engine.Engine
 	provider   provider.Provider
-	shutdownCh chan bool
+	dns        *dns.Syncer
+	dnsCh      chan struct{}
+	health     *health.Tracker
+	prober     *probe.Prober
+	proxy      *proxy.Manager
+	shapers    map[string]*fusis_net.Shaper
+	autopilot  *autopilot
+	shedder    shedder
+	shutdown   bool
+	shutdownCh chan struct{}
+
+	shutdownHooks []func(leave bool)
+
+	// published holds the versions of the summaries gossiped by the leader
+	summaryLock    sync.Mutex
+	published      map[string]uint64
+	tombstones     []tombstone
+	tombstonesFrom uint64
+	deltaSince     *uint64
+	deltaCh        chan struct{}
+
+	// certificates are reloaded when the TLS certificates are rotated
+	certLock     sync.Mutex
+	certificates []*config.Certificate
 }
 
-// NewBalancer initializes a new balancer
-//TODO: Graceful shutdown on initialization errors
-func NewBalancer(config *config.BalancerConfig) (*Balancer, error) {
+// NewBalancer initializes a new balancer. Extensions, if any, are registered
+// in the FSM before raft is started. When a step fails, what was set up by
+// the previous ones is torn down, so the ports and the raft database are
+// released.
+func NewBalancer(config *config.BalancerConfig, extensions ...engine.Extension) (_ *Balancer, err error) {
+	serviceIds, err := types.GetIdGenerator(config.ServiceIds)
+	if err != nil {
+		return nil, err
+	}
+	if !config.DestinationCheck.ValidMode() {
+		return nil, fmt.Errorf("invalid destination check mode %q: must be empty, warn or reject", config.DestinationCheck.Mode)
+	}
+
 	provider, err := provider.New(config)
 	if err != nil {
 		return nil, err
@@ -62,13 +110,49 @@ func NewBalancer(config *config.BalancerConfig) (*Balancer, error) {
 		return nil, err
 	}
 
+	for _, ext := range extensions {
+		if err := engine.RegisterExtension(ext); err != nil {
+			return nil, err
+		}
+	}
+
+	dnsSyncer, err := dns.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bandwidth caps are applied on the interface of each provider
+	shapers := map[string]*fusis_net.Shaper{"": fusis_net.NewShaper(config.Provider.Params["interface"])}
+	for name, p := range config.Providers {
+		shapers[name] = fusis_net.NewShaper(p.Params["interface"])
+	}
+
 	balancer := &Balancer{
-		eventCh:  make(chan serf.Event, 64),
-		engine:   engine,
-		provider: provider,
-		logger:   logrus.New(),
-		config:   config,
+		eventCh:    make(chan serf.Event, 64),
+		engine:     engine,
+		provider:   provider,
+		dns:        dnsSyncer,
+		dnsCh:      make(chan struct{}, 1),
+		health:     health.NewTracker(config.Health),
+		prober:     probe.NewProber(config.Probe),
+		proxy:      proxy.NewManager(engine.Logger),
+		shapers:    shapers,
+		published:  make(map[string]uint64),
+		deltaCh:    make(chan struct{}, 1),
+		autopilot:  newAutopilot(config.Autopilot),
+		logger:     engine.Logger,
+		logWriter:  engine.Logger.Writer(),
+		config:     config,
+		serviceIds: serviceIds,
+		shutdownCh: make(chan struct{}),
 	}
+	defer func() {
+		if err != nil {
+			balancer.teardown(false)
+		}
+	}()
+
+	balancer.subscribe()
 
 	if err = balancer.setupRaft(); err != nil {
 		return nil, fmt.Errorf("error setting up Raft: %v", err)
@@ -78,12 +162,55 @@ func NewBalancer(config *config.BalancerConfig) (*Balancer, error) {
 		return nil, fmt.Errorf("error setting up Serf: %v", err)
 	}
 
-	// Flushing all VIPs on the network interface
-	if err := fusis_net.DelVips(balancer.config.Provider.Params["interface"]); err != nil {
-		return nil, fmt.Errorf("error cleaning up network vips: %v", err)
+	// The VIPs added are recorded along with the raft data, so the ones of
+	// a previous run are told apart from the addresses of the host
+	if err = fusis_net.SetVipRecord(filepath.Join(config.ConfigPath, "vips.json")); err != nil {
+		return nil, fmt.Errorf("error reading the VIP record: %v", err)
+	}
+
+	// Flushing all VIPs on the network interface, unless they are owned by
+	// the process handing over to this one
+	if !config.Handover {
+		for _, iface := range balancer.vipInterfaces() {
+			if err = fusis_net.DelVips(iface); err != nil {
+				return nil, fmt.Errorf("error cleaning up network vips: %v", err)
+			}
+		}
 	}
 
 	go balancer.watchLeaderChanges()
+	go balancer.watchExpiry()
+	go balancer.watchSummaries()
+
+	go balancer.watchAutopilot()
+
+	if balancer.dns != nil {
+		go balancer.watchDNS()
+
+		if config.SecretsRefresh > 0 && secrets.HasRefs(config.DNS.Params) {
+			go balancer.watchSecrets(time.Duration(config.SecretsRefresh) * time.Second)
+		}
+	}
+
+	if config.IpvsWatch > 0 {
+		go balancer.watchIpvs(time.Duration(config.IpvsWatch) * time.Second)
+	}
+
+	if config.ReconcileInterval > 0 {
+		go balancer.watchReconcile(time.Duration(config.ReconcileInterval) * time.Second)
+	}
+
+	if config.Probe.Interval > 0 {
+		go balancer.watchProbes(time.Duration(config.Probe.Interval) * time.Second)
+	}
+
+	if balancer.keyring != nil && config.KeyRotation > 0 {
+		go balancer.watchKeyRotation(time.Duration(config.KeyRotation) * time.Second)
+	}
+
+	if config.SecretsRefresh > 0 && (config.TLS.Enabled() || config.RaftTLS.Enabled()) {
+		go balancer.watchCertificates(time.Duration(config.SecretsRefresh) * time.Second)
+	}
 
 	// Only collect stats if some interval is defined
 	if config.Stats.Interval > 0 {
@@ -99,6 +226,14 @@ func (b *Balancer) setupSerf() error {
 	conf.Init()
 	conf.Tags["role"] = "balancer"
 	conf.Tags["raft-port"] = strconv.Itoa(b.config.Ports["raft"])
+	conf.Tags["api-port"] = strconv.Itoa(b.config.APIPort())
+	conf.Tags[protocolTag] = strconv.Itoa(engine.CommandVersion)
+	if b.config.Zone != "" {
+		conf.Tags[zoneTag] = b.config.Zone
+	}
+	if b.config.NonVoter {
+		conf.Tags[nonvoterTag] = "true"
+	}
 
 	bindAddr, err := b.config.GetIpByInterface()
 	if err != nil {
@@ -110,6 +245,27 @@ func (b *Balancer) setupSerf() error {
 
 	conf.NodeName = b.config.Name
 	conf.EventCh = b.eventCh
+	conf.LogOutput = b.logWriter
+	conf.MemberlistConfig.LogOutput = b.logWriter
+
+	if !b.config.DevMode {
+		conf.SnapshotPath = b.config.SerfSnapshotPath
+		if conf.SnapshotPath == "" {
+			conf.SnapshotPath = filepath.Join(b.config.ConfigPath, "serf.snapshot")
+		}
+		// Shutdown always leaves the cluster, rejoining after a restart
+		// is the whole point of keeping the snapshot.
+		conf.RejoinAfterLeave = true
+	}
+
+	keyringFile := ""
+	if !b.config.DevMode {
+		keyringFile = filepath.Join(b.config.ConfigPath, "serf.keyring")
+	}
+	b.keyring, err = setupKeyring(conf, b.config.EncryptKey, keyringFile)
+	if err != nil {
+		return err
+	}
 
 	serf, err := serf.Create(conf)
 	if err != nil {
@@ -123,28 +279,24 @@ func (b *Balancer) setupSerf() error {
 	return nil
 }
 
-func (b *Balancer) newStdLogger() *log.Logger {
-	return log.New(b.logger.Writer(), "", 0)
-}
-
 func (b *Balancer) setupRaft() error {
 	// Setup Raft configuration.
 	raftConfig := raft.DefaultConfig()
-	raftConfig.Logger = b.newStdLogger()
-
+	raftConfig.LogOutput = b.logWriter
+	raftConfig.LocalID = raft.ServerID(b.config.Name)
 	raftConfig.ShutdownOnRemove = false
-	// Check for any existing peers.
-	peers, err := readPeersJSON(filepath.Join(b.config.ConfigPath, "peers.json"))
-	if err != nil {
-		return err
+
+	if b.config.NonVoter && (b.config.Bootstrap || len(b.config.RaftPeers) > 0) {
+		return fmt.Errorf("a nonvoter can't bootstrap the cluster")
 	}
 
-	// Allow the node to entry single-mode, potentially electing itself, if
-	// explicitly enabled and there is only 1 node in the cluster already.
-	if b.config.Bootstrap && len(peers) <= 1 {
-		b.logger.Infof("enabling single-node mode")
-		raftConfig.EnableSingleNode = true
-		raftConfig.DisableBootstrapAfterElect = false
+	var peers []raft.Server
+	if len(b.config.RaftPeers) > 0 && !b.config.DevMode {
+		var err error
+		peers, err = parseRaftPeers(b.config.RaftPeers, b.config.Ports["raft"])
+		if err != nil {
+			return err
+		}
 	}
 
 	ip, err := b.config.GetIpByInterface()
@@ -154,35 +306,34 @@ func (b *Balancer) setupRaft() error {
 
 	// Setup Raft communication.
 	raftAddr := &net.TCPAddr{IP: net.ParseIP(ip), Port: b.config.Ports["raft"]}
-	transport, err := raft.NewTCPTransport(raftAddr.String(), raftAddr, 3, 10*time.Second, os.Stderr)
+	transport, cert, err := newRaftTransport(raftAddr, b.config.RaftTLS, b.logWriter)
 	if err != nil {
 		return err
 	}
 	b.raftTransport = transport
+	if cert != nil {
+		b.AddCertificate(cert)
+	}
 
 	var log raft.LogStore
 	var stable raft.StableStore
 	var snap raft.SnapshotStore
 
 	if b.config.DevMode {
+		if b.config.RestoreFrom != "" {
+			return fmt.Errorf("restoring a snapshot requires the raft data to be persisted, it's not supported in dev mode")
+		}
 		store := raft.NewInmemStore()
 		b.raftInmem = store
 		stable = store
 		log = store
 		snap = raft.NewDiscardSnapshotStore()
-		b.raftPeers = &raft.StaticPeers{}
 	} else {
-		// Create peer storage.
-		peerStore := raft.NewJSONPeers(b.config.ConfigPath, transport)
-		b.raftPeers = peerStore
-
-		var snapshots *raft.FileSnapshotStore
 		// Create the snapshot store. This allows the Raft to truncate the log.
-		snapshots, err = raft.NewFileSnapshotStore(b.config.ConfigPath, retainSnapshotCount, os.Stderr)
+		snap, err = raft.NewFileSnapshotStore(b.config.ConfigPath, retainSnapshotCount, b.logWriter)
 		if err != nil {
 			return fmt.Errorf("file snapshot store: %s", err)
 		}
-		snap = snapshots
 
 		var logStore *raftboltdb.BoltStore
 		// Create the log store and stable store.
@@ -195,46 +346,252 @@ func (b *Balancer) setupRaft() error {
 		stable = logStore
 	}
 
-	go b.watchState()
+	hasState, err := raft.HasExistingState(log, stable, snap)
+	if err != nil {
+		return err
+	}
+
+	// A new cluster starts with this balancer and the configured peers, or
+	// with the state being restored. Balancers started without either wait
+	// for the leader to add them.
+	configuration := raft.Configuration{Servers: []raft.Server{{
+		Suffrage: raft.Voter,
+		ID:       raftConfig.LocalID,
+		Address:  transport.LocalAddr(),
+	}}}
+	for _, p := range peers {
+		if p.ID != raftConfig.LocalID {
+			configuration.Servers = append(configuration.Servers, p)
+		}
+	}
+	switch {
+	case hasState:
+		if b.config.RestoreFrom != "" {
+			b.logger.Warnf("balancer: raft data found in %s, not restoring %s", b.config.ConfigPath, b.config.RestoreFrom)
+		}
+		if err := b.recoverRaft(raftConfig, log, stable, snap); err != nil {
+			return err
+		}
+	case b.config.RestoreFrom != "":
+		if err := b.restoreFrom(b.config.RestoreFrom, snap, configuration); err != nil {
+			return err
+		}
+	case b.config.Bootstrap || len(peers) > 0:
+		b.logger.Infof("balancer: bootstrapping the cluster with %d balancers", len(configuration.Servers))
+		if err := raft.BootstrapCluster(raftConfig, log, stable, snap, transport, configuration); err != nil {
+			return fmt.Errorf("bootstrap cluster: %s", err)
+		}
+	}
+
+	// Only a restarted balancer warms up, a new one has no cluster to hand
+	// the leadership to.
+	if warmup := time.Duration(b.config.LeaderWarmup) * time.Second; warmup > 0 && hasState {
+		b.logger.Infof("balancer: handing the leadership over during %s warmup", warmup)
+		b.warmupUntil = time.Now().Add(warmup)
+	}
 
 	// Instantiate the Raft systems.
-	ra, err := raft.NewRaft(raftConfig, b.engine, log, stable, snap, b.raftPeers, transport)
+	ra, err := raft.NewRaft(raftConfig, b.engine, log, stable, snap, transport)
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
 	b.raft = ra
+	b.observeLeaderLoss()
 
 	return nil
 }
 
-func (b *Balancer) watchState() {
-	for {
-		select {
-		case rsp := <-b.engine.StateCh:
-			// TODO: this doesn't need to run all the time, we can implement
-			// some kind of throttling in the future waiting for a threashold of
-			// messages before applying the messages.
-			rsp <- b.handleStateChange()
+// recoverRaft replaces the raft configuration with the one in peers.json,
+// when the file exists, so a cluster that lost its quorum can be brought
+// back. The file is removed once the configuration is recovered.
+func (b *Balancer) recoverRaft(conf *raft.Config, logs raft.LogStore, stable raft.StableStore, snaps raft.SnapshotStore) error {
+	if b.config.DevMode {
+		return nil
+	}
+	path := filepath.Join(b.config.ConfigPath, "peers.json")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	configuration, err := raft.ReadConfigJSON(path)
+	if err != nil {
+		var legacy []string
+		if data, rerr := ioutil.ReadFile(path); rerr == nil && json.Unmarshal(data, &legacy) == nil {
+			return fmt.Errorf("%s lists raft addresses, as written by releases before server IDs; remove it or list the balancers by id and address", path)
+		}
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	b.logger.Warnf("balancer: recovering the raft configuration from %s", path)
+	if err := raft.RecoverCluster(conf, b.engine, logs, stable, snaps, b.raftTransport, configuration); err != nil {
+		return fmt.Errorf("recover cluster: %s", err)
+	}
+	return os.Remove(path)
+}
+
+// subscribe registers the balancer modules on the engine bus. Handlers
+// run in subscription order, so the kernel and the VIPs are synced before
+// the DNS records and the summaries.
+func (b *Balancer) subscribe() {
+	b.engine.Bus.Subscribe(bus.StateChanged{}.Topic(), func(e bus.Event) error {
+		return b.handleStateChange(e.(bus.StateChanged).Restored)
+	})
+	b.health.Subscribe(b.engine.Bus)
+	provider.Subscribe(b.provider, b.engine.Bus)
+
+	if b.dns != nil {
+		notify := func(bus.Event) error {
+			b.notifyDNS()
+			return nil
 		}
+		b.engine.Bus.Subscribe(bus.StateChanged{}.Topic(), notify)
+		b.engine.Bus.Subscribe(bus.LeadershipChanged{}.Topic(), notify)
 	}
+
+	b.engine.Bus.Subscribe(bus.StateChanged{}.Topic(), func(bus.Event) error {
+		if b.IsLeader() {
+			b.publishSummaries()
+		}
+		return nil
+	})
+	b.engine.Bus.Subscribe(bus.LeadershipChanged{}.Topic(), func(e bus.Event) error {
+		if e.(bus.LeadershipChanged).Leader {
+			// The previous leader may have not gossiped every change
+			b.resetSummaries()
+			b.publishSummaries()
+		}
+		return nil
+	})
+	b.engine.Bus.Subscribe(bus.CertificatesRotated{}.Topic(), func(bus.Event) error {
+		// Secrets may take a while to resolve, the FSM isn't held meanwhile
+		go b.reloadCertificates()
+		return nil
+	})
 }
 
-func (b *Balancer) handleStateChange() error {
+// handleStateChange syncs the kernel with the state. The syncs of restored
+// snapshots are paced, as they may add the whole state at once.
+func (b *Balancer) handleStateChange(restored bool) error {
 	if b.IsLeader() {
 		b.provider.SyncVIPs(b.engine.State)
+		b.syncBandwidth()
 	} else {
 		b.Lock()
 		defer b.Unlock()
 	}
-	return b.engine.Ipvs.SyncState(b.engine.State)
+	b.syncProxies()
+	if restored && b.config.CatchUp.Rate > 0 {
+		pacer := ipvs.NewChunkPacer(int(b.config.CatchUp.Rate), int(b.config.CatchUp.Chunk))
+		return b.engine.Ipvs.SyncStatePaced(b.routingState(), pacer)
+	}
+	return b.engine.Ipvs.SyncState(b.routingState())
 }
 
+// syncProxies runs the proxies of the http services. Like the VIPs, they
+// only run on the leader.
+func (b *Balancer) syncProxies() {
+	if !b.IsLeader() {
+		b.proxy.Stop()
+		return
+	}
+	if err := b.proxy.Sync(b.routingState().GetServices()); err != nil {
+		b.logger.Errorf("balancer: error syncing proxies: %v", err)
+	}
+}
+
+// IsLeader reports whether the balancer leads raft. It's false while raft
+// is created, as restoring a snapshot already publishes state changes.
 func (b *Balancer) IsLeader() bool {
-	return b.raft.State() == raft.Leader
+	return b.raft != nil && b.raft.State() == raft.Leader
 }
 
 func (b *Balancer) GetLeader() string {
-	return b.raft.Leader()
+	return string(b.raft.Leader())
+}
+
+// GetLeaderAPI returns the address of the leader API, or an empty string
+// when there's no known leader.
+func (b *Balancer) GetLeaderAPI() string {
+	leader := b.GetLeader()
+	if leader == "" {
+		return ""
+	}
+	for _, m := range b.serf.Members() {
+		if !isBalancer(m) || m.Status != serf.StatusAlive {
+			continue
+		}
+		if addr, err := raftPeerAddr(m); err != nil || addr != leader {
+			continue
+		}
+		if port := m.Tags["api-port"]; port != "" {
+			return net.JoinHostPort(m.Addr.String(), port)
+		}
+	}
+	// Balancers released before the api port was advertised listen on the
+	// default one
+	host, _, _ := net.SplitHostPort(leader)
+	return net.JoinHostPort(host, strconv.Itoa(config.DefaultAPIPort))
+}
+
+// GetCluster returns the members of the cluster known to the balancer,
+// along with the leader
+func (b *Balancer) GetCluster() types.Cluster {
+	cluster := types.Cluster{
+		Leader:    b.GetLeader(),
+		LeaderAPI: b.GetLeaderAPI(),
+		Members:   []types.Member{},
+	}
+	for _, m := range b.serf.Members() {
+		member := types.Member{
+			Name:   m.Name,
+			Addr:   m.Addr.String(),
+			Role:   m.Tags["role"],
+			Status: m.Status.String(),
+		}
+		if isBalancer(m) && cluster.Leader != "" {
+			if addr, err := raftPeerAddr(m); err == nil && addr == cluster.Leader {
+				member.Leader = true
+			}
+		}
+		cluster.Members = append(cluster.Members, member)
+	}
+	return cluster
+}
+
+// ForceLeave makes a failed member of the cluster leave, as if it left
+// gracefully, instead of being reaped once the reconnect timeout expires.
+// Members that keep failing and rejoining, churning the raft peers and the
+// destinations of the agents, are evicted this way.
+func (b *Balancer) ForceLeave(name string) error {
+	for _, m := range b.serf.Members() {
+		if m.Name != name {
+			continue
+		}
+		if m.Status == serf.StatusAlive {
+			return types.ErrMemberAlive
+		}
+		b.logger.Infof("balancer: forcing %s to leave", name)
+		return b.serf.RemoveFailedNode(name)
+	}
+	return types.ErrMemberNotFound
+}
+
+// Barrier blocks until every change committed before it is applied to the
+// FSM. Only a leader is able to commit the barrier, so it also verifies the
+// leadership, making the reads that follow it linearizable.
+func (b *Balancer) Barrier() error {
+	return b.raft.Barrier(raftTimeout).Error()
+}
+
+// ReadInfo returns how fresh the local state is.
+func (b *Balancer) ReadInfo() types.ReadInfo {
+	info := types.ReadInfo{
+		LastIndex:   b.engine.LastApplied(),
+		KnownLeader: b.GetLeader() != "",
+	}
+	if !b.IsLeader() {
+		info.LastContact = time.Since(b.raft.LastContact())
+	}
+	return info
 }
 
 // JoinPool joins the Fusis Serf cluster
@@ -254,18 +611,57 @@ func (b *Balancer) watchLeaderChanges() {
 	b.logger.Infof("Watching to Leader changes")
 
 	for {
-		isLeader := <-b.raft.LeaderCh()
-		b.Lock()
+		var isLeader bool
+		select {
+		case isLeader = <-b.raft.LeaderCh():
+		case <-b.shutdownCh:
+			return
+		}
+
+		if isLeader && time.Now().Before(b.warmupUntil) && b.handOverLeadership() {
+			// Raft reports the leadership lost once it's transferred
+			continue
+		}
+
+		var failover *types.FailoverTiming
 		if isLeader {
+			failover = b.takeOver()
+			// Raft drops the notifications nobody is waiting for, so a
+			// leadership lost during the take over would go unnoticed
+			if !b.IsLeader() {
+				isLeader = false
+				failover = nil
+			}
+		}
+		if !isLeader {
+			b.Lock()
 			b.flushVips()
-			b.setVips()
-		} else {
-			b.flushVips()
+			b.syncProxies()
+			b.Unlock()
+		}
+
+		if err := b.engine.Bus.Publish(bus.LeadershipChanged{Leader: isLeader, Failover: failover}); err != nil {
+			b.logger.Errorf("balancer: error handling leadership change: %v", err)
 		}
-		b.Unlock()
 	}
 }
 
+// handOverLeadership transfers the leadership won during the warmup to a
+// balancer that was already running. It reports whether the transfer
+// succeeded, it fails when this balancer is the only voter.
+func (b *Balancer) handOverLeadership() bool {
+	others, err := b.numOtherVoters()
+	if err != nil || others == 0 {
+		return false
+	}
+	b.logger.Infof("balancer: handing the leadership over during warmup")
+	if err := b.raft.LeadershipTransfer().Error(); err != nil {
+		b.logger.Warnf("balancer: error handing the leadership over: %v", err)
+		return false
+	}
+	return true
+}
+
 func (b *Balancer) handleEvents() {
 	for {
 		select {
@@ -280,28 +676,110 @@ func (b *Balancer) handleEvents() {
 			case serf.EventMemberLeave:
 				memberEvent := e.(serf.MemberEvent)
 				b.handleMemberLeave(memberEvent)
-			// case serf.EventQuery:
-			// 	query := e.(*serf.Query)
-			// 	b.handleQuery(query)
+			case serf.EventUser:
+				// Summaries are gossiped for the members outside raft
+			case serf.EventQuery:
+				query := e.(*serf.Query)
+				switch query.Name {
+				case deltaQuery:
+					b.handleDeltaQuery(query)
+				case registerQuery:
+					b.handleRegisterQuery(query)
+				}
 			default:
 				b.logger.Warnf("Balancer: unhandled Serf Event: %#v", e)
 			}
+		case <-b.shutdownCh:
+			return
 		}
 	}
 }
 
-func (b *Balancer) setVips() {
-	err := b.provider.SyncVIPs(b.engine.State)
-	if err != nil {
-		//TODO: Remove balancer from cluster when error occurs
-		b.logger.Error(err)
+// notifyDNS schedules a DNS records sync. Notifications are coalesced, so
+// a burst of state changes results in a single sync.
+func (b *Balancer) notifyDNS() {
+	if b.dns == nil {
+		return
+	}
+	select {
+	case b.dnsCh <- struct{}{}:
+	default:
 	}
 }
 
+func (b *Balancer) watchDNS() {
+	for {
+		select {
+		case <-b.dnsCh:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if !b.IsLeader() {
+			continue
+		}
+		if err := b.dns.Sync(b.GetServices()); err != nil {
+			b.logger.Errorf("balancer: error syncing dns records: %v", err)
+		}
+	}
+}
+
+// watchSecrets periodically reloads the integrations configured with
+// secret references, picking up rotated credentials.
+func (b *Balancer) watchSecrets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if err := b.dns.Reload(b.config.DNS); err != nil {
+			b.logger.Errorf("balancer: error reloading dns secrets: %v", err)
+		}
+	}
+}
+
+// vipInterfaces lists the interfaces the providers add the VIPs to
+func (b *Balancer) vipInterfaces() []string {
+	ifaces := []string{b.config.Provider.Params["interface"]}
+	for _, p := range b.config.Providers {
+		ifaces = append(ifaces, p.Params["interface"])
+	}
+	return ifaces
+}
+
+// providerInterface returns the interface the provider named name adds the
+// VIPs to, the empty name being the default provider
+func (b *Balancer) providerInterface(name string) string {
+	if name == "" {
+		return b.config.Provider.Params["interface"]
+	}
+	return b.config.Providers[name].Params["interface"]
+}
+
 func (b *Balancer) flushVips() {
-	if err := fusis_net.DelVips(b.config.Provider.Params["interface"]); err != nil {
-		//TODO: Remove balancer from cluster when error occurs
-		b.logger.Error(err)
+	for _, iface := range b.vipInterfaces() {
+		if err := fusis_net.DelVips(iface); err != nil {
+			//TODO: Remove balancer from cluster when error occurs
+			b.logger.Error(err)
+		}
+	}
+	for _, shaper := range b.shapers {
+		if err := shaper.Flush(); err != nil {
+			b.logger.Error(err)
+		}
+	}
+}
+
+// flushProvider withdraws the VIPs announced by the provider, if any
+func (b *Balancer) flushProvider() {
+	if f, ok := b.provider.(provider.Flusher); ok {
+		if err := f.FlushVIPs(); err != nil {
+			b.logger.Errorf("balancer: error withdrawing VIPs: %v", err)
+		}
 	}
 }
 
@@ -312,6 +790,12 @@ func (b *Balancer) handleMemberJoin(event serf.MemberEvent) {
 		return
 	}
 
+	// Stable balancers are added by the autopilot, and none at all with
+	// manual peers
+	if b.config.ManualPeers || b.autopilot.managesJoins() {
+		return
+	}
+
 	for _, m := range event.Members {
 		if isBalancer(m) {
 			b.addMemberToPool(m)
@@ -319,24 +803,102 @@ func (b *Balancer) handleMemberJoin(event serf.MemberEvent) {
 	}
 }
 
+// raftPeerAddr returns the address raft reaches a balancer at. Its server
+// ID is its name.
+func raftPeerAddr(m serf.Member) (string, error) {
+	raftPort, err := strconv.Atoi(m.Tags["raft-port"])
+	if err != nil {
+		return "", fmt.Errorf("invalid raft port of %s: %v", m.Name, err)
+	}
+	return (&net.TCPAddr{IP: m.Addr, Port: raftPort}).String(), nil
+}
+
 func (b *Balancer) addMemberToPool(m serf.Member) {
-	remoteAddr := fmt.Sprintf("%s:%v", m.Addr.String(), m.Tags["raft-port"])
+	b.logger.Infof("Adding Balancer to Pool: %s", m.Name)
+	if err := b.addRaftServer(m); err != nil {
+		b.logger.Errorf("node %s joined failure. err: %s", m.Name, err)
+	}
+}
+
+// addRaftServer adds a balancer to the raft configuration, as a nonvoter
+// when it was started as one. Adding a voter promotes a nonvoter.
+func (b *Balancer) addRaftServer(m serf.Member) error {
+	addr, err := raftPeerAddr(m)
+	if err != nil {
+		return err
+	}
+	return b.addRaftPeer(raft.ServerID(m.Name), raft.ServerAddress(addr), isNonvoter(m), 0)
+}
+
+// addRaftPeer adds a server to the latest raft configuration, unless it's
+// already there with the same address and suffrage.
+func (b *Balancer) addRaftPeer(id raft.ServerID, address raft.ServerAddress, nonvoter bool, timeout time.Duration) error {
+	servers, index, err := b.raftConfiguration()
+	if err != nil {
+		return err
+	}
+	for _, s := range servers {
+		if s.ID == id && s.Address == address && (s.Suffrage == raft.Nonvoter) == nonvoter {
+			return nil
+		}
+	}
+	if nonvoter {
+		return b.raft.AddNonvoter(id, address, index, timeout).Error()
+	}
+	return b.raft.AddVoter(id, address, index, timeout).Error()
+}
 
-	b.logger.Infof("Adding Balancer to Pool", remoteAddr)
-	f := b.raft.AddPeer(remoteAddr)
-	if f.Error() != nil {
-		b.logger.Errorf("node at %s joined failure. err: %s", remoteAddr, f.Error())
+// removeRaftPeer removes a server from the latest raft configuration,
+// servers already removed being ignored
+func (b *Balancer) removeRaftPeer(id raft.ServerID, timeout time.Duration) error {
+	servers, index, err := b.raftConfiguration()
+	if err != nil {
+		return err
 	}
+	for _, s := range servers {
+		if s.ID == id {
+			return b.raft.RemoveServer(id, index, timeout).Error()
+		}
+	}
+	return nil
+}
+
+// raftServers returns the servers of the latest raft configuration
+func (b *Balancer) raftServers() ([]raft.Server, error) {
+	servers, _, err := b.raftConfiguration()
+	return servers, err
+}
+
+// raftConfiguration returns the servers of the latest raft configuration
+// and its index. The membership changes are conditioned on the index, so
+// they fail instead of undoing a change made in the meantime, e.g. by the
+// autopilot of a previous leader.
+func (b *Balancer) raftConfiguration() ([]raft.Server, uint64, error) {
+	future := b.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, 0, err
+	}
+	return future.Configuration().Servers, future.Index(), nil
 }
 
 func isBalancer(m serf.Member) bool {
 	return m.Tags["role"] == "balancer"
 }
 
+// isNonvoter reports whether a balancer replicates the raft log without
+// voting
+func isNonvoter(m serf.Member) bool {
+	return m.Tags[nonvoterTag] == "true"
+}
+
 func (b *Balancer) handleMemberLeave(memberEvent serf.MemberEvent) {
 	b.logger.Infof("handleMemberLeave: %s", memberEvent)
 	for _, m := range memberEvent.Members {
 		if isBalancer(m) {
+			// Dead balancers are removed by the autopilot
+			if b.config.ManualPeers || (memberEvent.Type == serf.EventMemberFailed && b.autopilot.cleanup > 0) {
+				continue
+			}
 			b.handleBalancerLeave(m)
 		} else {
 			b.handleAgentLeave(m)
@@ -351,18 +913,11 @@ func (b *Balancer) handleBalancerLeave(m serf.Member) {
 		return
 	}
 
-	raftPort, err := strconv.Atoi(m.Tags["raft-port"])
-	if err != nil {
-		b.logger.Errorln("handle balancer leaver failed", err)
-	}
-
-	peer := &net.TCPAddr{IP: m.Addr, Port: raftPort}
-	b.logger.Infof("Removing %v peer from raft", peer)
+	b.logger.Infof("Removing %v peer from raft", m.Name)
 
-	future := b.raft.RemovePeer(peer.String())
-	if err := future.Error(); err != nil && err != raft.ErrUnknownPeer {
-		b.logger.Errorf("balancer: failed to remove raft peer '%v': %v", peer, err)
-	} else if err == nil {
+	if err := b.removeRaftPeer(raft.ServerID(m.Name), 0); err != nil {
+		b.logger.Errorf("balancer: failed to remove raft peer '%v': %v", m.Name, err)
+	} else {
 		b.logger.Infof("balancer: removed balancer '%s' as peer", m.Name)
 	}
 }
@@ -371,24 +926,28 @@ func (b *Balancer) Leave() {
 	b.logger.Info("balancer: server starting leave")
 	// s.left = true
 
-	// Check the number of known peers
-	numPeers, err := b.numOtherPeers()
+	// Check whether we are still in the raft configuration
+	member, err := b.isRaftServer()
 	if err != nil {
 		b.logger.Errorf("balancer: failed to check raft peers: %v", err)
 		return
 	}
 
-	// If we are the current leader, and we have any other peers (cluster has multiple
-	// servers), we should do a RemovePeer to safely reduce the quorum size. If we are
-	// not the leader, then we should issue our leave intention and wait to be removed
-	// for some sane period of time.
+	// If we are the current leader, and we have any other voters, we should
+	// do a RemoveServer to safely reduce the quorum size, stepping down once
+	// it's committed. If we are not the leader, then we should issue our
+	// leave intention and wait to be removed for some sane period of time.
 	isLeader := b.IsLeader()
-	// if isLeader && numPeers > 0 {
-	// 	future := b.raft.RemovePeer(b.raftTransport.LocalAddr())
-	// 	if err := future.Error(); err != nil && err != raft.ErrUnknownPeer {
-	// 		b.logger.Errorf("balancer: failed to remove ourself as raft peer: %v", err)
-	// 	}
-	// }
+	if isLeader && member && !b.config.ManualPeers {
+		voters, err := b.numOtherVoters()
+		if err != nil {
+			b.logger.Errorf("balancer: failed to check raft peers: %v", err)
+		} else if voters > 0 {
+			if err := b.removeRaftPeer(raft.ServerID(b.config.Name), 0); err != nil {
+				b.logger.Errorf("balancer: failed to remove ourself as raft peer: %v", err)
+			}
+		}
+	}
 
 	// Leave the LAN pool
 	if b.serf != nil {
@@ -399,56 +958,145 @@ func (b *Balancer) Leave() {
 
 	// If we were not leader, wait to be safely removed from the cluster.
 	// We must wait to allow the raft replication to take place, otherwise
-	// an immediate shutdown could cause a loss of quorum.
-	if !isLeader {
+	// an immediate shutdown could cause a loss of quorum. With manual peers,
+	// the removal is up to the operator.
+	if !isLeader && !b.config.ManualPeers {
 		limit := time.Now().Add(raftRemoveGracePeriod)
-		for numPeers > 0 && time.Now().Before(limit) {
-			// Update the number of peers
-			numPeers, err = b.numOtherPeers()
+		for member && time.Now().Before(limit) {
+			// Sleep a while and check again
+			time.Sleep(50 * time.Millisecond)
+
+			member, err = b.isRaftServer()
 			if err != nil {
 				b.logger.Errorf("balancer: failed to check raft peers: %v", err)
 				break
 			}
-
-			// Avoid the sleep if we are done
-			if numPeers == 0 {
-				break
-			}
-
-			// Sleep a while and check again
-			time.Sleep(50 * time.Millisecond)
 		}
-		if numPeers != 0 {
+		if member {
 			b.logger.Warnln("balancer: failed to leave raft peer set gracefully, timeout")
 		}
 	}
 }
 
-// numOtherPeers is used to check on the number of known peers
-// excluding the local node
-func (b *Balancer) numOtherPeers() (int, error) {
-	peers, err := b.raftPeers.Peers()
+// isRaftServer reports whether the local node is in the latest raft
+// configuration known to it, with the other balancers
+func (b *Balancer) isRaftServer() (bool, error) {
+	servers, err := b.raftServers()
+	if err != nil {
+		return false, err
+	}
+	local := false
+	for _, s := range servers {
+		if s.ID == raft.ServerID(b.config.Name) {
+			local = true
+		}
+	}
+	return local && len(servers) > 1, nil
+}
+
+// numOtherVoters is used to check on the number of voters excluding the
+// local node
+func (b *Balancer) numOtherVoters() (int, error) {
+	servers, err := b.raftServers()
 	if err != nil {
 		return 0, err
 	}
-	otherPeers := raft.ExcludePeer(peers, b.raftTransport.LocalAddr())
-	return len(otherPeers), nil
+	n := 0
+	for _, s := range servers {
+		if s.Suffrage == raft.Voter && s.ID != raft.ServerID(b.config.Name) {
+			n++
+		}
+	}
+	return n, nil
 }
 
+// Run joins the configured balancer pool and blocks until ctx is done or
+// the balancer is shut down, releasing all its resources before returning.
+// It's the entrypoint for programs embedding Fusis.
+func (b *Balancer) Run(ctx context.Context) error {
+	if len(b.config.Join) > 0 {
+		if err := b.JoinPool(); err != nil {
+			b.Shutdown()
+			return err
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-b.shutdownCh:
+	}
+
+	b.Shutdown()
+	return nil
+}
+
+// Shutdown leaves the cluster and stops every balancer goroutine. It's safe
+// to call it more than once.
 func (b *Balancer) Shutdown() {
-	b.Leave()
-	b.serf.Shutdown()
+	b.stop(true)
+}
 
-	future := b.raft.Shutdown()
-	if err := future.Error(); err != nil {
-		b.logger.Errorf("balancer: Error shutting down raft: %s", err)
+// Handover stops the balancer without leaving the cluster, so a new
+// process started with config.Handover can take its place during an
+// in-place upgrade. Raft peers, the IPVS table and the VIPs are kept, and
+// the other balancers only see a short failure of this node.
+func (b *Balancer) Handover() {
+	b.stop(false)
+}
+
+func (b *Balancer) stop(leave bool) {
+	b.Lock()
+	if b.shutdown {
+		b.Unlock()
+		return
 	}
+	b.shutdown = true
+	hooks := b.shutdownHooks
+	b.Unlock()
 
+	for _, fn := range hooks {
+		b.runHook("OnShutdown", func() { fn(leave) })
+	}
+
+	if leave {
+		b.Leave()
+	}
+	b.teardown(leave)
+}
+
+// teardown stops serf, raft and the balancer goroutines, releasing the
+// ports and the raft database for the next process. It only releases what
+// was set up, as it's also used when NewBalancer fails halfway. When
+// leaving, the VIPs and the raft peers are also cleared.
+func (b *Balancer) teardown(leave bool) {
+	if b.serf != nil {
+		b.serf.Shutdown()
+	}
+
+	if b.raft != nil {
+		future := b.raft.Shutdown()
+		if err := future.Error(); err != nil {
+			b.logger.Errorf("balancer: Error shutting down raft: %s", err)
+		}
+	}
+	b.proxy.Stop()
+	if leave {
+		// Other balancers can't take over the VIPs while they're still
+		// announced by this one
+		b.flushProvider()
+	}
+
+	if b.raftTransport != nil {
+		b.raftTransport.Close()
+	}
 	if b.raftStore != nil {
 		b.raftStore.Close()
 	}
 
-	b.raftPeers.SetPeers(nil)
+	// Raft is down, no more state changes will be applied, so it's safe to
+	// stop the goroutines serving it.
+	close(b.shutdownCh)
+	b.logWriter.Close()
 }
 
 func (b *Balancer) handleAgentLeave(m serf.Member) {
@@ -457,37 +1105,53 @@ func (b *Balancer) handleAgentLeave(m serf.Member) {
 		b.logger.Errorln("handleAgenteLeave failed", err)
 		return
 	}
+	// The destination may already be registered by a newer instance of
+	// the agent
+	if instance := dst.Labels[types.InstanceLabel]; instance != "" && m.Tags["instance"] != "" && instance != m.Tags["instance"] {
+		b.logger.Infof("balancer: instance %s of agent %s left, keeping the registration of instance %s", m.Tags["instance"], m.Name, instance)
+		return
+	}
 
+	if b.config.Drain.Agents && m.Status == serf.StatusLeft {
+		if err := b.DrainDestination(dst); err != nil {
+			b.logger.Errorf("balancer: error draining destination %s: %v", dst.Name, err)
+		}
+		return
+	}
 	b.DeleteDestination(dst)
 }
 
+// collectStats samples the stats of the services every stats interval until
+// the balancer shuts down. The collector keeps the engine lock free.
 func (b *Balancer) collectStats() {
-
-	interval := b.config.Stats.Interval
-
-	if interval > 0 {
-		ticker := time.NewTicker(time.Second * time.Duration(interval))
-		for tick := range ticker.C {
-			b.engine.CollectStats(tick)
-		}
-	}
+	interval := time.Second * time.Duration(b.config.Stats.Interval)
+	engine.NewStatsCollector(b.engine, interval).Run(b.shutdownCh)
 }
 
-func readPeersJSON(path string) ([]string, error) {
-	b, err := ioutil.ReadFile(path)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, err
-	}
-
-	if len(b) == 0 {
-		return nil, nil
-	}
-
-	var peers []string
-	dec := json.NewDecoder(bytes.NewReader(b))
-	if err := dec.Decode(&peers); err != nil {
-		return nil, err
+// parseRaftPeers parses the initial balancers, given as name=address. The
+// name is the server ID of the balancer, and the raft port is used for
+// addresses without a port.
+func parseRaftPeers(configured []string, defaultPort int) ([]raft.Server, error) {
+	var servers []raft.Server
+	known := make(map[string]bool, len(configured))
+	for _, p := range configured {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, expected name=address", p)
+		}
+		name, addr := parts[0], parts[1]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, strconv.Itoa(defaultPort))
+		}
+		if known[name] || known[addr] {
+			return nil, fmt.Errorf("duplicated raft peer %q", p)
+		}
+		known[name], known[addr] = true, true
+		servers = append(servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(name),
+			Address:  raft.ServerAddress(addr),
+		})
 	}
-
-	return peers, nil
+	return servers, nil
 }
@@ -0,0 +1,166 @@
+package fusis
+
+import (
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// ApplyDestinationBatch adds, removes and drains destinations of a service
+// in a single raft command, so every balancer switches between the two
+// destination sets at once. Drained destinations are taken out of rotation
+// by the command and removed once their connections are done, like
+// DrainDestination.
+func (b *Balancer) ApplyDestinationBatch(serviceId string, batch *types.DestinationBatch) error {
+	b.Lock()
+	svc, err := b.engine.State.GetService(serviceId)
+	if err != nil {
+		b.Unlock()
+		return err
+	}
+	cmdBatch, err := planBatch(b.engine.State, svc, batch)
+	if err != nil {
+		b.Unlock()
+		return err
+	}
+
+	c := &engine.Command{
+		Op:      engine.BatchDestinationsOp,
+		Service: svc,
+		Batch:   cmdBatch,
+	}
+	err = b.ApplyToRaft(c)
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i := range cmdBatch.Update {
+		b.startDrain(&cmdBatch.Update[i])
+	}
+	return nil
+}
+
+// PlanDestinationBatch validates batch like ApplyDestinationBatch, returning
+// the destinations the service would have without applying it
+func (b *Balancer) PlanDestinationBatch(serviceId string, batch *types.DestinationBatch) ([]types.Destination, error) {
+	b.Lock()
+	defer b.Unlock()
+	svc, err := b.engine.State.GetService(serviceId)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planBatch(b.engine.State, svc, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make(map[string]bool)
+	for _, dst := range plan.Remove {
+		removed[dst.GetId()] = true
+	}
+	drained := make(map[string]types.Destination)
+	for _, dst := range plan.Update {
+		drained[dst.GetId()] = dst
+	}
+	result := []types.Destination{}
+	for _, dst := range svc.Destinations {
+		if removed[dst.GetId()] {
+			continue
+		}
+		if d, ok := drained[dst.GetId()]; ok {
+			dst = d
+		}
+		result = append(result, dst)
+	}
+	return append(result, plan.Add...), nil
+}
+
+// planBatch validates the batch against the current destinations of svc
+// and turns it into the changes of the raft command. Removals are planned
+// first, so added destinations may reuse their names and addresses.
+func planBatch(state ipvs.State, svc *types.Service, batch *types.DestinationBatch) (*engine.DestinationBatch, error) {
+	if len(batch.Add)+len(batch.Remove)+len(batch.Drain) == 0 {
+		return nil, types.ErrInvalidBatch
+	}
+
+	current := make(map[string]types.Destination, len(svc.Destinations))
+	for _, dst := range svc.Destinations {
+		current[dst.GetId()] = dst
+	}
+
+	plan := &engine.DestinationBatch{}
+	taken := make(map[string]bool)
+	removed := make(map[string]bool)
+	take := func(name string) (types.Destination, error) {
+		if taken[name] {
+			return types.Destination{}, types.ErrInvalidBatch
+		}
+		dst, ok := current[name]
+		if !ok {
+			return dst, types.ErrDestinationNotFound
+		}
+		taken[name] = true
+		return dst, nil
+	}
+	for _, name := range batch.Remove {
+		dst, err := take(name)
+		if err != nil {
+			return nil, err
+		}
+		plan.Remove = append(plan.Remove, dst)
+		delete(current, name)
+		removed[name] = true
+	}
+	for _, name := range batch.Drain {
+		dst, err := take(name)
+		if err != nil {
+			return nil, err
+		}
+		dst.Weight = 0
+		dst.Version = 0
+		plan.Update = append(plan.Update, dst)
+	}
+
+	// current holds the destinations left after the removals
+	addrs := make(map[string]bool)
+	for _, dst := range current {
+		addrs[types.DestinationName("", dst.Host, dst.Port)] = true
+	}
+	added := make(map[string]bool)
+	refs := make(map[string]bool)
+	for _, dst := range batch.Add {
+		if !dst.ValidLabels() {
+			return nil, types.ErrInvalidLabels
+		}
+		if !svc.ValidDestinationMode(dst.Mode) {
+			return nil, types.ErrClientIPNotPreserved
+		}
+		dst.ServiceId = svc.GetId()
+		dst.Version = 0
+		if dst.Name == "" {
+			dst.Name = types.DestinationName(dst.ServiceId, dst.Host, dst.Port)
+		}
+
+		addr := types.DestinationName("", dst.Host, dst.Port)
+		if addrs[addr] || added[dst.GetId()] {
+			return nil, types.ErrDestinationAlreadyExists
+		}
+		if _, err := state.GetDestination(dst.GetId()); err == nil && !removed[dst.GetId()] {
+			return nil, types.ErrDestinationAlreadyExists
+		} else if err != nil && err != types.ErrDestinationNotFound {
+			return nil, err
+		}
+		if dst.ExternalId != "" {
+			other, err := state.GetDestinationByExternalId(dst.ExternalId)
+			if (err == nil && !removed[other.GetId()]) || refs[dst.ExternalId] {
+				return nil, types.ErrExternalIdInUse
+			}
+			refs[dst.ExternalId] = true
+		}
+		addrs[addr] = true
+		added[dst.GetId()] = true
+		plan.Add = append(plan.Add, dst)
+	}
+	return plan, nil
+}
@@ -0,0 +1,47 @@
+package fusis
+
+import (
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/ipvs"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestPlanBatch(c *C) {
+	state := ipvs.NewFusisState()
+	svc := &types.Service{Name: "web", Destinations: []types.Destination{
+		{Name: "v1-a", Host: "10.0.0.1", Port: 80, Weight: 1, ServiceId: "web"},
+		{Name: "v1-b", Host: "10.0.0.2", Port: 80, Weight: 1, ServiceId: "web"},
+	}}
+	state.AddService(svc)
+	for i := range svc.Destinations {
+		state.AddDestination(&svc.Destinations[i])
+	}
+	state.AddDestination(&types.Destination{Name: "other", Host: "10.0.0.9", Port: 80, ServiceId: "api"})
+
+	plan, err := planBatch(state, svc, &types.DestinationBatch{
+		Add:    []types.Destination{{Host: "10.0.0.1", Port: 80, Weight: 2}, {Host: "10.0.0.3", Port: 80}},
+		Remove: []string{"v1-a"},
+		Drain:  []string{"v1-b"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(plan.Remove, HasLen, 1)
+	c.Assert(plan.Remove[0].Name, Equals, "v1-a")
+	c.Assert(plan.Update, HasLen, 1)
+	c.Assert(plan.Update[0].Weight, Equals, int32(0))
+	c.Assert(plan.Add, HasLen, 2)
+	c.Assert(plan.Add[0].Name, Equals, "web-10.0.0.1-80")
+	c.Assert(plan.Add[0].ServiceId, Equals, "web")
+
+	_, err = planBatch(state, svc, &types.DestinationBatch{})
+	c.Assert(err, Equals, types.ErrInvalidBatch)
+	_, err = planBatch(state, svc, &types.DestinationBatch{Remove: []string{"v1-a"}, Drain: []string{"v1-a"}})
+	c.Assert(err, Equals, types.ErrInvalidBatch)
+	_, err = planBatch(state, svc, &types.DestinationBatch{Remove: []string{"other"}})
+	c.Assert(err, Equals, types.ErrDestinationNotFound)
+	_, err = planBatch(state, svc, &types.DestinationBatch{Add: []types.Destination{{Host: "10.0.0.2", Port: 80}}})
+	c.Assert(err, Equals, types.ErrDestinationAlreadyExists)
+	_, err = planBatch(state, svc, &types.DestinationBatch{Add: []types.Destination{{Name: "other", Host: "10.0.0.4", Port: 80}}})
+	c.Assert(err, Equals, types.ErrDestinationAlreadyExists)
+	_, err = planBatch(state, svc, &types.DestinationBatch{Add: []types.Destination{{Host: "10.0.0.4", Port: 80}, {Host: "10.0.0.4", Port: 80}}})
+	c.Assert(err, Equals, types.ErrDestinationAlreadyExists)
+}
@@ -0,0 +1,69 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/engine"
+)
+
+// AddCertificate makes cert reload whenever the certificates are rotated
+func (b *Balancer) AddCertificate(cert *config.Certificate) {
+	b.certLock.Lock()
+	defer b.certLock.Unlock()
+	b.certificates = append(b.certificates, cert)
+}
+
+// RotateCertificates makes every balancer reload its TLS certificates
+func (b *Balancer) RotateCertificates() error {
+	return b.ApplyToRaft(&engine.Command{Op: engine.RotateCertificatesOp})
+}
+
+// reloadCertificates reports whether any certificate changed
+func (b *Balancer) reloadCertificates() bool {
+	b.certLock.Lock()
+	certs := b.certificates
+	b.certLock.Unlock()
+
+	changed := false
+	for _, cert := range certs {
+		c, err := cert.Reload()
+		if err != nil {
+			b.logger.Errorf("balancer: error reloading TLS certificate: %v", err)
+			continue
+		}
+		changed = changed || c
+	}
+	if changed {
+		b.logger.Infof("balancer: TLS certificates reloaded")
+	}
+	return changed
+}
+
+// watchCertificates rotates the certificates once the leader's ones change
+func (b *Balancer) watchCertificates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pending := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if !b.IsLeader() {
+			continue
+		}
+		if !b.reloadCertificates() && !pending {
+			continue
+		}
+		// Retried on the next run, the leader already reloaded its own
+		pending = true
+		if err := b.RotateCertificates(); err != nil {
+			b.logger.Errorf("balancer: error rotating TLS certificates: %v", err)
+			continue
+		}
+		pending = false
+	}
+}
@@ -0,0 +1,72 @@
+package fusis
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+
+	"github.com/luizbafilho/fusis/config"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestRotateCertificates(c *C) {
+	dir := c.MkDir()
+	ca, caKey := writeCert(c, dir, "ca", nil, nil)
+	first, _ := writeCert(c, dir, "api", ca, caKey)
+	// Certificates may be secret references
+	cert, err := config.TLS{
+		CertFile: "file:" + filepath.Join(dir, "api.pem"),
+		KeyFile:  "file:" + filepath.Join(dir, "api-key.pem"),
+	}.LoadCertificate()
+	c.Assert(err, IsNil)
+	serverConfig, err := cert.ServerConfig()
+	c.Assert(err, IsNil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	presented := func() []byte {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	c.Assert(presented(), DeepEquals, first.Raw)
+
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	b.AddCertificate(cert)
+
+	second, _ := writeCert(c, dir, "api", ca, caKey)
+	c.Assert(b.RotateCertificates(), IsNil)
+	WaitForResult(func() (bool, error) {
+		return bytes.Equal(presented(), second.Raw), nil
+	}, func(err error) {
+		c.Fatalf("certificate was not reloaded")
+	})
+
+	changed, err := cert.Reload()
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, false)
+}
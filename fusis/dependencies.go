@@ -0,0 +1,125 @@
+package fusis
+
+import (
+	"sort"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// dependencyStages groups the ids of the services in the order their VIPs
+// are brought up: each stage only depends on the previous ones.
+// Dependencies on missing services are ignored, and services in a cycle,
+// which the API rejects, are brought up together in the last stage.
+func dependencyStages(services []types.Service) [][]string {
+	pending := make(map[string][]string, len(services))
+	for _, svc := range services {
+		pending[svc.GetId()] = svc.DependsOn
+	}
+
+	var stages [][]string
+	for len(pending) > 0 {
+		var stage []string
+		for id, deps := range pending {
+			ready := true
+			for _, dep := range deps {
+				if _, ok := pending[dep]; ok {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				stage = append(stage, id)
+			}
+		}
+		if len(stage) == 0 {
+			// Only cycles are left
+			for id := range pending {
+				stage = append(stage, id)
+			}
+		}
+
+		sort.Strings(stage)
+		for _, id := range stage {
+			delete(pending, id)
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// validDependencies reports whether the dependencies of svc exist and
+// don't make a cycle with the ones of the other services.
+func validDependencies(svc *types.Service, services []types.Service) bool {
+	if len(svc.DependsOn) == 0 {
+		return true
+	}
+
+	deps := make(map[string][]string, len(services)+1)
+	for _, s := range services {
+		deps[s.GetId()] = s.DependsOn
+	}
+	deps[svc.GetId()] = svc.DependsOn
+	for _, dep := range svc.DependsOn {
+		if _, ok := deps[dep]; !ok || dep == svc.GetId() {
+			return false
+		}
+	}
+
+	// Walk the dependencies of svc looking for it
+	visited := make(map[string]bool)
+	queue := append([]string{}, svc.DependsOn...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == svc.GetId() {
+			return false
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		queue = append(queue, deps[id]...)
+	}
+	return true
+}
+
+// stagedState only holds the services brought up so far
+type stagedState struct {
+	ipvs.State
+	up map[string]bool
+}
+
+func (s stagedState) GetServices() []types.Service {
+	var services []types.Service
+	for _, svc := range s.State.GetServices() {
+		if s.up[svc.GetId()] {
+			services = append(services, svc)
+		}
+	}
+	return services
+}
+
+// setVips brings up the VIPs of the services, in the order of their
+// dependencies.
+func (b *Balancer) setVips() {
+	stages := dependencyStages(b.engine.State.GetServices())
+	if len(stages) <= 1 {
+		if err := b.provider.SyncVIPs(b.engine.State); err != nil {
+			//TODO: Remove balancer from cluster when error occurs
+			b.logger.Error(err)
+		}
+	} else {
+		up := make(map[string]bool)
+		for _, stage := range stages {
+			b.logger.Infof("balancer: bringing up the VIPs of %v", stage)
+			for _, id := range stage {
+				up[id] = true
+			}
+			if err := b.provider.SyncVIPs(stagedState{State: b.engine.State, up: up}); err != nil {
+				b.logger.Error(err)
+			}
+		}
+	}
+	b.syncBandwidth()
+}
@@ -0,0 +1,43 @@
+package fusis
+
+import (
+	"github.com/luizbafilho/fusis/api/types"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestDependencyStages(c *C) {
+	services := []types.Service{
+		{Name: "app", DependsOn: []string{"db", "cache"}},
+		{Name: "db"},
+		{Name: "cache", DependsOn: []string{"db", "gone"}},
+		{Name: "web", DependsOn: []string{"app"}},
+		{Name: "static"},
+	}
+	c.Assert(dependencyStages(services), DeepEquals, [][]string{
+		{"db", "static"},
+		{"cache"},
+		{"app"},
+		{"web"},
+	})
+
+	// Cycles are brought up last
+	services = []types.Service{
+		{Name: "a", DependsOn: []string{"b"}},
+		{Name: "b", DependsOn: []string{"a"}},
+		{Name: "c"},
+	}
+	c.Assert(dependencyStages(services), DeepEquals, [][]string{{"c"}, {"a", "b"}})
+	c.Assert(dependencyStages(nil), IsNil)
+}
+
+func (s *FusisSuite) TestValidDependencies(c *C) {
+	services := []types.Service{
+		{Name: "db"},
+		{Name: "app", DependsOn: []string{"db"}},
+	}
+	c.Assert(validDependencies(&types.Service{Name: "web", DependsOn: []string{"app"}}, services), Equals, true)
+	c.Assert(validDependencies(&types.Service{Name: "web", DependsOn: []string{"unknown"}}, services), Equals, false)
+	c.Assert(validDependencies(&types.Service{Name: "web", DependsOn: []string{"web"}}, services), Equals, false)
+	// Updating db to depend on app would make a cycle
+	c.Assert(validDependencies(&types.Service{Name: "db", DependsOn: []string{"app"}}, services), Equals, false)
+}
@@ -0,0 +1,83 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/events"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// drainInterval is how often the connections of a draining destination are
+// checked
+var drainInterval = time.Second
+
+// DrainDestination takes a destination out of rotation, setting its weight
+// to 0, and removes it once its active connections fall to the drain
+// threshold or the drain timeout expires, so in-flight connections aren't
+// killed. It returns once the weight is changed, the removal happens in
+// background. The drain is cancelled if the weight is changed meanwhile.
+func (b *Balancer) DrainDestination(dst *types.Destination) error {
+	drained := *dst
+	drained.Weight = 0
+	drained.Version = 0
+	if err := b.UpdateDestination(&drained); err != nil {
+		return err
+	}
+	b.startDrain(&drained)
+	return nil
+}
+
+// startDrain waits in background for a destination already out of
+// rotation to be drained, then removes it
+func (b *Balancer) startDrain(dst *types.Destination) {
+	timeout := time.Duration(b.config.Drain.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	events.Publish(b.engine.Bus, dst.ServiceId, events.DestinationDraining, "Destination %s draining for up to %s", dst.Name, timeout)
+	go b.waitDrain(dst.GetId(), time.Now().Add(timeout))
+}
+
+func (b *Balancer) waitDrain(id string, deadline time.Time) {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		dst, err := b.GetDestination(id)
+		if err != nil {
+			// Removed meanwhile
+			return
+		}
+		if dst.Weight != 0 {
+			b.logger.Infof("balancer: drain of destination %s cancelled, its weight changed", dst.Name)
+			return
+		}
+
+		active, err := b.engine.ActiveConns(dst)
+		if err != nil {
+			b.logger.Errorf("balancer: error reading the connections of draining destination %s: %v", dst.Name, err)
+		} else if active <= b.config.Drain.Threshold {
+			b.removeDrained(dst)
+			return
+		}
+		if !time.Now().Before(deadline) {
+			b.logger.Warnf("balancer: drain of destination %s timed out with %d active connections", dst.Name, active)
+			b.removeDrained(dst)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+func (b *Balancer) removeDrained(dst *types.Destination) {
+	if err := b.DeleteDestination(dst); err != nil {
+		b.logger.Errorf("balancer: error removing drained destination %s: %v", dst.Name, err)
+	}
+}
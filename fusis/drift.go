@@ -0,0 +1,51 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/luizbafilho/fusis/events"
+)
+
+// watchIpvs checks the IPVS table for changes made by other tools, like a
+// flush with ipvsadm, every interval. Such changes are reverted right away
+// instead of lasting until the next state change.
+func (b *Balancer) watchIpvs(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		drifted, err := b.engine.Ipvs.Drifted()
+		if err != nil {
+			b.logger.Errorf("balancer: error checking the IPVS table: %v", err)
+			continue
+		}
+		if drifted {
+			b.resyncIpvs()
+		}
+	}
+}
+
+// resyncIpvs restores the IPVS table after an external change, recording it
+// in the events of every service
+func (b *Balancer) resyncIpvs() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.shutdown {
+		return
+	}
+	b.logger.Warn("balancer: IPVS table changed by another tool, syncing it again")
+	metrics.IncrCounter([]string{"fusis", "ipvs", "drift"}, 1)
+	for _, svc := range b.engine.State.GetServices() {
+		events.Publish(b.engine.Bus, svc.GetId(), events.TableDrifted, "IPVS table changed by another tool, synced again")
+	}
+	if err := b.engine.Ipvs.SyncState(b.routingState()); err != nil {
+		b.logger.Errorf("balancer: error syncing the IPVS table: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// expiryInterval is how often the leader looks for expired services
+var expiryInterval = time.Second
+
+// setExpiry computes when the service expires from its TTL. The expiration
+// time is replicated along with the service, so the timer survives leader
+// changes and restarts.
+func setExpiry(svc *types.Service) {
+	svc.ExpiresAt = nil
+	if svc.TTL > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(svc.TTL) * time.Second)
+		svc.ExpiresAt = &expiresAt
+	}
+}
+
+// watchExpiry deletes the services whose TTL is over. Only the leader
+// deletes them, using its own clock.
+func (b *Balancer) watchExpiry() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if !b.IsLeader() {
+			continue
+		}
+		now := time.Now()
+		for _, svc := range b.GetServices() {
+			if !svc.Expired(now) {
+				continue
+			}
+			b.logger.Infof("balancer: service %s expired, deleting it", svc.GetId())
+			if err := b.DeleteService(svc.GetId()); err != nil && err != types.ErrServiceNotFound {
+				b.logger.Errorf("balancer: error deleting expired service %s: %v", svc.GetId(), err)
+			}
+		}
+	}
+}
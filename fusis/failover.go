@@ -0,0 +1,138 @@
+package fusis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/api/types"
+	fusis_net "github.com/luizbafilho/fusis/net"
+	"github.com/luizbafilho/fusis/provider"
+)
+
+// failoverClock remembers when the raft leader was last lost, which is the
+// start of a failover. It's fed by a raft observer.
+type failoverClock struct {
+	sync.Mutex
+	lostAt time.Time
+}
+
+func (f *failoverClock) leaderLost(at time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	if f.lostAt.IsZero() {
+		f.lostAt = at
+	}
+}
+
+// take returns the time the leader was lost, if it was, resetting it
+func (f *failoverClock) take() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	lostAt := f.lostAt
+	f.lostAt = time.Time{}
+	return lostAt
+}
+
+// observeLeaderLoss makes raft report the loss of the leader. The filter
+// runs right after raft cleared the leader, so it reads the new one
+// reliably, and it drops every observation as there's nothing to deliver.
+func (b *Balancer) observeLeaderLoss() {
+	b.raft.RegisterObserver(raft.NewObserver(nil, false, func(o *raft.Observation) bool {
+		if _, ok := o.Data.(raft.LeaderObservation); ok && o.Raft.Leader() == "" {
+			b.failover.leaderLost(time.Now())
+		}
+		return false
+	}))
+}
+
+// takeOver brings the routing up on a new leader, timing each phase. The
+// timing is nil when no leader was lost before, e.g. on the first election
+// of a cluster.
+func (b *Balancer) takeOver() *types.FailoverTiming {
+	elected := time.Now()
+	timing := &types.FailoverTiming{LostAt: b.failover.take()}
+	if !timing.LostAt.IsZero() {
+		timing.Election = elected.Sub(timing.LostAt)
+	}
+
+	start := time.Now()
+	if err := b.Barrier(); err != nil {
+		b.logger.Errorf("balancer: error waiting for the state to be applied: %v", err)
+	}
+	timing.StateSync = time.Since(start)
+
+	b.Lock()
+	defer b.Unlock()
+
+	start = time.Now()
+	if err := b.engine.Ipvs.SyncState(b.routingState()); err != nil {
+		b.logger.Errorf("balancer: error syncing ipvs: %v", err)
+	}
+	timing.IPVS = time.Since(start)
+
+	start = time.Now()
+	b.flushVips()
+	b.setVips()
+	timing.IPAdd = time.Since(start)
+
+	start = time.Now()
+	b.announceVips()
+	timing.ARP = time.Since(start)
+
+	b.syncProxies()
+
+	if timing.LostAt.IsZero() {
+		return nil
+	}
+	timing.Total = time.Since(timing.LostAt)
+	b.logger.Infof("balancer: took over in %v (election %v, state sync %v, ipvs %v, ip add %v, arp %v)",
+		timing.Total, timing.Election, timing.StateSync, timing.IPVS, timing.IPAdd, timing.ARP)
+	measureFailover(timing)
+	return timing
+}
+
+// announceVips sends gratuitous ARPs for the VIPs brought up on the
+// interfaces of the providers. Providers announcing the VIPs elsewhere,
+// e.g. through BGP, don't need it.
+func (b *Balancer) announceVips() {
+	providers := map[string]provider.Provider{"": b.provider}
+	if m, ok := b.provider.(*provider.Multi); ok {
+		providers = m.Providers()
+	}
+	for name, p := range providers {
+		if _, ok := p.(provider.Flusher); ok {
+			continue
+		}
+		b.announceInterface(b.providerInterface(name))
+	}
+}
+
+func (b *Balancer) announceInterface(iface string) {
+	vips, err := fusis_net.GetFusisVipsIps(iface)
+	if err != nil {
+		b.logger.Errorf("balancer: error listing VIPs to announce: %v", err)
+		return
+	}
+	for _, vip := range vips {
+		if err := fusis_net.AnnounceIp(vip, iface); err != nil {
+			b.logger.Errorf("balancer: error announcing VIP %s: %v", vip, err)
+		}
+	}
+}
+
+// measureFailover emits the phases of a failover, in milliseconds
+func measureFailover(t *types.FailoverTiming) {
+	phases := map[string]time.Duration{
+		"election":   t.Election,
+		"state_sync": t.StateSync,
+		"ipvs":       t.IPVS,
+		"ip_add":     t.IPAdd,
+		"arp":        t.ARP,
+		"total":      t.Total,
+	}
+	for phase, d := range phases {
+		metrics.AddSample([]string{"fusis", "failover", phase}, float32(d)/float32(time.Millisecond))
+	}
+}
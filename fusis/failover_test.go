@@ -0,0 +1,43 @@
+package fusis
+
+import (
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestFailoverClock(c *C) {
+	var clock failoverClock
+	c.Assert(clock.take().IsZero(), Equals, true)
+
+	first := time.Now()
+	clock.leaderLost(first)
+	clock.leaderLost(first.Add(time.Second))
+	c.Assert(clock.take(), Equals, first)
+	c.Assert(clock.take().IsZero(), Equals, true)
+}
+
+func (s *FusisSuite) TestTakeOverTiming(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	// The first election of the cluster isn't a failover
+	c.Assert(b.takeOver(), IsNil)
+
+	lostAt := time.Now().Add(-time.Second)
+	b.failover.leaderLost(lostAt)
+	timing := b.takeOver()
+	c.Assert(timing, NotNil)
+	c.Assert(timing.LostAt, Equals, lostAt)
+	c.Assert(timing.Election >= time.Second, Equals, true)
+	c.Assert(timing.Total >= timing.Election+timing.StateSync+timing.IPVS+timing.IPAdd+timing.ARP, Equals, true)
+}
@@ -0,0 +1,42 @@
+package fusis
+
+import (
+	"github.com/hashicorp/raft"
+)
+
+// fastApply reports whether commands are applied straight to the local FSM
+// instead of going through the raft log. It's only honored in dev mode,
+// where the balancer is the single member of the cluster and replication
+// buys nothing.
+func (b *Balancer) fastApply() bool {
+	return b.config.DevMode && b.config.FastApply
+}
+
+// apply commits data and returns the FSM response along with the index the
+// command was applied at. In fast apply mode the command skips the raft
+// round-trip but still goes through the FSM, so versions, quarantining and
+// extensions behave exactly like in a regular cluster.
+func (b *Balancer) apply(data []byte) (interface{}, uint64, error) {
+	if !b.fastApply() {
+		f := b.raft.Apply(data, raftTimeout)
+		if err := f.Error(); err != nil {
+			return nil, 0, err
+		}
+		return f.Response(), f.Index(), nil
+	}
+
+	if b.raft.State() != raft.Leader {
+		return nil, 0, raft.ErrNotLeader
+	}
+
+	b.fastApplyLock.Lock()
+	defer b.fastApplyLock.Unlock()
+
+	l := &raft.Log{
+		Index: b.engine.LastApplied() + 1,
+		Term:  1,
+		Type:  raft.LogCommand,
+		Data:  data,
+	}
+	return b.engine.Apply(l), l.Index, nil
+}
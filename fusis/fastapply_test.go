@@ -0,0 +1,45 @@
+package fusis
+
+import (
+	"os"
+
+	"github.com/luizbafilho/fusis/api/types"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestFastApply(c *C) {
+	config := defaultConfig()
+	config.DevMode = true
+	config.FastApply = true
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	c.Assert(b.fastApply(), Equals, true)
+
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	c.Assert(s.service.Version, Not(Equals), uint64(0))
+	err = b.AddService(s.service)
+	c.Assert(err, Equals, types.ErrServiceAlreadyExists)
+	err = b.AddDestination(s.service, s.destination)
+	c.Assert(err, IsNil)
+	c.Assert(s.destination.Version > s.service.Version, Equals, true)
+	c.Assert(b.engine.LastApplied(), Equals, s.destination.Version)
+
+	dst, err := b.GetDestination(s.destination.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(dst, DeepEquals, s.destination)
+}
+
+func (s *FusisSuite) TestFastApplyIgnoredOutsideDevMode(c *C) {
+	config := defaultConfig()
+	config.FastApply = true
+	b := &Balancer{config: &config}
+	c.Assert(b.fastApply(), Equals, false)
+}
@@ -0,0 +1,102 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/events"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// healthState hides from the kernel the destinations that are out of
+// rotation, by syncing them with weight 0. IPVS keeps the established
+// connections to them but doesn't send new ones.
+type healthState struct {
+	ipvs.State
+	balancer *Balancer
+}
+
+func (s healthState) GetServices() []types.Service {
+	services := s.State.GetServices()
+	for i := range services {
+		for j := range services[i].Destinations {
+			dst := &services[i].Destinations[j]
+			if !s.balancer.health.InRotation(dst.GetId()) {
+				dst.Weight = 0
+			}
+		}
+	}
+	return services
+}
+
+func (b *Balancer) routingState() ipvs.State {
+	return healthState{State: b.engine.State, balancer: b}
+}
+
+// ReportDestinationHealth records the result of a destination health check.
+// Unhealthy and flapping destinations are taken out of rotation.
+func (b *Balancer) ReportDestinationHealth(id string, healthy bool) error {
+	b.Lock()
+	defer b.Unlock()
+
+	dst, err := b.engine.State.GetDestination(id)
+	if err != nil {
+		return err
+	}
+
+	before := b.health.Health(id)
+	changed, hold := b.health.Report(id, healthy)
+	after := b.health.Health(id)
+
+	if before.Healthy != after.Healthy {
+		events.Publish(b.engine.Bus, dst.ServiceId, events.HealthChanged, "Destination %s is %s", dst.Name, healthString(healthy))
+	}
+	if !before.Flapping && after.Flapping {
+		events.Publish(b.engine.Bus, dst.ServiceId, events.HealthChanged, "Destination %s is flapping, held out of rotation until %s", dst.Name, after.HeldUntil.Format(time.RFC3339))
+	}
+	if hold > 0 {
+		time.AfterFunc(hold, b.syncHealth)
+	}
+
+	if !changed {
+		return nil
+	}
+	b.syncProxies()
+	return b.engine.Ipvs.SyncState(b.routingState())
+}
+
+// GetDestinationHealth returns the health history of a destination, along
+// with the port it should be checked on
+func (b *Balancer) GetDestinationHealth(id string) (*types.DestinationHealth, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	dst, err := b.engine.State.GetDestination(id)
+	if err != nil {
+		return nil, err
+	}
+	health := b.health.Health(id)
+	health.CheckPort = dst.CheckPort()
+	return &health, nil
+}
+
+// syncHealth puts back in rotation the destinations whose hold expired
+func (b *Balancer) syncHealth() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.shutdown {
+		return
+	}
+	b.syncProxies()
+	if err := b.engine.Ipvs.SyncState(b.routingState()); err != nil {
+		b.logger.Errorf("balancer: error syncing destinations health: %v", err)
+	}
+}
+
+func healthString(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
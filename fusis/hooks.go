@@ -0,0 +1,61 @@
+package fusis
+
+import (
+	"github.com/luizbafilho/fusis/bus"
+)
+
+// Hooks let programs embedding Fusis run their own logic at the lifecycle
+// points of the balancer. They only see what happens after being
+// registered, e.g. IsLeader tells whether the balancer is already the
+// leader. Hooks run synchronously, so the slow ones should hand their work
+// over to their own goroutines, and their panics are logged instead of
+// crashing the balancer.
+
+// OnLeaderChange registers fn to be called when the balancer gains or loses
+// the raft leadership, once the VIPs are announced or flushed. The returned
+// function removes it.
+func (b *Balancer) OnLeaderChange(fn func(leader bool)) (remove func()) {
+	return b.engine.Bus.Subscribe(bus.LeadershipChanged{}.Topic(), func(e bus.Event) error {
+		b.runHook("OnLeaderChange", func() { fn(e.(bus.LeadershipChanged).Leader) })
+		return nil
+	})
+}
+
+// OnStateSync registers fn to be called when a change of the routing state
+// was synced to the kernel, with the raft index of the change. The returned
+// function removes it.
+func (b *Balancer) OnStateSync(fn func(index uint64)) (remove func()) {
+	return b.engine.Bus.Subscribe(bus.StateChanged{}.Topic(), func(e bus.Event) error {
+		b.runHook("OnStateSync", func() { fn(e.(bus.StateChanged).Index) })
+		return nil
+	})
+}
+
+// OnLoadShedding registers fn to be called when the leader starts or stops
+// shedding writes, with the reason it's overloaded. The returned function
+// removes it.
+func (b *Balancer) OnLoadShedding(fn func(shedding bool, reason string)) (remove func()) {
+	return b.engine.Bus.Subscribe(bus.LoadShedding{}.Topic(), func(e bus.Event) error {
+		evt := e.(bus.LoadShedding)
+		b.runHook("OnLoadShedding", func() { fn(evt.Shedding, evt.Reason) })
+		return nil
+	})
+}
+
+// OnShutdown registers fn to be called when the balancer is stopped, before
+// raft and serf are. leave is false during handovers, when the balancer
+// stops without leaving the cluster.
+func (b *Balancer) OnShutdown(fn func(leave bool)) {
+	b.Lock()
+	defer b.Unlock()
+	b.shutdownHooks = append(b.shutdownHooks, fn)
+}
+
+func (b *Balancer) runHook(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger.Errorf("balancer: %s hook panicked: %v", name, r)
+		}
+	}()
+	fn()
+}
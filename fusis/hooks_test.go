@@ -0,0 +1,51 @@
+package fusis
+
+import (
+	"os"
+
+	"github.com/luizbafilho/fusis/bus"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestHooks(c *C) {
+	config := defaultConfig()
+	config.DevMode = true
+	config.FastApply = true
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	var synced []uint64
+	b.OnStateSync(func(index uint64) {
+		synced = append(synced, index)
+	})
+	var leadership []bool
+	remove := b.OnLeaderChange(func(leader bool) {
+		leadership = append(leadership, leader)
+		panic("hooks may panic")
+	})
+	var left []bool
+	b.OnShutdown(func(leave bool) {
+		left = append(left, leave)
+	})
+
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	c.Assert(synced, DeepEquals, []uint64{s.service.Version})
+
+	err = b.engine.Bus.Publish(bus.LeadershipChanged{Leader: true})
+	c.Assert(err, IsNil)
+	remove()
+	err = b.engine.Bus.Publish(bus.LeadershipChanged{Leader: true})
+	c.Assert(err, IsNil)
+	c.Assert(leadership, DeepEquals, []bool{true})
+
+	b.Shutdown()
+	b.Shutdown()
+	c.Assert(left, DeepEquals, []bool{true})
+}
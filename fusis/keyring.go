@@ -0,0 +1,221 @@
+package fusis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/secrets"
+)
+
+// setupKeyring enables gossip encryption when an encryption key is
+// configured. The key may be a secret reference. Keys installed by previous
+// rotations are loaded from keyringFile, if any, so the node is still able to
+// talk to members that haven't switched to the configured key yet. The
+// file lists the primary key first, which is kept as the primary one, so
+// keys changed through the API survive restarts.
+func setupKeyring(conf *serf.Config, encryptKey, keyringFile string) (*memberlist.Keyring, error) {
+	if encryptKey == "" {
+		return nil, nil
+	}
+
+	configured, err := decodeEncryptKey(encryptKey)
+	if err != nil {
+		return nil, err
+	}
+
+	primary := configured
+	keys := [][]byte{configured}
+	if keyringFile != "" {
+		stored, err := readKeyringFile(keyringFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(stored) > 0 {
+			primary = stored[0]
+		}
+		keys = append(keys, stored...)
+	}
+
+	keyring, err := memberlist.NewKeyring(keys, primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	conf.MemberlistConfig.Keyring = keyring
+	conf.KeyringFile = keyringFile
+	return keyring, nil
+}
+
+func decodeEncryptKey(encryptKey string) ([]byte, error) {
+	value, err := secrets.Resolve(encryptKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return key, nil
+}
+
+func readKeyringFile(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("error reading keyring file %s: %v", path, err)
+	}
+
+	keys := make([][]byte, 0, len(encoded))
+	for _, k := range encoded {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("error reading keyring file %s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// watchKeyRotation periodically resolves the configured encryption key and,
+// when it changes, the leader rotates it on every member of the cluster,
+// balancers and agents alike, using serf key queries. Only changes are
+// rotated, so keys managed through the API aren't reverted to the
+// configured one.
+func (b *Balancer) watchKeyRotation(interval time.Duration) {
+	rotated, err := decodeEncryptKey(b.config.EncryptKey)
+	if err != nil {
+		b.logger.Errorf("balancer: error resolving gossip encryption key: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if !b.IsLeader() {
+			continue
+		}
+		key, err := decodeEncryptKey(b.config.EncryptKey)
+		if err != nil {
+			b.logger.Errorf("balancer: error resolving gossip encryption key: %v", err)
+			continue
+		}
+		if bytes.Equal(key, rotated) {
+			continue
+		}
+		if err := b.rotateKey(key); err != nil {
+			b.logger.Errorf("balancer: error rotating gossip encryption key: %v", err)
+			continue
+		}
+		rotated = key
+	}
+}
+
+// rotateKey installs key on every member and makes it the primary one.
+// Older keys are removed only once every member is using the new key,
+// otherwise the rotation is retried on the next run.
+func (b *Balancer) rotateKey(key []byte) error {
+	primary := b.keyring.GetPrimaryKey()
+	keys := b.keyring.GetKeys()
+	if string(key) == string(primary) && len(keys) == 1 {
+		return nil
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(key)
+	manager := b.serf.KeyManager()
+	if string(key) != string(primary) {
+		b.logger.Infof("balancer: rotating gossip encryption key")
+		if _, err := manager.InstallKey(encoded); err != nil {
+			return fmt.Errorf("error installing key: %v", err)
+		}
+		if _, err := manager.UseKey(encoded); err != nil {
+			return fmt.Errorf("error using key: %v", err)
+		}
+	}
+
+	for _, k := range keys {
+		if string(k) == string(key) {
+			continue
+		}
+		if _, err := manager.RemoveKey(base64.StdEncoding.EncodeToString(k)); err != nil {
+			return fmt.Errorf("error removing old key: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListKeys lists the gossip encryption keys installed across the cluster
+func (b *Balancer) ListKeys() (*types.Keyring, error) {
+	if b.keyring == nil {
+		return nil, types.ErrGossipNotEncrypted
+	}
+	rsp, err := b.serf.KeyManager().ListKeys()
+	if err != nil {
+		return nil, keyringError(rsp, err)
+	}
+	return &types.Keyring{Keys: rsp.Keys, Members: rsp.NumNodes}, nil
+}
+
+// InstallKey adds a gossip encryption key to every member, which is then
+// able to decrypt the messages encrypted with it
+func (b *Balancer) InstallKey(key string) error {
+	return b.changeKeyring(key, b.serf.KeyManager().InstallKey)
+}
+
+// UseKey makes an installed key the one every member encrypts with
+func (b *Balancer) UseKey(key string) error {
+	return b.changeKeyring(key, b.serf.KeyManager().UseKey)
+}
+
+// RemoveKey removes a gossip encryption key from every member. The primary
+// key can't be removed.
+func (b *Balancer) RemoveKey(key string) error {
+	return b.changeKeyring(key, b.serf.KeyManager().RemoveKey)
+}
+
+func (b *Balancer) changeKeyring(key string, change func(string) (*serf.KeyResponse, error)) error {
+	if b.keyring == nil {
+		return types.ErrGossipNotEncrypted
+	}
+	if !types.ValidEncryptKey(key) {
+		return types.ErrInvalidEncryptKey
+	}
+	b.logger.Infof("balancer: changing gossip keyring")
+	rsp, err := change(key)
+	return keyringError(rsp, err)
+}
+
+// keyringError adds the replies of the failed members to err, returned by
+// serf when any of them failed to change its keyring
+func keyringError(rsp *serf.KeyResponse, err error) error {
+	if err == nil || rsp == nil || len(rsp.Messages) == 0 {
+		return err
+	}
+	replies := make([]string, 0, len(rsp.Messages))
+	for member, msg := range rsp.Messages {
+		replies = append(replies, fmt.Sprintf("%s: %s", member, msg))
+	}
+	sort.Strings(replies)
+	return fmt.Errorf("%v: %s", err, strings.Join(replies, ", "))
+}
@@ -0,0 +1,86 @@
+package fusis
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/api/types"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestSetupKeyring(c *C) {
+	conf := serf.DefaultConfig()
+	keyring, err := setupKeyring(conf, "", "")
+	c.Assert(err, IsNil)
+	c.Assert(keyring, IsNil)
+	c.Assert(conf.MemberlistConfig.Keyring, IsNil)
+
+	configured := []byte("0123456789abcdef")
+	file := filepath.Join(c.MkDir(), "serf.keyring")
+	keyring, err = setupKeyring(conf, base64.StdEncoding.EncodeToString(configured), file)
+	c.Assert(err, IsNil)
+	c.Assert(conf.MemberlistConfig.Keyring, Equals, keyring)
+	c.Assert(conf.KeyringFile, Equals, file)
+	c.Assert(keyring.GetPrimaryKey(), DeepEquals, configured)
+	c.Assert(keyring.GetKeys(), HasLen, 1)
+
+	// The primary key of the keyring file was set through the API
+	primary := []byte("fedcba9876543210")
+	err = ioutil.WriteFile(file, []byte(`["`+base64.StdEncoding.EncodeToString(primary)+`"]`), 0600)
+	c.Assert(err, IsNil)
+	keyring, err = setupKeyring(conf, base64.StdEncoding.EncodeToString(configured), file)
+	c.Assert(err, IsNil)
+	c.Assert(keyring.GetPrimaryKey(), DeepEquals, primary)
+	c.Assert(keyring.GetKeys(), HasLen, 2)
+
+	_, err = setupKeyring(conf, "not base64", "")
+	c.Assert(err, ErrorMatches, "invalid encryption key: .*")
+}
+
+func (s *FusisSuite) TestManageKeyring(c *C) {
+	first := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	second := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))
+	config := defaultConfig()
+	config.EncryptKey = first
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+
+	keyring, err := b.ListKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keyring.Members, Equals, 1)
+	c.Assert(keyring.Keys, DeepEquals, map[string]int{first: 1})
+
+	c.Assert(b.InstallKey("not a key"), Equals, types.ErrInvalidEncryptKey)
+	c.Assert(b.InstallKey(second), IsNil)
+	c.Assert(b.UseKey(second), IsNil)
+	c.Assert(b.keyring.GetPrimaryKey(), DeepEquals, []byte("fedcba9876543210"))
+	err = b.RemoveKey(second)
+	c.Assert(err, ErrorMatches, "1/1 nodes reported failure: Test: .*")
+	c.Assert(b.RemoveKey(first), IsNil)
+
+	keyring, err = b.ListKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keyring.Keys, DeepEquals, map[string]int{second: 1})
+
+	// The keyring survives restarts
+	stored, err := readKeyringFile(filepath.Join(config.ConfigPath, "serf.keyring"))
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, [][]byte{[]byte("fedcba9876543210")})
+}
+
+func (s *FusisSuite) TestManageKeyringWithoutEncryption(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+
+	_, err = b.ListKeys()
+	c.Assert(err, Equals, types.ErrGossipNotEncrypted)
+	c.Assert(b.InstallKey(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))), Equals, types.ErrGossipNotEncrypted)
+}
@@ -3,11 +3,23 @@ package fusis
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
+	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/events"
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/provider"
 )
 
+// schedulerAvailable tells whether the kernel provides a scheduler, it's
+// replaced in tests
+var schedulerAvailable = ipvs.SchedulerAvailable
+
 type ErrCrashError struct {
 	original error
 }
@@ -28,6 +40,46 @@ func (b *Balancer) AddService(svc *types.Service) error {
 	b.Lock()
 	defer b.Unlock()
 
+	if svc.Id == "" {
+		svc.Id = b.GenerateServiceId(*svc)
+	}
+	if !types.ValidServiceId(svc.Id) {
+		return types.ErrInvalidServiceId
+	}
+	if externalIdInUse(b.engine.State, svc, nil) {
+		return types.ErrExternalIdInUse
+	}
+	if !svc.ValidServiceType() {
+		return types.ErrInvalidServiceType
+	}
+	if !svc.ValidDSCP() {
+		return types.ErrInvalidDSCP
+	}
+	if !svc.ValidClientIP() {
+		return types.ErrClientIPNotPreserved
+	}
+	if !svc.ValidFirewallMark() {
+		return types.ErrInvalidFirewallMark
+	}
+	if !svc.ValidPolicies() {
+		return types.ErrInvalidPolicies
+	}
+	if !svc.ValidPersistence() {
+		return types.ErrInvalidPersistence
+	}
+	if !svc.ValidSchedulerFlags() {
+		return types.ErrInvalidSchedulerFlags
+	}
+	if svc.Scheduler == types.SchedulerMaglev && !schedulerAvailable(svc.Scheduler) {
+		return types.ErrSchedulerUnavailable
+	}
+	if !validDependencies(svc, b.engine.State.GetServices()) {
+		return types.ErrInvalidDependency
+	}
+	if firewallMarkInUse(svc, b.engine.State.GetServices()) {
+		return types.ErrFirewallMarkInUse
+	}
+
 	_, err := b.engine.State.GetService(svc.GetId())
 	if err == nil {
 		return types.ErrServiceAlreadyExists
@@ -35,17 +87,66 @@ func (b *Balancer) AddService(svc *types.Service) error {
 		return err
 	}
 
-	if err = b.provider.AllocateVIP(svc, b.engine.State); err != nil {
-		return err
-	}
-
+	setExpiry(svc)
 	c := &engine.Command{
 		Op:      engine.AddServiceOp,
 		Service: svc,
 	}
 
+	p, err := b.serviceProvider(*svc)
+	if err != nil {
+		return err
+	}
+
+	r, ranged := p.(provider.RangeAllocator)
+	vipRange := ""
+	if ranged {
+		var ok bool
+		if vipRange, ok = r.VIPRange(svc.Pool); !ok {
+			return types.ErrUnknownPool
+		}
+	} else if svc.Pool != "" {
+		return types.ErrUnknownPool
+	}
+
+	// Static VIPs, e.g. kept by users migrating their services, aren't
+	// allocated
+	if svc.Host != "" {
+		if net.ParseIP(svc.Host) == nil || ranged && !r.ValidVIP(svc.Host, svc.Pool) {
+			return types.ErrInvalidVIP
+		}
+		if vipInUse(svc, b.engine.State.GetServices()) {
+			return types.ErrVIPInUse
+		}
+		return b.ApplyToRaft(c)
+	}
+
+	if !validPersistence(*svc, vipRange) {
+		return types.ErrInvalidPersistence
+	}
+
+	// The FSM allocates the VIP, unless some balancer predates it
+	if ranged {
+		c.Op, c.VIPRange = engine.AllocateServiceOp, vipRange
+		if b.checkProtocol(c) != nil {
+			c.Op, c.VIPRange = engine.AddServiceOp, ""
+		}
+	}
+	if c.Op == engine.AllocateServiceOp {
+		return b.ApplyToRaft(c)
+	}
+
+	if err = p.AllocateVIP(svc, b.engine.State); err != nil {
+		return err
+	}
+	if !svc.ValidPersistence() {
+		if e := p.ReleaseVIP(*svc); e != nil {
+			return e
+		}
+		return types.ErrInvalidPersistence
+	}
 	if err = b.ApplyToRaft(c); err != nil {
-		if e := b.provider.ReleaseVIP(*svc); e != nil {
+		if e := p.ReleaseVIP(*svc); e != nil {
 			return e
 		}
 		return err
@@ -54,6 +155,232 @@ func (b *Balancer) AddService(svc *types.Service) error {
 	return nil
 }
 
+// validPersistence checks the persistence netmask of a service yet to be
+// allocated against the family of its VIP range
+func validPersistence(svc types.Service, vipRange string) bool {
+	if ip, _, err := net.ParseCIDR(vipRange); err == nil {
+		svc.Host = ip.String()
+	}
+	return svc.ValidPersistence()
+}
+
+// serviceProvider returns the provider handling the VIP of svc
+func (b *Balancer) serviceProvider(svc types.Service) (provider.Provider, error) {
+	if m, ok := b.provider.(*provider.Multi); ok {
+		return m.Select(svc)
+	}
+	if svc.Provider != "" {
+		return nil, types.ErrUnknownProvider
+	}
+	return b.provider, nil
+}
+
+// GenerateServiceId returns the ID of a service created without one, using
+// the generator set in the config
+func (b *Balancer) GenerateServiceId(svc types.Service) string {
+	if b.serviceIds == nil {
+		return types.ServiceId(svc.Name)
+	}
+	return b.serviceIds(svc)
+}
+
+// externalIdInUse reports whether the external ID of svc, or of dst if not
+// nil, references another service or destination.
+func externalIdInUse(state ipvs.State, svc *types.Service, dst *types.Destination) bool {
+	if dst != nil {
+		if dst.ExternalId == "" {
+			return false
+		}
+		other, err := state.GetDestinationByExternalId(dst.ExternalId)
+		return err == nil && other.GetId() != dst.GetId()
+	}
+	if svc.ExternalId == "" {
+		return false
+	}
+	other, err := state.GetServiceByExternalId(svc.ExternalId)
+	return err == nil && other.GetId() != svc.GetId()
+}
+
+// firewallMarkInUse reports whether another service is balanced by a mark
+// of svc, its own or the one of a policy, as IPVS identifies fwmark services
+// by their mark alone.
+func firewallMarkInUse(svc *types.Service, services []types.Service) bool {
+	marks := make(map[uint32]bool)
+	for _, mark := range svc.FirewallMarks() {
+		marks[mark] = true
+	}
+	if len(marks) == 0 {
+		return false
+	}
+	for _, s := range services {
+		if s.GetId() == svc.GetId() {
+			continue
+		}
+		for _, mark := range s.FirewallMarks() {
+			if marks[mark] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// vipInUse tells whether the VIP of svc is used by another service
+func vipInUse(svc *types.Service, services []types.Service) bool {
+	for _, s := range services {
+		if s.GetId() != svc.GetId() && s.Host == svc.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateService replaces the attributes of an existing service. The VIP and
+// destinations are kept. If svc.Version is set, it must match the current
+// version of the service, otherwise ErrServiceVersionMismatch is returned.
+func (b *Balancer) UpdateService(svc *types.Service) error {
+	b.Lock()
+	defer b.Unlock()
+
+	current, err := b.engine.State.GetService(svc.GetId())
+	if err != nil {
+		return err
+	}
+
+	if svc.Version != 0 && svc.Version != current.Version {
+		return types.ErrServiceVersionMismatch
+	}
+	if !svc.ValidServiceType() {
+		return types.ErrInvalidServiceType
+	}
+	if !svc.ValidDSCP() {
+		return types.ErrInvalidDSCP
+	}
+	if !svc.ValidClientIP() {
+		return types.ErrClientIPNotPreserved
+	}
+	if !svc.ValidFirewallMark() {
+		return types.ErrInvalidFirewallMark
+	}
+	if !svc.ValidPolicies() {
+		return types.ErrInvalidPolicies
+	}
+	if !svc.ValidSchedulerFlags() {
+		return types.ErrInvalidSchedulerFlags
+	}
+	if svc.Scheduler == types.SchedulerMaglev && !schedulerAvailable(svc.Scheduler) {
+		return types.ErrSchedulerUnavailable
+	}
+
+	svc.Id = current.GetId()
+	if !validDependencies(svc, b.engine.State.GetServices()) {
+		return types.ErrInvalidDependency
+	}
+	if externalIdInUse(b.engine.State, svc, nil) {
+		return types.ErrExternalIdInUse
+	}
+	if firewallMarkInUse(svc, b.engine.State.GetServices()) {
+		return types.ErrFirewallMarkInUse
+	}
+	if svc.Name == "" {
+		svc.Name = current.Name
+	}
+	svc.Host = current.Host
+	svc.Pool = current.Pool
+	svc.Provider = current.Provider
+	if !svc.ValidPersistence() {
+		return types.ErrInvalidPersistence
+	}
+	svc.Destinations = []types.Destination{}
+	setExpiry(svc)
+
+	c := &engine.Command{
+		Op:      engine.UpdateServiceOp,
+		Service: svc,
+	}
+
+	return b.ApplyToRaft(c)
+}
+
+// RenameService changes the display name of a service. Its ID, VIP and
+// destinations are kept.
+func (b *Balancer) RenameService(id, name string) (*types.Service, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	current, err := b.engine.State.GetService(id)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := *current
+	svc.Id = current.GetId()
+	svc.Name = name
+	svc.Destinations = []types.Destination{}
+
+	c := &engine.Command{
+		Op:      engine.UpdateServiceOp,
+		Service: &svc,
+	}
+
+	if err := b.ApplyToRaft(c); err != nil {
+		return nil, err
+	}
+	return b.engine.State.GetService(id)
+}
+
+// GetSyncStatus returns the kernel sync status of a service
+func (b *Balancer) GetSyncStatus(id string) (*types.SyncStatus, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.engine.SyncStatus(id)
+}
+
+// WatchState notifies the changes of the routing state on the returned
+// channel until cancel is called. Notifications are coalesced, so slow
+// watchers only miss intermediate states.
+func (b *Balancer) WatchState() (changes <-chan struct{}, cancel func()) {
+	ch := make(chan struct{}, 1)
+	cancel = b.engine.Bus.Subscribe(bus.StateChanged{}.Topic(), func(bus.Event) error {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	return ch, cancel
+}
+
+// GetServiceEvents returns the recent lifecycle events of a service
+func (b *Balancer) GetServiceEvents(id string) ([]types.Event, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, err := b.engine.State.GetService(id); err != nil {
+		return nil, err
+	}
+	return b.engine.Events.Events(id), nil
+}
+
+// GetQuarantined returns the raft log entries this balancer was unable to
+// apply
+func (b *Balancer) GetQuarantined() []types.QuarantinedEntry {
+	return b.engine.Quarantined()
+}
+
+// GetServiceByExternalId returns the service with the external id ref
+func (b *Balancer) GetServiceByExternalId(ref string) (*types.Service, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.engine.State.GetServiceByExternalId(ref)
+}
+
+// GetDestinationByExternalId returns the destination with the external id ref
+func (b *Balancer) GetDestinationByExternalId(ref string) (*types.Destination, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.engine.State.GetDestinationByExternalId(ref)
+}
+
 //GetService get a service
 func (b *Balancer) GetService(name string) (*types.Service, error) {
 	b.Lock()
@@ -85,6 +412,13 @@ func (b *Balancer) GetDestination(name string) (*types.Destination, error) {
 }
 
 func (b *Balancer) AddDestination(svc *types.Service, dst *types.Destination) error {
+	// The connection is opened before locking, not to hold the other
+	// operations back
+	unreachable := b.checkDestination(svc, dst)
+	if unreachable != nil && b.config.DestinationCheck.Mode == config.DestinationCheckReject {
+		return *unreachable
+	}
+
 	b.Lock()
 	defer b.Unlock()
 
@@ -93,17 +427,28 @@ func (b *Balancer) AddDestination(svc *types.Service, dst *types.Destination) er
 		return err
 	}
 
+	if !dst.ValidLabels() {
+		return types.ErrInvalidLabels
+	}
+	if !stateSvc.ValidDestinationMode(dst.Mode) {
+		return types.ErrClientIPNotPreserved
+	}
+	dst.ServiceId = stateSvc.GetId()
+	if _, ok := stateSvc.FindDestination(dst.Host, dst.Port); ok {
+		return types.ErrDestinationAlreadyExists
+	}
+
+	if dst.Name == "" {
+		dst.Name = types.DestinationName(dst.ServiceId, dst.Host, dst.Port)
+	}
 	_, err = b.engine.State.GetDestination(dst.GetId())
 	if err == nil {
 		return types.ErrDestinationAlreadyExists
 	} else if err != types.ErrDestinationNotFound {
 		return err
 	}
-
-	for _, existDst := range stateSvc.Destinations {
-		if existDst.Host == dst.Host && existDst.Port == dst.Port {
-			return types.ErrDestinationAlreadyExists
-		}
+	if externalIdInUse(b.engine.State, stateSvc, dst) {
+		return types.ErrExternalIdInUse
 	}
 
 	c := &engine.Command{
@@ -112,6 +457,85 @@ func (b *Balancer) AddDestination(svc *types.Service, dst *types.Destination) er
 		Destination: dst,
 	}
 
+	if err := b.ApplyToRaft(c); err != nil {
+		return err
+	}
+	if unreachable != nil {
+		b.logger.Warnf("balancer: destination %s added though unreachable: %v", dst.GetId(), unreachable)
+		events.Publish(b.engine.Bus, dst.ServiceId, events.DestinationUnreachable, "Destination %s added though unreachable: %s", dst.Name, unreachable.Err)
+	}
+	return nil
+}
+
+// checkDestination connects to a destination about to be added, on its
+// check port, catching mistyped addresses before they're committed. It
+// returns nil when the destination is reachable or isn't checked, like the
+// ones of UDP services. See config.DestinationCheck.
+func (b *Balancer) checkDestination(svc *types.Service, dst *types.Destination) *types.ErrDestinationUnreachable {
+	conf := b.config.DestinationCheck
+	if conf.Mode == "" {
+		return nil
+	}
+	// Unknown services are reported once locked
+	stateSvc, err := b.engine.State.GetService(svc.GetId())
+	if err != nil || stateSvc.Protocol == "udp" {
+		return nil
+	}
+
+	timeout := time.Duration(conf.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	addr := net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.CheckPort())))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return &types.ErrDestinationUnreachable{Addr: addr, Err: err.Error()}
+	}
+	conn.Close()
+	return nil
+}
+
+// UpdateDestination changes the weight, forwarding mode and labels of a
+// destination in place, keeping its connections. The mode is kept when empty. If
+// dst.Version is set, the update is rejected with
+// ErrDestinationVersionMismatch when the destination was modified since.
+func (b *Balancer) UpdateDestination(dst *types.Destination) error {
+	b.Lock()
+	defer b.Unlock()
+
+	current, err := b.engine.State.GetDestination(dst.GetId())
+	if err != nil {
+		return err
+	}
+	if dst.Version != 0 && dst.Version != current.Version {
+		return types.ErrDestinationVersionMismatch
+	}
+	if !dst.ValidLabels() {
+		return types.ErrInvalidLabels
+	}
+	svc, err := b.engine.State.GetService(current.ServiceId)
+	if err != nil {
+		return err
+	}
+
+	dst.Name = current.Name
+	dst.Host = current.Host
+	dst.Port = current.Port
+	dst.ServiceId = current.ServiceId
+	dst.ExternalId = current.ExternalId
+	if dst.Mode == "" {
+		dst.Mode = current.Mode
+	}
+	if !svc.ValidDestinationMode(dst.Mode) {
+		return types.ErrClientIPNotPreserved
+	}
+
+	c := &engine.Command{
+		Op:          engine.UpdateDestinationOp,
+		Service:     svc,
+		Destination: dst,
+	}
+
 	return b.ApplyToRaft(c)
 }
 
@@ -137,18 +561,63 @@ func (b *Balancer) DeleteDestination(dst *types.Destination) error {
 	return b.ApplyToRaft(c)
 }
 
+// ApplyExtension replicates data to the named FSM extension and returns the
+// value returned by the extension Apply method.
+func (b *Balancer) ApplyExtension(name string, data []byte) (interface{}, error) {
+	c := &engine.Command{
+		Op:        engine.ExtensionOp,
+		Extension: name,
+		Data:      data,
+	}
+	c.Version = c.RequiredProtocol()
+	if err := b.checkProtocol(c); err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	rsp, _, err := b.apply(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
 func (b *Balancer) ApplyToRaft(cmd *engine.Command) error {
+	cmd.Version = cmd.RequiredProtocol()
+	if err := b.checkProtocol(cmd); err != nil {
+		return err
+	}
 	bytes, err := json.Marshal(cmd)
 	if err != nil {
 		return err
 	}
-	f := b.raft.Apply(bytes, raftTimeout)
-	if err = f.Error(); err != nil {
+	start := time.Now()
+	rsp, index, err := b.apply(bytes)
+	if err != nil {
+		return err
+	}
+	b.shedder.observe(time.Since(start))
+	if err, ok := rsp.(engine.ErrQuarantined); ok {
 		return err
 	}
-	rsp := f.Response()
 	if err, ok := rsp.(error); ok {
 		return ErrCrashError{original: err}
 	}
+
+	// Reflect the version assigned by the FSM back to the caller
+	switch cmd.Op {
+	case engine.AddServiceOp, engine.UpdateServiceOp:
+		cmd.Service.Version = index
+	case engine.AllocateServiceOp:
+		cmd.Service.Version = index
+		if svc, err := b.engine.State.GetService(cmd.Service.GetId()); err == nil {
+			cmd.Service.Host = svc.Host
+		}
+	case engine.AddDestinationOp, engine.UpdateDestinationOp:
+		cmd.Destination.Version = index
+	}
 	return nil
 }
@@ -3,14 +3,21 @@ package fusis
 import (
 	"fmt"
 	"io/ioutil"
+	gonet "net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
 	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/events"
 	"github.com/luizbafilho/fusis/net"
 	. "gopkg.in/check.v1"
 )
@@ -38,7 +45,7 @@ func (s *FusisSuite) SetUpSuite(c *C) {
 	// logrus.SetOutput(ioutil.Discard)
 	s.service = &types.Service{
 		Name:         "test",
-		Host:         "10.0.1.1",
+		Host:         "192.168.0.10",
 		Port:         80,
 		Scheduler:    "lc",
 		Protocol:     "tcp",
@@ -127,6 +134,247 @@ func (s *FusisSuite) TestAddService(c *C) {
 	c.Assert(err, Equals, types.ErrServiceAlreadyExists)
 }
 
+func (s *FusisSuite) TestAddServiceAllocatesVIP(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	first := &types.Service{Name: "first", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(first), IsNil)
+	second := &types.Service{Name: "second", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(second), IsNil)
+	c.Assert(first.Host, Equals, "192.168.0.1")
+	c.Assert(second.Host, Equals, "192.168.0.2")
+
+	srv, err := b.GetService("second")
+	c.Assert(err, IsNil)
+	c.Assert(srv.Host, Equals, second.Host)
+}
+
+func (s *FusisSuite) TestAddServiceStaticVIP(c *C) {
+	config := defaultConfig()
+	config.Provider.Pools = map[string]string{"public": "10.10.0.0/29"}
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	static := &types.Service{Name: "static", Host: "192.168.0.7", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(static), IsNil)
+	srv, err := b.GetService("static")
+	c.Assert(err, IsNil)
+	c.Assert(srv.Host, Equals, "192.168.0.7")
+
+	// Any pool is allowed unless the service picks one
+	public := &types.Service{Name: "public", Host: "10.10.0.5", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(public), IsNil)
+
+	invalid := []*types.Service{
+		{Name: "outside", Host: "172.16.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr"},
+		{Name: "other-pool", Host: "192.168.0.8", Port: 80, Protocol: "tcp", Scheduler: "rr", Pool: "public"},
+		{Name: "garbage", Host: "vip", Port: 80, Protocol: "tcp", Scheduler: "rr"},
+	}
+	for _, svc := range invalid {
+		c.Check(b.AddService(svc), Equals, types.ErrInvalidVIP, Commentf(svc.Name))
+	}
+	used := &types.Service{Name: "used", Host: "192.168.0.7", Port: 443, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(used), Equals, types.ErrVIPInUse)
+
+	// Allocations skip the static VIPs
+	allocated := &types.Service{Name: "allocated", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(allocated), IsNil)
+	c.Assert(allocated.Host, Equals, "192.168.0.1")
+}
+
+func (s *FusisSuite) TestAddServiceFromPool(c *C) {
+	config := defaultConfig()
+	config.Provider.Pools = map[string]string{"public": "10.10.0.0/29"}
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	public := &types.Service{Name: "public", Port: 80, Protocol: "tcp", Scheduler: "rr", Pool: "public"}
+	c.Assert(b.AddService(public), IsNil)
+	c.Assert(public.Host, Equals, "10.10.0.1")
+	internal := &types.Service{Name: "internal", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(internal), IsNil)
+	c.Assert(internal.Host, Equals, "192.168.0.1")
+
+	unknown := &types.Service{Name: "unknown", Port: 80, Protocol: "tcp", Scheduler: "rr", Pool: "unknown"}
+	c.Assert(b.AddService(unknown), Equals, types.ErrUnknownPool)
+
+	// Updates keep the pool along with the VIP
+	update := &types.Service{Name: "public", Port: 80, Protocol: "tcp", Scheduler: "wrr"}
+	c.Assert(b.UpdateService(update), IsNil)
+	srv, err := b.GetService("public")
+	c.Assert(err, IsNil)
+	c.Assert(srv.Pool, Equals, "public")
+	c.Assert(srv.Host, Equals, "10.10.0.1")
+}
+
+func (s *FusisSuite) TestAddServiceWithProvider(c *C) {
+	conf := defaultConfig()
+	conf.Providers = map[string]config.Provider{
+		"public": {Type: "none", Params: map[string]string{"interface": "lo", "vipRange": "10.10.0.0/29"}},
+	}
+	b, err := NewBalancer(&conf)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(conf.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	public := &types.Service{Name: "public", Port: 80, Protocol: "tcp", Scheduler: "rr", Provider: "public"}
+	c.Assert(b.AddService(public), IsNil)
+	c.Assert(public.Host, Equals, "10.10.0.1")
+	internal := &types.Service{Name: "internal", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(internal), IsNil)
+	c.Assert(internal.Host, Equals, "192.168.0.1")
+
+	unknown := &types.Service{Name: "unknown", Port: 80, Protocol: "tcp", Scheduler: "rr", Provider: "unknown"}
+	c.Assert(b.AddService(unknown), Equals, types.ErrUnknownProvider)
+}
+
+func (s *FusisSuite) TestUpdateServiceInPlace(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	svc := &types.Service{Name: "web", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(svc), IsNil)
+	dst := &types.Destination{Name: "web-1", Host: "192.168.1.1", Port: 8080, Mode: "nat", Weight: 1}
+	c.Assert(b.AddDestination(svc, dst), IsNil)
+
+	update := &types.Service{Name: "web", Port: 8000, Protocol: "tcp", Scheduler: "wlc", PersistenceTimeout: 300, Version: svc.Version}
+	c.Assert(b.UpdateService(update), IsNil)
+
+	srv, err := b.GetService("web")
+	c.Assert(err, IsNil)
+	c.Assert(srv.Host, Equals, svc.Host)
+	c.Assert(srv.Port, Equals, uint16(8000))
+	c.Assert(srv.Scheduler, Equals, "wlc")
+	c.Assert(srv.PersistenceTimeout, Equals, uint32(300))
+	c.Assert(srv.Destinations, HasLen, 1)
+	c.Assert(srv.Version > svc.Version, Equals, true)
+}
+
+func (s *FusisSuite) TestServicePersistenceIPv6(c *C) {
+	config := defaultConfig()
+	config.Provider.Pools = map[string]string{"v6": "2001:db8::/124"}
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	// The netmask is checked against the family of the allocated VIP
+	svc := &types.Service{Name: "web6", Port: 80, Protocol: "tcp", Scheduler: "rr", Pool: "v6", PersistenceTimeout: 300, PersistenceNetmask: 64}
+	c.Assert(b.AddService(svc), IsNil)
+	c.Assert(svc.Host, Equals, "2001:db8::1")
+	web4 := &types.Service{Name: "web4", Port: 80, Protocol: "tcp", Scheduler: "rr", PersistenceTimeout: 300, PersistenceNetmask: 64}
+	c.Assert(b.AddService(web4), Equals, types.ErrInvalidPersistence)
+
+	// and against the current VIP on updates
+	update := &types.Service{Name: "web6", Port: 80, Protocol: "tcp", Scheduler: "rr", PersistenceTimeout: 300, PersistenceNetmask: 96}
+	c.Assert(b.UpdateService(update), IsNil)
+	srv, err := b.GetService("web6")
+	c.Assert(err, IsNil)
+	c.Assert(srv.PersistenceNetmask, Equals, uint8(96))
+
+	web4.PersistenceNetmask = 24
+	c.Assert(b.AddService(web4), IsNil)
+	update = &types.Service{Name: "web4", Port: 80, Protocol: "tcp", Scheduler: "rr", PersistenceTimeout: 300, PersistenceNetmask: 64}
+	c.Assert(b.UpdateService(update), Equals, types.ErrInvalidPersistence)
+}
+
+func (s *FusisSuite) TestServiceExpiry(c *C) {
+	defer func(interval time.Duration) { expiryInterval = interval }(expiryInterval)
+	expiryInterval = 50 * time.Millisecond
+
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	svc := &types.Service{Name: "ephemeral", Port: 80, Protocol: "tcp", Scheduler: "rr", TTL: 1}
+	err = b.AddService(svc)
+	c.Assert(err, IsNil)
+	srv, err := b.GetService("ephemeral")
+	c.Assert(err, IsNil)
+	c.Assert(srv.ExpiresAt, NotNil)
+	c.Assert(srv.Expired(time.Now()), Equals, false)
+
+	WaitForResult(func() (bool, error) {
+		_, err := b.GetService("ephemeral")
+		return err == types.ErrServiceNotFound, err
+	}, func(err error) {
+		c.Fatalf("service did not expire: %v", err)
+	})
+}
+
+func (s *FusisSuite) TestRenameService(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	err = b.AddDestination(s.service, s.destination)
+	c.Assert(err, IsNil)
+	srv, err := b.RenameService(s.service.GetId(), "renamed")
+	c.Assert(err, IsNil)
+	c.Assert(srv.Id, Equals, s.service.GetId())
+	c.Assert(srv.Name, Equals, "renamed")
+	c.Assert(srv.Host, Equals, s.service.Host)
+	c.Assert(srv.Destinations, HasLen, 1)
+	_, err = b.RenameService("unknown", "renamed")
+	c.Assert(err, Equals, types.ErrServiceNotFound)
+}
+
 func (s *FusisSuite) TestAddServiceConcurrent(c *C) {
 	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(10))
 	config := defaultConfig()
@@ -262,6 +510,154 @@ func (s *FusisSuite) TestAddDestination(c *C) {
 	c.Assert(dst, DeepEquals, s.destination)
 }
 
+func (s *FusisSuite) TestUpdateDestination(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	err = b.UpdateDestination(&types.Destination{Name: s.destination.GetId(), Weight: 5})
+	c.Assert(err, Equals, types.ErrDestinationNotFound)
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	err = b.AddDestination(s.service, s.destination)
+	c.Assert(err, IsNil)
+
+	err = b.UpdateDestination(&types.Destination{Name: s.destination.GetId(), Weight: 5, Version: s.destination.Version + 1})
+	c.Assert(err, Equals, types.ErrDestinationVersionMismatch)
+
+	update := &types.Destination{Name: s.destination.GetId(), Host: "10.0.0.99", Weight: 5, Version: s.destination.Version}
+	err = b.UpdateDestination(update)
+	c.Assert(err, IsNil)
+	c.Assert(update.Version > s.destination.Version, Equals, true)
+	dst, err := b.GetDestination(s.destination.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(dst.Weight, Equals, int32(5))
+	c.Assert(dst.Host, Equals, s.destination.Host)
+	c.Assert(dst.Mode, Equals, s.destination.Mode)
+	c.Assert(dst.Version, Equals, update.Version)
+}
+
+func (s *FusisSuite) TestDrainDestination(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	err = b.AddDestination(s.service, s.destination)
+	c.Assert(err, IsNil)
+
+	err = b.DrainDestination(s.destination)
+	c.Assert(err, IsNil)
+	// There are no connections to wait for
+	WaitForResult(func() (bool, error) {
+		_, err := b.GetDestination(s.destination.GetId())
+		return err == types.ErrDestinationNotFound, err
+	}, func(err error) {
+		c.Fatalf("drained destination not removed: %v", err)
+	})
+	evts, err := b.GetServiceEvents(s.service.GetId())
+	c.Assert(err, IsNil)
+	var kinds []string
+	for _, e := range evts {
+		kinds = append(kinds, e.Type)
+	}
+	c.Assert(kinds, DeepEquals, []string{events.ServiceCreated, events.VIPAllocated, events.DestinationAdded, events.DestinationUpdated, events.DestinationDraining, events.DestinationRemoved})
+}
+
+func (s *FusisSuite) TestAddDestinationCheck(c *C) {
+	l, err := gonet.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// A port just released refuses connections
+	closed, err := gonet.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	closed.Close()
+
+	config := defaultConfig()
+	config.DestinationCheck.Mode = "reject"
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	svc := &types.Service{Name: "checked", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+	c.Assert(b.AddService(svc), IsNil)
+
+	up := &types.Destination{Name: "up", Host: "127.0.0.1", Port: uint16(l.Addr().(*gonet.TCPAddr).Port), Mode: "nat"}
+	c.Assert(b.AddDestination(svc, up), IsNil)
+	down := &types.Destination{Name: "down", Host: "127.0.0.1", Port: uint16(closed.Addr().(*gonet.TCPAddr).Port), Mode: "nat"}
+	err = b.AddDestination(svc, down)
+	c.Assert(err, FitsTypeOf, types.ErrDestinationUnreachable{})
+	_, err = b.GetDestination(down.GetId())
+	c.Assert(err, Equals, types.ErrDestinationNotFound)
+
+	b.config.DestinationCheck.Mode = "warn"
+	c.Assert(b.AddDestination(svc, down), IsNil)
+	evts, err := b.GetServiceEvents(svc.GetId())
+	c.Assert(err, IsNil)
+	warned := false
+	for _, e := range evts {
+		warned = warned || e.Type == events.DestinationUnreachable
+	}
+	c.Assert(warned, Equals, true)
+}
+
+func (s *FusisSuite) TestInvalidDestinationCheckMode(c *C) {
+	config := defaultConfig()
+	config.DestinationCheck.Mode = "fail"
+	defer os.RemoveAll(config.ConfigPath)
+	_, err := NewBalancer(&config)
+	c.Assert(err, ErrorMatches, "invalid destination check mode.*")
+}
+
+func (s *FusisSuite) TestAddDestinationGeneratedName(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	dst := &types.Destination{Host: "192.168.1.2", Port: 80, Mode: "nat", Weight: 1}
+	err = b.AddDestination(s.service, dst)
+	c.Assert(err, IsNil)
+	c.Assert(dst.Name, Equals, "test-192.168.1.2-80")
+	c.Assert(dst.ServiceId, Equals, s.service.GetId())
+	_, err = b.GetDestination(dst.Name)
+	c.Assert(err, IsNil)
+}
+
 func (s *FusisSuite) TestDeleteDestination(c *C) {
 	config := defaultConfig()
 	b, err := NewBalancer(&config)
@@ -419,8 +815,8 @@ func (s *FusisSuite) TestJoinPoolLeave(c *C) {
 
 	// Check the members
 	WaitForResult(func() (bool, error) {
-		peers, _ := b.raftPeers.Peers()
-		return len(peers) == 2, nil
+		servers, _ := b.raftServers()
+		return len(servers) == 2, nil
 	}, func(err error) {
 		c.Fatalf("balancer could not join the raft cluster")
 	})
@@ -429,13 +825,107 @@ func (s *FusisSuite) TestJoinPoolLeave(c *C) {
 	s2.Leave()
 
 	WaitForResult(func() (bool, error) {
-		peers, _ := b.raftPeers.Peers()
-		return len(peers) == 1, nil
+		servers, _ := b.raftServers()
+		return len(servers) == 1, nil
 	}, func(err error) {
 		c.Fatalf("balancer could not leave the raft cluster")
 	})
 }
 
+func (s *FusisSuite) TestJoinPoolLeaderLeave(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	join, err := config.GetIpByInterface()
+	c.Assert(err, IsNil)
+	config2 := defaultConfig()
+	config2.Name = "test2"
+	config2.Ports["raft"] = getPort()
+	config2.Ports["serf"] = getPort()
+	config2.Join = []string{fmt.Sprintf("%v:%v", join, config.Ports["serf"])}
+	config2.Bootstrap = false
+	s2, err := NewBalancer(&config2)
+	c.Assert(err, IsNil)
+	defer s2.Shutdown()
+	defer os.RemoveAll(config2.ConfigPath)
+	c.Assert(s2.JoinPool(), IsNil)
+	WaitForResult(func() (bool, error) {
+		servers, _ := b.raftServers()
+		return len(servers) == 2, nil
+	}, func(err error) {
+		c.Fatalf("balancer could not join the raft cluster")
+	})
+
+	// Adding a server already there doesn't change the configuration
+	_, index, err := b.raftConfiguration()
+	c.Assert(err, IsNil)
+	m, ok := b.balancerMember("test2")
+	c.Assert(ok, Equals, true)
+	c.Assert(b.addRaftServer(m), IsNil)
+	_, after, err := b.raftConfiguration()
+	c.Assert(err, IsNil)
+	c.Assert(after, Equals, index)
+
+	// The leader removes itself, so the remaining balancer keeps a quorum
+	b.Leave()
+	WaitForResult(func() (bool, error) {
+		servers, _ := s2.raftServers()
+		return len(servers) == 1 && servers[0].ID == "test2" && s2.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("leader could not leave the raft cluster")
+	})
+}
+
+func (s *FusisSuite) TestJoinPoolNonvoter(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	join, err := config.GetIpByInterface()
+	c.Assert(err, IsNil)
+	config2 := defaultConfig()
+	config2.Name = "test2"
+	config2.Join = []string{fmt.Sprintf("%v:%v", join, config.Ports["serf"])}
+	config2.NonVoter = true
+	defer os.RemoveAll(config2.ConfigPath)
+
+	// Nonvoters don't take part in the quorum the cluster is bootstrapped
+	// with
+	_, err = NewBalancer(&config2)
+	c.Assert(err, ErrorMatches, ".*a nonvoter can't bootstrap the cluster")
+
+	config2.Bootstrap = false
+	s2, err := NewBalancer(&config2)
+	c.Assert(err, IsNil)
+	defer s2.Shutdown()
+	c.Assert(s2.JoinPool(), IsNil)
+
+	WaitForResult(func() (bool, error) {
+		servers, _ := b.raftServers()
+		return len(servers) == 2 && servers[1].Suffrage == raft.Nonvoter, nil
+	}, func(err error) {
+		c.Fatalf("balancer did not join raft as a nonvoter")
+	})
+	voters, err := b.numOtherVoters()
+	c.Assert(err, IsNil)
+	c.Assert(voters, Equals, 0)
+}
+
 func (s *FusisSuite) TestWatchState(c *C) {
 	config := defaultConfig()
 	b, err := NewBalancer(&config)
@@ -451,31 +941,141 @@ func (s *FusisSuite) TestWatchState(c *C) {
 
 	s.service.Host = "192.168.85.43"
 	b.engine.State.AddService(s.service)
-	errCh := make(chan error)
-	b.engine.StateCh <- errCh
-	c.Assert(<-errCh, IsNil)
-	addrs, err := net.GetVips(config.Interface)
+	c.Assert(b.engine.Bus.Publish(bus.StateChanged{}), IsNil)
+	ips, err := net.GetFusisVipsIps(config.Interface)
 	c.Assert(err, IsNil)
 	found := false
-	for _, a := range addrs {
-		if a.IPNet.String() == "192.168.85.43/32" {
+	for _, ip := range ips {
+		if ip == "192.168.85.43" {
 			found = true
 			break
 		}
 	}
 	c.Assert(found, Equals, true)
 	b.engine.State.DeleteService(s.service)
-	errCh = make(chan error)
-	b.engine.StateCh <- errCh
-	c.Assert(<-errCh, IsNil)
-	addrs, err = net.GetVips(config.Interface)
+	c.Assert(b.engine.Bus.Publish(bus.StateChanged{}), IsNil)
+	ips, err = net.GetFusisVipsIps(config.Interface)
 	c.Assert(err, IsNil)
 	deleted := true
-	for _, a := range addrs {
-		if a.IPNet.String() == "192.168.85.43/32" {
+	for _, ip := range ips {
+		if ip == "192.168.85.43" {
 			deleted = false
 			break
 		}
 	}
 	c.Assert(deleted, Equals, true)
 }
+
+func (s *FusisSuite) TestLeaderWarmupIgnoredOnBootstrap(c *C) {
+	config := defaultConfig()
+	config.LeaderWarmup = 60
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	c.Assert(b.warmupUntil.IsZero(), Equals, true)
+}
+
+func (s *FusisSuite) TestSerfSnapshot(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	_, err = os.Stat(filepath.Join(config.ConfigPath, "serf.snapshot"))
+	c.Assert(err, IsNil)
+}
+
+func (s *FusisSuite) TestNewBalancerTearsDownOnError(c *C) {
+	config := defaultConfig()
+	defer os.RemoveAll(config.ConfigPath)
+	// Serf is set up after raft, and fails with an invalid key
+	config.EncryptKey = "not base64"
+
+	_, err := NewBalancer(&config)
+	c.Assert(err, NotNil)
+
+	db, err := bolt.Open(filepath.Join(config.ConfigPath, "raft.db"), 0600, &bolt.Options{Timeout: time.Second})
+	c.Assert(err, IsNil)
+	db.Close()
+
+	ip, err := config.GetIpByInterface()
+	c.Assert(err, IsNil)
+	l, err := gonet.Listen("tcp", fmt.Sprintf("%s:%d", ip, config.Ports["raft"]))
+	c.Assert(err, IsNil)
+	l.Close()
+}
+
+func (s *FusisSuite) TestParseRaftPeers(c *C) {
+	servers, err := parseRaftPeers([]string{"b1=10.0.0.1", "b2=10.0.0.2:9000"}, 4382)
+	c.Assert(err, IsNil)
+	c.Assert(servers, DeepEquals, []raft.Server{
+		{Suffrage: raft.Voter, ID: "b1", Address: "10.0.0.1:4382"},
+		{Suffrage: raft.Voter, ID: "b2", Address: "10.0.0.2:9000"},
+	})
+
+	_, err = parseRaftPeers([]string{"10.0.0.1:4382"}, 4382)
+	c.Assert(err, ErrorMatches, `invalid raft peer "10.0.0.1:4382", expected name=address`)
+	_, err = parseRaftPeers([]string{"b1=10.0.0.1", "b1=10.0.0.2"}, 4382)
+	c.Assert(err, ErrorMatches, `duplicated raft peer "b1=10.0.0.2"`)
+}
+
+func (s *FusisSuite) TestProtocolNegotiation(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	c.Assert(b.clusterProtocol(), Equals, engine.CommandVersion)
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+
+	// Pretend to be a balancer released before UpdateServiceOp existed
+	tags := map[string]string{}
+	for k, v := range b.serf.LocalMember().Tags {
+		tags[k] = v
+	}
+	tags[protocolTag] = "0"
+	err = b.serf.SetTags(tags)
+	c.Assert(err, IsNil)
+	c.Assert(b.clusterProtocol(), Equals, 0)
+
+	err = b.UpdateService(s.service)
+	c.Assert(err, DeepEquals, ErrProtocolUnsupported{Op: engine.UpdateServiceOp, Required: 1, Cluster: 0})
+	err = b.DeleteService(s.service.GetId())
+	c.Assert(err, IsNil)
+
+	// Pretend to be a balancer released before http services existed
+	tags[protocolTag] = "1"
+	err = b.serf.SetTags(tags)
+	c.Assert(err, IsNil)
+	svc := &types.Service{Name: "web", Port: 80, Protocol: "tcp", Scheduler: "rr", Type: types.ServiceTypeHTTP}
+	err = b.AddService(svc)
+	c.Assert(err, DeepEquals, ErrProtocolUnsupported{Op: engine.AddServiceOp, Required: 2, Cluster: 1})
+}
+
+func (s *FusisSuite) TestFirewallMarkInUse(c *C) {
+	services := []types.Service{
+		{Name: "ftp", FirewallMark: 1},
+		{Name: "web"},
+	}
+	c.Assert(firewallMarkInUse(&types.Service{Name: "sip", FirewallMark: 1}, services), Equals, true)
+	c.Assert(firewallMarkInUse(&types.Service{Name: "sip", FirewallMark: 2}, services), Equals, false)
+	c.Assert(firewallMarkInUse(&types.Service{Name: "ftp", FirewallMark: 1}, services), Equals, false)
+	c.Assert(firewallMarkInUse(&types.Service{Name: "api"}, services), Equals, false)
+
+	services = append(services, types.Service{Name: "app", Policies: []types.Policy{{Name: "internal", Mark: 2}}})
+	c.Assert(firewallMarkInUse(&types.Service{Name: "sip", FirewallMark: 2}, services), Equals, true)
+	c.Assert(firewallMarkInUse(&types.Service{Name: "api", Policies: []types.Policy{{Name: "internal", Mark: 1}}}, services), Equals, true)
+	c.Assert(firewallMarkInUse(&types.Service{Name: "app", Policies: []types.Policy{{Name: "internal", Mark: 2}}}, services), Equals, false)
+}
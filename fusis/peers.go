@@ -0,0 +1,81 @@
+package fusis
+
+import (
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// GetPeers returns the raft servers of the cluster
+func (b *Balancer) GetPeers() ([]types.Peer, error) {
+	servers, err := b.raftServers()
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]types.Peer, 0, len(servers))
+	for _, s := range servers {
+		peers = append(peers, types.Peer{
+			Name:     string(s.ID),
+			Address:  string(s.Address),
+			NonVoter: s.Suffrage != raft.Voter,
+		})
+	}
+	return peers, nil
+}
+
+// AddPeer adds a balancer to raft, or promotes a nonvoter. Without an
+// address, the balancer must be a member of the cluster, and the raft
+// address it advertises is used, along with its nonvoter tag. It's how
+// balancers join when the membership is managed explicitly, see
+// config.BalancerConfig.ManualPeers.
+func (b *Balancer) AddPeer(peer types.Peer) error {
+	if peer.Name == "" {
+		return types.ErrInvalidPeer
+	}
+	if peer.Address == "" {
+		m, ok := b.balancerMember(peer.Name)
+		if !ok {
+			return types.ErrInvalidPeer
+		}
+		addr, err := raftPeerAddr(m)
+		if err != nil {
+			return err
+		}
+		peer.Address = addr
+		peer.NonVoter = peer.NonVoter || isNonvoter(m)
+	} else if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+		return types.ErrInvalidPeer
+	}
+
+	b.logger.Infof("balancer: adding %s at %s to raft", peer.Name, peer.Address)
+	return b.addRaftPeer(raft.ServerID(peer.Name), raft.ServerAddress(peer.Address), peer.NonVoter, raftTimeout)
+}
+
+// RemovePeer removes a balancer from raft, by name or raft address, which
+// is how dead balancers that never left the cluster are forced out.
+// Removing the leader makes it step down once the change is committed.
+func (b *Balancer) RemovePeer(peer string) error {
+	servers, index, err := b.raftConfiguration()
+	if err != nil {
+		return err
+	}
+	for _, s := range servers {
+		if string(s.ID) == peer || string(s.Address) == peer {
+			b.logger.Infof("balancer: removing %s at %s from raft", s.ID, s.Address)
+			return b.raft.RemoveServer(s.ID, index, raftTimeout).Error()
+		}
+	}
+	return types.ErrPeerNotFound
+}
+
+// balancerMember returns the serf member of the balancer named name
+func (b *Balancer) balancerMember(name string) (m serf.Member, ok bool) {
+	for _, m := range b.serf.Members() {
+		if m.Name == name && isBalancer(m) {
+			return m, true
+		}
+	}
+	return serf.Member{}, false
+}
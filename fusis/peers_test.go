@@ -0,0 +1,36 @@
+package fusis
+
+import (
+	"os"
+
+	"github.com/luizbafilho/fusis/api/types"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestManualPeers(c *C) {
+	config := defaultConfig()
+	config.ManualPeers = true
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	peers, err := b.GetPeers()
+	c.Assert(err, IsNil)
+	c.Assert(peers, HasLen, 1)
+	c.Assert(peers[0].Name, Equals, config.Name)
+
+	c.Assert(b.AddPeer(types.Peer{}), Equals, types.ErrInvalidPeer)
+	c.Assert(b.AddPeer(types.Peer{Name: "unknown"}), Equals, types.ErrInvalidPeer)
+	c.Assert(b.AddPeer(types.Peer{Name: "lb2", Address: "10.0.0.2"}), Equals, types.ErrInvalidPeer)
+	c.Assert(b.RemovePeer("unknown"), Equals, types.ErrPeerNotFound)
+	c.Assert(b.RemovePeer("10.0.0.2:4382"), Equals, types.ErrPeerNotFound)
+
+	c.Assert(b.ForceLeave("unknown"), Equals, types.ErrMemberNotFound)
+	c.Assert(b.ForceLeave(config.Name), Equals, types.ErrMemberAlive)
+}
@@ -0,0 +1,58 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/events"
+)
+
+// watchProbes connects to the services through their VIPs every interval
+// while the balancer leads, as only the leader has the VIPs up. Failures
+// and recoveries are recorded in the events of the services.
+func (b *Balancer) watchProbes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if !b.IsLeader() {
+			b.prober.Reset()
+			continue
+		}
+		b.Lock()
+		services := b.routingState().GetServices()
+		b.Unlock()
+
+		results, changed := b.prober.Probe(services)
+		for _, r := range results {
+			metrics.AddSample([]string{"fusis", "probe", "latency"}, float32(r.Latency)/float32(time.Millisecond))
+			if !r.Success {
+				metrics.IncrCounter([]string{"fusis", "probe", "failed"}, 1)
+			}
+		}
+		for _, r := range changed {
+			if r.Success {
+				b.logger.Infof("balancer: probe of service %s through %s recovered", r.Service, r.Address)
+				events.Publish(b.engine.Bus, r.Service, events.ProbeRecovered, "Connecting through %s succeeded again", r.Address)
+			} else {
+				b.logger.Warnf("balancer: probe of service %s through %s failed: %s", r.Service, r.Address, r.Error)
+				events.Publish(b.engine.Bus, r.Service, events.ProbeFailed, "Connecting through %s failed: %s", r.Address, r.Error)
+			}
+		}
+	}
+}
+
+// GetProbes returns the last probe of each service. They're only run by
+// the leader.
+func (b *Balancer) GetProbes() ([]types.ProbeResult, error) {
+	if b.config.Probe.Interval == 0 {
+		return nil, types.ErrProbesDisabled
+	}
+	return b.prober.Results(), nil
+}
@@ -0,0 +1,65 @@
+package fusis
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/engine"
+)
+
+// protocolTag is the serf tag used by balancers to advertise the command
+// protocol version they are able to apply.
+const protocolTag = "protocol"
+
+// ErrProtocolUnsupported is returned when a command requires a protocol
+// version not yet supported by every balancer in the cluster, which usually
+// means a rolling upgrade is in progress.
+type ErrProtocolUnsupported struct {
+	Op       engine.CommandOp
+	Required int
+	Cluster  int
+}
+
+func (e ErrProtocolUnsupported) Error() string {
+	return fmt.Sprintf("%v requires protocol version %d, but the cluster only supports version %d", e.Op, e.Required, e.Cluster)
+}
+
+// clusterProtocol returns the lowest protocol version advertised by the
+// balancers in the cluster. Failed balancers are still taken into account,
+// as they may come back running an older release.
+func (b *Balancer) clusterProtocol() int {
+	version := engine.CommandVersion
+	for _, m := range b.serf.Members() {
+		if !isBalancer(m) || m.Status == serf.StatusLeft {
+			continue
+		}
+		if v := memberProtocol(m); v < version {
+			version = v
+		}
+	}
+	return version
+}
+
+// memberProtocol returns the protocol version of a member. Balancers
+// released before the version was advertised speak version 0.
+func memberProtocol(m serf.Member) int {
+	v, err := strconv.Atoi(m.Tags[protocolTag])
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// checkProtocol refuses commands that some balancer wouldn't be able to
+// apply, instead of letting them be quarantined on that balancer.
+func (b *Balancer) checkProtocol(cmd *engine.Command) error {
+	required := cmd.RequiredProtocol()
+	if required == 0 {
+		return nil
+	}
+	if cluster := b.clusterProtocol(); required > cluster {
+		return ErrProtocolUnsupported{Op: cmd.Op, Required: required, Cluster: cluster}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package fusis
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// watchReconcile brings the VIPs and the IPVS table back to the routing
+// state every interval while the balancer leads. Otherwise only raft applies
+// and leadership changes sync them, so changes made out of band, like a VIP
+// deleted with ip addr del, or a sync that failed, would last until the next
+// state change.
+func (b *Balancer) watchReconcile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+
+		if b.IsLeader() {
+			b.reconcile()
+		}
+	}
+}
+
+// reconcile syncs the VIPs and applies the differences between the IPVS
+// table and the routing state, counting the rounds that found any in the
+// fusis.reconcile.ipvs metric
+func (b *Balancer) reconcile() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.shutdown || !b.IsLeader() {
+		return
+	}
+	if err := b.provider.SyncVIPs(b.engine.State); err != nil {
+		b.logger.Errorf("balancer: error reconciling the VIPs: %v", err)
+	}
+	plan, err := b.engine.Ipvs.Reconcile(b.routingState(), false)
+	if plan != nil && !plan.Empty() {
+		b.logger.Warnf("balancer: IPVS table out of sync, reconciled %d services and %d destinations",
+			len(plan.AddServices)+len(plan.UpdateServices)+len(plan.DeleteServices),
+			len(plan.AddDestinations)+len(plan.UpdateDestinations)+len(plan.DeleteDestinations))
+		metrics.IncrCounter([]string{"fusis", "reconcile", "ipvs"}, 1)
+	}
+	if err != nil {
+		b.logger.Errorf("balancer: error reconciling the IPVS table: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package fusis
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// registerQuery is the serf query agents register themselves as
+// destinations with. Only the leader answers it.
+const registerQuery = "add-destination"
+
+// errStaleRegistration is returned for registrations of a previous instance
+// of an agent, e.g. replayed by the gossip after it restarted
+var errStaleRegistration = errors.New("stale registration: the agent restarted since")
+
+// registration is the answer of the leader to a registerQuery
+type registration struct {
+	Error string `json:",omitempty"`
+}
+
+func (b *Balancer) handleRegisterQuery(q *serf.Query) {
+	if !b.IsLeader() {
+		return
+	}
+
+	var rsp registration
+	var dst types.Destination
+	if err := json.Unmarshal(q.Payload, &dst); err != nil {
+		rsp.Error = err.Error()
+	} else if err := b.registerAgent(&dst); err != nil {
+		b.logger.Errorf("balancer: error registering agent %s: %v", dst.Name, err)
+		rsp.Error = err.Error()
+	} else {
+		b.logger.Infof("balancer: agent %s registered to %s", dst.Name, dst.ServiceId)
+	}
+
+	payload, err := json.Marshal(rsp)
+	if err != nil {
+		b.logger.Errorf("balancer: error encoding registration: %v", err)
+		return
+	}
+	if err := q.Respond(payload); err != nil {
+		b.logger.Errorf("balancer: error answering registration of %s: %v", dst.Name, err)
+	}
+}
+
+// registerAgent adds the destination of an agent to its service. Agents
+// register again every time they join, so the registration of a known
+// agent only updates its weight and mode. The destination of another agent
+// with the same name isn't taken over, unless it's a previous instance of
+// the agent, see types.InstanceLabel.
+func (b *Balancer) registerAgent(dst *types.Destination) error {
+	instance := dst.Labels[types.InstanceLabel]
+	if member := b.memberInstance(dst.Name); instance != "" && member != "" && member != instance {
+		return errStaleRegistration
+	}
+
+	svc, err := b.GetService(dst.ServiceId)
+	if err != nil {
+		return err
+	}
+	dst.ServiceId = svc.GetId()
+
+	current, err := b.GetDestination(dst.Name)
+	if err == types.ErrDestinationNotFound {
+		return b.AddDestination(svc, dst)
+	}
+	if err != nil {
+		return err
+	}
+	if instance != "" && current.Labels[types.InstanceLabel] != instance {
+		return b.replaceAgent(svc, current, dst)
+	}
+	if current.ServiceId != dst.ServiceId || current.Host != dst.Host || current.Port != dst.Port {
+		return types.ErrDestinationAlreadyExists
+	}
+	if current.Weight == dst.Weight && current.Mode == dst.Mode {
+		return nil
+	}
+	update := *current
+	update.Weight = dst.Weight
+	update.Mode = dst.Mode
+	update.Version = 0
+	return b.UpdateDestination(&update)
+}
+
+// replaceAgent replaces the destination registered by a previous instance
+// of an agent, keeping the labels set since.
+func (b *Balancer) replaceAgent(svc *types.Service, current, dst *types.Destination) error {
+	b.logger.Infof("balancer: agent %s restarted as instance %s, replacing its registration", dst.Name, dst.Labels[types.InstanceLabel])
+	labels := make(map[string]string, len(current.Labels)+1)
+	for k, v := range current.Labels {
+		labels[k] = v
+	}
+	labels[types.InstanceLabel] = dst.Labels[types.InstanceLabel]
+
+	if current.ServiceId == dst.ServiceId && current.Host == dst.Host && current.Port == dst.Port {
+		update := *current
+		update.Weight = dst.Weight
+		update.Mode = dst.Mode
+		update.Labels = labels
+		update.Version = 0
+		return b.UpdateDestination(&update)
+	}
+
+	replacement := *dst
+	replacement.Labels = labels
+	if current.ServiceId == dst.ServiceId {
+		// Swapped in a single command, so the service never lacks it
+		return b.ApplyDestinationBatch(svc.GetId(), &types.DestinationBatch{
+			Remove: []string{current.GetId()},
+			Add:    []types.Destination{replacement},
+		})
+	}
+	if err := b.DeleteDestination(current); err != nil {
+		return err
+	}
+	return b.AddDestination(svc, &replacement)
+}
+
+// memberInstance returns the instance fingerprint of the alive member
+// named name, empty when unknown
+func (b *Balancer) memberInstance(name string) string {
+	for _, m := range b.serf.Members() {
+		if m.Name == name && m.Status == serf.StatusAlive {
+			return m.Tags["instance"]
+		}
+	}
+	return ""
+}
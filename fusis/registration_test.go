@@ -0,0 +1,79 @@
+package fusis
+
+import (
+	"os"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestRegisterAgent(c *C) {
+	config := defaultConfig()
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	dst := &types.Destination{Name: "agent1", Host: "192.168.1.10", Port: 80, Weight: 1, Mode: "route", ServiceId: s.service.GetId()}
+	err = b.registerAgent(dst)
+	c.Assert(err, Equals, types.ErrServiceNotFound)
+
+	err = b.AddService(s.service)
+	c.Assert(err, IsNil)
+	err = b.registerAgent(dst)
+	c.Assert(err, IsNil)
+	current, err := b.GetDestination("agent1")
+	c.Assert(err, IsNil)
+	c.Assert(current.Host, Equals, "192.168.1.10")
+
+	// Joining again updates the weight and the mode
+	rejoin := *dst
+	rejoin.Weight = 5
+	err = b.registerAgent(&rejoin)
+	c.Assert(err, IsNil)
+	current, err = b.GetDestination("agent1")
+	c.Assert(err, IsNil)
+	c.Assert(current.Weight, Equals, int32(5))
+
+	other := *dst
+	other.Host = "192.168.1.11"
+	err = b.registerAgent(&other)
+	c.Assert(err, Equals, types.ErrDestinationAlreadyExists)
+
+	// A new instance of the agent replaces its registration
+	rebuilt := other
+	rebuilt.Labels = map[string]string{types.InstanceLabel: "2-b"}
+	err = b.registerAgent(&rebuilt)
+	c.Assert(err, IsNil)
+	current, err = b.GetDestination("agent1")
+	c.Assert(err, IsNil)
+	c.Assert(current.Host, Equals, "192.168.1.11")
+	c.Assert(current.Labels, DeepEquals, map[string]string{types.InstanceLabel: "2-b"})
+
+	restarted := rebuilt
+	restarted.Labels = map[string]string{types.InstanceLabel: "3-c"}
+	restarted.Weight = 2
+	err = b.registerAgent(&restarted)
+	c.Assert(err, IsNil)
+	current, err = b.GetDestination("agent1")
+	c.Assert(err, IsNil)
+	c.Assert(current.Weight, Equals, int32(2))
+	c.Assert(current.Labels[types.InstanceLabel], Equals, "3-c")
+}
+
+func (s *FusisSuite) TestAgentDestination(c *C) {
+	agent, err := NewAgent(&config.AgentConfig{Name: "agent1", Host: "192.168.1.10", Port: 8080, Mode: "route", Service: "web"})
+	c.Assert(err, IsNil)
+	dst, err := agent.destination()
+	c.Assert(err, IsNil)
+	c.Assert(dst.Labels[types.InstanceLabel], Equals, agent.instance)
+	c.Assert(agent.instance, Matches, "[0-9]+-[0-9a-f-]{36}")
+	dst.Labels = nil
+	c.Assert(dst, DeepEquals, types.Destination{Name: "agent1", Host: "192.168.1.10", Port: 8080, Weight: 1, Mode: "route", ServiceId: "web"})
+}
@@ -0,0 +1,41 @@
+package fusis
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/engine"
+)
+
+// restoreFrom seeds the snapshot store of a new cluster with the state in
+// path. Raft restores it into the engine before the balancer serves, and
+// sends it to the balancers joining later, as the log starts after it.
+// The cluster starts with the servers in configuration.
+func (b *Balancer) restoreFrom(path string, snaps raft.SnapshotStore, configuration raft.Configuration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, index, err := engine.ImportSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot %s: %v", path, err)
+	}
+	// Raft indexes start at 1, and the commands applied after the restore
+	// must come after the ones already applied to the snapshot
+	if index == 0 {
+		index = 1
+	}
+
+	sink, err := snaps.Create(raft.SnapshotVersionMax, index, 1, configuration, index, b.raftTransport)
+	if err != nil {
+		return err
+	}
+	if _, err := sink.Write(data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	b.logger.Infof("balancer: restoring %s at index %d", path, index)
+	return sink.Close()
+}
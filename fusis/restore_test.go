@@ -0,0 +1,64 @@
+package fusis
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/luizbafilho/fusis/api/types"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestRestoreFrom(c *C) {
+	svc := *s.service
+	svc.Destinations = []types.Destination{*s.destination}
+	exported, err := json.Marshal([]types.Service{svc})
+	c.Assert(err, IsNil)
+	path := filepath.Join(c.MkDir(), "services.json")
+	c.Assert(ioutil.WriteFile(path, exported, 0644), IsNil)
+
+	config := defaultConfig()
+	config.RestoreFrom = path
+	defer os.RemoveAll(config.ConfigPath)
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	_, err = b.GetService(s.service.Name)
+	c.Assert(err, IsNil)
+	_, err = b.GetDestination(s.destination.GetId())
+	c.Assert(err, IsNil)
+	other := &types.Service{Name: "other", Port: 80, Scheduler: "lc", Protocol: "tcp"}
+	c.Assert(b.AddService(other), IsNil)
+	b.Shutdown()
+
+	// Restarting with the same flag keeps the state of the cluster
+	b, err = NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+	WaitForResult(func() (bool, error) {
+		_, err := b.GetService("other")
+		return err == nil, err
+	}, func(err error) {
+		c.Fatalf("service added after the restore is missing: %v", err)
+	})
+}
+
+func (s *FusisSuite) TestRestoreFromDevMode(c *C) {
+	config := defaultConfig()
+	config.DevMode = true
+	config.RestoreFrom = filepath.Join(c.MkDir(), "state.bin")
+	defer os.RemoveAll(config.ConfigPath)
+	_, err := NewBalancer(&config)
+	c.Assert(err, ErrorMatches, ".*restoring a snapshot requires .*")
+}
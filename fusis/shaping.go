@@ -0,0 +1,30 @@
+package fusis
+
+import (
+	fusis_net "github.com/luizbafilho/fusis/net"
+)
+
+// syncBandwidth applies the bandwidth caps of the services to the VIP
+// interface of their provider. Like the VIPs, they're only applied by the
+// leader.
+func (b *Balancer) syncBandwidth() {
+	limits := make(map[string][]fusis_net.BandwidthLimit)
+	for _, svc := range b.engine.State.GetServices() {
+		if svc.MaxBandwidth == 0 {
+			continue
+		}
+		limits[svc.Provider] = append(limits[svc.Provider], fusis_net.BandwidthLimit{
+			IP:       svc.Host,
+			Port:     svc.Port,
+			Protocol: svc.Protocol,
+			Rate:     svc.MaxBandwidth,
+		})
+	}
+
+	// The services of unknown providers are left alone, like their VIPs
+	for name, shaper := range b.shapers {
+		if err := shaper.Sync(limits[name]); err != nil {
+			b.logger.Errorf("balancer: error applying bandwidth limits on %s: %v", b.providerInterface(name), err)
+		}
+	}
+}
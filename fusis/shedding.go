@@ -0,0 +1,94 @@
+package fusis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/luizbafilho/fusis/bus"
+)
+
+// latencyWeight is the weight of the last raft apply in the average latency
+const latencyWeight = 0.2
+
+// shedder tracks the load of the leader, see Balancer.Overloaded
+type shedder struct {
+	sync.Mutex
+	// latency is the moving average of the raft apply latency, as of last
+	latency time.Duration
+	last    time.Time
+	// reason is why the writes are shed, empty when they aren't
+	reason string
+}
+
+// observe adds the latency of a raft apply to the average
+func (s *shedder) observe(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if s.latency == 0 {
+		s.latency = d
+	} else {
+		s.latency = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(s.latency))
+	}
+	s.last = time.Now()
+}
+
+// Overloaded reports whether the leader sheds the writes that aren't
+// critical, and how long their clients should wait before retrying. The
+// load is evaluated on each write, see config.Shedding. The apply latency
+// is forgotten once no write was applied for the retry interval, so the
+// writes are let through again to measure it.
+func (b *Balancer) Overloaded() (retryAfter time.Duration, overloaded bool) {
+	conf := b.config.Shedding
+	if conf.ApplyLatency == 0 && conf.PendingSyncs == 0 {
+		return 0, false
+	}
+	retryAfter = time.Duration(conf.RetryAfter) * time.Second
+	if retryAfter == 0 {
+		retryAfter = time.Second
+	}
+
+	reason := ""
+	threshold := time.Duration(conf.ApplyLatency) * time.Millisecond
+	b.shedder.Lock()
+	if conf.ApplyLatency > 0 && time.Since(b.shedder.last) < retryAfter && b.shedder.latency > threshold {
+		reason = fmt.Sprintf("raft apply latency %v above %v", b.shedder.latency, threshold)
+	}
+	if conf.PendingSyncs > 0 {
+		if pending := b.pendingSyncs(); pending > uint64(conf.PendingSyncs) {
+			reason = fmt.Sprintf("%d raft entries pending sync, above %d", pending, conf.PendingSyncs)
+		}
+	}
+	changed := (reason != "") != (b.shedder.reason != "")
+	b.shedder.reason = reason
+	b.shedder.Unlock()
+
+	if changed {
+		if reason != "" {
+			b.logger.Warnf("balancer: overloaded, shedding the writes that aren't critical: %s", reason)
+			metrics.SetGauge([]string{"fusis", "shedding"}, 1)
+		} else {
+			b.logger.Infof("balancer: load back to normal, accepting every write")
+			metrics.SetGauge([]string{"fusis", "shedding"}, 0)
+		}
+		if err := b.engine.Bus.Publish(bus.LoadShedding{Shedding: reason != "", Reason: reason}); err != nil {
+			b.logger.Errorf("balancer: error handling load shedding change: %v", err)
+		}
+	}
+	return retryAfter, reason != ""
+}
+
+// pendingSyncs returns the number of raft entries appended but not yet
+// applied to the state and synced to the kernel. It counts the entries not
+// applied to the FSM too, e.g. configuration changes, so it's approximate.
+func (b *Balancer) pendingSyncs() uint64 {
+	if b.fastApply() {
+		return 0
+	}
+	last, applied := b.raft.LastIndex(), b.engine.LastApplied()
+	if last <= applied {
+		return 0
+	}
+	return last - applied
+}
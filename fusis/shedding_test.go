@@ -0,0 +1,44 @@
+package fusis
+
+import (
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestOverloaded(c *C) {
+	config := defaultConfig()
+	config.Shedding.ApplyLatency = 50
+	config.Shedding.RetryAfter = 1
+	b, err := NewBalancer(&config)
+	c.Assert(err, IsNil)
+	defer b.Shutdown()
+	defer os.RemoveAll(config.ConfigPath)
+	WaitForResult(func() (bool, error) {
+		return b.IsLeader(), nil
+	}, func(err error) {
+		c.Fatalf("balancer did not become leader")
+	})
+
+	var changes []bool
+	b.OnLoadShedding(func(shedding bool, reason string) {
+		changes = append(changes, shedding)
+	})
+
+	b.shedder.latency = 0
+	b.shedder.observe(time.Millisecond)
+	_, overloaded := b.Overloaded()
+	c.Assert(overloaded, Equals, false)
+
+	b.shedder.observe(time.Second)
+	retryAfter, overloaded := b.Overloaded()
+	c.Assert(overloaded, Equals, true)
+	c.Assert(retryAfter, Equals, time.Second)
+
+	// Without new writes, the latency is measured again
+	b.shedder.last = time.Now().Add(-2 * time.Second)
+	_, overloaded = b.Overloaded()
+	c.Assert(overloaded, Equals, false)
+	c.Assert(changes, DeepEquals, []bool{true, false})
+}
@@ -0,0 +1,426 @@
+package fusis
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+const (
+	// summaryEvent is the serf user event the leader gossips the summaries
+	// of the services and destinations with, so members outside raft, like
+	// the agents, know about them without reaching the API.
+	summaryEvent = "fusis-summary"
+	// digestEvent is the serf user event the leader periodically gossips
+	// the digest of every summary with. Members whose summaries don't match
+	// it are stale, and ask the leader for the changes they missed with the
+	// deltaQuery serf query.
+	digestEvent = "fusis-digest"
+	deltaQuery  = "fusis-delta"
+
+	// maxTombstones is the number of deletions the leader remembers to
+	// gossip them again to stale members.
+	maxTombstones = 1024
+)
+
+// digestInterval is how often the leader gossips the digest
+var digestInterval = 10 * time.Second
+
+// summary describes a service or a destination. Serf user events are
+// limited to a few hundred bytes, so only the attributes identifying them
+// are gossiped.
+type summary struct {
+	Service     *types.Service     `json:"s,omitempty"`
+	Destination *types.Destination `json:"d,omitempty"`
+	// Deleted is set, along with the raft index of the deletion in Version,
+	// when the service or destination no longer exists.
+	Deleted bool   `json:"x,omitempty"`
+	Version uint64 `json:"v,omitempty"`
+}
+
+func serviceSummary(svc types.Service) summary {
+	return summary{Service: &types.Service{
+		Id:        svc.GetId(),
+		Name:      svc.Name,
+		Host:      svc.Host,
+		Port:      svc.Port,
+		Protocol:  svc.Protocol,
+		Scheduler: svc.Scheduler,
+		Type:      svc.Type,
+		Version:   svc.Version,
+	}}
+}
+
+func destinationSummary(dst types.Destination) summary {
+	return summary{Destination: &types.Destination{
+		Name:      dst.Name,
+		Host:      dst.Host,
+		Port:      dst.Port,
+		Weight:    dst.Weight,
+		Mode:      dst.Mode,
+		ServiceId: dst.ServiceId,
+		Version:   dst.Version,
+	}}
+}
+
+// key identifies the summarized service or destination
+func (s summary) key() string {
+	if s.Service != nil {
+		return "s/" + s.Service.GetId()
+	}
+	return "d/" + s.Destination.GetId()
+}
+
+func (s summary) version() uint64 {
+	if s.Deleted {
+		return s.Version
+	}
+	if s.Service != nil {
+		return s.Service.Version
+	}
+	return s.Destination.Version
+}
+
+// deletedSummary returns the summary gossiped when the service or
+// destination identified by key is deleted at the given raft index.
+func deletedSummary(key string, index uint64) summary {
+	deleted := summary{Deleted: true, Version: index}
+	if key[0] == 's' {
+		deleted.Service = &types.Service{Id: key[2:]}
+	} else {
+		deleted.Destination = &types.Destination{Name: key[2:]}
+	}
+	return deleted
+}
+
+// digest identifies a set of summaries, so members can check whether they
+// know every service and destination in the versions the leader does. From
+// is the oldest index the leader is able to send the changes since.
+type digest struct {
+	Index uint64 `json:"i"`
+	From  uint64 `json:"f,omitempty"`
+	Count int    `json:"n"`
+	Hash  uint64 `json:"h"`
+}
+
+func (d digest) matches(other digest) bool {
+	return d.Count == other.Count && d.Hash == other.Hash
+}
+
+func makeDigest(index uint64, versions map[string]uint64) digest {
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s@%d\n", key, versions[key])
+	}
+	return digest{Index: index, Count: len(keys), Hash: h.Sum64()}
+}
+
+// delta is the payload of the deltaQuery, asking for the changes applied
+// after the Since index.
+type delta struct {
+	Since uint64 `json:"since"`
+}
+
+func (b *Balancer) currentSummaries() map[string]summary {
+	current := make(map[string]summary)
+	for _, svc := range b.engine.State.GetServices() {
+		s := serviceSummary(svc)
+		current[s.key()] = s
+		for _, dst := range svc.Destinations {
+			s := destinationSummary(dst)
+			current[s.key()] = s
+		}
+	}
+	return current
+}
+
+// publishSummaries gossips the summaries of the services and destinations
+// changed since the last call, and of the deleted ones.
+func (b *Balancer) publishSummaries() {
+	b.summaryLock.Lock()
+	defer b.summaryLock.Unlock()
+
+	current := b.currentSummaries()
+	for key, s := range current {
+		if version, ok := b.published[key]; ok && version == s.version() {
+			continue
+		}
+		if b.sendSummary(s) {
+			b.published[key] = s.version()
+		}
+	}
+
+	index := b.engine.LastApplied()
+	for key := range b.published {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		if b.sendSummary(deletedSummary(key, index)) {
+			delete(b.published, key)
+			b.tombstones = append(b.tombstones, tombstone{key: key, index: index})
+			if len(b.tombstones) > maxTombstones {
+				b.tombstonesFrom = b.tombstones[0].index
+				b.tombstones = b.tombstones[len(b.tombstones)-maxTombstones:]
+			}
+		}
+	}
+}
+
+// tombstone records the deletion of a service or destination
+type tombstone struct {
+	key   string
+	index uint64
+}
+
+// publishDelta gossips again the summaries changed after the since index,
+// deletions included, for the members that missed them. Deletions are only
+// remembered since the leader took over, up to maxTombstones of them, so
+// members synced before that must fetch everything again, see checkDigest.
+func (b *Balancer) publishDelta(since uint64) {
+	b.summaryLock.Lock()
+	defer b.summaryLock.Unlock()
+
+	for _, s := range b.currentSummaries() {
+		if s.version() > since {
+			b.sendSummary(s)
+		}
+	}
+	for _, t := range b.tombstones {
+		if t.index > since {
+			b.sendSummary(deletedSummary(t.key, t.index))
+		}
+	}
+}
+
+func (b *Balancer) publishDigest() {
+	versions := make(map[string]uint64)
+	for key, s := range b.currentSummaries() {
+		versions[key] = s.version()
+	}
+	d := makeDigest(b.engine.LastApplied(), versions)
+	b.summaryLock.Lock()
+	d.From = b.tombstonesFrom
+	b.summaryLock.Unlock()
+
+	payload, err := json.Marshal(d)
+	if err != nil {
+		b.logger.Errorf("balancer: error encoding digest: %v", err)
+		return
+	}
+	if err := b.serf.UserEvent(digestEvent, payload, true); err != nil {
+		b.logger.Errorf("balancer: error gossiping digest: %v", err)
+	}
+}
+
+// handleDeltaQuery schedules the delta asked by a stale member. Requests
+// are coalesced, so members going stale together cause a single delta.
+func (b *Balancer) handleDeltaQuery(q *serf.Query) {
+	if !b.IsLeader() {
+		return
+	}
+	var d delta
+	if err := json.Unmarshal(q.Payload, &d); err != nil {
+		b.logger.Errorf("balancer: invalid delta query: %v", err)
+		return
+	}
+
+	b.summaryLock.Lock()
+	if b.deltaSince == nil || d.Since < *b.deltaSince {
+		b.deltaSince = &d.Since
+	}
+	b.summaryLock.Unlock()
+
+	select {
+	case b.deltaCh <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Balancer) sendSummary(s summary) bool {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		b.logger.Errorf("balancer: error encoding summary of %s: %v", s.key(), err)
+		return false
+	}
+	if err := b.serf.UserEvent(summaryEvent, payload, false); err != nil {
+		b.logger.Errorf("balancer: error gossiping summary of %s: %v", s.key(), err)
+		return false
+	}
+	return true
+}
+
+// resetSummaries makes the next publish gossip every summary again. It's
+// called when the balancer becomes the leader, which doesn't know the
+// deletions gossiped by the previous one.
+func (b *Balancer) resetSummaries() {
+	b.summaryLock.Lock()
+	defer b.summaryLock.Unlock()
+	b.published = make(map[string]uint64)
+	b.tombstones = nil
+	b.tombstonesFrom = b.engine.LastApplied()
+}
+
+func (b *Balancer) watchSummaries() {
+	ticker := time.NewTicker(digestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if b.IsLeader() {
+				b.publishDigest()
+			}
+		case <-b.deltaCh:
+			b.summaryLock.Lock()
+			since := b.deltaSince
+			b.deltaSince = nil
+			b.summaryLock.Unlock()
+
+			if since != nil && b.IsLeader() {
+				b.publishDelta(*since)
+			}
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// summaryCache holds the services and destinations known from the gossiped
+// summaries. Summaries may arrive out of order, so older versions never
+// replace newer ones, and deletions are remembered to ignore late updates.
+type summaryCache struct {
+	sync.Mutex
+	items   map[string]summary
+	deleted map[string]uint64
+
+	// synced is the index of the last digest matching the cache
+	synced     uint64
+	stale      bool
+	lastDigest time.Time
+}
+
+func newSummaryCache() *summaryCache {
+	return &summaryCache{
+		items:   make(map[string]summary),
+		deleted: make(map[string]uint64),
+	}
+}
+
+func (c *summaryCache) handle(payload []byte) error {
+	var s summary
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return err
+	}
+	if s.Service == nil && s.Destination == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	key := s.key()
+	if version, ok := c.deleted[key]; ok && version >= s.version() {
+		return nil
+	}
+	if current, ok := c.items[key]; ok && current.version() > s.version() {
+		return nil
+	}
+	if s.Deleted {
+		delete(c.items, key)
+		c.deleted[key] = s.version()
+		return nil
+	}
+	delete(c.deleted, key)
+	c.items[key] = s
+	return nil
+}
+
+// GetServices returns the services known from gossip
+func (c *summaryCache) GetServices() []types.Service {
+	c.Lock()
+	defer c.Unlock()
+
+	services := []types.Service{}
+	for _, s := range c.items {
+		if s.Service != nil {
+			services = append(services, c.withDestinations(*s.Service))
+		}
+	}
+	return services
+}
+
+// GetService returns a service known from gossip
+func (c *summaryCache) GetService(id string) (*types.Service, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, ok := c.items["s/"+id]
+	if !ok {
+		return nil, types.ErrServiceNotFound
+	}
+	svc := c.withDestinations(*s.Service)
+	return &svc, nil
+}
+
+func (c *summaryCache) withDestinations(svc types.Service) types.Service {
+	svc.Destinations = []types.Destination{}
+	for _, s := range c.items {
+		if s.Destination != nil && s.Destination.ServiceId == svc.GetId() {
+			svc.Destinations = append(svc.Destinations, *s.Destination)
+		}
+	}
+	return svc
+}
+
+// checkDigest compares the cache with the digest gossiped by the leader.
+// When they don't match, the cache is stale and the changes applied after
+// the returned index must be fetched. If the leader no longer remembers
+// the deletions since then, the cache is cleared to fetch everything again.
+func (c *summaryCache) checkDigest(payload []byte) (since uint64, stale bool, err error) {
+	var d digest
+	if err := json.Unmarshal(payload, &d); err != nil {
+		return 0, false, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	versions := make(map[string]uint64, len(c.items))
+	for key, s := range c.items {
+		versions[key] = s.version()
+	}
+	local := makeDigest(d.Index, versions)
+
+	c.lastDigest = time.Now()
+	c.stale = !local.matches(d)
+	if !c.stale {
+		c.synced = d.Index
+	} else if c.synced < d.From {
+		c.items = make(map[string]summary)
+		c.deleted = make(map[string]uint64)
+		c.synced = 0
+	}
+	return c.synced, c.stale, nil
+}
+
+// Status reports how fresh the cache is
+func (c *summaryCache) Status() types.SummaryStatus {
+	c.Lock()
+	defer c.Unlock()
+	return types.SummaryStatus{
+		Index:      c.synced,
+		Stale:      c.stale,
+		LastDigest: c.lastDigest,
+	}
+}
@@ -0,0 +1,89 @@
+package fusis
+
+import (
+	"encoding/json"
+
+	"github.com/luizbafilho/fusis/api/types"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FusisSuite) TestSummaryCache(c *C) {
+	cache := newSummaryCache()
+	send := func(sum summary) {
+		payload, err := json.Marshal(sum)
+		c.Assert(err, IsNil)
+		c.Assert(len(payload) < 256, Equals, true)
+		c.Assert(cache.handle(payload), IsNil)
+	}
+
+	svc := types.Service{Id: "web", Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr", Version: 2}
+	dst := types.Destination{Name: "host-1", Host: "192.168.0.1", Port: 8080, Weight: 1, Mode: "nat", ServiceId: "web", Version: 3}
+	send(serviceSummary(svc))
+	send(destinationSummary(dst))
+
+	got, err := cache.GetService("web")
+	c.Assert(err, IsNil)
+	c.Assert(got.Host, Equals, "10.0.0.1")
+	c.Assert(got.Destinations, DeepEquals, []types.Destination{dst})
+
+	// Older versions don't replace newer ones
+	old := svc
+	old.Host, old.Version = "10.0.0.9", 1
+	send(serviceSummary(old))
+	got, err = cache.GetService("web")
+	c.Assert(err, IsNil)
+	c.Assert(got.Host, Equals, "10.0.0.1")
+
+	// Deletions aren't undone by late updates
+	send(summary{Destination: &types.Destination{Name: "host-1"}, Deleted: true, Version: 4})
+	send(destinationSummary(dst))
+	got, err = cache.GetService("web")
+	c.Assert(err, IsNil)
+	c.Assert(got.Destinations, HasLen, 0)
+	c.Assert(cache.GetServices(), HasLen, 1)
+}
+
+func (s *FusisSuite) TestSummaryCacheCheckDigest(c *C) {
+	cache := newSummaryCache()
+	svc := serviceSummary(types.Service{Id: "web", Name: "web", Version: 2})
+	dst := destinationSummary(types.Destination{Name: "host-1", ServiceId: "web", Version: 3})
+	leader := map[string]uint64{svc.key(): 2, dst.key(): 3}
+	check := func(d digest) (uint64, bool) {
+		payload, err := json.Marshal(d)
+		c.Assert(err, IsNil)
+		since, stale, err := cache.checkDigest(payload)
+		c.Assert(err, IsNil)
+		return since, stale
+	}
+	handle := func(sum summary) {
+		payload, err := json.Marshal(sum)
+		c.Assert(err, IsNil)
+		c.Assert(cache.handle(payload), IsNil)
+	}
+
+	handle(svc)
+	since, stale := check(makeDigest(3, leader))
+	c.Assert(stale, Equals, true)
+	c.Assert(since, Equals, uint64(0))
+
+	handle(dst)
+	_, stale = check(makeDigest(3, leader))
+	c.Assert(stale, Equals, false)
+	c.Assert(cache.Status(), DeepEquals, types.SummaryStatus{Index: 3, LastDigest: cache.Status().LastDigest})
+
+	// A missed deletion makes the cache stale since the last match
+	delete(leader, dst.key())
+	since, stale = check(makeDigest(5, leader))
+	c.Assert(stale, Equals, true)
+	c.Assert(since, Equals, uint64(3))
+
+	// When the leader can't send the deletions since then, everything is
+	// fetched again
+	d := makeDigest(6, leader)
+	d.From = 4
+	since, stale = check(d)
+	c.Assert(stale, Equals, true)
+	c.Assert(since, Equals, uint64(0))
+	c.Assert(cache.GetServices(), HasLen, 0)
+}
@@ -0,0 +1,72 @@
+package fusis
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/config"
+)
+
+const (
+	raftMaxPool          = 3
+	raftTransportTimeout = 10 * time.Second
+)
+
+// newRaftTransport returns the raft transport bound to addr, over TLS when
+// conf is enabled and plain TCP otherwise. The certificate presented is
+// returned, to be reloaded when rotated.
+func newRaftTransport(addr *net.TCPAddr, conf config.TLS, logOutput io.Writer) (*raft.NetworkTransport, *config.Certificate, error) {
+	if !conf.Enabled() {
+		trans, err := raft.NewTCPTransport(addr.String(), addr, raftMaxPool, raftTransportTimeout, logOutput)
+		return trans, nil, err
+	}
+
+	// Only balancers holding a certificate of the CA take part in the
+	// replication, whichever end opens the connection
+	conf.VerifyClients = true
+	cert, err := conf.LoadCertificate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("raft tls: %v", err)
+	}
+	serverConfig, err := cert.ServerConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("raft tls: %v", err)
+	}
+	clientConfig, err := cert.ClientConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("raft tls: %v", err)
+	}
+
+	l, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := &tlsStreamLayer{
+		Listener:  tls.NewListener(l, serverConfig),
+		advertise: addr,
+		config:    clientConfig,
+	}
+	return raft.NewNetworkTransport(stream, raftMaxPool, raftTransportTimeout, logOutput), cert, nil
+}
+
+// tlsStreamLayer is a raft stream layer whose connections, both accepted
+// and dialed, are over TLS
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+// Dial implements the raft.StreamLayer interface
+func (t *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), t.config)
+}
+
+// Addr returns the address advertised to the other balancers
+func (t *tlsStreamLayer) Addr() net.Addr {
+	return t.advertise
+}
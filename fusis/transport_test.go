@@ -0,0 +1,101 @@
+package fusis
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	gonet "net"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/config"
+	. "gopkg.in/check.v1"
+)
+
+// writeCert writes a certificate for 127.0.0.1 and its key to dir, signed
+// by parent, or self-signed as a CA when parent is nil.
+func writeCert(c *C, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []gonet.IP{gonet.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600), IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600), IsNil)
+	return cert, key
+}
+
+func (s *FusisSuite) TestRaftTLSTransport(c *C) {
+	dir := c.MkDir()
+	ca, caKey := writeCert(c, dir, "ca", nil, nil)
+	writeCert(c, dir, "balancer-1", ca, caKey)
+	writeCert(c, dir, "balancer-2", ca, caKey)
+	writeCert(c, dir, "rogue", nil, nil)
+	tlsConfig := func(name, ca string) config.TLS {
+		return config.TLS{
+			CertFile: filepath.Join(dir, name+".pem"),
+			KeyFile:  filepath.Join(dir, name+"-key.pem"),
+			CAFile:   filepath.Join(dir, ca+".pem"),
+		}
+	}
+	newTransport := func(conf config.TLS) *raft.NetworkTransport {
+		addr := &gonet.TCPAddr{IP: gonet.ParseIP("127.0.0.1"), Port: getPort()}
+		trans, _, err := newRaftTransport(addr, conf, ioutil.Discard)
+		c.Assert(err, IsNil)
+		return trans
+	}
+
+	follower := newTransport(tlsConfig("balancer-2", "ca"))
+	defer follower.Close()
+	go func() {
+		for rpc := range follower.Consumer() {
+			rpc.Respond(&raft.AppendEntriesResponse{Term: 2, Success: true}, nil)
+		}
+	}()
+
+	leader := newTransport(tlsConfig("balancer-1", "ca"))
+	defer leader.Close()
+	var resp raft.AppendEntriesResponse
+	err := leader.AppendEntries("balancer-2", follower.LocalAddr(), &raft.AppendEntriesRequest{Term: 2}, &resp)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Success, Equals, true)
+
+	// Balancers without a certificate of the CA are rejected
+	rogue := newTransport(tlsConfig("rogue", "rogue"))
+	defer rogue.Close()
+	err = rogue.AppendEntries("balancer-2", follower.LocalAddr(), &raft.AppendEntriesRequest{Term: 3}, &resp)
+	c.Assert(err, NotNil)
+
+	_, _, err = newRaftTransport(&gonet.TCPAddr{IP: gonet.ParseIP("127.0.0.1"), Port: getPort()}, config.TLS{
+		CertFile: filepath.Join(dir, "balancer-1.pem"),
+		KeyFile:  filepath.Join(dir, "balancer-1-key.pem"),
+	}, ioutil.Discard)
+	c.Assert(err, ErrorMatches, "raft tls: verifying clients requires a CA file")
+}
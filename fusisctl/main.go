@@ -0,0 +1,17 @@
+// Command fusisctl is the client of the fusis management API, the same as
+// "fusis ctl" without the balancer and agent commands.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/luizbafilho/fusis/ctl"
+)
+
+func main() {
+	if err := ctl.NewCommand("fusisctl").Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,145 @@
+// Package health keeps the health history of destinations and detects
+// flapping ones, which are held out of rotation until they're stable.
+package health
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
+	"github.com/luizbafilho/fusis/config"
+)
+
+const (
+	defaultFlapThreshold = 4
+	defaultFlapWindow    = 5 * time.Minute
+	maxTransitions       = 20
+)
+
+type destinationHealth struct {
+	unhealthy   bool
+	heldUntil   time.Time
+	transitions []types.HealthTransition
+}
+
+// Tracker records health reports of destinations. Destinations without
+// reports are considered healthy.
+type Tracker struct {
+	sync.Mutex
+	threshold    int
+	window       time.Duration
+	destinations map[string]*destinationHealth
+	now          func() time.Time
+}
+
+func NewTracker(conf config.Health) *Tracker {
+	t := &Tracker{
+		threshold:    conf.FlapThreshold,
+		window:       time.Duration(conf.FlapWindow) * time.Second,
+		destinations: make(map[string]*destinationHealth),
+		now:          time.Now,
+	}
+	if t.threshold <= 0 {
+		t.threshold = defaultFlapThreshold
+	}
+	if t.window <= 0 {
+		t.window = defaultFlapWindow
+	}
+	return t
+}
+
+// Report records the current health of a destination. It returns whether
+// the destination entered or left the rotation, and for how long it's held
+// out of it if flapping.
+func (t *Tracker) Report(id string, healthy bool) (changed bool, hold time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	d, ok := t.destinations[id]
+	if !ok {
+		d = &destinationHealth{}
+		t.destinations[id] = d
+	}
+	if d.unhealthy == !healthy {
+		return false, 0
+	}
+
+	before := d.inRotation(now)
+	d.unhealthy = !healthy
+	d.transitions = append(d.transitions, types.HealthTransition{Time: now, Healthy: healthy})
+	if len(d.transitions) > maxTransitions {
+		d.transitions = d.transitions[len(d.transitions)-maxTransitions:]
+	}
+
+	if t.recentTransitions(d, now) >= t.threshold {
+		d.heldUntil = now.Add(t.window)
+	}
+
+	return before != d.inRotation(now), d.heldUntil.Sub(now)
+}
+
+// InRotation reports whether a destination should receive traffic
+func (t *Tracker) InRotation(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	d, ok := t.destinations[id]
+	if !ok {
+		return true
+	}
+	return d.inRotation(t.now())
+}
+
+// Health returns the health state and recent transitions of a destination
+func (t *Tracker) Health(id string) types.DestinationHealth {
+	t.Lock()
+	defer t.Unlock()
+
+	d, ok := t.destinations[id]
+	if !ok {
+		return types.DestinationHealth{Healthy: true, Transitions: []types.HealthTransition{}}
+	}
+
+	now := t.now()
+	transitions := make([]types.HealthTransition, len(d.transitions))
+	copy(transitions, d.transitions)
+	return types.DestinationHealth{
+		Healthy:     !d.unhealthy,
+		Flapping:    now.Before(d.heldUntil),
+		HeldUntil:   d.heldUntil,
+		Transitions: transitions,
+	}
+}
+
+// Forget drops the history of a destination
+func (t *Tracker) Forget(id string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.destinations, id)
+}
+
+// Subscribe forgets the history of the destinations removed, as published
+// on b
+func (t *Tracker) Subscribe(b *bus.Bus) {
+	b.Subscribe(bus.DestinationRemoved{}.Topic(), func(e bus.Event) error {
+		dst := e.(bus.DestinationRemoved).Destination
+		t.Forget(dst.GetId())
+		return nil
+	})
+}
+
+func (t *Tracker) recentTransitions(d *destinationHealth, now time.Time) int {
+	count := 0
+	for _, tr := range d.transitions {
+		if now.Sub(tr.Time) <= t.window {
+			count++
+		}
+	}
+	return count
+}
+
+func (d *destinationHealth) inRotation(now time.Time) bool {
+	return !d.unhealthy && !now.Before(d.heldUntil)
+}
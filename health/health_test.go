@@ -0,0 +1,85 @@
+package health
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
+	"github.com/luizbafilho/fusis/config"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type HealthSuite struct {
+	now     time.Time
+	tracker *Tracker
+}
+
+var _ = Suite(&HealthSuite{})
+
+func (s *HealthSuite) SetUpTest(c *C) {
+	s.now = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.tracker = NewTracker(config.Health{FlapThreshold: 3, FlapWindow: 60})
+	s.tracker.now = func() time.Time { return s.now }
+}
+
+func (s *HealthSuite) TestUnknownDestinationIsHealthy(c *C) {
+	c.Assert(s.tracker.InRotation("dst1"), Equals, true)
+	c.Assert(s.tracker.Health("dst1").Healthy, Equals, true)
+}
+
+func (s *HealthSuite) TestReport(c *C) {
+	changed, _ := s.tracker.Report("dst1", true)
+	c.Assert(changed, Equals, false)
+
+	changed, _ = s.tracker.Report("dst1", false)
+	c.Assert(changed, Equals, true)
+	c.Assert(s.tracker.InRotation("dst1"), Equals, false)
+
+	s.now = s.now.Add(2 * time.Minute)
+	changed, _ = s.tracker.Report("dst1", true)
+	c.Assert(changed, Equals, true)
+	c.Assert(s.tracker.InRotation("dst1"), Equals, true)
+
+	health := s.tracker.Health("dst1")
+	c.Assert(health.Healthy, Equals, true)
+	c.Assert(health.Flapping, Equals, false)
+	c.Assert(health.Transitions, HasLen, 2)
+}
+
+func (s *HealthSuite) TestFlapping(c *C) {
+	s.tracker.Report("dst1", false)
+	s.now = s.now.Add(10 * time.Second)
+	s.tracker.Report("dst1", true)
+	s.now = s.now.Add(10 * time.Second)
+	changed, hold := s.tracker.Report("dst1", false)
+	c.Assert(changed, Equals, true)
+	c.Assert(hold, Equals, time.Minute)
+
+	s.now = s.now.Add(10 * time.Second)
+	changed, _ = s.tracker.Report("dst1", true)
+	c.Assert(changed, Equals, false)
+	c.Assert(s.tracker.InRotation("dst1"), Equals, false)
+	c.Assert(s.tracker.Health("dst1").Flapping, Equals, true)
+
+	// Stable for the whole window, back in rotation
+	s.now = s.now.Add(time.Minute)
+	c.Assert(s.tracker.InRotation("dst1"), Equals, true)
+	c.Assert(s.tracker.Health("dst1").Flapping, Equals, false)
+}
+
+func (s *HealthSuite) TestForget(c *C) {
+	s.tracker.Report("dst1", false)
+	s.tracker.Forget("dst1")
+	c.Assert(s.tracker.InRotation("dst1"), Equals, true)
+}
+
+func (s *HealthSuite) TestSubscribe(c *C) {
+	b := bus.New()
+	s.tracker.Subscribe(b)
+	s.tracker.Report("dst1", false)
+	b.Publish(bus.DestinationRemoved{Destination: types.Destination{Name: "dst1"}})
+	c.Assert(s.tracker.InRotation("dst1"), Equals, true)
+}
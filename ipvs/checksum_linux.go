@@ -0,0 +1,65 @@
+package ipvs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	gipvs "github.com/google/seesaw/ipvs"
+)
+
+// Drifted reports whether the IPVS table changed since the last sync, e.g.
+// because it was flushed or edited with ipvsadm. It compares the checksum
+// of the table with the one recorded after the sync, so it's false until
+// the first sync.
+func (ipvs *Ipvs) Drifted() (bool, error) {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	if !ipvs.synced {
+		return false, nil
+	}
+	sum, err := tableChecksum()
+	if err != nil {
+		return false, err
+	}
+	return sum != ipvs.checksum, nil
+}
+
+// recordChecksum records the checksum of the table after a sync. When the
+// table can't be read, drifts are ignored until the next sync. Must be
+// called with the ipvs locked.
+func (ipvs *Ipvs) recordChecksum() {
+	sum, err := tableChecksum()
+	ipvs.checksum = sum
+	ipvs.synced = err == nil
+}
+
+// tableChecksum hashes the services and destinations of the IPVS table,
+// leaving out their stats, which change all the time.
+func tableChecksum() (uint64, error) {
+	var services []*gipvs.Service
+	err := timeOp(opGetServices, nil, func() (err error) {
+		services, err = gipvs.GetServices()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	lines := []string{}
+	for _, gsvc := range services {
+		s := FromService(gsvc)
+		lines = append(lines, fmt.Sprintf("%s %s %v %d %d", s.KernelKey(), s.Scheduler, s.SchedulerFlags, s.PersistenceTimeout, s.PersistenceNetmask))
+		for _, d := range s.Destinations {
+			lines = append(lines, fmt.Sprintf("%s %s %d %s", s.KernelKey(), d.KernelKey(), d.Weight, d.Mode))
+		}
+	}
+	sort.Strings(lines)
+
+	h := fnv.New64a()
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	return h.Sum64(), nil
+}
@@ -0,0 +1,26 @@
+package ipvs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// SyncError is returned by SyncState when part of the state could not be
+// synced to the kernel. Services holds the errors of each service by ID.
+type SyncError struct {
+	Services map[string][]string
+	errors   []string
+}
+
+func (e *SyncError) add(svc *types.Service, msg string) {
+	e.errors = append(e.errors, msg)
+	if svc != nil {
+		e.Services[svc.GetId()] = append(e.Services[svc.GetId()], msg)
+	}
+}
+
+func (e *SyncError) Error() string {
+	return fmt.Sprintf("multiple errors: %s", strings.Join(e.errors, " | "))
+}
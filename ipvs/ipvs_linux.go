@@ -0,0 +1,80 @@
+package ipvs
+
+import (
+	"fmt"
+	"sync"
+
+	gipvs "github.com/google/seesaw/ipvs"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+type Ipvs struct {
+	sync.Mutex
+	// checksum is the one of the table after the last sync, see Drifted
+	checksum uint64
+	synced   bool
+	// managed holds the kernel keys of the services and destinations
+	// created by fusis, the others being conflicts
+	managed map[string]bool
+}
+
+//New creates a new ipvs struct and flushes the IPVS Table
+func New() (*Ipvs, error) {
+	ipvs, err := Init()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ipvs.Flush(); err != nil {
+		return nil, fmt.Errorf("IPVS flushing table failed: %v", err)
+	}
+	ipvs.managed = make(map[string]bool)
+
+	return ipvs, nil
+}
+
+//Init creates a new ipvs struct keeping the current IPVS Table
+func Init() (*Ipvs, error) {
+	if err := gipvs.Init(); err != nil {
+		return nil, fmt.Errorf("IPVS initialisation failed: %v", err)
+	}
+
+	services, err := gipvs.GetServices()
+	if err != nil {
+		return nil, fmt.Errorf("IPVS reading table failed: %v", err)
+	}
+	managed := make(map[string]bool)
+	for _, gsvc := range services {
+		svc := FromService(gsvc)
+		managed[svc.KernelKey()] = true
+		for _, dst := range svc.Destinations {
+			managed[destinationKey(&svc, &dst)] = true
+		}
+	}
+	return &Ipvs{managed: managed}, nil
+}
+
+// SyncState brings the IPVS table to the routing state, see Reconcile
+func (ipvs *Ipvs) SyncState(state State) error {
+	_, err := ipvs.Reconcile(state, false)
+	return err
+}
+
+// Flush flushes all services and destinations from the IPVS table.
+func (ipvs *Ipvs) Flush() error {
+	return timeOp(opFlush, nil, gipvs.Flush)
+}
+
+// GetService reads a service, along with its destinations and stats, from
+// the IPVS table.
+func GetService(svc *types.Service) (types.Service, error) {
+	var service *gipvs.Service
+	err := timeOp(opGetService, svc, func() (err error) {
+		service, err = gipvs.GetService(ToIpvsService(svc))
+		return err
+	})
+	if err != nil {
+		return types.Service{}, err
+	}
+	return FromService(service), nil
+}
@@ -0,0 +1,273 @@
+package ipvs_test
+
+import (
+	"fmt"
+	"sort"
+
+	gipvs "github.com/google/seesaw/ipvs"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/ipvs"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *IpvsSuite) TestNewIpvs(c *C) {
+	i, err := ipvs.New()
+	c.Assert(err, IsNil)
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+}
+
+type serviceList []*gipvs.Service
+
+func (l serviceList) Len() int      { return len(l) }
+func (l serviceList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l serviceList) Less(i, j int) bool {
+	return fmt.Sprintf("%v", l[i].Address) < fmt.Sprintf("%v", l[j].Address)
+}
+
+func matchState(c *C, services1 []*gipvs.Service, state ipvs.State) {
+	for _, s := range services1 {
+		s.Flags = 0
+		s.Statistics = nil
+		for _, d := range s.Destinations {
+			d.Statistics = nil
+		}
+	}
+	stateServices := state.GetServices()
+	cmp := make([]*gipvs.Service, len(stateServices))
+	for i, s := range stateServices {
+		cmp[i] = ipvs.ToIpvsService(&s)
+	}
+	sort.Sort(serviceList(services1))
+	sort.Sort(serviceList(cmp))
+	c.Check(services1, DeepEquals, cmp)
+}
+
+func (s *IpvsSuite) TestIpvsSyncState(c *C) {
+	i, err := ipvs.New()
+	c.Assert(err, IsNil)
+	srv2 := &types.Service{
+		Name:         "test1",
+		Host:         "10.0.9.9",
+		Port:         80,
+		Scheduler:    "lc",
+		Protocol:     "tcp",
+		Destinations: []types.Destination{},
+	}
+	dst2 := &types.Destination{
+		Name:   "test1",
+		Host:   "192.168.9.9",
+		Port:   80,
+		Mode:   "nat",
+		Weight: 1,
+	}
+	s.state.AddService(s.service)
+	s.state.AddDestination(s.destination)
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+	services, err := gipvs.GetServices()
+	c.Assert(err, IsNil)
+	matchState(c, services, s.state)
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+	services, err = gipvs.GetServices()
+	c.Assert(err, IsNil)
+	matchState(c, services, s.state)
+	s.state.DeleteDestination(s.destination)
+	dst2.ServiceId = s.destination.ServiceId
+	s.state.AddDestination(dst2)
+	s.state.AddService(srv2)
+	dst2.Name = "testx"
+	dst2.ServiceId = srv2.GetId()
+	s.state.AddDestination(dst2)
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+	services, err = gipvs.GetServices()
+	c.Assert(err, IsNil)
+	matchState(c, services, s.state)
+	s.state.DeleteService(srv2)
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+	services, err = gipvs.GetServices()
+	c.Assert(err, IsNil)
+	matchState(c, services, s.state)
+}
+
+func (s *IpvsSuite) TestPersistentServiceConversion(c *C) {
+	svc := &types.Service{
+		Host:               "10.0.1.1",
+		Port:               80,
+		Scheduler:          "rr",
+		Protocol:           "tcp",
+		PersistenceTimeout: 300,
+		PersistenceNetmask: 24,
+	}
+	// Services read from the kernel always carry stats
+	fromKernel := func(gsvc *gipvs.Service) types.Service {
+		gsvc.Statistics = &gipvs.ServiceStats{}
+		return ipvs.FromService(gsvc)
+	}
+	gsvc := ipvs.ToIpvsService(svc)
+	c.Assert(gsvc.Flags&gipvs.SFPersistent, Not(Equals), gipvs.ServiceFlags(0))
+	c.Assert(gsvc.Timeout, Equals, uint32(300))
+	back := fromKernel(gsvc)
+	c.Assert(back.PersistenceTimeout, Equals, uint32(300))
+	c.Assert(back.PersistenceNetmask, Equals, uint8(24))
+
+	svc.PersistenceNetmask = 0
+	back = fromKernel(ipvs.ToIpvsService(svc))
+	c.Assert(back.PersistenceNetmask, Equals, uint8(0))
+
+	svc.Host = "2001:db8::1"
+	svc.PersistenceNetmask = 64
+	gsvc = ipvs.ToIpvsService(svc)
+	c.Assert(gsvc.Netmask, Equals, uint32(64))
+	back = fromKernel(gsvc)
+	c.Assert(back.PersistenceNetmask, Equals, uint8(64))
+
+	svc.PersistenceTimeout = 0
+	svc.PersistenceNetmask = 0
+	gsvc = ipvs.ToIpvsService(svc)
+	c.Assert(gsvc.Flags, Equals, gipvs.ServiceFlags(0))
+	c.Assert(fromKernel(gsvc).PersistenceTimeout, Equals, uint32(0))
+}
+
+func (s *IpvsSuite) TestMaglevServiceConversion(c *C) {
+	svc := &types.Service{
+		Host:           "10.0.1.1",
+		Port:           80,
+		Scheduler:      types.SchedulerMaglev,
+		Protocol:       "tcp",
+		SchedulerFlags: []string{types.SchedulerFlagMHPort},
+	}
+	gsvc := ipvs.ToIpvsService(svc)
+	c.Assert(gsvc.Flags, Equals, gipvs.ServiceFlags(0x0010))
+	gsvc.Statistics = &gipvs.ServiceStats{}
+	c.Assert(ipvs.FromService(gsvc).SchedulerFlags, DeepEquals, []string{types.SchedulerFlagMHPort})
+
+	// The same kernel flags mean something else to other schedulers
+	gsvc.Scheduler = "rr"
+	c.Assert(ipvs.FromService(gsvc).SchedulerFlags, IsNil)
+}
+
+func (s *IpvsSuite) TestIpvsDrifted(c *C) {
+	i, err := ipvs.New()
+	c.Assert(err, IsNil)
+	drifted, err := i.Drifted()
+	c.Assert(err, IsNil)
+	c.Assert(drifted, Equals, false)
+
+	s.state.AddService(s.service)
+	s.state.AddDestination(s.destination)
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+	drifted, err = i.Drifted()
+	c.Assert(err, IsNil)
+	c.Assert(drifted, Equals, false)
+
+	// Flushed by another tool
+	err = gipvs.Flush()
+	c.Assert(err, IsNil)
+	drifted, err = i.Drifted()
+	c.Assert(err, IsNil)
+	c.Assert(drifted, Equals, true)
+
+	err = i.SyncState(s.state)
+	c.Assert(err, IsNil)
+	drifted, err = i.Drifted()
+	c.Assert(err, IsNil)
+	c.Assert(drifted, Equals, false)
+}
+
+func (s *IpvsSuite) TestIpvsReconcile(c *C) {
+	i, err := ipvs.New()
+	c.Assert(err, IsNil)
+	s.state.AddService(s.service)
+	s.state.AddDestination(s.destination)
+
+	plan, err := i.Reconcile(s.state, true)
+	c.Assert(err, IsNil)
+	c.Assert(plan.AddServices, HasLen, 1)
+	services, err := gipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 0)
+
+	_, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+	plan, err = i.Reconcile(s.state, true)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Empty(), Equals, true)
+
+	// Only the changed destination is updated
+	s.destination.Weight = 5
+	s.state.UpdateDestination(s.destination)
+	plan, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+	c.Assert(plan.UpdateServices, HasLen, 0)
+	c.Assert(plan.UpdateDestinations, HasLen, 1)
+	c.Assert(plan.UpdateDestinations[0].Destination.Weight, Equals, int32(5))
+
+	// Entries created by other tools are conflicts
+	foreign := &types.Service{Host: "10.0.9.9", Port: 80, Scheduler: "rr", Protocol: "tcp"}
+	err = gipvs.AddService(*ipvs.ToIpvsService(foreign))
+	c.Assert(err, IsNil)
+	plan, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+	c.Assert(plan.DeleteServices, HasLen, 1)
+	c.Assert(plan.Conflicts, DeepEquals, []string{foreign.KernelKey()})
+
+	s.state.DeleteService(s.service)
+	plan, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+	c.Assert(plan.DeleteServices, HasLen, 1)
+	c.Assert(plan.Conflicts, HasLen, 0)
+}
+
+func (s *IpvsSuite) TestIpvsUpdateServiceInPlace(c *C) {
+	i, err := ipvs.New()
+	c.Assert(err, IsNil)
+	svc := *s.service
+	s.state.AddService(&svc)
+	s.state.AddDestination(s.destination)
+	_, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+
+	// The scheduler and persistence are edited without touching the
+	// destinations, so the connections survive
+	svc.Scheduler = "rr"
+	svc.PersistenceTimeout = 300
+	s.state.UpdateService(&svc)
+	plan, err := i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+	c.Assert(plan.UpdateServices, HasLen, 1)
+	c.Assert(plan.AddServices, HasLen, 0)
+	c.Assert(plan.DeleteServices, HasLen, 0)
+	c.Assert(plan.AddDestinations, HasLen, 0)
+	c.Assert(plan.DeleteDestinations, HasLen, 0)
+	services, err := gipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 1)
+	c.Assert(services[0].Scheduler, Equals, "rr")
+	c.Assert(services[0].Timeout, Equals, uint32(300))
+	c.Assert(services[0].Destinations, HasLen, 1)
+
+	// IPVS identifies services by their address, so a new port replaces
+	// the kernel service
+	svc.Port = 8080
+	s.state.UpdateService(&svc)
+	plan, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+	c.Assert(plan.DeleteServices, HasLen, 1)
+	c.Assert(plan.AddServices, HasLen, 1)
+	c.Assert(plan.UpdateServices, HasLen, 0)
+	services, err = gipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 1)
+	c.Assert(services[0].Port, Equals, uint16(8080))
+	c.Assert(services[0].Destinations, HasLen, 1)
+
+	s.state.DeleteService(&svc)
+	_, err = i.Reconcile(s.state, false)
+	c.Assert(err, IsNil)
+}
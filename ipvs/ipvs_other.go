@@ -0,0 +1,54 @@
+//go:build !linux
+// +build !linux
+
+package ipvs
+
+import (
+	"sync"
+
+	"github.com/luizbafilho/fusis/api/types"
+	fusis_net "github.com/luizbafilho/fusis/net"
+)
+
+// IPVS is available on Linux only. These stubs let the packages depending
+// on this one, like engine, be imported on other platforms.
+
+type Ipvs struct {
+	sync.Mutex
+}
+
+func New() (*Ipvs, error) {
+	return nil, fusis_net.ErrUnsupportedPlatform
+}
+
+func Init() (*Ipvs, error) {
+	return nil, fusis_net.ErrUnsupportedPlatform
+}
+
+func (ipvs *Ipvs) SyncState(state State) error {
+	return fusis_net.ErrUnsupportedPlatform
+}
+
+func (ipvs *Ipvs) SyncStatePaced(state State, pacer Pacer) error {
+	return fusis_net.ErrUnsupportedPlatform
+}
+
+func (ipvs *Ipvs) Drifted() (bool, error) {
+	return false, fusis_net.ErrUnsupportedPlatform
+}
+
+func (ipvs *Ipvs) Flush() error {
+	return fusis_net.ErrUnsupportedPlatform
+}
+
+func GetService(svc *types.Service) (types.Service, error) {
+	return types.Service{}, fusis_net.ErrUnsupportedPlatform
+}
+
+func SchedulerAvailable(name string) bool {
+	return false
+}
+
+func (ipvs *Ipvs) Reconcile(state State, dryRun bool) (*Plan, error) {
+	return nil, fusis_net.ErrUnsupportedPlatform
+}
@@ -0,0 +1,59 @@
+package ipvs
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/armon/go-metrics"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// IPVS operations, as named in the metrics and logs
+const (
+	opGetServices       = "get_services"
+	opGetService        = "get_service"
+	opAddService        = "add_service"
+	opUpdateService     = "update_service"
+	opDeleteService     = "delete_service"
+	opAddDestination    = "add_destination"
+	opUpdateDestination = "update_destination"
+	opDeleteDestination = "delete_destination"
+	opFlush             = "flush"
+)
+
+// slowOpThreshold holds the nanoseconds over which operations are logged
+var slowOpThreshold int64
+
+// SetSlowOpThreshold makes the IPVS operations taking longer than d be
+// logged, along with the service they changed. Zero disables it.
+func SetSlowOpThreshold(d time.Duration) {
+	atomic.StoreInt64(&slowOpThreshold, int64(d))
+}
+
+// timeOp runs an IPVS operation on svc, if any, emitting its latency in
+// milliseconds as the fusis.ipvs.<op> sample.
+func timeOp(op string, svc *types.Service, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	metrics.AddSample([]string{"fusis", "ipvs", op}, float32(elapsed)/float32(time.Millisecond))
+	if threshold := time.Duration(atomic.LoadInt64(&slowOpThreshold)); threshold > 0 && elapsed >= threshold {
+		entry := logrus.WithFields(logrus.Fields{"op": op, "duration": elapsed})
+		if svc != nil {
+			entry = entry.WithField("service", opSubject(svc))
+		}
+		entry.Warnf("ipvs: slow %s, took %v", op, elapsed)
+	}
+	return err
+}
+
+// opSubject identifies the service of an operation. Services read from the
+// kernel are only known by their address.
+func opSubject(svc *types.Service) string {
+	if id := svc.GetId(); id != "" {
+		return id
+	}
+	return svc.KernelKey()
+}
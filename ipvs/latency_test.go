@@ -0,0 +1,45 @@
+package ipvs
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/metrics"
+	. "gopkg.in/check.v1"
+)
+
+type LatencySuite struct{}
+
+var _ = Suite(&LatencySuite{})
+
+func (s *LatencySuite) TearDownTest(c *C) {
+	SetSlowOpThreshold(0)
+	logrus.SetOutput(ioutil.Discard)
+}
+
+func (s *LatencySuite) TestTimeOp(c *C) {
+	sink, err := metrics.Setup()
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+
+	failure := errors.New("netlink failure")
+	err = timeOp(opAddService, &types.Service{Name: "web"}, func() error { return failure })
+	c.Assert(err, Equals, failure)
+	c.Assert(out.Len(), Equals, 0)
+
+	SetSlowOpThreshold(time.Millisecond)
+	err = timeOp(opAddService, &types.Service{Host: "10.0.0.1", Port: 80, Protocol: "tcp"}, func() error {
+		time.Sleep(2 * time.Millisecond)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(out.String(), Matches, "(?s).*slow add_service.*service=10.0.0.1-80-tcp.*")
+	// The last count of a histogram includes every sample
+	hist := sink.Snapshot().Histograms["fusis.ipvs.add_service"]
+	c.Assert(hist.Counts[len(hist.Buckets)], Equals, uint64(2))
+}
@@ -0,0 +1,51 @@
+package ipvs
+
+import "time"
+
+// Pacer spreads the operations of a sync over time, so a large one, like
+// the sync of a restored snapshot, doesn't saturate netlink and starve the
+// data plane.
+type Pacer interface {
+	// Pace is called after each operation, with the time it took, and
+	// blocks until the next one may run.
+	Pace(took time.Duration)
+}
+
+// ChunkPacer runs the operations in chunks, pausing between them to keep
+// the average rate. The pause is at least as long as the chunk took, so the
+// kernel gets to breathe when it's slow to apply them.
+type ChunkPacer struct {
+	rate  int
+	chunk int
+
+	n     int
+	busy  time.Duration
+	sleep func(time.Duration)
+}
+
+// NewChunkPacer creates a pacer running chunks of chunk operations at rate
+// operations per second. A zero rate only pauses for the back-pressure.
+func NewChunkPacer(rate, chunk int) *ChunkPacer {
+	if chunk <= 0 {
+		chunk = 1
+	}
+	return &ChunkPacer{rate: rate, chunk: chunk, sleep: time.Sleep}
+}
+
+func (p *ChunkPacer) Pace(took time.Duration) {
+	p.n++
+	p.busy += took
+	if p.n < p.chunk {
+		return
+	}
+
+	var pause time.Duration
+	if p.rate > 0 {
+		pause = time.Duration(p.chunk)*time.Second/time.Duration(p.rate) - p.busy
+	}
+	if pause < p.busy {
+		pause = p.busy
+	}
+	p.n, p.busy = 0, 0
+	p.sleep(pause)
+}
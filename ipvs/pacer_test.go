@@ -0,0 +1,34 @@
+package ipvs
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type PacerSuite struct{}
+
+var _ = Suite(&PacerSuite{})
+
+func (s *PacerSuite) TestChunkPacer(c *C) {
+	var pauses []time.Duration
+	p := NewChunkPacer(100, 10)
+	p.sleep = func(d time.Duration) { pauses = append(pauses, d) }
+
+	// A chunk of 10 operations takes 100ms at 100 operations per second
+	for i := 0; i < 10; i++ {
+		p.Pace(time.Millisecond)
+	}
+	c.Assert(pauses, DeepEquals, []time.Duration{90 * time.Millisecond})
+
+	// Slow operations pause as long as they took
+	for i := 0; i < 10; i++ {
+		p.Pace(20 * time.Millisecond)
+	}
+	c.Assert(pauses, DeepEquals, []time.Duration{90 * time.Millisecond, 200 * time.Millisecond})
+
+	for i := 0; i < 9; i++ {
+		p.Pace(time.Millisecond)
+	}
+	c.Assert(pauses, HasLen, 2)
+}
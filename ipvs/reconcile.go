@@ -0,0 +1,35 @@
+package ipvs
+
+import "github.com/luizbafilho/fusis/api/types"
+
+// Plan holds the changes bringing the IPVS table to the routing state.
+// Services and destinations already matching the state are left alone.
+type Plan struct {
+	AddServices        []*types.Service
+	UpdateServices     []*types.Service
+	DeleteServices     []*types.Service
+	AddDestinations    []DestinationChange
+	UpdateDestinations []DestinationChange
+	DeleteDestinations []DestinationChange
+	// Conflicts are the kernel keys of the entries of the table fusis
+	// didn't create, e.g. with ipvsadm. They're deleted like any other
+	// entry missing from the state.
+	Conflicts []string
+}
+
+// DestinationChange is a change to a destination of a service
+type DestinationChange struct {
+	Service     *types.Service
+	Destination *types.Destination
+}
+
+// Empty reports whether the table already matches the state
+func (p *Plan) Empty() bool {
+	return len(p.AddServices) == 0 && len(p.UpdateServices) == 0 && len(p.DeleteServices) == 0 &&
+		len(p.AddDestinations) == 0 && len(p.UpdateDestinations) == 0 && len(p.DeleteDestinations) == 0
+}
+
+// destinationKey identifies a destination of a service in the kernel
+func destinationKey(svc *types.Service, dst *types.Destination) string {
+	return svc.KernelKey() + "/" + dst.KernelKey()
+}
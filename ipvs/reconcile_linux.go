@@ -0,0 +1,203 @@
+package ipvs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	gipvs "github.com/google/seesaw/ipvs"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// Reconcile diffs the IPVS table against the routing state and applies the
+// resulting plan, unless dryRun is set. Errors applying the plan are
+// returned as a SyncError, after every change was tried.
+func (ipvs *Ipvs) Reconcile(state State, dryRun bool) (*Plan, error) {
+	return ipvs.reconcile(state, dryRun, nil)
+}
+
+// SyncStatePaced is like SyncState, the operations being paced by pacer.
+// The table is locked until the sync completes.
+func (ipvs *Ipvs) SyncStatePaced(state State, pacer Pacer) error {
+	_, err := ipvs.reconcile(state, false, pacer)
+	return err
+}
+
+func (ipvs *Ipvs) reconcile(state State, dryRun bool, pacer Pacer) (*Plan, error) {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	plan, err := ipvs.plan(state)
+	if err != nil || dryRun {
+		return plan, err
+	}
+	if ipvs.managed == nil {
+		ipvs.managed = make(map[string]bool)
+	}
+	defer ipvs.recordChecksum()
+	return plan, ipvs.apply(plan, pacer)
+}
+
+func (ipvs *Ipvs) plan(state State) (*Plan, error) {
+	var current []*gipvs.Service
+	err := timeOp(opGetServices, nil, func() (err error) {
+		current, err = gipvs.GetServices()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make(map[string]*types.Service)
+	services := state.GetServices()
+	for i, s := range services {
+		// Proxied services are served in userspace
+		if s.IsProxied() {
+			continue
+		}
+		desired[s.KernelKey()] = &services[i]
+		// The clients of the policies are balanced by fwmark services
+		for _, p := range s.PolicyServices() {
+			p := p
+			desired[p.KernelKey()] = &p
+		}
+	}
+
+	plan := &Plan{}
+	for _, gsvc := range current {
+		old := FromService(gsvc)
+		key := old.KernelKey()
+		svc, ok := desired[key]
+		if !ok {
+			plan.DeleteServices = append(plan.DeleteServices, &old)
+			ipvs.checkConflict(plan, key)
+			continue
+		}
+		delete(desired, key)
+
+		if serviceChanged(gsvc, ToIpvsService(svc)) {
+			plan.UpdateServices = append(plan.UpdateServices, svc)
+		}
+		ipvs.planDestinations(plan, &old, svc)
+	}
+	for _, svc := range desired {
+		plan.AddServices = append(plan.AddServices, svc)
+	}
+	return plan, nil
+}
+
+func (ipvs *Ipvs) planDestinations(plan *Plan, old, svc *types.Service) {
+	desired := make(map[string]*types.Destination)
+	for i, d := range svc.Destinations {
+		desired[d.KernelKey()] = &svc.Destinations[i]
+	}
+	for i, d := range old.Destinations {
+		dst, ok := desired[d.KernelKey()]
+		if !ok {
+			plan.DeleteDestinations = append(plan.DeleteDestinations, DestinationChange{svc, &old.Destinations[i]})
+			ipvs.checkConflict(plan, destinationKey(svc, &d))
+			continue
+		}
+		delete(desired, d.KernelKey())
+
+		if d.Weight != dst.Weight || stringToDestinationFlags(d.Mode) != stringToDestinationFlags(dst.Mode) {
+			plan.UpdateDestinations = append(plan.UpdateDestinations, DestinationChange{svc, dst})
+		}
+	}
+	for _, dst := range desired {
+		plan.AddDestinations = append(plan.AddDestinations, DestinationChange{svc, dst})
+	}
+}
+
+func (ipvs *Ipvs) checkConflict(plan *Plan, key string) {
+	if !ipvs.managed[key] {
+		plan.Conflicts = append(plan.Conflicts, key)
+	}
+}
+
+// serviceChanged reports whether the settings of a kernel service differ
+// from the desired ones. The hashed flag is set by the kernel itself.
+func serviceChanged(current, desired *gipvs.Service) bool {
+	return current.Scheduler != desired.Scheduler ||
+		current.Flags&^gipvs.SFHashed != desired.Flags ||
+		current.Timeout != desired.Timeout ||
+		current.Netmask != desired.Netmask
+}
+
+func (ipvs *Ipvs) apply(plan *Plan, pacer Pacer) error {
+	// paced runs the operations of the plan, through the pacer if any
+	paced := func(op string, svc *types.Service, fn func() error) error {
+		start := time.Now()
+		err := timeOp(op, svc, fn)
+		if pacer != nil {
+			pacer.Pace(time.Since(start))
+		}
+		return err
+	}
+
+	for _, key := range plan.Conflicts {
+		logrus.WithField("key", key).Warn("Removing IPVS entry not created by fusis")
+	}
+
+	syncErr := &SyncError{Services: make(map[string][]string)}
+	for _, s := range plan.AddServices {
+		err := paced(opAddService, s, func() error { return gipvs.AddService(*ToIpvsService(s)) })
+		if err != nil {
+			syncErr.add(s, fmt.Sprintf("error adding service %#v: %s", s, err))
+			continue
+		}
+		ipvs.managed[s.KernelKey()] = true
+		for i := range s.Destinations {
+			ipvs.managed[destinationKey(s, &s.Destinations[i])] = true
+		}
+	}
+	for _, s := range plan.DeleteServices {
+		err := paced(opDeleteService, s, func() error { return gipvs.DeleteService(*ToIpvsService(s)) })
+		if err != nil {
+			syncErr.add(nil, fmt.Sprintf("error deleting service %#v: %s", s, err))
+			continue
+		}
+		delete(ipvs.managed, s.KernelKey())
+		for i := range s.Destinations {
+			delete(ipvs.managed, destinationKey(s, &s.Destinations[i]))
+		}
+	}
+	for _, s := range plan.UpdateServices {
+		err := paced(opUpdateService, s, func() error { return gipvs.UpdateService(*ToIpvsService(s)) })
+		if err != nil {
+			syncErr.add(s, fmt.Sprintf("error updating service %#v: %s", s, err))
+		}
+	}
+	for _, c := range plan.AddDestinations {
+		err := paced(opAddDestination, c.Service, func() error {
+			return gipvs.AddDestination(*ToIpvsService(c.Service), *toIpvsDestination(c.Destination))
+		})
+		if err != nil {
+			syncErr.add(c.Service, fmt.Sprintf("error adding destination %#v: %s", c.Destination, err))
+			continue
+		}
+		ipvs.managed[destinationKey(c.Service, c.Destination)] = true
+	}
+	for _, c := range plan.DeleteDestinations {
+		err := paced(opDeleteDestination, c.Service, func() error {
+			return gipvs.DeleteDestination(*ToIpvsService(c.Service), *toIpvsDestination(c.Destination))
+		})
+		if err != nil {
+			syncErr.add(c.Service, fmt.Sprintf("error deleting destination %#v: %s", c.Destination, err))
+			continue
+		}
+		delete(ipvs.managed, destinationKey(c.Service, c.Destination))
+	}
+	for _, c := range plan.UpdateDestinations {
+		err := paced(opUpdateDestination, c.Service, func() error {
+			return gipvs.UpdateDestination(*ToIpvsService(c.Service), *toIpvsDestination(c.Destination))
+		})
+		if err != nil {
+			syncErr.add(c.Service, fmt.Sprintf("error updating destination %#v: %s", c.Destination, err))
+		}
+	}
+	if len(syncErr.errors) > 0 {
+		return syncErr
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package ipvs
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+)
+
+var (
+	schedulersLock sync.Mutex
+	schedulers     = make(map[string]bool)
+)
+
+// SchedulerAvailable reports whether the kernel provides the scheduler,
+// loading its module if needed. Available schedulers are cached, as modules
+// stay loaded, while missing ones are looked up again, in case their module
+// was installed since.
+func SchedulerAvailable(name string) bool {
+	schedulersLock.Lock()
+	defer schedulersLock.Unlock()
+
+	if schedulers[name] {
+		return true
+	}
+	module := "ip_vs_" + name
+	available := moduleLoaded(module)
+	if !available && exec.Command("modprobe", "-q", module).Run() == nil {
+		available = moduleLoaded(module)
+	}
+	schedulers[name] = available
+	return available
+}
+
+func moduleLoaded(module string) bool {
+	_, err := os.Stat("/sys/module/" + module)
+	return err == nil
+}
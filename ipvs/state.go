@@ -1,6 +1,7 @@
 package ipvs
 
 import (
+	"sync"
 	"time"
 
 	"github.com/luizbafilho/fusis/api/types"
@@ -10,27 +11,46 @@ type State interface {
 	GetServices() []types.Service
 	GetService(name string) (*types.Service, error)
 	AddService(svc *types.Service)
+	UpdateService(svc *types.Service)
 	DeleteService(svc *types.Service)
 
 	GetDestination(name string) (*types.Destination, error)
 	AddDestination(dst *types.Destination)
+	UpdateDestination(dst *types.Destination)
 	DeleteDestination(dst *types.Destination)
+	GetDestinations() []types.Destination
+	GetServiceByExternalId(ref string) (*types.Service, error)
+	GetDestinationByExternalId(ref string) (*types.Destination, error)
+	Reset()
 	CollectStats(tick time.Time)
 }
 
+// FusisState is the routing state kept by the FSM. It's safe for concurrent
+// use, and the services and destinations it returns are copies, so readers
+// like the stats collector don't race with the FSM applying commands.
 type FusisState struct {
+	sync.RWMutex
 	Services     map[string]types.Service
 	Destinations map[string]types.Destination
+
+	// serviceRefs and destinationRefs index the services and destinations
+	// ids by their external ids
+	serviceRefs     map[string]string
+	destinationRefs map[string]string
 }
 
 func NewFusisState() *FusisState {
 	return &FusisState{
-		Services:     make(map[string]types.Service),
-		Destinations: make(map[string]types.Destination),
+		Services:        make(map[string]types.Service),
+		Destinations:    make(map[string]types.Destination),
+		serviceRefs:     make(map[string]string),
+		destinationRefs: make(map[string]string),
 	}
 }
 
 func (s *FusisState) GetServices() []types.Service {
+	s.RLock()
+	defer s.RUnlock()
 	services := []types.Service{}
 	for _, v := range s.Services {
 		s.getDestinations(&v)
@@ -40,6 +60,8 @@ func (s *FusisState) GetServices() []types.Service {
 }
 
 func (s *FusisState) GetService(name string) (*types.Service, error) {
+	s.RLock()
+	defer s.RUnlock()
 	svc := s.Services[name]
 	if svc.Name == "" {
 		return nil, types.ErrServiceNotFound
@@ -48,6 +70,7 @@ func (s *FusisState) GetService(name string) (*types.Service, error) {
 	return &svc, nil
 }
 
+// getDestinations must be called with the state locked
 func (s *FusisState) getDestinations(svc *types.Service) {
 	dsts := []types.Destination{}
 	for _, d := range s.Destinations {
@@ -58,15 +81,59 @@ func (s *FusisState) getDestinations(svc *types.Service) {
 	svc.Destinations = dsts
 }
 
+// GetServiceByExternalId looks ref up in the external id index
+func (s *FusisState) GetServiceByExternalId(ref string) (*types.Service, error) {
+	s.RLock()
+	id, ok := s.serviceRefs[ref]
+	s.RUnlock()
+	if !ok || ref == "" {
+		return nil, types.ErrServiceNotFound
+	}
+	return s.GetService(id)
+}
+
 func (s *FusisState) AddService(svc *types.Service) {
+	s.Lock()
+	defer s.Unlock()
+	s.putService(svc)
+}
+
+func (s *FusisState) UpdateService(svc *types.Service) {
+	s.Lock()
+	defer s.Unlock()
+	s.putService(svc)
+}
+
+// putService must be called with the state locked
+func (s *FusisState) putService(svc *types.Service) {
+	if old, ok := s.Services[svc.GetId()]; ok && old.ExternalId != "" {
+		delete(s.serviceRefs, old.ExternalId)
+	}
 	s.Services[svc.GetId()] = *svc
+	if svc.ExternalId != "" {
+		s.serviceRefs[svc.ExternalId] = svc.GetId()
+	}
 }
 
+// DeleteService removes the service along with its destinations, so they
+// don't come back if a service with the same id is created again.
 func (s *FusisState) DeleteService(svc *types.Service) {
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.Services[svc.GetId()]; ok && old.ExternalId != "" {
+		delete(s.serviceRefs, old.ExternalId)
+	}
 	delete(s.Services, svc.GetId())
+	for id, d := range s.Destinations {
+		if d.ServiceId == svc.GetId() {
+			s.deleteDestination(id)
+		}
+	}
 }
 
 func (s *FusisState) GetDestination(name string) (*types.Destination, error) {
+	s.RLock()
+	defer s.RUnlock()
 	dst := s.Destinations[name]
 	if dst.Name == "" {
 		return nil, types.ErrDestinationNotFound
@@ -74,12 +141,72 @@ func (s *FusisState) GetDestination(name string) (*types.Destination, error) {
 	return &dst, nil
 }
 
+// GetDestinations returns every destination, including the ones whose
+// service doesn't exist
+func (s *FusisState) GetDestinations() []types.Destination {
+	s.RLock()
+	defer s.RUnlock()
+	dsts := []types.Destination{}
+	for _, d := range s.Destinations {
+		dsts = append(dsts, d)
+	}
+	return dsts
+}
+
+// GetDestinationByExternalId looks ref up in the external id index
+func (s *FusisState) GetDestinationByExternalId(ref string) (*types.Destination, error) {
+	s.RLock()
+	id, ok := s.destinationRefs[ref]
+	s.RUnlock()
+	if !ok || ref == "" {
+		return nil, types.ErrDestinationNotFound
+	}
+	return s.GetDestination(id)
+}
+
 func (s *FusisState) AddDestination(dst *types.Destination) {
+	s.Lock()
+	defer s.Unlock()
+	s.putDestination(dst)
+}
+
+func (s *FusisState) UpdateDestination(dst *types.Destination) {
+	s.Lock()
+	defer s.Unlock()
+	s.putDestination(dst)
+}
+
+// putDestination must be called with the state locked
+func (s *FusisState) putDestination(dst *types.Destination) {
+	s.deleteDestination(dst.GetId())
 	s.Destinations[dst.GetId()] = *dst
+	if dst.ExternalId != "" {
+		s.destinationRefs[dst.ExternalId] = dst.GetId()
+	}
 }
 
 func (s *FusisState) DeleteDestination(dst *types.Destination) {
-	delete(s.Destinations, dst.GetId())
+	s.Lock()
+	defer s.Unlock()
+	s.deleteDestination(dst.GetId())
+}
+
+// deleteDestination must be called with the state locked
+func (s *FusisState) deleteDestination(id string) {
+	if old, ok := s.Destinations[id]; ok && old.ExternalId != "" {
+		delete(s.destinationRefs, old.ExternalId)
+	}
+	delete(s.Destinations, id)
+}
+
+// Reset removes every service and destination
+func (s *FusisState) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.Services = make(map[string]types.Service)
+	s.Destinations = make(map[string]types.Destination)
+	s.serviceRefs = make(map[string]string)
+	s.destinationRefs = make(map[string]string)
 }
 
 func (s *FusisState) CollectStats(tick time.Time) {
@@ -40,6 +40,16 @@ func (s *IpvsSuite) TestDelService(c *C) {
 	c.Assert(err, Equals, types.ErrServiceNotFound)
 }
 
+func (s *IpvsSuite) TestDelServiceRemovesDestinations(c *C) {
+	s.state.AddService(s.service)
+	s.state.AddDestination(s.destination)
+	s.state.DeleteService(s.service)
+	s.state.AddService(s.service)
+
+	_, err := s.state.GetDestination(s.destination.Name)
+	c.Assert(err, Equals, types.ErrDestinationNotFound)
+}
+
 func (s *IpvsSuite) TestAddDestination(c *C) {
 	s.state.AddService(s.service)
 	s.state.AddDestination(s.destination)
@@ -57,3 +67,42 @@ func (s *IpvsSuite) TestDelDestination(c *C) {
 	_, err := s.state.GetDestination(s.destination.Name)
 	c.Assert(err, DeepEquals, types.ErrDestinationNotFound)
 }
+
+func (s *IpvsSuite) TestReset(c *C) {
+	s.state.AddService(s.service)
+	s.state.AddDestination(s.destination)
+	c.Assert(s.state.GetDestinations(), DeepEquals, []types.Destination{*s.destination})
+
+	s.state.Reset()
+	c.Assert(s.state.GetServices(), HasLen, 0)
+	c.Assert(s.state.GetDestinations(), HasLen, 0)
+}
+
+func (s *IpvsSuite) TestExternalIdIndex(c *C) {
+	svc := *s.service
+	svc.ExternalId = "app-1"
+	s.state.AddService(&svc)
+	dst := *s.destination
+	dst.ExternalId = "pod-1"
+	s.state.AddDestination(&dst)
+
+	found, err := s.state.GetServiceByExternalId("app-1")
+	c.Assert(err, IsNil)
+	c.Assert(found.GetId(), Equals, svc.GetId())
+	foundDst, err := s.state.GetDestinationByExternalId("pod-1")
+	c.Assert(err, IsNil)
+	c.Assert(foundDst.GetId(), Equals, dst.GetId())
+
+	svc.ExternalId = "app-2"
+	s.state.UpdateService(&svc)
+	_, err = s.state.GetServiceByExternalId("app-1")
+	c.Assert(err, Equals, types.ErrServiceNotFound)
+	_, err = s.state.GetServiceByExternalId("app-2")
+	c.Assert(err, IsNil)
+
+	s.state.DeleteService(&svc)
+	_, err = s.state.GetServiceByExternalId("app-2")
+	c.Assert(err, Equals, types.ErrServiceNotFound)
+	_, err = s.state.GetDestinationByExternalId("pod-1")
+	c.Assert(err, Equals, types.ErrDestinationNotFound)
+}
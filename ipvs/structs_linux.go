@@ -3,6 +3,7 @@ package ipvs
 import (
 	"net"
 	"syscall"
+	"unsafe"
 
 	gipvs "github.com/google/seesaw/ipvs"
 	"github.com/luizbafilho/fusis/api/types"
@@ -14,6 +15,19 @@ const (
 	RouteMode  = gipvs.DFForwardRoute
 )
 
+// The kernel IP_VS_SVC_F_SCHED1 and IP_VS_SVC_F_SCHED2 service flags, whose
+// meaning depends on the scheduler
+const (
+	sfSched1 gipvs.ServiceFlags = 0x0008
+	sfSched2 gipvs.ServiceFlags = 0x0010
+)
+
+// schedulerFlags maps the scheduler flags to the kernel ones
+var schedulerFlags = map[string]gipvs.ServiceFlags{
+	types.SchedulerFlagMHFallback: sfSched1,
+	types.SchedulerFlagMHPort:     sfSched2,
+}
+
 func stringToIPProto(s string) gipvs.IPProto {
 	var value gipvs.IPProto
 	if s == "udp" {
@@ -42,7 +56,8 @@ func stringToDestinationFlags(s string) gipvs.DestinationFlags {
 	var flag gipvs.DestinationFlags
 
 	switch s {
-	case "nat":
+	case "nat", types.ModeFullNAT:
+		// The source of full nat packets is rewritten by iptables
 		flag = NatMode
 	case "tunnel":
 		flag = TunnelMode
@@ -78,13 +93,67 @@ func ToIpvsService(s *types.Service) *gipvs.Service {
 		destinations = append(destinations, toIpvsDestination(&dest))
 	}
 
-	return &gipvs.Service{
+	svc := &gipvs.Service{
 		Address:      net.ParseIP(s.Host),
 		Port:         s.Port,
 		Protocol:     stringToIPProto(s.Protocol),
 		Scheduler:    s.Scheduler,
 		Destinations: destinations,
 	}
+	if s.FirewallMark > 0 {
+		// The kernel ignores the address and port of fwmark services, but
+		// the address family must match the destinations one
+		svc.Address = net.IPv4zero.To4()
+		svc.Port = 0
+		svc.Protocol = syscall.IPPROTO_TCP
+		svc.FirewallMark = s.FirewallMark
+	}
+	svc.Netmask = kernelNetmask(svc.Address, s.PersistenceNetmask)
+	if s.PersistenceTimeout > 0 {
+		svc.Flags |= gipvs.SFPersistent
+		svc.Timeout = s.PersistenceTimeout
+	}
+	for _, flag := range s.SchedulerFlags {
+		svc.Flags |= schedulerFlags[flag]
+	}
+	return svc
+}
+
+// kernelNetmask converts a persistence prefix length to the netmask format
+// the kernel expects for the family of addr: a netmask in network byte
+// order for IPv4, and the prefix length itself for IPv6.
+func kernelNetmask(addr net.IP, prefix uint8) uint32 {
+	if addr.To4() == nil {
+		if prefix == 0 {
+			return 128
+		}
+		return uint32(prefix)
+	}
+	if prefix == 0 {
+		prefix = 32
+	}
+	mask := net.CIDRMask(int(prefix), 32)
+	// The netlink attribute is sent in host byte order, so the bytes of the
+	// mask are reinterpreted as is
+	return *(*uint32)(unsafe.Pointer(&mask[0]))
+}
+
+// persistenceNetmask is the inverse of kernelNetmask. Full length masks are
+// reported as 0, the default.
+func persistenceNetmask(addr net.IP, netmask uint32) uint8 {
+	if addr.To4() == nil {
+		if netmask >= 128 {
+			return 0
+		}
+		return uint8(netmask)
+	}
+	mask := make(net.IPMask, 4)
+	*(*uint32)(unsafe.Pointer(&mask[0])) = netmask
+	ones, bits := mask.Size()
+	if bits == 0 || ones == 32 {
+		return 0
+	}
+	return uint8(ones)
 }
 
 func toIpvsDestination(d *types.Destination) *gipvs.Destination {
@@ -127,14 +196,27 @@ func FromService(s *gipvs.Service) types.Service {
 		destinations = append(destinations, fromDestination(dst))
 	}
 
-	return types.Service{
+	svc := types.Service{
 		Host:         s.Address.String(),
 		Port:         s.Port,
 		Protocol:     ipProtoToString(s.Protocol),
 		Scheduler:    s.Scheduler,
+		FirewallMark: s.FirewallMark,
 		Destinations: destinations,
 		Stats:        getServiceStats(s),
 	}
+	if s.Flags&gipvs.SFPersistent != 0 {
+		svc.PersistenceTimeout = s.Timeout
+		svc.PersistenceNetmask = persistenceNetmask(s.Address, s.Netmask)
+	}
+	if s.Scheduler == types.SchedulerMaglev {
+		for _, flag := range []string{types.SchedulerFlagMHFallback, types.SchedulerFlagMHPort} {
+			if s.Flags&schedulerFlags[flag] != 0 {
+				svc.SchedulerFlags = append(svc.SchedulerFlags, flag)
+			}
+		}
+	}
+	return svc
 }
 
 func fromDestination(d *gipvs.Destination) types.Destination {
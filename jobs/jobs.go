@@ -0,0 +1,146 @@
+// Package jobs runs the long running operations started by the API in
+// background, keeping their status and progress so clients can poll them
+// instead of holding a connection open until they finish.
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// DefaultMaxFinished is the number of finished jobs kept by default. The
+// oldest ones are forgotten first.
+const DefaultMaxFinished = 100
+
+// Progress is how a running job reports its steps
+type Progress struct {
+	manager *Manager
+	id      string
+}
+
+// Step records n more steps of the job as done
+func (p *Progress) Step(n int) {
+	p.manager.update(p.id, func(j *types.Job) { j.Done += n })
+}
+
+// Func is the operation of a job. It returns the job result.
+type Func func(p *Progress) (interface{}, error)
+
+// Manager runs jobs and keeps their status in memory.
+type Manager struct {
+	sync.Mutex
+	maxFinished int
+	jobs        map[string]*types.Job
+	finished    []string
+	now         func() time.Time
+}
+
+func NewManager(maxFinished int) *Manager {
+	if maxFinished <= 0 {
+		maxFinished = DefaultMaxFinished
+	}
+	return &Manager{
+		maxFinished: maxFinished,
+		jobs:        make(map[string]*types.Job),
+		now:         time.Now,
+	}
+}
+
+// Start runs fn in background as a job of the given kind and total steps,
+// returning the job as started.
+func (m *Manager) Start(kind string, total int, fn Func) types.Job {
+	m.Lock()
+	job := &types.Job{
+		Id:        newId(),
+		Kind:      kind,
+		Status:    types.JobRunning,
+		Total:     total,
+		StartedAt: m.now(),
+	}
+	m.jobs[job.Id] = job
+	started := *job
+	m.Unlock()
+
+	go m.run(job.Id, fn)
+	return started
+}
+
+func (m *Manager) run(id string, fn Func) {
+	result, err := func() (result interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic running job: %v", r)
+			}
+		}()
+		return fn(&Progress{manager: m, id: id})
+	}()
+
+	m.update(id, func(j *types.Job) {
+		now := m.now()
+		j.FinishedAt = &now
+		if err != nil {
+			j.Status = types.JobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = types.JobSucceeded
+		j.Result = result
+		j.Done = j.Total
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	m.finished = append(m.finished, id)
+	if len(m.finished) > m.maxFinished {
+		for _, old := range m.finished[:len(m.finished)-m.maxFinished] {
+			delete(m.jobs, old)
+		}
+		m.finished = m.finished[len(m.finished)-m.maxFinished:]
+	}
+}
+
+func (m *Manager) update(id string, fn func(j *types.Job)) {
+	m.Lock()
+	defer m.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		fn(j)
+	}
+}
+
+// Get returns a job by id
+func (m *Manager) Get(id string) (*types.Job, error) {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, types.ErrJobNotFound
+	}
+	job := *j
+	return &job, nil
+}
+
+// List returns the known jobs, oldest first
+func (m *Manager) List() []types.Job {
+	m.Lock()
+	defer m.Unlock()
+	jobs := make([]types.Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].StartedAt.Before(jobs[k].StartedAt) })
+	return jobs
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("error generating job id: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
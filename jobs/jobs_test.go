@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type JobsSuite struct{}
+
+var _ = Suite(&JobsSuite{})
+
+func wait(c *C, m *Manager, id string) *types.Job {
+	for i := 0; i < 100; i++ {
+		job, err := m.Get(id)
+		c.Assert(err, IsNil)
+		if job.Status != types.JobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("job %s still running", id)
+	return nil
+}
+
+func (s *JobsSuite) TestStart(c *C) {
+	m := NewManager(0)
+	step := make(chan struct{})
+	job := m.Start("drain", 2, func(p *Progress) (interface{}, error) {
+		p.Step(1)
+		<-step
+		return "done", nil
+	})
+	c.Assert(job.Status, Equals, types.JobRunning)
+	c.Assert(job.Kind, Equals, "drain")
+	c.Assert(job.Total, Equals, 2)
+
+	close(step)
+	finished := wait(c, m, job.Id)
+	c.Assert(finished.Status, Equals, types.JobSucceeded)
+	c.Assert(finished.Done, Equals, 2)
+	c.Assert(finished.Result, Equals, "done")
+	c.Assert(finished.FinishedAt, NotNil)
+
+	_, err := m.Get("unknown")
+	c.Assert(err, Equals, types.ErrJobNotFound)
+}
+
+func (s *JobsSuite) TestStartFailed(c *C) {
+	m := NewManager(0)
+	failed := m.Start("batch", 1, func(p *Progress) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	panicked := m.Start("batch", 1, func(p *Progress) (interface{}, error) {
+		panic("oops")
+	})
+
+	job := wait(c, m, failed.Id)
+	c.Assert(job.Status, Equals, types.JobFailed)
+	c.Assert(job.Error, Equals, "boom")
+	job = wait(c, m, panicked.Id)
+	c.Assert(job.Status, Equals, types.JobFailed)
+	c.Assert(job.Error, Equals, "panic running job: oops")
+}
+
+func (s *JobsSuite) TestMaxFinished(c *C) {
+	m := NewManager(2)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job := m.Start("drain", 0, func(p *Progress) (interface{}, error) { return nil, nil })
+		wait(c, m, job.Id)
+		ids = append(ids, job.Id)
+	}
+	_, err := m.Get(ids[0])
+	c.Assert(err, Equals, types.ErrJobNotFound)
+	c.Assert(m.List(), HasLen, 2)
+}
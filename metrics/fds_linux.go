@@ -0,0 +1,18 @@
+package metrics
+
+import "os"
+
+// openFDs counts the file descriptors open by the process
+func openFDs() (int, error) {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	fds, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// Leave out the descriptor reading the directory
+	return len(fds) - 1, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package metrics
+
+import "errors"
+
+func openFDs() (int, error) {
+	return 0, errors.New("open file descriptors are only counted on Linux")
+}
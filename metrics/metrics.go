@@ -0,0 +1,223 @@
+// Package metrics collects the process metrics of a balancer: the Go
+// runtime ones (goroutines, heap, GC pauses), the open file descriptors and
+// the timings emitted by raft, so control plane slowness can be correlated
+// with resource pressure. They're kept in memory and served by the API.
+package metrics
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+)
+
+const (
+	// interval is the duration of each aggregation interval
+	interval = 10 * time.Second
+	// retain is how long the intervals are kept
+	retain = time.Minute
+)
+
+// DefaultHistograms are the samples kept as histograms, besides being
+// aggregated, with their bucket upper bounds. Raft, failover and IPVS
+// timings are in milliseconds and GC pauses in nanoseconds.
+var DefaultHistograms = map[string][]float64{
+	"fusis.failover.total":          {250, 500, 1000, 2000, 5000, 10000, 30000},
+	"fusis.ipvs.get_services":       ipvsBuckets,
+	"fusis.ipvs.get_service":        ipvsBuckets,
+	"fusis.ipvs.add_service":        ipvsBuckets,
+	"fusis.ipvs.update_service":     ipvsBuckets,
+	"fusis.ipvs.delete_service":     ipvsBuckets,
+	"fusis.ipvs.add_destination":    ipvsBuckets,
+	"fusis.ipvs.update_destination": ipvsBuckets,
+	"fusis.ipvs.delete_destination": ipvsBuckets,
+	"fusis.ipvs.flush":              ipvsBuckets,
+	"raft.commitTime":               {1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	"raft.fsm.apply":                {0.1, 0.5, 1, 5, 10, 50, 100},
+	"runtime.gc_pause_ns":           {1e4, 1e5, 5e5, 1e6, 5e6, 1e7, 1e8},
+}
+
+// ipvsBuckets are the bounds of the IPVS operation histograms, which
+// usually take well under a millisecond
+var ipvsBuckets = []float64{0.1, 0.5, 1, 5, 10, 50, 100, 500}
+
+// Aggregate is the rolled up view of a counter or sample in an interval
+type Aggregate struct {
+	Count  int     `json:"count"`
+	Sum    float64 `json:"sum"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+}
+
+// Histogram counts the samples at most each of its bucket upper bounds,
+// since the process started. Its last count includes every sample.
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+}
+
+func (h *Histogram) add(val float64) {
+	for i, bound := range h.Buckets {
+		if val <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Counts[len(h.Buckets)]++
+	h.Sum += val
+}
+
+// Snapshot holds the latest gauges, the counters and samples aggregated in
+// the last complete interval, and the histograms.
+type Snapshot struct {
+	Interval   time.Time            `json:"interval"`
+	Gauges     map[string]float32   `json:"gauges"`
+	Counters   map[string]Aggregate `json:"counters"`
+	Samples    map[string]Aggregate `json:"samples"`
+	Histograms map[string]Histogram `json:"histograms"`
+}
+
+// Sink aggregates the metrics in memory, keeping histograms of some of the
+// samples.
+type Sink struct {
+	*gometrics.InmemSink
+
+	sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// NewSink creates a sink keeping histograms of the given samples, keyed by
+// their flattened names.
+func NewSink(histograms map[string][]float64) *Sink {
+	s := &Sink{
+		InmemSink:  gometrics.NewInmemSink(interval, retain),
+		histograms: make(map[string]*Histogram, len(histograms)),
+	}
+	for key, buckets := range histograms {
+		s.histograms[key] = &Histogram{Buckets: buckets, Counts: make([]uint64, len(buckets)+1)}
+	}
+	return s
+}
+
+func (s *Sink) AddSample(key []string, val float32) {
+	s.InmemSink.AddSample(key, val)
+
+	s.Lock()
+	defer s.Unlock()
+	if h, ok := s.histograms[strings.Join(key, ".")]; ok {
+		h.add(float64(val))
+	}
+}
+
+// Snapshot returns the current metrics
+func (s *Sink) Snapshot() Snapshot {
+	snap := Snapshot{
+		Gauges:     make(map[string]float32),
+		Counters:   make(map[string]Aggregate),
+		Samples:    make(map[string]Aggregate),
+		Histograms: make(map[string]Histogram),
+	}
+
+	// The current interval may have just started, so counters and samples
+	// come from the previous one, while gauges are updated by the newest
+	data := s.Data()
+	latest := data[len(data)-1]
+	aggregated := latest
+	if len(data) > 1 {
+		aggregated = data[len(data)-2]
+	}
+
+	aggregated.RLock()
+	snap.Interval = aggregated.Interval
+	for k, v := range aggregated.Gauges {
+		snap.Gauges[k] = v
+	}
+	for k, v := range aggregated.Counters {
+		snap.Counters[k] = toAggregate(v)
+	}
+	for k, v := range aggregated.Samples {
+		snap.Samples[k] = toAggregate(v)
+	}
+	aggregated.RUnlock()
+
+	latest.RLock()
+	for k, v := range latest.Gauges {
+		snap.Gauges[k] = v
+	}
+	latest.RUnlock()
+
+	s.Lock()
+	for k, h := range s.histograms {
+		snap.Histograms[k] = Histogram{
+			Buckets: h.Buckets,
+			Counts:  append([]uint64{}, h.Counts...),
+			Sum:     h.Sum,
+		}
+	}
+	s.Unlock()
+	return snap
+}
+
+func toAggregate(a *gometrics.AggregateSample) Aggregate {
+	agg := Aggregate{
+		Count:  a.Count,
+		Sum:    a.Sum,
+		Min:    a.Min,
+		Max:    a.Max,
+		Mean:   a.Mean(),
+		Stddev: a.Stddev(),
+	}
+	// Stddev is NaN for a single sample, which JSON can't encode
+	if math.IsNaN(agg.Stddev) {
+		agg.Stddev = 0
+	}
+	return agg
+}
+
+var (
+	globalLock sync.Mutex
+	globalSink *Sink
+)
+
+// Setup makes the metrics of the process, including the ones emitted by
+// the vendored libraries, be kept by a new sink. Runtime metrics and the
+// open file descriptors are collected every second.
+func Setup() (*Sink, error) {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if globalSink != nil {
+		return globalSink, nil
+	}
+
+	sink := NewSink(DefaultHistograms)
+	conf := gometrics.DefaultConfig("")
+	conf.EnableHostname = false
+	m, err := gometrics.NewGlobal(conf, sink)
+	if err != nil {
+		return nil, err
+	}
+	go collectFDs(m, conf.ProfileInterval)
+
+	globalSink = sink
+	return sink, nil
+}
+
+// Global returns the sink set up by Setup, if any
+func Global() *Sink {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	return globalSink
+}
+
+func collectFDs(m *gometrics.Metrics, every time.Duration) {
+	for {
+		if fds, err := openFDs(); err == nil {
+			m.SetGauge([]string{"process", "open_fds"}, float32(fds))
+		}
+		time.Sleep(every)
+	}
+}
@@ -0,0 +1,34 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/luizbafilho/fusis/metrics"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestSinkSnapshot(c *C) {
+	sink := metrics.NewSink(map[string][]float64{"raft.commitTime": {1, 10}})
+	sink.SetGauge([]string{"runtime", "num_goroutines"}, 42)
+	sink.IncrCounter([]string{"raft", "apply"}, 1)
+	for _, ms := range []float32{0.5, 2, 8, 30} {
+		sink.AddSample([]string{"raft", "commitTime"}, ms)
+	}
+	sink.AddSample([]string{"raft", "fsm", "apply"}, 1)
+
+	snap := sink.Snapshot()
+	c.Assert(snap.Gauges["runtime.num_goroutines"], Equals, float32(42))
+	c.Assert(snap.Counters["raft.apply"].Count, Equals, 1)
+	c.Assert(snap.Samples["raft.commitTime"].Count, Equals, 4)
+	c.Assert(snap.Samples["raft.commitTime"].Max, Equals, float64(30))
+	c.Assert(snap.Histograms, DeepEquals, map[string]metrics.Histogram{
+		"raft.commitTime": {Buckets: []float64{1, 10}, Counts: []uint64{1, 3, 4}, Sum: 40.5},
+	})
+}
@@ -0,0 +1,30 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// AnnounceIp sends a gratuitous ARP for ip on iface, so the neighbours
+// update their caches right away after the VIP moved to this balancer
+// instead of waiting for the stale entries to expire. IPv6 addresses are
+// announced with an unsolicited neighbour advertisement instead. The VIPs
+// of a bond slave are announced on the bond.
+func AnnounceIp(ip, iface string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	iface = vipInterface(iface)
+	if parsed.To4() == nil {
+		return advertiseIp(parsed, iface)
+	}
+	args := []string{"-U", "-c", "1", "-I", iface, ip}
+	out, err := exec.Command("arping", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("arping %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package net
+
+import "errors"
+
+// ErrUnsupportedPlatform is returned by the operations relying on Linux
+// only features, like netlink and IPVS, on other platforms.
+var ErrUnsupportedPlatform = errors.New("not supported on this platform")
+
+// ErrUnlabeledInterface is returned when adding an IPv4 VIP to an interface
+// whose name leaves no room for the label telling the VIPs apart.
+var ErrUnlabeledInterface = errors.New("interface name too long to label the VIPs")
+
+// ErrAddressInUse is returned when adding a VIP already on the interface
+// as an address that wasn't added by fusis.
+var ErrAddressInUse = errors.New("address already on the interface, not added by fusis")
@@ -0,0 +1,137 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Iptables manages the rules fusis needs in an iptables table. Rules are
+// kept in chains owned by fusis, named after the built-in chain jumping to
+// them, e.g. FUSIS-PREROUTING, so the rules of the host and of other tools
+// are never touched.
+type Iptables struct {
+	sync.Mutex
+	table   string
+	synced  bool
+	applied map[string][][]string
+}
+
+func NewIptables(table string) *Iptables {
+	return &Iptables{table: table}
+}
+
+// Sync replaces the rules of the fusis chains. Rules are keyed by the
+// built-in chain they're hooked to, and each rule holds the iptables
+// arguments following the chain name. The chains are replaced atomically
+// with iptables-restore, and nothing is done when the rules didn't change or
+// no rule was ever applied.
+func (t *Iptables) Sync(rules map[string][][]string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(rules) == 0 {
+		rules = nil
+	}
+	if t.synced && reflect.DeepEqual(t.applied, rules) {
+		return nil
+	}
+	if !t.synced && rules == nil {
+		t.synced = true
+		return nil
+	}
+
+	chains := make([]string, 0, len(rules)+len(t.applied))
+	for chain := range rules {
+		chains = append(chains, chain)
+	}
+	for chain := range t.applied {
+		if _, ok := rules[chain]; !ok {
+			chains = append(chains, chain)
+		}
+	}
+	sort.Strings(chains)
+
+	t.synced = false
+	for _, chain := range chains {
+		if err := t.hook(chain); err != nil {
+			return err
+		}
+	}
+	if err := t.restore(IptablesRestore(t.table, chains, rules)); err != nil {
+		return err
+	}
+	t.synced, t.applied = true, rules
+	return nil
+}
+
+// Flush removes the rules applied to the fusis chains
+func (t *Iptables) Flush() error {
+	t.Lock()
+	applied := len(t.applied) > 0
+	t.Unlock()
+
+	if !applied {
+		return nil
+	}
+	return t.Sync(map[string][][]string{})
+}
+
+// hook creates the fusis chain of a built-in chain, if needed, and makes
+// sure the built-in chain jumps to it.
+func (t *Iptables) hook(builtin string) error {
+	chain := fusisChain(builtin)
+	if err := iptables("-t", t.table, "-S", chain); err != nil {
+		if err := iptables("-t", t.table, "-N", chain); err != nil {
+			return err
+		}
+	}
+	if err := iptables("-t", t.table, "-C", builtin, "-j", chain); err != nil {
+		return iptables("-t", t.table, "-I", builtin, "-j", chain)
+	}
+	return nil
+}
+
+func (t *Iptables) restore(input string) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables-restore failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// IptablesRestore returns the iptables-restore input replacing the rules of
+// the fusis chains of the given built-in chains. Declaring a chain flushes
+// it, so chains without rules are emptied.
+func IptablesRestore(table string, chains []string, rules map[string][][]string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%s\n", table)
+	for _, chain := range chains {
+		fmt.Fprintf(&b, ":%s - [0:0]\n", fusisChain(chain))
+	}
+	for _, chain := range chains {
+		for _, rule := range rules[chain] {
+			fmt.Fprintf(&b, "-A %s %s\n", fusisChain(chain), strings.Join(rule, " "))
+		}
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+func fusisChain(builtin string) string {
+	return "FUSIS-" + builtin
+}
+
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const icmpv6NeighborAdvertisement = 136
+
+// advertiseIp sends an unsolicited neighbour advertisement for ip to all
+// the nodes on iface, overriding the link-layer address they have cached
+// for it. The kernel picks the link-local address of iface as source, and
+// fills in the checksum.
+func advertiseIp(ip net.IP, iface string) error {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("error opening icmpv6 socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	// Neighbour discovery messages with another hop limit are dropped
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, i.Index); err != nil {
+		return err
+	}
+	to := &syscall.SockaddrInet6{ZoneId: uint32(i.Index)}
+	copy(to.Addr[:], net.IPv6linklocalallnodes)
+	if err := syscall.Sendto(fd, neighborAdvertisement(ip, i.HardwareAddr), 0, to); err != nil {
+		return fmt.Errorf("error advertising %s on %s: %v", ip, iface, err)
+	}
+	return nil
+}
+
+// neighborAdvertisement builds a neighbour advertisement for target with
+// the override flag set, carrying mac as its target link-layer address.
+// See RFC 4861, section 4.4.
+func neighborAdvertisement(target net.IP, mac net.HardwareAddr) []byte {
+	msg := make([]byte, 24)
+	msg[0] = icmpv6NeighborAdvertisement
+	msg[4] = 0x20 // override
+	copy(msg[8:24], target.To16())
+	if len(mac) > 0 {
+		// The options are padded to multiples of 8 bytes
+		size := (2 + len(mac) + 7) / 8
+		opt := make([]byte, size*8)
+		opt[0] = 2 // target link-layer address
+		opt[1] = byte(size)
+		copy(opt[2:], mac)
+		msg = append(msg, opt...)
+	}
+	return msg
+}
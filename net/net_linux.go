@@ -0,0 +1,323 @@
+package net
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// labelMax is the longest label of an address, IFNAMSIZ - 1
+const labelMax = 15
+
+// vipLabel is the label of the IPv4 VIPs added to iface, telling them
+// apart from the addresses of the host, e.g. on the bonded interfaces and
+// VLANs holding several of them, so only the VIPs are ever removed. It's
+// truncated to fit, and empty when the name of iface leaves no room for it,
+// as labels must start with the name of the interface.
+func vipLabel(iface string) string {
+	if len(iface)+2 > labelMax {
+		return ""
+	}
+	label := iface + ":fusis"
+	if len(label) > labelMax {
+		label = label[:labelMax]
+	}
+	return label
+}
+
+// vlanName splits the name of a VLAN subinterface, e.g. bond0.100, into
+// its parent and VLAN id
+func vlanName(iface string) (string, int, bool) {
+	i := strings.LastIndex(iface, ".")
+	if i <= 0 {
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(iface[i+1:])
+	if err != nil || id < 1 || id > 4094 {
+		return "", 0, false
+	}
+	return iface[:i], id, true
+}
+
+// vipLink finds the link the VIPs of iface are added to. The VIPs of a
+// bond slave go to the bond itself, as the addresses of the slaves are
+// ignored. With create, a missing VLAN subinterface is created on its
+// parent and brought up.
+func vipLink(iface string, create bool) (netlink.Link, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		parent, id, ok := vlanName(iface)
+		if !create || !ok {
+			return nil, err
+		}
+		if link, err = createVlan(iface, parent, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if index := link.Attrs().MasterIndex; index != 0 {
+		master, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		if master.Type() == "bond" {
+			return master, nil
+		}
+	}
+	return link, nil
+}
+
+func createVlan(iface, parent string, id int) (netlink.Link, error) {
+	parentLink, err := vipLink(parent, false)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the parent of VLAN %s: %v", iface, err)
+	}
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: iface, ParentIndex: parentLink.Attrs().Index},
+		VlanId:    id,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		return nil, fmt.Errorf("error creating VLAN %s: %v", iface, err)
+	}
+	if err := netlink.LinkSetUp(vlan); err != nil {
+		return nil, fmt.Errorf("error bringing VLAN %s up: %v", iface, err)
+	}
+	return netlink.LinkByName(iface)
+}
+
+// vipInterface returns the name of the interface the VIPs of iface are
+// added to, see vipLink
+func vipInterface(iface string) string {
+	link, err := vipLink(iface, false)
+	if err != nil {
+		return iface
+	}
+	return link.Attrs().Name
+}
+
+//AddIp it receives a CIDR Address and add it to the given interface
+func AddIp(ip, iface string) error {
+	link, err := vipLink(iface, true)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netlink.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	// IPv6 addresses are usable, and announceable, right away without
+	// duplicate address detection. They can't be labeled, only the IPv4
+	// ones are, and the VIPs are recorded to tell them apart, see GetVips.
+	name := link.Attrs().Name
+	if addr.IP.To4() == nil {
+		addr.Flags = syscall.IFA_F_NODAD
+	} else if addr.Label = vipLabel(name); addr.Label == "" {
+		return fmt.Errorf("error adding %s to %s: %v", ip, name, ErrUnlabeledInterface)
+	}
+
+	err = netlink.AddrAdd(link, addr)
+	if err == syscall.EEXIST {
+		err = existingVip(link, addr)
+	}
+	if err != nil {
+		return err
+	}
+	return record.add(name, addr.IPNet.String())
+}
+
+// existingVip checks the address already on link with the IP of addr is a
+// VIP: labeled, or recorded for the IPv6 ones. The other addresses, e.g.
+// managed by the operator, or left unlabeled by previous releases, which
+// recorded nothing, are never taken over.
+func existingVip(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	family := netlink.FAMILY_V4
+	if addr.Label == "" {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if !a.IP.Equal(addr.IP) {
+			continue
+		}
+		if addr.Label != "" && a.Label == addr.Label || addr.Label == "" && record.has(name, a.IPNet.String()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("error adding %s to %s: %v", addr.IPNet, name, ErrAddressInUse)
+}
+
+func DelIp(ip, iface string) error {
+	link, err := vipLink(iface, false)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netlink.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+
+	if err := netlink.AddrDel(link, addr); err != nil {
+		return err
+	}
+	return record.remove(link.Attrs().Name, addr.IPNet.String())
+}
+
+func DelVips(iface string) error {
+	link, err := vipLink(iface, false)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := GetVips(iface)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range addrs {
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return err
+		}
+	}
+
+	return record.clear(link.Attrs().Name)
+}
+
+// GetVips lists the VIPs of iface: the labeled IPv4 addresses and the
+// recorded IPv6 ones, see SetVipRecord. The other addresses, e.g. the ones
+// managed by the operator on a shared interface, are never listed, so
+// they're left alone by DelVips and the syncs. Bond slaves list the VIPs of
+// their bond.
+func GetVips(iface string) ([]netlink.Addr, error) {
+	link, err := vipLink(iface, false)
+	if err != nil {
+		return []netlink.Addr{}, err
+	}
+
+	v4, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return []netlink.Addr{}, err
+	}
+	addrs := []netlink.Addr{}
+	label := vipLabel(link.Attrs().Name)
+	for _, a := range v4 {
+		if label != "" && a.Label == label {
+			addrs = append(addrs, a)
+		}
+	}
+
+	v6, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return []netlink.Addr{}, err
+	}
+	for _, a := range v6 {
+		if record.has(link.Attrs().Name, a.IPNet.String()) {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+func GetFusisVipsIps(iface string) ([]string, error) {
+	addrs, err := GetVips(iface)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP.String()
+	}
+	return ips, nil
+}
+
+func GetIpByInterface(iface string) (string, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+
+	return addrs[0].IP.String(), nil
+}
+
+func SetIpForwarding() error {
+	return ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+}
+
+// SetArpIsolation keeps the host from answering ARP requests for the
+// addresses it doesn't own on the asked interface, and from using them as
+// source of its own requests, like arptables rules would. Hosts behind a
+// balancer in route mode own the VIP on their loopback interface, and must
+// leave answering for it to the balancer.
+func SetArpIsolation(iface string) error {
+	settings := map[string]string{"arp_ignore": "1", "arp_announce": "2"}
+	for _, dev := range []string{"all", iface} {
+		for name, value := range settings {
+			path := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/%s", dev, name)
+			if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetIpvsConntrack makes IPVS keep conntrack entries for its connections,
+// which the netfilter rules matching them, like the full nat ones, rely on.
+func SetIpvsConntrack() error {
+	return ioutil.WriteFile("/proc/sys/net/ipv4/vs/conntrack", []byte("1"), 0644)
+}
+
+func AddDefaultGateway(ip string) error {
+	err := netlink.RouteAdd(&netlink.Route{
+		Scope: netlink.SCOPE_UNIVERSE,
+		Gw:    net.ParseIP(ip),
+	})
+	if err != nil {
+		return fmt.Errorf("error adding default gateway %s: %v", ip, err)
+	}
+	return nil
+}
+
+func GetDefaultGateway() (*netlink.Route, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	var route netlink.Route
+	for _, v := range routes {
+		if v.Gw != nil {
+			route = v
+		}
+	}
+
+	if route.Gw == nil {
+		return nil, fmt.Errorf("default gateway not found")
+	}
+
+	return &route, nil
+}
+
+func DeleteDefaultGateway(route *netlink.Route) error {
+	err := netlink.RouteDel(route)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package net_test
+
+import (
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luizbafilho/fusis/net"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type NetSuite struct {
+	iface string
+}
+
+var _ = Suite(&NetSuite{"eth0"})
+
+func (s *NetSuite) SetUpSuite(c *C) {
+}
+
+func (s *NetSuite) SetUpTest(c *C) {
+	net.DelVips(s.iface)
+}
+
+func (s *NetSuite) TearDownTest(c *C) {
+	net.DelVips("")
+}
+
+func (s *NetSuite) TestAddIp(c *C) {
+	err := net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+
+	addrs, err := net.GetVips(s.iface)
+	c.Assert(err, IsNil)
+
+	found := false
+	for _, a := range addrs {
+		if a.IPNet.String() == "192.168.0.1/32" {
+			found = true
+		}
+	}
+
+	c.Assert(found, Equals, true)
+}
+
+func (s *NetSuite) TestAddIpExisting(c *C) {
+	err := net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+	err = net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+
+	// The addresses of the host are never taken over
+	for _, label := range []string{"", "eth0:ops"} {
+		args := []string{"addr", "add", "192.168.0.3/32", "dev", "eth0"}
+		if label != "" {
+			args = append(args, "label", label)
+		}
+		err = exec.Command("ip", args...).Run()
+		c.Assert(err, IsNil)
+		err = net.AddIp("192.168.0.3/32", "eth0")
+		c.Assert(err, ErrorMatches, ".*"+net.ErrAddressInUse.Error())
+		ips, err := net.GetFusisVipsIps(s.iface)
+		c.Assert(err, IsNil)
+		c.Assert(ips, DeepEquals, []string{"192.168.0.1"})
+		err = exec.Command("ip", "addr", "del", "192.168.0.3/32", "dev", "eth0").Run()
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *NetSuite) TestIPv6Vips(c *C) {
+	err := exec.Command("ip", "addr", "add", "fd00::3/128", "dev", "eth0", "nodad").Run()
+	c.Assert(err, IsNil)
+	defer exec.Command("ip", "addr", "del", "fd00::3/128", "dev", "eth0").Run()
+	err = net.AddIp("fd00::1/128", "eth0")
+	c.Assert(err, IsNil)
+
+	// Only the recorded addresses are VIPs, whatever their flags
+	ips, err := net.GetFusisVipsIps(s.iface)
+	c.Assert(err, IsNil)
+	c.Assert(ips, DeepEquals, []string{"fd00::1"})
+	err = net.AddIp("fd00::3/128", "eth0")
+	c.Assert(err, ErrorMatches, ".*"+net.ErrAddressInUse.Error())
+
+	err = net.DelVips(s.iface)
+	c.Assert(err, IsNil)
+	out, err := exec.Command("ip", "-6", "-o", "addr", "show", "dev", "eth0").CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, "(?s).*fd00::3/128.*")
+	c.Assert(string(out), Not(Matches), "(?s).*fd00::1/128.*")
+}
+
+func (s *NetSuite) TestVipRecord(c *C) {
+	dir, err := ioutil.TempDir("", "fusis-net")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vips.json")
+	c.Assert(net.SetVipRecord(path), IsNil)
+	defer net.SetVipRecord("")
+
+	err = net.AddIp("fd00::1/128", "eth0")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"eth0":["fd00::1/128"]}`)
+
+	err = net.DelVips(s.iface)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{}`)
+}
+
+func (s *NetSuite) TestDelIp(c *C) {
+	err := net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+
+	err = net.DelIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+
+	addrs, err := net.GetVips(s.iface)
+	c.Assert(err, IsNil)
+
+	deleted := true
+	for _, a := range addrs {
+		if a.IPNet.String() == "192.168.0.1/32" {
+			deleted = false
+		}
+	}
+
+	c.Assert(deleted, Equals, true)
+}
+
+func (s *NetSuite) TestDelVips(c *C) {
+	err := net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+	err = net.AddIp("192.168.0.2/32", "eth0")
+	c.Assert(err, IsNil)
+
+	err = net.DelVips(s.iface)
+	c.Assert(err, IsNil)
+
+	addrs, err := net.GetVips(s.iface)
+	c.Assert(err, IsNil)
+
+	found := false
+	for _, a := range addrs {
+		if a.IPNet.String() == "192.168.0.1/32" || a.IPNet.String() == "192.168.0.2/32" {
+			found = true
+		}
+	}
+
+	c.Assert(found, Equals, false)
+}
+
+func (s *NetSuite) TestDelVipsKeepsHostAddresses(c *C) {
+	err := exec.Command("ip", "addr", "add", "192.168.0.3/32", "dev", "eth0", "label", "eth0:ops").Run()
+	c.Assert(err, IsNil)
+	defer exec.Command("ip", "addr", "del", "192.168.0.3/32", "dev", "eth0").Run()
+	err = net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+
+	err = net.DelVips(s.iface)
+	c.Assert(err, IsNil)
+
+	out, err := exec.Command("ip", "-4", "-o", "addr", "show", "dev", "eth0").CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, "(?s).*192.168.0.3/32.*")
+	c.Assert(string(out), Not(Matches), "(?s).*192.168.0.1/32.*")
+}
+
+func (s *NetSuite) TestAddIpUnlabeledInterface(c *C) {
+	err := exec.Command("ip", "link", "add", "fusisdummy0123", "type", "dummy").Run()
+	if err != nil {
+		c.Skip("the kernel lacks the dummy module")
+	}
+	defer exec.Command("ip", "link", "del", "fusisdummy0123").Run()
+
+	err = net.AddIp("192.168.0.1/32", "fusisdummy0123")
+	c.Assert(err, ErrorMatches, ".*"+net.ErrUnlabeledInterface.Error())
+}
+
+func (s *NetSuite) TestGetVips(c *C) {
+	err := net.AddIp("192.168.0.1/32", "eth0")
+	c.Assert(err, IsNil)
+	err = net.AddIp("192.168.0.2/32", "eth0")
+	c.Assert(err, IsNil)
+
+	addrs, err := net.GetVips(s.iface)
+	c.Assert(err, IsNil)
+
+	c.Assert(len(addrs), Equals, 2)
+	c.Assert(addrs[0].Label, Equals, "eth0:fusis")
+}
+
+func (s *NetSuite) TestVlanVips(c *C) {
+	defer exec.Command("ip", "link", "del", "eth0.100").Run()
+
+	err := net.AddIp("192.168.0.1/32", "eth0.100")
+	if err != nil && strings.Contains(err.Error(), "not supported") {
+		c.Skip("the kernel lacks the 8021q module")
+	}
+	c.Assert(err, IsNil)
+	out, err := exec.Command("ip", "-d", "link", "show", "eth0.100").CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, "(?s).*vlan protocol 802.1Q id 100.*")
+
+	addrs, err := net.GetVips("eth0.100")
+	c.Assert(err, IsNil)
+	c.Assert(addrs, HasLen, 1)
+	c.Assert(addrs[0].Label, Equals, "eth0.100:fusis")
+
+	// The VLAN doesn't hold the address of the host
+	ips, err := net.GetFusisVipsIps("eth0.100")
+	c.Assert(err, IsNil)
+	c.Assert(ips, DeepEquals, []string{"192.168.0.1"})
+}
+
+func (s *NetSuite) TestShaperSync(c *C) {
+	shaper := net.NewShaper(s.iface)
+	defer shaper.Flush()
+
+	err := shaper.Sync([]net.BandwidthLimit{
+		{IP: "192.168.0.1", Port: 80, Protocol: "tcp", Rate: 10000000},
+		{IP: "192.168.0.2", Port: 53, Protocol: "udp", Rate: 1000000},
+	})
+	c.Assert(err, IsNil)
+
+	out, err := exec.Command("tc", "class", "show", "dev", s.iface).CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, "(?s).*rate 10Mbit ceil 10Mbit.*")
+	c.Assert(string(out), Matches, "(?s).*rate 1Mbit ceil 1Mbit.*")
+
+	err = shaper.Flush()
+	c.Assert(err, IsNil)
+	out, err = exec.Command("tc", "class", "show", "dev", s.iface).CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "")
+}
+
+func (s *NetSuite) TestIptablesRestore(c *C) {
+	input := net.IptablesRestore("mangle", []string{"POSTROUTING", "PREROUTING"}, map[string][][]string{
+		"PREROUTING": {{"-d", "10.0.0.1/32", "-j", "DSCP", "--set-dscp", "46"}},
+	})
+	c.Assert(input, Equals, `*mangle
+:FUSIS-POSTROUTING - [0:0]
+:FUSIS-PREROUTING - [0:0]
+-A FUSIS-PREROUTING -d 10.0.0.1/32 -j DSCP --set-dscp 46
+COMMIT
+`)
+}
+
+func (s *NetSuite) TestVRRPAdvertisement(c *C) {
+	adv := net.VRRPAdvertisement(51, 254, 1, []gonet.IP{gonet.ParseIP("192.168.0.1")})
+	c.Assert(adv, DeepEquals, []byte{
+		0x21, 51, 254, 1, 0, 1, 0x20, 0x20,
+		192, 168, 0, 1,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	})
+}
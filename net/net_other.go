@@ -0,0 +1,70 @@
+//go:build !linux
+// +build !linux
+
+package net
+
+import (
+	"fmt"
+	"net"
+)
+
+// The VIPs are managed through netlink, available on Linux only. These
+// stubs let the packages depending on this one, like config, be imported
+// on other platforms.
+
+func AddIp(ip, iface string) error {
+	return ErrUnsupportedPlatform
+}
+
+func DelIp(ip, iface string) error {
+	return ErrUnsupportedPlatform
+}
+
+func DelVips(iface string) error {
+	return ErrUnsupportedPlatform
+}
+
+func GetFusisVipsIps(iface string) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func GetIpByInterface(iface string) (string, error) {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address found on %s", iface)
+}
+
+func vipInterface(iface string) string {
+	return iface
+}
+
+func advertiseIp(ip net.IP, iface string) error {
+	return ErrUnsupportedPlatform
+}
+
+func SendVRRP(iface string, advertisement []byte) error {
+	return ErrUnsupportedPlatform
+}
+
+func SetIpForwarding() error {
+	return ErrUnsupportedPlatform
+}
+
+func SetArpIsolation(iface string) error {
+	return ErrUnsupportedPlatform
+}
+
+func SetIpvsConntrack() error {
+	return ErrUnsupportedPlatform
+}
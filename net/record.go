@@ -0,0 +1,119 @@
+package net
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// vipRecord keeps the VIPs added to each interface. IPv6 addresses can't be
+// labeled, so it's what tells the IPv6 VIPs apart from the addresses of the
+// host. It's persisted, if a path is set, so the VIPs of a previous run are
+// still removed on startup.
+type vipRecord struct {
+	sync.Mutex
+	path string
+	vips map[string]map[string]bool
+}
+
+var record = &vipRecord{vips: make(map[string]map[string]bool)}
+
+// SetVipRecord persists the record of the VIPs added to path, loading the
+// VIPs recorded there by a previous run. With an empty path, the record is
+// only kept in memory.
+func SetVipRecord(path string) error {
+	record.Lock()
+	defer record.Unlock()
+
+	if path == "" {
+		record.path = ""
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		var saved map[string][]string
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return err
+		}
+		for iface, vips := range saved {
+			for _, vip := range vips {
+				record.set(iface, vip)
+			}
+		}
+	}
+	record.path = path
+	return nil
+}
+
+func (r *vipRecord) has(iface, vip string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.vips[iface][vip]
+}
+
+func (r *vipRecord) add(iface, vip string) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.vips[iface][vip] {
+		return nil
+	}
+	r.set(iface, vip)
+	return r.save()
+}
+
+func (r *vipRecord) remove(iface, vip string) error {
+	r.Lock()
+	defer r.Unlock()
+	if !r.vips[iface][vip] {
+		return nil
+	}
+	delete(r.vips[iface], vip)
+	return r.save()
+}
+
+// clear forgets the VIPs of iface, once they're removed
+func (r *vipRecord) clear(iface string) error {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.vips[iface]) == 0 {
+		return nil
+	}
+	delete(r.vips, iface)
+	return r.save()
+}
+
+func (r *vipRecord) set(iface, vip string) {
+	if r.vips[iface] == nil {
+		r.vips[iface] = make(map[string]bool)
+	}
+	r.vips[iface][vip] = true
+}
+
+// save writes the record to its path, replacing the previous one
+// atomically
+func (r *vipRecord) save() error {
+	if r.path == "" {
+		return nil
+	}
+	saved := make(map[string][]string)
+	for iface, vips := range r.vips {
+		for vip := range vips {
+			saved[iface] = append(saved[iface], vip)
+		}
+		sort.Strings(saved[iface])
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,134 @@
+package net
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BandwidthLimit caps the rate, in bits per second, of the traffic sent
+// from a VIP port.
+type BandwidthLimit struct {
+	IP       string
+	Port     uint16
+	Protocol string
+	Rate     uint64
+}
+
+// Shaper applies bandwidth limits to the egress traffic of an interface
+// using tc. An HTB qdisc is installed as the interface root, with a class
+// per limit whose queue is scheduled by fq, when supported by the kernel.
+// Traffic not matching any limit isn't shaped.
+type Shaper struct {
+	sync.Mutex
+	iface   string
+	synced  bool
+	applied []BandwidthLimit
+}
+
+func NewShaper(iface string) *Shaper {
+	return &Shaper{iface: iface}
+}
+
+// Sync replaces the limits applied to the interface. Nothing is done when
+// they didn't change, so the queues aren't reset needlessly, and the root
+// qdisc of the interface is left alone until a limit is applied.
+func (s *Shaper) Sync(limits []BandwidthLimit) error {
+	s.Lock()
+	defer s.Unlock()
+
+	limits = append([]BandwidthLimit(nil), limits...)
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].IP != limits[j].IP {
+			return limits[i].IP < limits[j].IP
+		}
+		if limits[i].Port != limits[j].Port {
+			return limits[i].Port < limits[j].Port
+		}
+		return limits[i].Protocol < limits[j].Protocol
+	})
+	if s.synced && reflect.DeepEqual(s.applied, limits) {
+		return nil
+	}
+	if !s.synced && len(limits) == 0 {
+		s.synced = true
+		return nil
+	}
+
+	// Make sure the next sync starts over if this one fails
+	s.synced, s.applied = false, nil
+	if err := s.apply(limits); err != nil {
+		tc("qdisc", "del", "dev", s.iface, "root")
+		return err
+	}
+	s.synced, s.applied = true, limits
+	return nil
+}
+
+// Flush removes the limits applied to the interface
+func (s *Shaper) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.applied) == 0 {
+		return nil
+	}
+	s.synced, s.applied = false, nil
+	if err := s.apply(nil); err != nil {
+		return err
+	}
+	s.synced = true
+	return nil
+}
+
+func (s *Shaper) apply(limits []BandwidthLimit) error {
+	// Deleting the root qdisc fails when the default one is installed
+	tc("qdisc", "del", "dev", s.iface, "root")
+	if len(limits) == 0 {
+		return nil
+	}
+
+	if err := tc("qdisc", "add", "dev", s.iface, "root", "handle", "1:", "htb"); err != nil {
+		return err
+	}
+	for i, l := range limits {
+		class := fmt.Sprintf("1:%x", i+1)
+		rate := strconv.FormatUint(l.Rate, 10) + "bit"
+		if err := tc("class", "add", "dev", s.iface, "parent", "1:", "classid", class, "htb", "rate", rate, "ceil", rate); err != nil {
+			return err
+		}
+		// Without fq the class keeps the default pfifo queue, which still
+		// enforces the limit, only less fairly among flows
+		tc("qdisc", "add", "dev", s.iface, "parent", class, "handle", fmt.Sprintf("%x:", i+2), "fq")
+
+		match := []string{
+			"filter", "add", "dev", s.iface, "parent", "1:", "protocol", "ip", "prio", "1", "u32",
+			"match", "ip", "src", l.IP + "/32",
+			"match", "ip", "sport", strconv.Itoa(int(l.Port)), "0xffff",
+		}
+		if proto, ok := ipProtocols[l.Protocol]; ok {
+			match = append(match, "match", "ip", "protocol", proto, "0xff")
+		}
+		if err := tc(append(match, "flowid", class)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ipProtocols = map[string]string{
+	"tcp": "6",
+	"udp": "17",
+}
+
+func tc(args ...string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
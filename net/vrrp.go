@@ -0,0 +1,50 @@
+package net
+
+import (
+	"net"
+)
+
+// VRRP advertisements are sent to this group, with the VRRP protocol
+// number, see RFC 3768.
+const (
+	VRRPGroup    = "224.0.0.18"
+	VRRPProtocol = 112
+)
+
+// VRRPAdvertisement builds a VRRPv2 advertisement of the virtual router
+// vrid owning the vips, without authentication. interval is the
+// advertisement interval in seconds. A priority of 0 tells the backups
+// the master stopped, so they take over right away.
+func VRRPAdvertisement(vrid, priority, interval byte, vips []net.IP) []byte {
+	msg := make([]byte, 8, 8+4*len(vips)+8)
+	msg[0] = 0x21 // version 2, advertisement
+	msg[1] = vrid
+	msg[2] = priority
+	msg[3] = byte(len(vips))
+	msg[5] = interval
+	for _, ip := range vips {
+		msg = append(msg, ip.To4()...)
+	}
+	// Authentication data, unused without authentication
+	msg = append(msg, make([]byte, 8)...)
+
+	sum := checksum(msg)
+	msg[6] = byte(sum >> 8)
+	msg[7] = byte(sum)
+	return msg
+}
+
+// checksum is the internet checksum of b, see RFC 1071
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,30 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SendVRRP sends a VRRP advertisement, see VRRPAdvertisement, on iface.
+// The kernel picks the primary address of iface as source.
+func SendVRRP(iface string, advertisement []byte) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, VRRPProtocol)
+	if err != nil {
+		return fmt.Errorf("error opening vrrp socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.BindToDevice(fd, iface); err != nil {
+		return err
+	}
+	// Advertisements with another TTL are dropped by the backups
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 255); err != nil {
+		return err
+	}
+	to := &syscall.SockaddrInet4{}
+	copy(to.Addr[:], net.ParseIP(VRRPGroup).To4())
+	if err := syscall.Sendto(fd, advertisement, 0, to); err != nil {
+		return fmt.Errorf("error sending vrrp advertisement on %s: %v", iface, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Package probe checks services end to end, connecting to their VIPs from
+// the balancer. The connections cross IPVS like the client traffic does, so
+// they fail when the IPVS table is programmed but the traffic still isn't
+// delivered, e.g. due to rp_filter or missing routes.
+package probe
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+)
+
+const defaultTimeout = time.Second
+
+// Dialer opens a connection to address, giving up after timeout
+type Dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// Prober keeps the result of the last probe of each service
+type Prober struct {
+	sync.Mutex
+	timeout time.Duration
+	dial    Dialer
+	results map[string]types.ProbeResult
+	now     func() time.Time
+}
+
+func NewProber(conf config.Probe) *Prober {
+	p := &Prober{
+		timeout: time.Duration(conf.Timeout) * time.Second,
+		dial:    net.DialTimeout,
+		results: make(map[string]types.ProbeResult),
+		now:     time.Now,
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+	return p
+}
+
+// Probable reports whether a service is probed. UDP services don't answer
+// connections, and services without destinations are expected to fail.
+func Probable(svc types.Service) bool {
+	return svc.Protocol != "udp" && svc.Host != "" && len(svc.Destinations) > 0
+}
+
+// Probe connects to the VIP of each probable service at once, recording the
+// outcomes. It returns the results, sorted by service, along with the ones
+// whose success changed since the previous probe. A service probed for the
+// first time only changes when it fails. The results of the services left
+// out are dropped.
+func (p *Prober) Probe(services []types.Service) (results, changed []types.ProbeResult) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, svc := range services {
+		if !Probable(svc) {
+			continue
+		}
+		wg.Add(1)
+		go func(svc types.Service) {
+			defer wg.Done()
+			r := p.probe(svc)
+			lock.Lock()
+			results = append(results, r)
+			lock.Unlock()
+		}(svc)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Service < results[j].Service })
+
+	p.Lock()
+	defer p.Unlock()
+	previous := p.results
+	p.results = make(map[string]types.ProbeResult, len(results))
+	for i, r := range results {
+		last, ok := previous[r.Service]
+		if !r.Success {
+			r.Failures = last.Failures + 1
+			results[i] = r
+		}
+		if (ok && last.Success != r.Success) || (!ok && !r.Success) {
+			changed = append(changed, r)
+		}
+		p.results[r.Service] = r
+	}
+	return results, changed
+}
+
+func (p *Prober) probe(svc types.Service) types.ProbeResult {
+	r := types.ProbeResult{
+		Service: svc.GetId(),
+		Address: net.JoinHostPort(svc.Host, strconv.Itoa(int(svc.Port))),
+		Time:    p.now(),
+	}
+	start := time.Now()
+	conn, err := p.dial("tcp", r.Address, p.timeout)
+	r.Latency = time.Since(start)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	conn.Close()
+	r.Success = true
+	return r
+}
+
+// Results returns the last result of each service probed, sorted by service
+func (p *Prober) Results() []types.ProbeResult {
+	p.Lock()
+	defer p.Unlock()
+	results := make([]types.ProbeResult, 0, len(p.results))
+	for _, r := range p.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Service < results[j].Service })
+	return results
+}
+
+// Reset drops every result, e.g. when the balancer stops leading and the
+// VIPs are no longer up on it
+func (p *Prober) Reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.results = make(map[string]types.ProbeResult)
+}
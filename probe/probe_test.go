@@ -0,0 +1,124 @@
+package probe
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ProbeSuite struct {
+	prober *Prober
+	// down are the addresses refusing connections
+	down map[string]bool
+}
+
+var _ = Suite(&ProbeSuite{})
+
+func (s *ProbeSuite) SetUpTest(c *C) {
+	s.down = make(map[string]bool)
+	s.prober = NewProber(config.Probe{})
+	s.prober.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		c.Assert(network, Equals, "tcp")
+		c.Assert(timeout, Equals, time.Second)
+		if s.down[address] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+}
+
+func service(id, host string, protocol string) types.Service {
+	return types.Service{
+		Id:           id,
+		Host:         host,
+		Port:         80,
+		Protocol:     protocol,
+		Destinations: []types.Destination{{Name: "d1", Host: "192.168.1.1", Port: 80}},
+	}
+}
+
+func (s *ProbeSuite) TestProbe(c *C) {
+	web := service("web", "10.0.0.1", "tcp")
+	api := service("api", "10.0.0.2", "tcp")
+	dns := service("dns", "10.0.0.3", "udp")
+	empty := service("empty", "10.0.0.4", "tcp")
+	empty.Destinations = nil
+
+	results, changed := s.prober.Probe([]types.Service{web, api, dns, empty})
+	c.Assert(results, HasLen, 2)
+	c.Assert(results[0].Service, Equals, "api")
+	c.Assert(results[0].Address, Equals, "10.0.0.2:80")
+	c.Assert(results[0].Success, Equals, true)
+	c.Assert(results[1].Service, Equals, "web")
+	c.Assert(changed, HasLen, 0)
+
+	s.down["10.0.0.1:80"] = true
+	for i := 1; i <= 2; i++ {
+		results, changed = s.prober.Probe([]types.Service{web, api})
+		c.Assert(results[1].Success, Equals, false)
+		c.Assert(results[1].Error, Equals, "connection refused")
+		c.Assert(results[1].Failures, Equals, i)
+	}
+	// Only the first failure is a change
+	c.Assert(changed, HasLen, 0)
+
+	delete(s.down, "10.0.0.1:80")
+	_, changed = s.prober.Probe([]types.Service{web, api})
+	c.Assert(changed, HasLen, 1)
+	c.Assert(changed[0].Service, Equals, "web")
+	c.Assert(changed[0].Success, Equals, true)
+	c.Assert(changed[0].Failures, Equals, 0)
+}
+
+func (s *ProbeSuite) TestFirstProbeFailing(c *C) {
+	s.down["10.0.0.1:80"] = true
+	_, changed := s.prober.Probe([]types.Service{service("web", "10.0.0.1", "tcp")})
+	c.Assert(changed, HasLen, 1)
+	c.Assert(changed[0].Failures, Equals, 1)
+}
+
+func (s *ProbeSuite) TestResults(c *C) {
+	s.prober.Probe([]types.Service{service("web", "10.0.0.1", "tcp"), service("api", "10.0.0.2", "tcp")})
+	c.Assert(s.prober.Results(), HasLen, 2)
+
+	// Services left out are forgotten
+	s.prober.Probe([]types.Service{service("web", "10.0.0.1", "tcp")})
+	results := s.prober.Results()
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Service, Equals, "web")
+
+	s.prober.Reset()
+	c.Assert(s.prober.Results(), HasLen, 0)
+}
+
+func (s *ProbeSuite) TestProbeConnects(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+
+	prober := NewProber(config.Probe{Timeout: 2})
+	svc := service("web", "127.0.0.1", "tcp")
+	svc.Port = uint16(addr.Port)
+	results, _ := prober.Probe([]types.Service{svc})
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Success, Equals, true)
+}
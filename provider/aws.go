@@ -0,0 +1,228 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	gonet "net"
+	"strings"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// AWS moves the VIPs to the leader in a VPC, where they can't be announced
+// with ARP, by assigning them as secondary private IPs of its network
+// interface (ENI) through the AWS CLI. Assignments are taken over from the
+// ENI of the previous leader, and the VIPs are released once the leadership
+// is lost. The VIPs are also added to interface, like the none provider
+// does, as the instance must own them to accept their packets.
+//
+// Params, besides the ones of the none provider:
+//   - awsCommand: the aws CLI, defaults to aws in the PATH
+//   - region: the region of the instance, defaults to the CLI configuration
+//   - networkInterfaceId: the ENI the VIPs are assigned to, defaults to the
+//     one attached to interface
+//   - elasticIps: the VIPs reachable from the internet, as comma separated
+//     vip=allocation id pairs, whose Elastic IPs are associated with them
+//
+// The VIP pools must be inside the subnet of the ENI. Only the secondary
+// IPs inside them are managed, other IPs of the ENI are left alone.
+type AWS struct {
+	*None
+	command    string
+	args       []string
+	eni        string
+	elasticIps map[string]string
+}
+
+// awsNetworkInterfaces is the output of
+// aws ec2 describe-network-interfaces
+type awsNetworkInterfaces struct {
+	NetworkInterfaces []struct {
+		NetworkInterfaceId string
+		PrivateIpAddresses []struct {
+			Primary          bool
+			PrivateIpAddress string
+			Association      *struct {
+				AllocationId string
+			}
+		}
+	}
+}
+
+func NewAWS(conf *config.BalancerConfig) (Provider, error) {
+	none, err := NewNone(conf)
+	if err != nil {
+		return nil, err
+	}
+	params := conf.Provider.Params
+
+	a := &AWS{
+		None:       none.(*None),
+		command:    params["awsCommand"],
+		args:       []string{"--output", "json"},
+		eni:        params["networkInterfaceId"],
+		elasticIps: make(map[string]string),
+	}
+	if a.command == "" {
+		a.command = "aws"
+	}
+	if region := params["region"]; region != "" {
+		a.args = append(a.args, "--region", region)
+	}
+	if eips := params["elasticIps"]; eips != "" {
+		for _, pair := range strings.Split(eips, ",") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) != 2 || gonet.ParseIP(parts[0]) == nil || parts[1] == "" {
+				return nil, fmt.Errorf("invalid elasticIps entry %q, expected vip=allocation id", pair)
+			}
+			a.elasticIps[parts[0]] = parts[1]
+		}
+	}
+	if a.eni == "" {
+		if a.eni, err = a.interfaceENI(params["interface"]); err != nil {
+			return nil, fmt.Errorf("error finding the network interface id: %v", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *AWS) ec2(args ...string) ([]byte, error) {
+	return runCommand(a.command, append(append([]string{"ec2"}, a.args...), args...)...)
+}
+
+// interfaceENI finds the ENI attached to iface by its MAC address
+func (a *AWS) interfaceENI(iface string) (string, error) {
+	i, err := gonet.InterfaceByName(iface)
+	if err != nil {
+		return "", err
+	}
+	if len(i.HardwareAddr) == 0 {
+		return "", fmt.Errorf("%s has no MAC address", iface)
+	}
+	out, err := a.ec2("describe-network-interfaces", "--filters", "Name=mac-address,Values="+i.HardwareAddr.String())
+	if err != nil {
+		return "", err
+	}
+	var enis awsNetworkInterfaces
+	if err := json.Unmarshal(out, &enis); err != nil {
+		return "", err
+	}
+	if len(enis.NetworkInterfaces) == 0 {
+		return "", fmt.Errorf("no network interface found with the MAC address of %s", iface)
+	}
+	return enis.NetworkInterfaces[0].NetworkInterfaceId, nil
+}
+
+// SyncVIPs makes the secondary IPs of the ENI match the VIPs
+func (a *AWS) SyncVIPs(state ipvs.State) error {
+	var errors []string
+	if err := a.None.SyncVIPs(state); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	wanted := make(map[string]bool)
+	for _, s := range state.GetServices() {
+		if ip := gonet.ParseIP(s.Host); ip != nil && a.inPools(ip) {
+			wanted[s.Host] = true
+		}
+	}
+	if err := a.syncAddresses(wanted); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// FlushVIPs releases every VIP assigned to the ENI
+func (a *AWS) FlushVIPs() error {
+	return a.syncAddresses(nil)
+}
+
+func (a *AWS) syncAddresses(wanted map[string]bool) error {
+	assigned, err := a.assigned()
+	if err != nil {
+		return err
+	}
+
+	var errors []string
+	var toAssign, toUnassign []string
+	for _, ip := range sortedKeys(wanted) {
+		if _, ok := assigned[ip]; !ok {
+			toAssign = append(toAssign, ip)
+		}
+	}
+	for _, ip := range sortedKeys(toSet(assigned)) {
+		if !wanted[ip] {
+			toUnassign = append(toUnassign, ip)
+		}
+	}
+	if len(toAssign) > 0 {
+		// Reassigning takes the VIPs over from the ENI of the previous leader
+		args := append([]string{"assign-private-ip-addresses", "--network-interface-id", a.eni, "--allow-reassignment", "--private-ip-addresses"}, toAssign...)
+		if _, err := a.ec2(args...); err != nil {
+			errors = append(errors, fmt.Sprintf("error assigning %s: %s", strings.Join(toAssign, ", "), err))
+		}
+	}
+	if len(toUnassign) > 0 {
+		args := append([]string{"unassign-private-ip-addresses", "--network-interface-id", a.eni, "--private-ip-addresses"}, toUnassign...)
+		if _, err := a.ec2(args...); err != nil {
+			errors = append(errors, fmt.Sprintf("error unassigning %s: %s", strings.Join(toUnassign, ", "), err))
+		}
+	}
+	for _, ip := range sortedKeys(wanted) {
+		allocation, ok := a.elasticIps[ip]
+		if !ok || assigned[ip] == allocation {
+			continue
+		}
+		if _, err := a.ec2("associate-address", "--allocation-id", allocation, "--network-interface-id", a.eni, "--private-ip-address", ip, "--allow-reassociation"); err != nil {
+			errors = append(errors, fmt.Sprintf("error associating %s with %s: %s", allocation, ip, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// assigned lists the secondary IPs of the ENI inside the VIP pools, along
+// with the allocation id of the Elastic IP associated with them, if any
+func (a *AWS) assigned() (map[string]string, error) {
+	out, err := a.ec2("describe-network-interfaces", "--network-interface-ids", a.eni)
+	if err != nil {
+		return nil, err
+	}
+
+	var enis awsNetworkInterfaces
+	if err := json.Unmarshal(out, &enis); err != nil {
+		return nil, fmt.Errorf("error reading the network interface: %v", err)
+	}
+	if len(enis.NetworkInterfaces) == 0 {
+		return nil, fmt.Errorf("network interface %s not found", a.eni)
+	}
+
+	assigned := make(map[string]string)
+	for _, addr := range enis.NetworkInterfaces[0].PrivateIpAddresses {
+		ip := gonet.ParseIP(addr.PrivateIpAddress)
+		if addr.Primary || ip == nil || !a.inPools(ip) {
+			continue
+		}
+		assigned[addr.PrivateIpAddress] = ""
+		if addr.Association != nil {
+			assigned[addr.PrivateIpAddress] = addr.Association.AllocationId
+		}
+	}
+	return assigned, nil
+}
+
+func toSet(m map[string]string) map[string]bool {
+	set := make(map[string]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
@@ -0,0 +1,74 @@
+package provider_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/provider"
+
+	. "gopkg.in/check.v1"
+)
+
+type AWSSuite struct{}
+
+var _ = Suite(&AWSSuite{})
+
+// fakeAws writes an aws CLI logging its calls and describing eni as the
+// network interface
+func fakeAws(c *C, dir, eni string) string {
+	err := ioutil.WriteFile(filepath.Join(dir, "eni.json"), []byte(eni), 0644)
+	c.Assert(err, IsNil)
+	script := `#!/bin/sh
+echo "$@" >> ` + filepath.Join(dir, "calls") + `
+case "$*" in *describe-network-interfaces*) cat ` + filepath.Join(dir, "eni.json") + `;; esac
+`
+	path := filepath.Join(dir, "aws")
+	err = ioutil.WriteFile(path, []byte(script), 0755)
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (s *AWSSuite) TestFlushVIPs(c *C) {
+	dir, err := ioutil.TempDir("", "fusis-aws")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	conf := &config.BalancerConfig{Provider: config.Provider{Type: "aws", Params: map[string]string{
+		"interface":          "lo",
+		"vipRange":           "10.0.1.240/28",
+		"region":             "us-east-1",
+		"networkInterfaceId": "eni-1",
+		"awsCommand": fakeAws(c, dir, `{"NetworkInterfaces": [{"NetworkInterfaceId": "eni-1", "PrivateIpAddresses": [
+			{"Primary": true, "PrivateIpAddress": "10.0.1.10"},
+			{"Primary": false, "PrivateIpAddress": "10.0.1.241", "Association": {"AllocationId": "eipalloc-1"}},
+			{"Primary": false, "PrivateIpAddress": "10.0.1.242"},
+			{"Primary": false, "PrivateIpAddress": "10.0.1.20"}
+		]}]}`),
+	}}}
+	p, err := provider.New(conf)
+	c.Assert(err, IsNil)
+
+	err = p.(provider.Flusher).FlushVIPs()
+	c.Assert(err, IsNil)
+
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Split(strings.TrimSpace(string(calls)), "\n"), DeepEquals, []string{
+		"ec2 --output json --region us-east-1 describe-network-interfaces --network-interface-ids eni-1",
+		"ec2 --output json --region us-east-1 unassign-private-ip-addresses --network-interface-id eni-1 --private-ip-addresses 10.0.1.241 10.0.1.242",
+	})
+}
+
+func (s *AWSSuite) TestInvalidElasticIps(c *C) {
+	conf := &config.BalancerConfig{Provider: config.Provider{Type: "aws", Params: map[string]string{
+		"interface":          "lo",
+		"vipRange":           "10.0.1.240/28",
+		"networkInterfaceId": "eni-1",
+		"elasticIps":         "10.0.1.240",
+	}}}
+	_, err := provider.New(conf)
+	c.Assert(err, ErrorMatches, `invalid elasticIps entry "10.0.1.240".*`)
+}
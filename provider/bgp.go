@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	gonet "net"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// BGP announces the VIPs to the upstream routers through a local GoBGP
+// daemon, so they can be anycast from several sites. The VIPs are still
+// added to the interface, usually a loopback or dummy one, as IPVS only
+// balances packets addressed to the host. Only the leader announces them,
+// and they're withdrawn once it loses the leadership.
+//
+// Params, besides the ones of the none provider:
+//   - bgpCommand: the gobgp CLI, defaults to gobgp in the PATH
+//   - bgpHost and bgpPort: the address of the daemon gRPC API, defaults to
+//     the CLI defaults
+//   - nexthop: the next hop of the routes, defaults to the IP of the
+//     balancer interface
+//   - community: an optional community attached to the routes
+//
+// Only /32 routes inside the VIP pools are managed, other routes in the
+// daemon RIB are left alone.
+type BGP struct {
+	*None
+	command   string
+	args      []string
+	nexthop   string
+	community string
+}
+
+func NewBGP(conf *config.BalancerConfig) (Provider, error) {
+	none, err := NewNone(conf)
+	if err != nil {
+		return nil, err
+	}
+	params := conf.Provider.Params
+
+	nexthop := params["nexthop"]
+	if nexthop == "" {
+		nexthop, err = conf.GetIpByInterface()
+		if err != nil {
+			return nil, fmt.Errorf("error finding the BGP next hop: %v", err)
+		}
+	}
+
+	b := &BGP{
+		None:      none.(*None),
+		command:   params["bgpCommand"],
+		nexthop:   nexthop,
+		community: params["community"],
+	}
+	if b.command == "" {
+		b.command = "gobgp"
+	}
+	if host := params["bgpHost"]; host != "" {
+		b.args = append(b.args, "-u", host)
+	}
+	if port := params["bgpPort"]; port != "" {
+		b.args = append(b.args, "-p", port)
+	}
+	return b, nil
+}
+
+func runCommand(command string, args ...string) ([]byte, error) {
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v: %s", command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func (b *BGP) gobgp(args ...string) ([]byte, error) {
+	return runCommand(b.command, append(append([]string{}, b.args...), args...)...)
+}
+
+// SyncVIPs makes the announced routes match the VIPs
+func (b *BGP) SyncVIPs(state ipvs.State) error {
+	var errors []string
+	if err := b.None.SyncVIPs(state); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	wanted := make(map[string]bool)
+	for _, s := range state.GetServices() {
+		if s.Host != "" {
+			wanted[s.Host+"/32"] = true
+		}
+	}
+	if err := b.syncRoutes(wanted); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// FlushVIPs withdraws every announced VIP
+func (b *BGP) FlushVIPs() error {
+	return b.syncRoutes(nil)
+}
+
+func (b *BGP) syncRoutes(wanted map[string]bool) error {
+	announced, err := b.announced()
+	if err != nil {
+		return err
+	}
+
+	var errors []string
+	for _, prefix := range sortedKeys(wanted) {
+		if announced[prefix] {
+			continue
+		}
+		args := []string{"global", "rib", "add", "-a", "ipv4", prefix, "nexthop", b.nexthop}
+		if b.community != "" {
+			args = append(args, "community", b.community)
+		}
+		if _, err := b.gobgp(args...); err != nil {
+			errors = append(errors, fmt.Sprintf("error announcing %s: %s", prefix, err))
+		}
+	}
+	for _, prefix := range sortedKeys(announced) {
+		if wanted[prefix] {
+			continue
+		}
+		if _, err := b.gobgp("global", "rib", "del", "-a", "ipv4", prefix); err != nil {
+			errors = append(errors, fmt.Sprintf("error withdrawing %s: %s", prefix, err))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// announced lists the /32 routes inside the VIP pools in the daemon global
+// RIB. The JSON output of the CLI is keyed by prefix.
+func (b *BGP) announced() (map[string]bool, error) {
+	out, err := b.gobgp("global", "rib", "-a", "ipv4", "-j")
+	if err != nil {
+		return nil, err
+	}
+
+	var rib map[string]json.RawMessage
+	if err := json.Unmarshal(out, &rib); err != nil {
+		return nil, fmt.Errorf("error reading the BGP RIB: %v", err)
+	}
+
+	announced := make(map[string]bool)
+	for prefix := range rib {
+		ip, network, err := gonet.ParseCIDR(prefix)
+		if err != nil {
+			continue
+		}
+		if ones, _ := network.Mask.Size(); ones == 32 && b.inPools(ip) {
+			announced[prefix] = true
+		}
+	}
+	return announced, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
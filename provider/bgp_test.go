@@ -0,0 +1,58 @@
+package provider_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/provider"
+
+	. "gopkg.in/check.v1"
+)
+
+type BGPSuite struct{}
+
+var _ = Suite(&BGPSuite{})
+
+// fakeGobgp writes a gobgp CLI logging its calls and listing rib as the
+// global RIB
+func fakeGobgp(c *C, dir, rib string) string {
+	err := ioutil.WriteFile(filepath.Join(dir, "rib.json"), []byte(rib), 0644)
+	c.Assert(err, IsNil)
+	script := `#!/bin/sh
+echo "$@" >> ` + filepath.Join(dir, "calls") + `
+case "$*" in *-j) cat ` + filepath.Join(dir, "rib.json") + `;; esac
+`
+	path := filepath.Join(dir, "gobgp")
+	err = ioutil.WriteFile(path, []byte(script), 0755)
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (s *BGPSuite) TestFlushVIPs(c *C) {
+	dir, err := ioutil.TempDir("", "fusis-bgp")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	conf := &config.BalancerConfig{Provider: config.Provider{Type: "bgp", Params: map[string]string{
+		"interface":  "lo",
+		"vipRange":   "192.168.0.0/28",
+		"nexthop":    "10.0.0.1",
+		"bgpCommand": fakeGobgp(c, dir, `{"192.168.0.1/32": [], "192.168.0.0/28": [], "10.9.9.9/32": []}`),
+		"bgpHost":    "127.0.0.1",
+	}}}
+	p, err := provider.New(conf)
+	c.Assert(err, IsNil)
+
+	err = p.(provider.Flusher).FlushVIPs()
+	c.Assert(err, IsNil)
+
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Split(strings.TrimSpace(string(calls)), "\n"), DeepEquals, []string{
+		"-u 127.0.0.1 global rib -a ipv4 -j",
+		"-u 127.0.0.1 global rib del -a ipv4 192.168.0.1/32",
+	})
+}
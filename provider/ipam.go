@@ -37,6 +37,18 @@ func (i *Ipam) Allocate(state ipvs.State) (string, error) {
 	return "", nil
 }
 
+// AllocateFrom returns the lowest address of iprange not used by the
+// services of state, or an empty string when they're all used. It only
+// depends on its arguments, unlike Allocate, so it's safe to call from the
+// FSM.
+func AllocateFrom(iprange string, state ipvs.State) (string, error) {
+	i, err := NewIpam(iprange)
+	if err != nil {
+		return "", err
+	}
+	return i.Allocate(state)
+}
+
 //Release releases a allocated IP
 func (i *Ipam) Release(allocIP string) {}
 
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/ipvs"
 	"github.com/luizbafilho/fusis/provider"
 
@@ -52,3 +53,26 @@ func (s *IpamSuite) TestIpAllocation(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(ip, Equals, "192.168.0.3")
 }
+
+func (s *IpamSuite) TestPools(c *C) {
+	conf := &config.BalancerConfig{Provider: config.Provider{
+		Type:   "none",
+		Params: map[string]string{"interface": "lo", "vipRange": "192.168.0.0/28"},
+		Pools:  map[string]string{"public": "10.10.0.0/29"},
+	}}
+	p, err := provider.New(conf)
+	c.Assert(err, IsNil)
+
+	r, ok := p.(provider.RangeAllocator).VIPRange("")
+	c.Assert(ok, Equals, true)
+	c.Assert(r, Equals, "192.168.0.0/28")
+	r, ok = p.(provider.RangeAllocator).VIPRange("public")
+	c.Assert(ok, Equals, true)
+	c.Assert(r, Equals, "10.10.0.0/29")
+	_, ok = p.(provider.RangeAllocator).VIPRange("internal")
+	c.Assert(ok, Equals, false)
+
+	conf.Provider.Pools["internal"] = "10.20.0.0"
+	_, err = provider.New(conf)
+	c.Assert(err, ErrorMatches, "invalid range of pool internal: .*")
+}
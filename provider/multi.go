@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// Multi runs several providers at once, e.g. none for the internal VIPs and
+// bgp for the public ones. Each service is handled by the provider named by
+// its Provider field, the empty name being the default provider. The
+// services of unknown providers are left alone.
+type Multi struct {
+	providers map[string]Provider
+	// firewall syncs the iptables rules of the services of every provider,
+	// as they share the chains
+	firewall *firewall
+}
+
+// firewallSharer is implemented by the providers syncing the iptables rules
+// of their services, which stop doing so when run by Multi
+type firewallSharer interface {
+	shareFirewall()
+}
+
+func newMulti(providers map[string]Provider) *Multi {
+	for _, p := range providers {
+		if f, ok := p.(firewallSharer); ok {
+			f.shareFirewall()
+		}
+	}
+	return &Multi{providers: providers, firewall: newFirewall()}
+}
+
+// Providers returns the providers by name
+func (m *Multi) Providers() map[string]Provider {
+	return m.providers
+}
+
+// Select returns the provider handling the VIP of svc
+func (m *Multi) Select(svc types.Service) (Provider, error) {
+	p, ok := m.providers[svc.Provider]
+	if !ok {
+		return nil, types.ErrUnknownProvider
+	}
+	return p, nil
+}
+
+func (m *Multi) AllocateVIP(s *types.Service, state ipvs.State) error {
+	p, err := m.Select(*s)
+	if err != nil {
+		return err
+	}
+	return p.AllocateVIP(s, state)
+}
+
+func (m *Multi) ReleaseVIP(s types.Service) error {
+	p, err := m.Select(s)
+	if err != nil {
+		return err
+	}
+	return p.ReleaseVIP(s)
+}
+
+// SyncVIPs syncs each provider with the services it handles, and the
+// iptables rules with every service
+func (m *Multi) SyncVIPs(state ipvs.State) error {
+	var errors []string
+	for _, name := range m.names() {
+		if err := m.providers[name].SyncVIPs(providerState{State: state, provider: name}); err != nil {
+			errors = append(errors, fmt.Sprintf("provider %q: %s", name, err))
+		}
+	}
+	errors = append(errors, m.firewall.sync(state.GetServices())...)
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// FlushVIPs withdraws the VIPs of the providers announcing them elsewhere
+// than the balancer interface.
+func (m *Multi) FlushVIPs() error {
+	var errors []string
+	for _, name := range m.names() {
+		f, ok := m.providers[name].(Flusher)
+		if !ok {
+			continue
+		}
+		if err := f.FlushVIPs(); err != nil {
+			errors = append(errors, fmt.Sprintf("provider %q: %s", name, err))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+func (m *Multi) names() []string {
+	var names []string
+	for name := range m.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerState only holds the services handled by a provider
+type providerState struct {
+	ipvs.State
+	provider string
+}
+
+func (s providerState) GetServices() []types.Service {
+	services := []types.Service{}
+	for _, svc := range s.State.GetServices() {
+		if svc.Provider == s.provider {
+			services = append(services, svc)
+		}
+	}
+	return services
+}
@@ -0,0 +1,32 @@
+package provider
+
+import (
+	"github.com/luizbafilho/fusis/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type MultiFirewallSuite struct{}
+
+var _ = Suite(&MultiFirewallSuite{})
+
+func (s *MultiFirewallSuite) TestMultiSharesFirewall(c *C) {
+	conf := &config.BalancerConfig{
+		Provider: config.Provider{Type: "none", Params: map[string]string{"interface": "eth0", "vipRange": "192.168.0.0/28"}},
+	}
+	p, err := New(conf)
+	c.Assert(err, IsNil)
+	c.Assert(p.(*None).firewall, NotNil)
+
+	// The providers would flush the rules of each other's services
+	conf.Providers = map[string]config.Provider{
+		"public": {Type: "none", Params: map[string]string{"interface": "lo", "vipRange": "10.10.0.0/29"}},
+	}
+	p, err = New(conf)
+	c.Assert(err, IsNil)
+	m := p.(*Multi)
+	c.Assert(m.firewall, NotNil)
+	for _, p := range m.Providers() {
+		c.Assert(p.(*None).firewall, IsNil)
+	}
+}
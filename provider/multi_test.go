@@ -0,0 +1,46 @@
+package provider_test
+
+import (
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/provider"
+
+	. "gopkg.in/check.v1"
+)
+
+type MultiSuite struct{}
+
+var _ = Suite(&MultiSuite{})
+
+func (s *MultiSuite) TestNewMulti(c *C) {
+	conf := &config.BalancerConfig{
+		Provider: config.Provider{Type: "none", Params: map[string]string{"interface": "eth0", "vipRange": "192.168.0.0/28"}},
+	}
+	p, err := provider.New(conf)
+	c.Assert(err, IsNil)
+	c.Assert(p, FitsTypeOf, &provider.None{})
+
+	conf.Providers = map[string]config.Provider{
+		"public": {Type: "none", Params: map[string]string{"interface": "lo", "vipRange": "10.10.0.0/29"}},
+	}
+	p, err = provider.New(conf)
+	c.Assert(err, IsNil)
+	c.Assert(p, FitsTypeOf, &provider.Multi{})
+	m := p.(*provider.Multi)
+	c.Assert(m.Providers(), HasLen, 2)
+
+	public, err := m.Select(types.Service{Name: "web", Provider: "public"})
+	c.Assert(err, IsNil)
+	r, _ := public.(provider.RangeAllocator).VIPRange("")
+	c.Assert(r, Equals, "10.10.0.0/29")
+	_, err = m.Select(types.Service{Name: "web", Provider: "unknown"})
+	c.Assert(err, Equals, types.ErrUnknownProvider)
+
+	conf.Providers["internal"] = config.Provider{Type: "none", Params: map[string]string{"interface": "eth0", "vipRange": "10.20.0.0/29"}}
+	_, err = provider.New(conf)
+	c.Assert(err, ErrorMatches, `providers default and internal can't share interface "eth0"`)
+
+	conf.Providers["internal"] = config.Provider{Type: "unknown"}
+	_, err = provider.New(conf)
+	c.Assert(err, ErrorMatches, "provider internal: Provider not registered")
+}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"fmt"
+	gonet "net"
 	"strings"
 
 	"github.com/luizbafilho/fusis/api/types"
@@ -12,7 +13,13 @@ import (
 
 type None struct {
 	iface string
+	// pools holds the VIP ranges by pool name, vipRange being the one of
+	// the empty name
+	pools map[string]*gonet.IPNet
 	ipam  *Ipam
+	// firewall syncs the iptables rules of the services, nil when Multi
+	// syncs them for every provider
+	firewall *firewall
 }
 
 func NewNone(config *config.BalancerConfig) (Provider, error) {
@@ -21,9 +28,25 @@ func NewNone(config *config.BalancerConfig) (Provider, error) {
 		return nil, err
 	}
 
+	pools := make(map[string]*gonet.IPNet)
+	_, pools[""], err = gonet.ParseCIDR(config.Provider.Params["vipRange"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid vipRange: %v", err)
+	}
+	for name, r := range config.Provider.Pools {
+		if name == "" {
+			return nil, fmt.Errorf("invalid pool: must have a name")
+		}
+		if _, pools[name], err = gonet.ParseCIDR(r); err != nil {
+			return nil, fmt.Errorf("invalid range of pool %s: %v", name, err)
+		}
+	}
+
 	return &None{
-		iface: config.Provider.Params["interface"],
-		ipam:  i,
+		iface:    config.Provider.Params["interface"],
+		pools:    pools,
+		ipam:     i,
+		firewall: newFirewall(),
 	}, nil
 }
 
@@ -37,6 +60,42 @@ func (n None) AllocateVIP(s *types.Service, state ipvs.State) error {
 	return nil
 }
 
+func (n None) VIPRange(pool string) (string, bool) {
+	r, ok := n.pools[pool]
+	if !ok {
+		return "", false
+	}
+	return r.String(), true
+}
+
+func (n None) ValidVIP(host, pool string) bool {
+	ip := gonet.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if pool == "" {
+		return n.inPools(ip)
+	}
+	r, ok := n.pools[pool]
+	return ok && r.Contains(ip)
+}
+
+// inPools tells whether ip belongs to a VIP pool, the addresses managed by
+// the providers embedding None
+func (n None) inPools(ip gonet.IP) bool {
+	for _, r := range n.pools {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// shareFirewall leaves the iptables rules to Multi
+func (n *None) shareFirewall() {
+	n.firewall = nil
+}
+
 func (n None) ReleaseVIP(s types.Service) error {
 	n.ipam.Release(s.Host)
 	return nil
@@ -62,19 +121,30 @@ func (n None) SyncVIPs(state ipvs.State) error {
 	}
 	var errors []string
 	for ip := range toAddMap {
-		err := net.AddIp(ip+"/32", n.iface)
+		err := net.AddIp(hostCIDR(ip), n.iface)
 		if err != nil {
 			errors = append(errors, fmt.Sprintf("error adding ip %s: %s", ip, err))
 		}
 	}
 	for _, ip := range toRemove {
-		err := net.DelIp(ip+"/32", n.iface)
+		err := net.DelIp(hostCIDR(ip), n.iface)
 		if err != nil {
 			errors = append(errors, fmt.Sprintf("error deleting ip %s: %s", ip, err))
 		}
 	}
+	if n.firewall != nil {
+		errors = append(errors, n.firewall.sync(newServices)...)
+	}
 	if len(errors) > 0 {
 		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
 	}
 	return nil
 }
+
+// hostCIDR returns ip as a single host network
+func hostCIDR(ip string) string {
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
@@ -0,0 +1,233 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	gonet "net"
+	"strings"
+
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// OpenStack lets the VIPs through the port security of Neutron by adding
+// them to the allowed address pairs of the port of the leader, through the
+// OpenStack CLI, and moves the floating IPs of the VIPs to it. The VIPs are
+// added to interface and announced with gratuitous ARP like the none
+// provider does, pairs left on the ports of previous leaders are harmless.
+//
+// Params, besides the ones of the none provider:
+//   - openstackCommand: the openstack CLI, defaults to openstack in the PATH
+//   - cloud: the cloud of clouds.yaml to use, defaults to the OS_*
+//     environment variables
+//   - portId: the Neutron port of the balancer, defaults to the one with
+//     the MAC address of interface
+//   - floatingIps: the VIPs reachable from outside the tenant, as comma
+//     separated vip=floating IP pairs, the floating IP given by ID or
+//     address
+//
+// The VIP pools must be inside the subnet of the port, outside its allocation
+// pool. Only the pairs inside them are managed.
+type OpenStack struct {
+	*None
+	command     string
+	args        []string
+	port        string
+	floatingIps map[string]string
+}
+
+// openstackPort is the output of openstack port show
+type openstackPort struct {
+	AllowedAddressPairs []struct {
+		IPAddress  string `json:"ip_address"`
+		MACAddress string `json:"mac_address"`
+	} `json:"allowed_address_pairs"`
+}
+
+// openstackFloatingIP is an entry of openstack floating ip list
+type openstackFloatingIP struct {
+	ID                string `json:"ID"`
+	FloatingIPAddress string `json:"Floating IP Address"`
+	FixedIPAddress    string `json:"Fixed IP Address"`
+}
+
+func NewOpenStack(conf *config.BalancerConfig) (Provider, error) {
+	none, err := NewNone(conf)
+	if err != nil {
+		return nil, err
+	}
+	params := conf.Provider.Params
+
+	o := &OpenStack{
+		None:        none.(*None),
+		command:     params["openstackCommand"],
+		port:        params["portId"],
+		floatingIps: make(map[string]string),
+	}
+	if o.command == "" {
+		o.command = "openstack"
+	}
+	if cloud := params["cloud"]; cloud != "" {
+		o.args = append(o.args, "--os-cloud", cloud)
+	}
+	if fips := params["floatingIps"]; fips != "" {
+		for _, pair := range strings.Split(fips, ",") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) != 2 || gonet.ParseIP(parts[0]) == nil || parts[1] == "" {
+				return nil, fmt.Errorf("invalid floatingIps entry %q, expected vip=floating IP", pair)
+			}
+			o.floatingIps[parts[0]] = parts[1]
+		}
+	}
+	if o.port == "" {
+		if o.port, err = o.interfacePort(params["interface"]); err != nil {
+			return nil, fmt.Errorf("error finding the port id: %v", err)
+		}
+	}
+	return o, nil
+}
+
+func (o *OpenStack) openstack(args ...string) ([]byte, error) {
+	return runCommand(o.command, append(append([]string{}, o.args...), args...)...)
+}
+
+// interfacePort finds the port of iface by its MAC address
+func (o *OpenStack) interfacePort(iface string) (string, error) {
+	i, err := gonet.InterfaceByName(iface)
+	if err != nil {
+		return "", err
+	}
+	if len(i.HardwareAddr) == 0 {
+		return "", fmt.Errorf("%s has no MAC address", iface)
+	}
+	out, err := o.openstack("port", "list", "--mac-address", i.HardwareAddr.String(), "-f", "json")
+	if err != nil {
+		return "", err
+	}
+	var ports []struct {
+		ID string `json:"ID"`
+	}
+	if err := json.Unmarshal(out, &ports); err != nil {
+		return "", err
+	}
+	if len(ports) == 0 {
+		return "", fmt.Errorf("no port found with the MAC address of %s", iface)
+	}
+	return ports[0].ID, nil
+}
+
+// SyncVIPs makes the address pairs and floating IPs of the port match the VIPs
+func (o *OpenStack) SyncVIPs(state ipvs.State) error {
+	var errors []string
+	if err := o.None.SyncVIPs(state); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	wanted := make(map[string]bool)
+	for _, s := range state.GetServices() {
+		if ip := gonet.ParseIP(s.Host); ip != nil && o.inPools(ip) {
+			wanted[s.Host] = true
+		}
+	}
+	if err := o.syncPairs(wanted); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if err := o.syncFloatingIps(wanted); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+func (o *OpenStack) syncPairs(wanted map[string]bool) error {
+	out, err := o.openstack("port", "show", o.port, "-f", "json", "-c", "allowed_address_pairs")
+	if err != nil {
+		return err
+	}
+	var port openstackPort
+	if err := json.Unmarshal(out, &port); err != nil {
+		return fmt.Errorf("error reading the port: %v", err)
+	}
+
+	var errors []string
+	var set, unset []string
+	allowed := make(map[string]bool)
+	for _, pair := range port.AllowedAddressPairs {
+		ip := gonet.ParseIP(pair.IPAddress)
+		if ip == nil || !o.inPools(ip) {
+			continue
+		}
+		allowed[pair.IPAddress] = true
+		if !wanted[pair.IPAddress] {
+			// Pairs are only removed when matching their MAC address too
+			arg := "ip-address=" + pair.IPAddress
+			if pair.MACAddress != "" {
+				arg += ",mac-address=" + pair.MACAddress
+			}
+			unset = append(unset, "--allowed-address", arg)
+		}
+	}
+	for _, ip := range sortedKeys(wanted) {
+		if !allowed[ip] {
+			set = append(set, "--allowed-address", "ip-address="+ip)
+		}
+	}
+	if len(set) > 0 {
+		if _, err := o.openstack(append(append([]string{"port", "set"}, set...), o.port)...); err != nil {
+			errors = append(errors, fmt.Sprintf("error allowing the VIPs on port %s: %s", o.port, err))
+		}
+	}
+	if len(unset) > 0 {
+		if _, err := o.openstack(append(append([]string{"port", "unset"}, unset...), o.port)...); err != nil {
+			errors = append(errors, fmt.Sprintf("error disallowing the VIPs on port %s: %s", o.port, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+func (o *OpenStack) syncFloatingIps(wanted map[string]bool) error {
+	if len(o.floatingIps) == 0 {
+		return nil
+	}
+	out, err := o.openstack("floating", "ip", "list", "--port", o.port, "-f", "json")
+	if err != nil {
+		return err
+	}
+	var fips []openstackFloatingIP
+	if err := json.Unmarshal(out, &fips); err != nil {
+		return fmt.Errorf("error reading the floating IPs: %v", err)
+	}
+
+	var errors []string
+	for _, vip := range sortedKeys(wanted) {
+		fip, ok := o.floatingIps[vip]
+		if !ok {
+			continue
+		}
+		associated := false
+		for _, f := range fips {
+			if (f.ID == fip || f.FloatingIPAddress == fip) && f.FixedIPAddress == vip {
+				associated = true
+			}
+		}
+		if associated {
+			continue
+		}
+		// Setting the port moves the floating IP from the previous leader
+		if _, err := o.openstack("floating", "ip", "set", "--port", o.port, "--fixed-ip-address", vip, fip); err != nil {
+			errors = append(errors, fmt.Sprintf("error associating %s with %s: %s", fip, vip, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
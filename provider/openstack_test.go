@@ -0,0 +1,33 @@
+package provider_test
+
+import (
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/provider"
+
+	. "gopkg.in/check.v1"
+)
+
+type OpenStackSuite struct{}
+
+var _ = Suite(&OpenStackSuite{})
+
+func (s *OpenStackSuite) TestNewOpenStack(c *C) {
+	params := map[string]string{
+		"interface":   "lo",
+		"vipRange":    "10.0.1.240/28",
+		"portId":      "port-1",
+		"floatingIps": "10.0.1.240=203.0.113.10, 10.0.1.241=fip-2",
+	}
+	conf := &config.BalancerConfig{Provider: config.Provider{Type: "openstack", Params: params}}
+	_, err := provider.New(conf)
+	c.Assert(err, IsNil)
+
+	params["floatingIps"] = "203.0.113.10"
+	_, err = provider.New(conf)
+	c.Assert(err, ErrorMatches, `invalid floatingIps entry "203.0.113.10".*`)
+
+	delete(params, "floatingIps")
+	delete(params, "portId")
+	_, err = provider.New(conf)
+	c.Assert(err, ErrorMatches, "error finding the port id: lo has no MAC address")
+}
@@ -2,8 +2,10 @@ package provider
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/bus"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/ipvs"
 )
@@ -16,13 +18,89 @@ type Provider interface {
 	SyncVIPs(state ipvs.State) error
 }
 
+// Flusher is implemented by the providers announcing the VIPs elsewhere
+// than the balancer interface. FlushVIPs withdraws them when the balancer
+// stops leading.
+type Flusher interface {
+	FlushVIPs() error
+}
+
+// RangeAllocator is implemented by the providers allocating the VIPs from
+// ranges. The balancers allocate them while applying the services to the
+// FSM instead of calling AllocateVIP, so they're replicated along with the
+// services. VIPRange returns the range of a pool of VIPs, the empty name
+// being the default one, and whether the pool exists. ValidVIP tells
+// whether a VIP given by the user belongs to pool, or to any pool when it's
+// empty.
+type RangeAllocator interface {
+	VIPRange(pool string) (string, bool)
+	ValidVIP(host, pool string) bool
+}
+
+// Subscribe makes a Flusher provider withdraw the VIPs once the balancer
+// loses the leadership, as published on b
+func Subscribe(p Provider, b *bus.Bus) {
+	f, ok := p.(Flusher)
+	if !ok {
+		return
+	}
+	b.Subscribe(bus.LeadershipChanged{}.Topic(), func(e bus.Event) error {
+		if e.(bus.LeadershipChanged).Leader {
+			return nil
+		}
+		return f.FlushVIPs()
+	})
+}
+
+// New creates the provider of the config, or a Multi provider when more
+// providers are configured.
 func New(config *config.BalancerConfig) (Provider, error) {
+	def, err := newProvider(config, config.Provider)
+	if err != nil || len(config.Providers) == 0 {
+		return def, err
+	}
+
+	providers := map[string]Provider{"": def}
+	interfaces := map[string]string{config.Provider.Params["interface"]: "default"}
+	for name, conf := range config.Providers {
+		if name == "" {
+			return nil, fmt.Errorf("invalid provider: must have a name")
+		}
+		// Providers remove the VIPs of the interface they don't handle
+		iface := conf.Params["interface"]
+		if other, ok := interfaces[iface]; ok {
+			return nil, fmt.Errorf("providers %s and %s can't share interface %q", other, name, iface)
+		}
+		interfaces[iface] = name
+
+		if providers[name], err = newProvider(config, conf); err != nil {
+			return nil, fmt.Errorf("provider %s: %v", name, err)
+		}
+	}
+	return newMulti(providers), nil
+}
+
+func newProvider(config *config.BalancerConfig, conf config.Provider) (Provider, error) {
 	var provider Provider
 	var err error
 
+	c := *config
+	c.Provider = conf
+	config = &c
+
 	switch config.Provider.Type {
 	case "none":
 		provider, err = NewNone(config)
+	case "bgp":
+		provider, err = NewBGP(config)
+	case "aws":
+		provider, err = NewAWS(config)
+	case "openstack":
+		provider, err = NewOpenStack(config)
+	case "vrrp":
+		provider, err = NewVRRP(config)
+	default:
+		err = ErrProviderNotRegistered
 	}
 
 	return provider, err
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/net"
+)
+
+// DSCPRules returns the mangle rules marking the traffic of the services
+// with a DSCP value. Requests are marked before being forwarded by IPVS,
+// which keeps the mark, and replies are marked on their way out.
+func DSCPRules(services []types.Service) map[string][][]string {
+	rules := make(map[string][][]string)
+	for _, svc := range services {
+		if svc.DSCP == 0 {
+			continue
+		}
+		port := strconv.Itoa(int(svc.Port))
+		dscp := strconv.Itoa(int(svc.DSCP))
+		rules["PREROUTING"] = append(rules["PREROUTING"], []string{
+			"-d", svc.Host + "/32", "-p", svc.Protocol, "--dport", port, "-j", "DSCP", "--set-dscp", dscp,
+		})
+		rules["POSTROUTING"] = append(rules["POSTROUTING"], []string{
+			"-s", svc.Host + "/32", "-p", svc.Protocol, "--sport", port, "-j", "DSCP", "--set-dscp", dscp,
+		})
+	}
+	return rules
+}
+
+// FirewallMarkRules returns the mangle rules marking the packets of the
+// fwmark services, which IPVS balances by mark. See Service.FirewallMark.
+func FirewallMarkRules(services []types.Service) map[string][][]string {
+	rules := make(map[string][][]string)
+	for _, svc := range services {
+		if svc.FirewallMark == 0 {
+			continue
+		}
+		rule := []string{"-d", svc.Host + "/32"}
+		if len(svc.MarkPorts) > 0 {
+			ports := append([]string{strconv.Itoa(int(svc.Port))}, svc.MarkPorts...)
+			rule = append(rule, "-p", svc.Protocol, "-m", "multiport", "--dports", strings.Join(ports, ","))
+		}
+		rule = append(rule, "-j", "MARK", "--set-mark", strconv.FormatUint(uint64(svc.FirewallMark), 10))
+		rules["PREROUTING"] = append(rules["PREROUTING"], rule)
+	}
+	return rules
+}
+
+// PolicyRules returns the mangle rules marking the packets the clients of
+// the service policies send to the VIP port, which IPVS balances by the
+// policy services. See Service.Policies. Packets keep the mark of the first
+// policy matching them.
+func PolicyRules(services []types.Service) map[string][][]string {
+	rules := make(map[string][][]string)
+	for _, svc := range services {
+		port := strconv.Itoa(int(svc.Port))
+		for _, p := range svc.Policies {
+			mark := strconv.FormatUint(uint64(p.Mark), 10)
+			for _, src := range p.Sources {
+				rules["PREROUTING"] = append(rules["PREROUTING"], []string{
+					"-s", src, "-d", svc.Host + "/32", "-p", svc.Protocol, "--dport", port,
+					"-m", "mark", "--mark", "0", "-j", "MARK", "--set-mark", mark,
+				})
+			}
+		}
+	}
+	return rules
+}
+
+// mergeRules joins the rules of the same table, in order
+func mergeRules(all ...map[string][][]string) map[string][][]string {
+	merged := make(map[string][][]string)
+	for _, rules := range all {
+		for chain, r := range rules {
+			merged[chain] = append(merged[chain], r...)
+		}
+	}
+	return merged
+}
+
+// ConnLimitRules returns the filter rules rejecting the new connections of
+// a client exceeding the concurrent connections allowed per client IP by
+// the services. They're evaluated before IPVS, which hooks in after the
+// filter table.
+func ConnLimitRules(services []types.Service) map[string][][]string {
+	rules := make(map[string][][]string)
+	for _, svc := range services {
+		if svc.MaxConnsPerClient == 0 {
+			continue
+		}
+		rule := []string{
+			"-d", svc.Host + "/32", "-p", svc.Protocol, "--dport", strconv.Itoa(int(svc.Port)),
+			"-m", "conntrack", "--ctstate", "NEW",
+			"-m", "connlimit", "--connlimit-above", strconv.Itoa(int(svc.MaxConnsPerClient)), "--connlimit-mask", "32",
+			"-j", "REJECT",
+		}
+		if svc.Protocol == "tcp" {
+			rule = append(rule, "--reject-with", "tcp-reset")
+		}
+		rules["INPUT"] = append(rules["INPUT"], rule)
+	}
+	return rules
+}
+
+// FullNATRules returns the nat rules rewriting the source of the packets
+// IPVS forwards to the destinations in fullnat mode to the address of the
+// balancer, so their replies come back through it. The ipvs match requires
+// IPVS to keep conntrack entries, see net.SetIpvsConntrack.
+func FullNATRules(services []types.Service) map[string][][]string {
+	rules := make(map[string][][]string)
+	for _, svc := range services {
+		for _, dst := range svc.Destinations {
+			if dst.Mode != types.ModeFullNAT {
+				continue
+			}
+			rule := []string{"-m", "ipvs", "--vmethod", "MASQ"}
+			if svc.FirewallMark == 0 {
+				rule = append(rule, "--vaddr", svc.Host+"/32", "--vport", strconv.Itoa(int(svc.Port)), "--vproto", svc.Protocol)
+			}
+			rule = append(rule, "-d", dst.Host+"/32", "-j", "MASQUERADE")
+			rules["POSTROUTING"] = append(rules["POSTROUTING"], rule)
+		}
+	}
+	return rules
+}
+
+// firewall syncs the iptables rules of the services. The chains are shared
+// by the whole balancer, so they're synced with every service at once.
+type firewall struct {
+	mangle *net.Iptables
+	filter *net.Iptables
+	nat    *net.Iptables
+}
+
+func newFirewall() *firewall {
+	return &firewall{
+		mangle: net.NewIptables("mangle"),
+		filter: net.NewIptables("filter"),
+		nat:    net.NewIptables("nat"),
+	}
+}
+
+// sync applies the rules of services, returning the errors found
+func (f *firewall) sync(services []types.Service) []string {
+	var errors []string
+	if err := f.mangle.Sync(mergeRules(FirewallMarkRules(services), PolicyRules(services), DSCPRules(services))); err != nil {
+		errors = append(errors, fmt.Sprintf("error syncing mangle rules: %s", err))
+	}
+	if err := f.filter.Sync(ConnLimitRules(services)); err != nil {
+		errors = append(errors, fmt.Sprintf("error syncing connection limit rules: %s", err))
+	}
+	natRules := FullNATRules(services)
+	if len(natRules) > 0 {
+		if err := net.SetIpvsConntrack(); err != nil {
+			errors = append(errors, fmt.Sprintf("error enabling ipvs conntrack: %s", err))
+		}
+	}
+	if err := f.nat.Sync(natRules); err != nil {
+		errors = append(errors, fmt.Sprintf("error syncing full nat rules: %s", err))
+	}
+	return errors
+}
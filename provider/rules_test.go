@@ -0,0 +1,94 @@
+package provider_test
+
+import (
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/provider"
+
+	. "gopkg.in/check.v1"
+)
+
+type RulesSuite struct{}
+
+var _ = Suite(&RulesSuite{})
+
+func (s *RulesSuite) TestDSCPRules(c *C) {
+	rules := provider.DSCPRules([]types.Service{
+		{Name: "db", Host: "10.0.0.1", Port: 5432, Protocol: "tcp", DSCP: 46},
+		{Name: "web", Host: "10.0.0.2", Port: 80, Protocol: "tcp"},
+	})
+	c.Assert(rules, DeepEquals, map[string][][]string{
+		"PREROUTING": {
+			{"-d", "10.0.0.1/32", "-p", "tcp", "--dport", "5432", "-j", "DSCP", "--set-dscp", "46"},
+		},
+		"POSTROUTING": {
+			{"-s", "10.0.0.1/32", "-p", "tcp", "--sport", "5432", "-j", "DSCP", "--set-dscp", "46"},
+		},
+	})
+
+	c.Assert(provider.DSCPRules([]types.Service{{Name: "web"}}), HasLen, 0)
+}
+
+func (s *RulesSuite) TestConnLimitRules(c *C) {
+	rules := provider.ConnLimitRules([]types.Service{
+		{Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", MaxConnsPerClient: 100},
+		{Name: "dns", Host: "10.0.0.2", Port: 53, Protocol: "udp", MaxConnsPerClient: 10},
+		{Name: "db", Host: "10.0.0.3", Port: 5432, Protocol: "tcp"},
+	})
+	c.Assert(rules, DeepEquals, map[string][][]string{
+		"INPUT": {
+			{"-d", "10.0.0.1/32", "-p", "tcp", "--dport", "80", "-m", "conntrack", "--ctstate", "NEW",
+				"-m", "connlimit", "--connlimit-above", "100", "--connlimit-mask", "32", "-j", "REJECT", "--reject-with", "tcp-reset"},
+			{"-d", "10.0.0.2/32", "-p", "udp", "--dport", "53", "-m", "conntrack", "--ctstate", "NEW",
+				"-m", "connlimit", "--connlimit-above", "10", "--connlimit-mask", "32", "-j", "REJECT"},
+		},
+	})
+}
+
+func (s *RulesSuite) TestFirewallMarkRules(c *C) {
+	rules := provider.FirewallMarkRules([]types.Service{
+		{Name: "ftp", Host: "10.0.0.1", Port: 21, Protocol: "tcp", FirewallMark: 1, MarkPorts: []string{"20", "30000:30100"}},
+		{Name: "sip", Host: "10.0.0.2", Port: 5060, Protocol: "udp", FirewallMark: 2},
+		{Name: "web", Host: "10.0.0.3", Port: 80, Protocol: "tcp"},
+	})
+	c.Assert(rules, DeepEquals, map[string][][]string{
+		"PREROUTING": {
+			{"-d", "10.0.0.1/32", "-p", "tcp", "-m", "multiport", "--dports", "21,20,30000:30100", "-j", "MARK", "--set-mark", "1"},
+			{"-d", "10.0.0.2/32", "-j", "MARK", "--set-mark", "2"},
+		},
+	})
+}
+
+func (s *RulesSuite) TestPolicyRules(c *C) {
+	rules := provider.PolicyRules([]types.Service{
+		{Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Policies: []types.Policy{
+			{Name: "internal", Sources: []string{"10.0.0.0/8", "172.16.0.0/12"}, Destinations: []string{"canary"}, Mark: 10},
+			{Name: "office", Sources: []string{"192.168.0.0/16"}, Destinations: []string{"stable"}, Mark: 11},
+		}},
+		{Name: "api", Host: "10.0.0.2", Port: 80, Protocol: "tcp"},
+	})
+	c.Assert(rules, DeepEquals, map[string][][]string{
+		"PREROUTING": {
+			{"-s", "10.0.0.0/8", "-d", "10.0.0.1/32", "-p", "tcp", "--dport", "80", "-m", "mark", "--mark", "0", "-j", "MARK", "--set-mark", "10"},
+			{"-s", "172.16.0.0/12", "-d", "10.0.0.1/32", "-p", "tcp", "--dport", "80", "-m", "mark", "--mark", "0", "-j", "MARK", "--set-mark", "10"},
+			{"-s", "192.168.0.0/16", "-d", "10.0.0.1/32", "-p", "tcp", "--dport", "80", "-m", "mark", "--mark", "0", "-j", "MARK", "--set-mark", "11"},
+		},
+	})
+}
+
+func (s *RulesSuite) TestFullNATRules(c *C) {
+	rules := provider.FullNATRules([]types.Service{
+		{Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Destinations: []types.Destination{
+			{Host: "192.168.0.1", Port: 8080, Mode: types.ModeFullNAT},
+			{Host: "192.168.0.2", Port: 8080, Mode: "nat"},
+		}},
+		{Name: "ftp", Host: "10.0.0.2", Port: 21, Protocol: "tcp", FirewallMark: 1, Destinations: []types.Destination{
+			{Host: "192.168.0.3", Port: 21, Mode: types.ModeFullNAT},
+		}},
+	})
+	c.Assert(rules, DeepEquals, map[string][][]string{
+		"POSTROUTING": {
+			{"-m", "ipvs", "--vmethod", "MASQ", "--vaddr", "10.0.0.1/32", "--vport", "80", "--vproto", "tcp", "-d", "192.168.0.1/32", "-j", "MASQUERADE"},
+			{"-m", "ipvs", "--vmethod", "MASQ", "-d", "192.168.0.3/32", "-j", "MASQUERADE"},
+		},
+	})
+}
@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"fmt"
+	gonet "net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/net"
+)
+
+// VRRP adds the VIPs to the interface like the none provider does, and
+// advertises their ownership with VRRPv2 while the balancer leads, so the
+// keepalived instances of the same virtual router stay backups, e.g. while
+// migrating from keepalived. The VIPs are announced with gratuitous ARP once
+// the advertisements start, and the backups are told to take over right
+// away once the leadership is lost.
+//
+// Params, besides the ones of the none provider:
+//   - vrid: the virtual router id, from 1 to 255, required
+//   - priority: the priority advertised, from 1 to 254, defaults to 254
+//     so the leader wins over the keepalived instances
+//   - advertInterval: the interval between the advertisements, in seconds,
+//     defaults to 1
+//
+// The VIPs advertised are the IPv4 VIPs of the services, which must match
+// the virtual_ipaddress of the keepalived instances, as they drop the
+// advertisements of another set of addresses. Authentication isn't
+// supported.
+type VRRP struct {
+	*None
+	iface    string
+	vrid     byte
+	priority byte
+	interval byte
+
+	sync.Mutex
+	vips []gonet.IP
+	// stopCh stops the advertisements, nil when they're stopped
+	stopCh chan struct{}
+}
+
+func NewVRRP(conf *config.BalancerConfig) (Provider, error) {
+	none, err := NewNone(conf)
+	if err != nil {
+		return nil, err
+	}
+	params := conf.Provider.Params
+
+	vrid, err := byteParam(params, "vrid", 0, 1, 255)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := byteParam(params, "priority", 254, 1, 254)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := byteParam(params, "advertInterval", 1, 1, 255)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VRRP{
+		None:     none.(*None),
+		iface:    params["interface"],
+		vrid:     vrid,
+		priority: priority,
+		interval: interval,
+	}, nil
+}
+
+// byteParam parses the param name between min and max, def when it's
+// unset. A zero def makes the param required.
+func byteParam(params map[string]string, name string, def, min, max byte) (byte, error) {
+	v, ok := params[name]
+	if !ok && def != 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < int(min) || n > int(max) {
+		return 0, fmt.Errorf("invalid %s %q: must be between %d and %d", name, v, min, max)
+	}
+	return byte(n), nil
+}
+
+// SyncVIPs starts advertising the VIPs
+func (v *VRRP) SyncVIPs(state ipvs.State) error {
+	err := v.None.SyncVIPs(state)
+
+	var vips []gonet.IP
+	for _, s := range state.GetServices() {
+		if ip := gonet.ParseIP(s.Host).To4(); ip != nil {
+			vips = append(vips, ip)
+		}
+	}
+	sort.Slice(vips, func(i, j int) bool { return vips[i].String() < vips[j].String() })
+
+	v.Lock()
+	defer v.Unlock()
+	v.vips = vips
+	if v.stopCh == nil {
+		v.stopCh = make(chan struct{})
+		go v.advertise(v.stopCh)
+	}
+	return err
+}
+
+// FlushVIPs stops the advertisements, advertising a priority of 0 so the
+// backups take over right away.
+func (v *VRRP) FlushVIPs() error {
+	v.Lock()
+	defer v.Unlock()
+	if v.stopCh == nil {
+		return nil
+	}
+	close(v.stopCh)
+	v.stopCh = nil
+	return net.SendVRRP(v.iface, net.VRRPAdvertisement(v.vrid, 0, v.interval, v.vips))
+}
+
+// advertise advertises the VIPs every interval until stopCh is closed
+func (v *VRRP) advertise(stopCh chan struct{}) {
+	ticker := time.NewTicker(time.Duration(v.interval) * time.Second)
+	defer ticker.Stop()
+
+	announced := false
+	for {
+		v.Lock()
+		vips := v.vips
+		v.Unlock()
+		if err := net.SendVRRP(v.iface, net.VRRPAdvertisement(v.vrid, v.priority, v.interval, vips)); err != nil {
+			log.Errorf("vrrp: error advertising virtual router %d: %v", v.vrid, err)
+		} else if !announced {
+			// The keepalived master drops the VIPs once it hears the first
+			// advertisement, the neighbours must learn they moved here
+			announced = true
+			v.announce(vips)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (v *VRRP) announce(vips []gonet.IP) {
+	var errors []string
+	for _, ip := range vips {
+		if err := net.AnnounceIp(ip.String(), v.iface); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		log.Errorf("vrrp: error announcing the VIPs: %s", strings.Join(errors, " | "))
+	}
+}
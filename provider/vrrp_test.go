@@ -0,0 +1,31 @@
+package provider_test
+
+import (
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/provider"
+
+	. "gopkg.in/check.v1"
+)
+
+type VRRPSuite struct{}
+
+var _ = Suite(&VRRPSuite{})
+
+func (s *VRRPSuite) TestNewVRRP(c *C) {
+	params := map[string]string{
+		"interface": "lo",
+		"vipRange":  "192.168.0.0/28",
+	}
+	conf := &config.BalancerConfig{Provider: config.Provider{Type: "vrrp", Params: params}}
+	_, err := provider.New(conf)
+	c.Assert(err, ErrorMatches, `invalid vrid "": must be between 1 and 255`)
+
+	params["vrid"] = "51"
+	p, err := provider.New(conf)
+	c.Assert(err, IsNil)
+	c.Assert(p, Implements, new(provider.Flusher))
+
+	params["priority"] = "255"
+	_, err = provider.New(conf)
+	c.Assert(err, ErrorMatches, `invalid priority "255": must be between 1 and 254`)
+}
@@ -0,0 +1,187 @@
+// Package proxy implements the embedded proxies serving the services of
+// type http and sni. The leader runs a proxy on the VIP of each of them, so
+// L4 and L7 services are managed by the same control plane.
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// Manager keeps a proxy running for each http and sni service
+type Manager struct {
+	sync.Mutex
+	logger  *logrus.Logger
+	proxies map[string]*serviceProxy
+}
+
+func NewManager(logger *logrus.Logger) *Manager {
+	return &Manager{
+		logger:  logger,
+		proxies: make(map[string]*serviceProxy),
+	}
+}
+
+// Sync starts the proxies of new services, updates the routing of the
+// existing ones and stops the proxies of removed services. Destinations
+// with weight 0 don't receive requests.
+func (m *Manager) Sync(services []types.Service) error {
+	m.Lock()
+	defer m.Unlock()
+
+	desired := make(map[string]types.Service)
+	for _, svc := range services {
+		if svc.IsProxied() {
+			desired[svc.GetId()] = svc
+		}
+	}
+
+	var errors []string
+	for id, p := range m.proxies {
+		svc, ok := desired[id]
+		if ok && p.addr == proxyAddr(svc) && p.typ == svc.Type {
+			continue
+		}
+		// Removed, moved to another address or changed type
+		p.close()
+		delete(m.proxies, id)
+	}
+	for id, svc := range desired {
+		if p, ok := m.proxies[id]; ok {
+			p.service.Store(svc)
+			continue
+		}
+		p, err := newServiceProxy(svc, m.logger)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error starting proxy of service %s: %s", id, err))
+			continue
+		}
+		m.proxies[id] = p
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// Stop stops every proxy
+func (m *Manager) Stop() {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, p := range m.proxies {
+		p.close()
+		delete(m.proxies, id)
+	}
+}
+
+func proxyAddr(svc types.Service) string {
+	return net.JoinHostPort(svc.Host, strconv.Itoa(int(svc.Port)))
+}
+
+type serviceProxy struct {
+	addr    string
+	typ     string
+	server  io.Closer
+	service atomic.Value // types.Service
+	next    uint32
+	logger  *logrus.Logger
+}
+
+func newServiceProxy(svc types.Service, logger *logrus.Logger) (*serviceProxy, error) {
+	p := &serviceProxy{addr: proxyAddr(svc), typ: svc.Type, logger: logger}
+	p.service.Store(svc)
+
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var serve func() error
+	if svc.Type == types.ServiceTypeSNI {
+		server := newSNIServer(l, p)
+		p.server, serve = server, server.serve
+	} else {
+		server := &http.Server{Handler: p}
+		p.server, serve = server, func() error { return server.Serve(l) }
+	}
+
+	go func() {
+		err := serve()
+		logger.Debugf("proxy: %s stopped: %v", p.addr, err)
+	}()
+	return p, nil
+}
+
+// close stops the proxy, closing the connections being served
+func (p *serviceProxy) close() {
+	p.server.Close()
+}
+
+func (p *serviceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	svc := p.service.Load().(types.Service)
+
+	var names []string
+	for _, route := range svc.Routes {
+		if r.Header.Get(route.Header) == route.Value {
+			names = route.Destinations
+			break
+		}
+	}
+
+	dst, ok := p.pick(svc, names)
+	if !ok {
+		http.Error(w, "no destination available", http.StatusServiceUnavailable)
+		return
+	}
+
+	target := net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.Port)))
+	rp := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = target
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// pick selects in round robin a destination among the named ones, the
+// destinations of the route matching the request, or among every
+// destination if names is nil.
+func (p *serviceProxy) pick(svc types.Service, names []string) (types.Destination, bool) {
+	var allowed map[string]bool
+	if names != nil {
+		allowed = make(map[string]bool)
+		for _, name := range names {
+			allowed[name] = true
+		}
+	}
+
+	var candidates []types.Destination
+	for _, dst := range svc.Destinations {
+		if dst.Weight <= 0 {
+			continue
+		}
+		if allowed != nil && !allowed[dst.Name] {
+			continue
+		}
+		candidates = append(candidates, dst)
+	}
+
+	if len(candidates) == 0 {
+		return types.Destination{}, false
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return candidates[int(n-1)%len(candidates)], true
+}
@@ -0,0 +1,173 @@
+package proxy_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ProxySuite struct{}
+
+var _ = Suite(&ProxySuite{})
+
+func backend(c *C, name string) (*httptest.Server, types.Destination) {
+	return serve(c, httptest.NewServer, name)
+}
+
+func tlsBackend(c *C, name string) (*httptest.Server, types.Destination) {
+	return serve(c, httptest.NewTLSServer, name)
+}
+
+func serve(c *C, newServer func(http.Handler) *httptest.Server, name string) (*httptest.Server, types.Destination) {
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	p, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+	return srv, types.Destination{Name: name, Host: host, Port: uint16(p), Weight: 1}
+}
+
+func freePort(c *C) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func get(c *C, url string, header map[string]string) (int, string) {
+	return do(c, http.DefaultClient, url, header)
+}
+
+func do(c *C, client *http.Client, url string, header map[string]string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, string(body)
+}
+
+func (s *ProxySuite) TestSyncRoutesByHeader(c *C) {
+	blue, blueDst := backend(c, "blue")
+	defer blue.Close()
+	green, greenDst := backend(c, "green")
+	defer green.Close()
+
+	svc := types.Service{
+		Name:         "web",
+		Host:         "127.0.0.1",
+		Port:         freePort(c),
+		Protocol:     "tcp",
+		Type:         types.ServiceTypeHTTP,
+		Destinations: []types.Destination{blueDst, greenDst},
+		Routes: []types.HTTPRoute{
+			{Header: "X-Canary", Value: "1", Destinations: []string{"green"}},
+		},
+	}
+	url := "http://" + net.JoinHostPort(svc.Host, strconv.Itoa(int(svc.Port)))
+
+	m := proxy.NewManager(logrus.New())
+	defer m.Stop()
+	err := m.Sync([]types.Service{svc, {Name: "l4", Host: "127.0.0.1", Port: 1}})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		status, body := get(c, url, map[string]string{"X-Canary": "1"})
+		c.Assert(status, Equals, http.StatusOK)
+		c.Assert(body, Equals, "green")
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		_, body := get(c, url, nil)
+		seen[body] = true
+	}
+	c.Assert(seen, DeepEquals, map[string]bool{"blue": true, "green": true})
+
+	// Destinations out of rotation don't get requests
+	svc.Destinations[1].Weight = 0
+	err = m.Sync([]types.Service{svc})
+	c.Assert(err, IsNil)
+	status, _ := get(c, url, map[string]string{"X-Canary": "1"})
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+
+	// Removed services are no longer served
+	err = m.Sync(nil)
+	c.Assert(err, IsNil)
+	_, err = http.Get(url)
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxySuite) TestSyncRoutesBySNI(c *C) {
+	blue, blueDst := tlsBackend(c, "blue")
+	defer blue.Close()
+	green, greenDst := tlsBackend(c, "green")
+	defer green.Close()
+
+	svc := types.Service{
+		Name:         "tenants",
+		Host:         "127.0.0.1",
+		Port:         freePort(c),
+		Protocol:     "tcp",
+		Type:         types.ServiceTypeSNI,
+		Destinations: []types.Destination{blueDst, greenDst},
+		SNIRoutes: []types.SNIRoute{
+			{ServerName: "blue.example.com", Destinations: []string{"blue"}},
+			{ServerName: "*.green.example.com", Destinations: []string{"green"}},
+		},
+	}
+	url := "https://" + net.JoinHostPort(svc.Host, strconv.Itoa(int(svc.Port)))
+
+	m := proxy.NewManager(logrus.New())
+	defer m.Stop()
+	err := m.Sync([]types.Service{svc})
+	c.Assert(err, IsNil)
+
+	client := func(serverName string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}}
+	}
+
+	for i := 0; i < 3; i++ {
+		status, body := do(c, client("blue.example.com"), url, nil)
+		c.Assert(status, Equals, http.StatusOK)
+		c.Assert(body, Equals, "blue")
+		_, body = do(c, client("www.green.example.com"), url, nil)
+		c.Assert(body, Equals, "green")
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		_, body := do(c, client("other.example.com"), url, nil)
+		seen[body] = true
+	}
+	c.Assert(seen, DeepEquals, map[string]bool{"blue": true, "green": true})
+
+	// Connections are closed when no destination is available
+	svc.Destinations[0].Weight = 0
+	err = m.Sync([]types.Service{svc})
+	c.Assert(err, IsNil)
+	_, err = client("blue.example.com").Get(url)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+const (
+	helloTimeout = 5 * time.Second
+	dialTimeout  = 5 * time.Second
+)
+
+var errHelloRead = errors.New("client hello read")
+
+// sniServer dispatches TLS connections to the destinations of a sni
+// service based on the server name requested by the client. TLS isn't
+// terminated: the connection bytes, handshake included, are relayed
+// untouched to the chosen destination.
+type sniServer struct {
+	sync.Mutex
+	listener net.Listener
+	proxy    *serviceProxy
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func newSNIServer(l net.Listener, p *serviceProxy) *sniServer {
+	return &sniServer{
+		listener: l,
+		proxy:    p,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *sniServer) serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections and closes the ones being relayed
+func (s *sniServer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *sniServer) track(conns ...net.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return false
+	}
+	for _, conn := range conns {
+		s.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (s *sniServer) untrack(conns ...net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, conn := range conns {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *sniServer) handle(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	serverName, hello, err := readServerName(conn)
+	if err != nil {
+		s.proxy.logger.Debugf("proxy: %s: error reading client hello from %s: %v", s.proxy.addr, conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	svc := s.proxy.service.Load().(types.Service)
+	dst, ok := s.proxy.pick(svc, sniDestinations(svc.SNIRoutes, serverName))
+	if !ok {
+		s.proxy.logger.Debugf("proxy: %s: no destination available for %q", s.proxy.addr, serverName)
+		return
+	}
+
+	target := net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.Port)))
+	backend, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		s.proxy.logger.Errorf("proxy: %s: error connecting to %s: %v", s.proxy.addr, target, err)
+		return
+	}
+	defer backend.Close()
+	if !s.track(backend) {
+		return
+	}
+	defer s.untrack(backend)
+
+	if _, err := backend.Write(hello); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go relay(backend, conn)
+	go relay(conn, backend)
+	<-done
+	<-done
+}
+
+// sniDestinations returns the destinations of the first route matching
+// serverName, or nil if none matches.
+func sniDestinations(routes []types.SNIRoute, serverName string) []string {
+	serverName = strings.ToLower(serverName)
+	for _, route := range routes {
+		name := strings.ToLower(route.ServerName)
+		if name == serverName {
+			return route.Destinations
+		}
+		if strings.HasPrefix(name, "*.") && strings.HasSuffix(serverName, name[1:]) {
+			return route.Destinations
+		}
+	}
+	return nil
+}
+
+// readServerName reads the TLS client hello from conn, returning the
+// requested server name along with the bytes read, which must be relayed
+// to the destination before the rest of the connection. The hello is parsed
+// by the tls package, aborting the handshake as soon as it's received.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &buf)}, config).Handshake()
+	if err != errHelloRead {
+		return "", nil, err
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// helloConn only allows reading from the connection, so aborting the
+// handshake doesn't send an alert to the client.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                { return nil }
@@ -0,0 +1,143 @@
+// Package secrets resolves sensitive config values stored outside the
+// config file. Any param value may be a reference to its actual value:
+//
+//	file:/run/secrets/aws-secret-key        contents of the file
+//	env:AWS_SECRET_KEY                      value of the environment variable
+//	vault:secret/data/fusis/route53#secret  field of a Vault secret
+//
+// Other values are used as they are. Vault is reached at VAULT_ADDR using
+// the token in VAULT_TOKEN, and both KV version 1 and 2 secrets are
+// supported.
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	filePrefix  = "file:"
+	envPrefix   = "env:"
+	vaultPrefix = "vault:"
+)
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// IsRef reports whether value is a reference to a secret.
+func IsRef(value string) bool {
+	for _, p := range []string{filePrefix, envPrefix, vaultPrefix} {
+		if strings.HasPrefix(value, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRefs reports whether any of the params is a reference to a secret.
+func HasRefs(params map[string]string) bool {
+	for _, v := range params {
+		if IsRef(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the value a reference points to. Values that aren't
+// references are returned unchanged.
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, filePrefix):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, filePrefix))
+		if err != nil {
+			return "", fmt.Errorf("secrets: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, envPrefix):
+		name := strings.TrimPrefix(value, envPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secrets: environment variable %s not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, vaultPrefix):
+		return readVault(strings.TrimPrefix(value, vaultPrefix))
+	}
+	return value, nil
+}
+
+// ResolveParams returns a copy of params with every reference resolved.
+func ResolveParams(params map[string]string) (map[string]string, error) {
+	if params == nil {
+		return nil, nil
+	}
+
+	resolved := make(map[string]string, len(params))
+	for k, v := range params {
+		value, err := Resolve(v)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s param: %v", k, err)
+		}
+		resolved[k] = value
+	}
+	return resolved, nil
+}
+
+func readVault(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("secrets: invalid vault reference %q, expected <path>#<field>", ref)
+	}
+	path, field := strings.Trim(parts[0], "/"), parts[1]
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("secrets: VAULT_ADDR not set")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secrets: reading vault secret %s failed. Status Code: %v. Body: %q", path, resp.StatusCode, string(body))
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("secrets: unable to unmarshal vault secret %s: %v", path, err)
+	}
+
+	data := secret.Data
+	// KV version 2 nests the secret fields along with its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secrets: field %s not found in vault secret %s", field, path)
+	}
+	return value, nil
+}
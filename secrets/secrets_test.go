@@ -0,0 +1,84 @@
+package secrets_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luizbafilho/fusis/secrets"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SecretsSuite struct{}
+
+var _ = Suite(&SecretsSuite{})
+
+func (s *SecretsSuite) TestResolvePlainValue(c *C) {
+	v, err := secrets.Resolve("plain")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "plain")
+	c.Assert(secrets.IsRef("plain"), Equals, false)
+}
+
+func (s *SecretsSuite) TestResolveFile(c *C) {
+	path := filepath.Join(c.MkDir(), "secret")
+	err := ioutil.WriteFile(path, []byte("s3cr3t\n"), 0600)
+	c.Assert(err, IsNil)
+
+	v, err := secrets.Resolve("file:" + path)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "s3cr3t")
+}
+
+func (s *SecretsSuite) TestResolveEnv(c *C) {
+	os.Setenv("FUSIS_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("FUSIS_TEST_SECRET")
+
+	v, err := secrets.Resolve("env:FUSIS_TEST_SECRET")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "s3cr3t")
+
+	_, err = secrets.Resolve("env:FUSIS_TEST_UNSET")
+	c.Assert(err, ErrorMatches, "secrets: environment variable FUSIS_TEST_UNSET not set")
+}
+
+func (s *SecretsSuite) TestResolveVault(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Vault-Token"), Equals, "tok")
+		switch r.URL.Path {
+		case "/v1/secret/data/fusis":
+			w.Write([]byte(`{"data": {"data": {"key": "v2"}, "metadata": {"version": 1}}}`))
+		case "/v1/secret/fusis":
+			w.Write([]byte(`{"data": {"key": "v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	os.Setenv("VAULT_ADDR", srv.URL)
+	os.Setenv("VAULT_TOKEN", "tok")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	params, err := secrets.ResolveParams(map[string]string{
+		"a": "vault:secret/data/fusis#key",
+		"b": "vault:secret/fusis#key",
+		"c": "plain",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(params, DeepEquals, map[string]string{"a": "v2", "b": "v1", "c": "plain"})
+
+	_, err = secrets.Resolve("vault:secret/fusis#missing")
+	c.Assert(err, ErrorMatches, "secrets: field missing not found in vault secret secret/fusis")
+	_, err = secrets.Resolve("vault:secret/unknown#key")
+	c.Assert(err, ErrorMatches, "secrets: reading vault secret secret/unknown failed.*")
+	_, err = secrets.Resolve("vault:secret/fusis")
+	c.Assert(err, ErrorMatches, "secrets: invalid vault reference.*")
+}
@@ -0,0 +1,269 @@
+// Package simulation estimates how the scheduler of a service spreads the
+// connections of synthetic clients across its destinations, mimicking the
+// IPVS schedulers, so capacity can be planned before a rollout.
+package simulation
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+const (
+	maxClients     = 1000000
+	maxConnections = 1000000
+
+	defaultSubnet      = "10.0.0.0/8"
+	defaultConcurrency = 100
+
+	// hashTableSize is the number of buckets of the IPVS hashing schedulers
+	hashTableSize = 256
+)
+
+// scheduler picks the destination of a connection. active holds the open
+// connections of each destination.
+type scheduler func(client uint32, active []int) int
+
+// Run simulates the connections described by params against the
+// destinations of svc in rotation, the ones with weight greater than 0.
+func Run(svc types.Service, params types.SimulationParams) (*types.SimulationResult, error) {
+	params, subnet, err := validate(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var dsts []types.Destination
+	for _, dst := range svc.Destinations {
+		if dst.Weight > 0 {
+			dsts = append(dsts, dst)
+		}
+	}
+	result := &types.SimulationResult{Scheduler: svc.Scheduler, Destinations: []types.SimulatedDestination{}}
+	if len(dsts) == 0 {
+		return result, nil
+	}
+
+	pick, err := newScheduler(svc, dsts)
+	if err != nil {
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewSource(params.Seed))
+	clients := pickClients(rng, subnet, params.Clients)
+	nextClient := func() uint32 { return clients[rng.Intn(len(clients))] }
+	if params.Distribution == "zipf" {
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(len(clients)-1))
+		nextClient = func() uint32 { return clients[zipf.Uint64()] }
+	}
+
+	active := make([]int, len(dsts))
+	conns := make([]int, len(dsts))
+	seen := make([]map[uint32]bool, len(dsts))
+	for i := range seen {
+		seen[i] = make(map[uint32]bool)
+	}
+	persisted := make(map[uint32]int)
+	// open holds the destinations of the open connections, oldest first
+	open := make([]int, 0, params.Concurrency)
+
+	for n := 0; n < params.Connections; n++ {
+		if len(open) == params.Concurrency {
+			active[open[0]]--
+			open = open[1:]
+		}
+
+		client := nextClient()
+		i, ok := persisted[client]
+		if !params.Persistent || !ok {
+			i = pick(client, active)
+			persisted[client] = i
+		}
+		active[i]++
+		conns[i]++
+		seen[i][client] = true
+		open = append(open, i)
+	}
+
+	for i, dst := range dsts {
+		result.Destinations = append(result.Destinations, types.SimulatedDestination{
+			Name:        dst.Name,
+			Weight:      dst.Weight,
+			Connections: conns[i],
+			Share:       float64(conns[i]) / float64(params.Connections),
+			Clients:     len(seen[i]),
+		})
+	}
+	return result, nil
+}
+
+func validate(params types.SimulationParams) (types.SimulationParams, *net.IPNet, error) {
+	if params.Subnet == "" {
+		params.Subnet = defaultSubnet
+	}
+	if params.Distribution == "" {
+		params.Distribution = "uniform"
+	}
+	if params.Concurrency <= 0 {
+		params.Concurrency = defaultConcurrency
+	}
+
+	_, subnet, err := net.ParseCIDR(params.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return params, nil, types.ErrInvalidSimulation
+	}
+	if params.Clients < 1 || params.Clients > maxClients ||
+		params.Connections < 1 || params.Connections > maxConnections {
+		return params, nil, types.ErrInvalidSimulation
+	}
+	if params.Distribution != "uniform" && params.Distribution != "zipf" {
+		return params, nil, types.ErrInvalidSimulation
+	}
+	// There can't be more clients than addresses in the subnet
+	if ones, bits := subnet.Mask.Size(); bits-ones < 32 && params.Clients > 1<<uint(bits-ones) {
+		params.Clients = 1 << uint(bits-ones)
+	}
+	return params, subnet, nil
+}
+
+// pickClients returns n distinct addresses of subnet
+func pickClients(rng *rand.Rand, subnet *net.IPNet, n int) []uint32 {
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	hostMask := ^binary.BigEndian.Uint32(net.IP(subnet.Mask).To4())
+
+	picked := make(map[uint32]bool, n)
+	clients := make([]uint32, 0, n)
+	for len(clients) < n {
+		addr := base | (rng.Uint32() & hostMask)
+		if picked[addr] {
+			continue
+		}
+		picked[addr] = true
+		clients = append(clients, addr)
+	}
+	return clients
+}
+
+func newScheduler(svc types.Service, dsts []types.Destination) (scheduler, error) {
+	weights := make([]int, len(dsts))
+	for i, dst := range dsts {
+		weights[i] = int(dst.Weight)
+	}
+
+	switch svc.Scheduler {
+	case "rr":
+		next := -1
+		return func(uint32, []int) int {
+			next = (next + 1) % len(dsts)
+			return next
+		}, nil
+	case "wrr":
+		return weightedRoundRobin(weights), nil
+	case "lc":
+		return leastConnections(func(i int, active []int) int { return active[i] }, weights, false), nil
+	case "wlc":
+		return leastConnections(func(i int, active []int) int { return active[i] }, weights, true), nil
+	case "sed":
+		return leastConnections(func(i int, active []int) int { return active[i] + 1 }, weights, true), nil
+	case "nq":
+		sed := leastConnections(func(i int, active []int) int { return active[i] + 1 }, weights, true)
+		return func(client uint32, active []int) int {
+			for i := range active {
+				if active[i] == 0 {
+					return i
+				}
+			}
+			return sed(client, active)
+		}, nil
+	case "sh", types.SchedulerMaglev:
+		// Maglev builds its own lookup table, but spreads the clients by
+		// weight just like sh
+		table := hashTable(weights)
+		return func(client uint32, _ []int) int { return table[hashAddr(client)] }, nil
+	case "dh":
+		// Every connection goes to the VIP, so to the same destination
+		var vip uint32
+		if ip := net.ParseIP(svc.Host).To4(); ip != nil {
+			vip = binary.BigEndian.Uint32(ip)
+		}
+		i := hashTable(weights)[hashAddr(vip)]
+		return func(uint32, []int) int { return i }, nil
+	}
+	return nil, types.ErrUnsupportedScheduler
+}
+
+// weightedRoundRobin interleaves the destinations by weight, like the IPVS
+// wrr scheduler
+func weightedRoundRobin(weights []int) scheduler {
+	max, gcd := 0, 0
+	for _, w := range weights {
+		if w > max {
+			max = w
+		}
+		gcd = greatestCommonDivisor(gcd, w)
+	}
+
+	i, cw := -1, 0
+	return func(uint32, []int) int {
+		for {
+			i = (i + 1) % len(weights)
+			if i == 0 {
+				cw -= gcd
+				if cw <= 0 {
+					cw = max
+				}
+			}
+			if weights[i] >= cw {
+				return i
+			}
+		}
+	}
+}
+
+func greatestCommonDivisor(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// leastConnections picks the destination with the least overhead, divided
+// by its weight when weighted. Ties go to the first destination.
+func leastConnections(overhead func(i int, active []int) int, weights []int, weighted bool) scheduler {
+	return func(_ uint32, active []int) int {
+		least := 0
+		for i := 1; i < len(active); i++ {
+			if weighted {
+				// overhead(i)/weights[i] < overhead(least)/weights[least]
+				if overhead(i, active)*weights[least] < overhead(least, active)*weights[i] {
+					least = i
+				}
+			} else if overhead(i, active) < overhead(least, active) {
+				least = i
+			}
+		}
+		return least
+	}
+}
+
+// hashTable fills the buckets of the IPVS hashing schedulers, each
+// destination taking as many consecutive buckets as its weight
+func hashTable(weights []int) []int {
+	table := make([]int, hashTableSize)
+	i, taken := 0, 0
+	for b := range table {
+		table[b] = i
+		taken++
+		if taken >= weights[i] {
+			i = (i + 1) % len(weights)
+			taken = 0
+		}
+	}
+	return table
+}
+
+// hashAddr is the multiplicative hash of the IPVS hashing schedulers
+func hashAddr(addr uint32) int {
+	return int((addr * 2654435761) >> (32 - 8) & (hashTableSize - 1))
+}
@@ -0,0 +1,93 @@
+package simulation
+
+import (
+	"testing"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func service(scheduler string, weights ...int32) types.Service {
+	svc := types.Service{Name: "myservice", Host: "10.1.1.1", Scheduler: scheduler}
+	for i, w := range weights {
+		svc.Destinations = append(svc.Destinations, types.Destination{Name: string(rune('a' + i)), Weight: w})
+	}
+	return svc
+}
+
+func connections(result *types.SimulationResult) []int {
+	var conns []int
+	for _, dst := range result.Destinations {
+		conns = append(conns, dst.Connections)
+	}
+	return conns
+}
+
+func (s *S) TestRunRoundRobin(c *check.C) {
+	result, err := Run(service("rr", 1, 5, 1), types.SimulationParams{Clients: 10, Connections: 300})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Scheduler, check.Equals, "rr")
+	c.Assert(connections(result), check.DeepEquals, []int{100, 100, 100})
+	c.Assert(result.Destinations[0].Share, check.Equals, 1.0/3)
+}
+
+func (s *S) TestRunWeightedRoundRobin(c *check.C) {
+	result, err := Run(service("wrr", 1, 3, 0), types.SimulationParams{Clients: 10, Connections: 400})
+	c.Assert(err, check.IsNil)
+	c.Assert(connections(result), check.DeepEquals, []int{100, 300})
+}
+
+func (s *S) TestRunLeastConnections(c *check.C) {
+	params := types.SimulationParams{Clients: 10, Connections: 1000, Concurrency: 10}
+	result, err := Run(service("wlc", 1, 4), params)
+	c.Assert(err, check.IsNil)
+	c.Assert(connections(result), check.DeepEquals, []int{200, 800})
+	result, err = Run(service("lc", 1, 4), params)
+	c.Assert(err, check.IsNil)
+	c.Assert(connections(result), check.DeepEquals, []int{500, 500})
+}
+
+func (s *S) TestRunSourceHashing(c *check.C) {
+	result, err := Run(service("sh", 1, 1), types.SimulationParams{Clients: 5, Connections: 1000, Seed: 42})
+	c.Assert(err, check.IsNil)
+	// Each client always goes to the same destination
+	c.Assert(result.Destinations[0].Clients+result.Destinations[1].Clients, check.Equals, 5)
+	c.Assert(result.Destinations[0].Connections+result.Destinations[1].Connections, check.Equals, 1000)
+}
+
+func (s *S) TestRunPersistent(c *check.C) {
+	result, err := Run(service("rr", 1, 1), types.SimulationParams{Clients: 2, Connections: 100, Subnet: "192.168.0.0/24", Persistent: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Destinations[0].Connections+result.Destinations[1].Connections, check.Equals, 100)
+	c.Assert(result.Destinations[0].Clients, check.Equals, 1)
+	c.Assert(result.Destinations[1].Clients, check.Equals, 1)
+}
+
+func (s *S) TestRunDeterministic(c *check.C) {
+	params := types.SimulationParams{Clients: 100, Connections: 1000, Distribution: "zipf", Seed: 7}
+	first, err := Run(service("sh", 1, 2, 3), params)
+	c.Assert(err, check.IsNil)
+	second, err := Run(service("sh", 1, 2, 3), params)
+	c.Assert(err, check.IsNil)
+	c.Assert(first, check.DeepEquals, second)
+}
+
+func (s *S) TestRunErrors(c *check.C) {
+	_, err := Run(service("ovf", 1), types.SimulationParams{Clients: 1, Connections: 1})
+	c.Assert(err, check.Equals, types.ErrUnsupportedScheduler)
+	for _, params := range []types.SimulationParams{
+		{Clients: 0, Connections: 1},
+		{Clients: 1, Connections: 1000001},
+		{Clients: 1, Connections: 1, Distribution: "pareto"},
+		{Clients: 1, Connections: 1, Subnet: "fe80::/64"},
+	} {
+		_, err := Run(service("rr", 1), params)
+		c.Assert(err, check.Equals, types.ErrInvalidSimulation)
+	}
+}
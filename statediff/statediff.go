@@ -0,0 +1,206 @@
+// Package statediff compares the services exported from two clusters, e.g.
+// to validate a migration. Services are matched by id and destinations by
+// name. Attributes that naturally differ between clusters, like versions,
+// stats and expiration times, are ignored.
+package statediff
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+var (
+	ignoredServiceFields     = map[string]bool{"Id": true, "Destinations": true, "Stats": true, "ExpiresAt": true, "Version": true}
+	ignoredDestinationFields = map[string]bool{"Name": true, "ServiceId": true, "Stats": true, "Version": true}
+)
+
+// Diff holds the differences between two sets of services
+type Diff struct {
+	Added   []types.Service `json:",omitempty"`
+	Removed []types.Service `json:",omitempty"`
+	Changed []ServiceDiff   `json:",omitempty"`
+}
+
+// ServiceDiff holds the differences of a service present on both sides
+type ServiceDiff struct {
+	Id                  string
+	Fields              []FieldDiff         `json:",omitempty"`
+	AddedDestinations   []types.Destination `json:",omitempty"`
+	RemovedDestinations []types.Destination `json:",omitempty"`
+	ChangedDestinations []DestinationDiff   `json:",omitempty"`
+}
+
+// DestinationDiff holds the differences of a destination present on both
+// sides
+type DestinationDiff struct {
+	Name   string
+	Fields []FieldDiff
+}
+
+// FieldDiff is an attribute having different values on each side
+type FieldDiff struct {
+	Name   string
+	Before interface{}
+	After  interface{}
+}
+
+// Empty reports whether both sides are equivalent
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Compare returns what changes from the before services to the after ones
+func Compare(before, after []types.Service) Diff {
+	var diff Diff
+
+	beforeById := servicesById(before)
+	afterById := servicesById(after)
+
+	for _, id := range sortedIds(afterById) {
+		if _, ok := beforeById[id]; !ok {
+			diff.Added = append(diff.Added, afterById[id])
+		}
+	}
+	for _, id := range sortedIds(beforeById) {
+		a, ok := afterById[id]
+		if !ok {
+			diff.Removed = append(diff.Removed, beforeById[id])
+			continue
+		}
+		if d := compareService(beforeById[id], a); d != nil {
+			diff.Changed = append(diff.Changed, *d)
+		}
+	}
+	return diff
+}
+
+func compareService(before, after types.Service) *ServiceDiff {
+	d := ServiceDiff{
+		Id:     before.GetId(),
+		Fields: compareFields(before, after, ignoredServiceFields),
+	}
+
+	beforeByName := destinationsByName(before.Destinations)
+	afterByName := destinationsByName(after.Destinations)
+	for _, name := range sortedNames(afterByName) {
+		if _, ok := beforeByName[name]; !ok {
+			d.AddedDestinations = append(d.AddedDestinations, afterByName[name])
+		}
+	}
+	for _, name := range sortedNames(beforeByName) {
+		a, ok := afterByName[name]
+		if !ok {
+			d.RemovedDestinations = append(d.RemovedDestinations, beforeByName[name])
+			continue
+		}
+		if fields := compareFields(beforeByName[name], a, ignoredDestinationFields); len(fields) > 0 {
+			d.ChangedDestinations = append(d.ChangedDestinations, DestinationDiff{Name: name, Fields: fields})
+		}
+	}
+
+	if len(d.Fields) == 0 && len(d.AddedDestinations) == 0 && len(d.RemovedDestinations) == 0 && len(d.ChangedDestinations) == 0 {
+		return nil
+	}
+	return &d
+}
+
+// compareFields compares the exported fields of two structs of the same
+// type, skipping the ignored ones.
+func compareFields(before, after interface{}, ignored map[string]bool) []FieldDiff {
+	var fields []FieldDiff
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < b.NumField(); i++ {
+		name := b.Type().Field(i).Name
+		if ignored[name] {
+			continue
+		}
+		bv, av := b.Field(i).Interface(), a.Field(i).Interface()
+		if !reflect.DeepEqual(bv, av) && !bothEmpty(b.Field(i), a.Field(i)) {
+			fields = append(fields, FieldDiff{Name: name, Before: bv, After: av})
+		}
+	}
+	return fields
+}
+
+// bothEmpty treats nil and empty maps and slices as equal, as they're
+// equivalent once exported.
+func bothEmpty(b, a reflect.Value) bool {
+	switch b.Kind() {
+	case reflect.Map, reflect.Slice:
+		return b.Len() == 0 && a.Len() == 0
+	}
+	return false
+}
+
+// Write prints the diff in a human readable format: added items are
+// prefixed by +, removed ones by - and changed ones by ~.
+func (d Diff) Write(w io.Writer) {
+	for _, svc := range d.Added {
+		fmt.Fprintf(w, "+ service %s (%s)\n", svc.GetId(), serviceAddr(svc))
+	}
+	for _, svc := range d.Removed {
+		fmt.Fprintf(w, "- service %s (%s)\n", svc.GetId(), serviceAddr(svc))
+	}
+	for _, svc := range d.Changed {
+		fmt.Fprintf(w, "~ service %s\n", svc.Id)
+		writeFields(w, "    ", svc.Fields)
+		for _, dst := range svc.AddedDestinations {
+			fmt.Fprintf(w, "  + destination %s (%s:%d)\n", dst.GetId(), dst.Host, dst.Port)
+		}
+		for _, dst := range svc.RemovedDestinations {
+			fmt.Fprintf(w, "  - destination %s (%s:%d)\n", dst.GetId(), dst.Host, dst.Port)
+		}
+		for _, dst := range svc.ChangedDestinations {
+			fmt.Fprintf(w, "  ~ destination %s\n", dst.Name)
+			writeFields(w, "      ", dst.Fields)
+		}
+	}
+}
+
+func writeFields(w io.Writer, indent string, fields []FieldDiff) {
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s%s: %v -> %v\n", indent, f.Name, f.Before, f.After)
+	}
+}
+
+func serviceAddr(svc types.Service) string {
+	return fmt.Sprintf("%s:%d/%s", svc.Host, svc.Port, svc.Protocol)
+}
+
+func servicesById(services []types.Service) map[string]types.Service {
+	byId := make(map[string]types.Service, len(services))
+	for _, svc := range services {
+		byId[svc.GetId()] = svc
+	}
+	return byId
+}
+
+func destinationsByName(dsts []types.Destination) map[string]types.Destination {
+	byName := make(map[string]types.Destination, len(dsts))
+	for _, dst := range dsts {
+		byName[dst.GetId()] = dst
+	}
+	return byName
+}
+
+func sortedIds(services map[string]types.Service) []string {
+	ids := make([]string, 0, len(services))
+	for id := range services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedNames(dsts map[string]types.Destination) []string {
+	names := make([]string, 0, len(dsts))
+	for name := range dsts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
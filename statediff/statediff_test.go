@@ -0,0 +1,59 @@
+package statediff_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/statediff"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type StateDiffSuite struct{}
+
+var _ = Suite(&StateDiffSuite{})
+
+func (s *StateDiffSuite) TestCompare(c *C) {
+	before := []types.Service{
+		{
+			Id: "web", Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr", Version: 3,
+			Destinations: []types.Destination{
+				{Name: "web-1", Host: "192.168.0.1", Port: 8080, Weight: 1, Mode: "nat", ServiceId: "web"},
+				{Name: "web-2", Host: "192.168.0.2", Port: 8080, Weight: 1, Mode: "nat", ServiceId: "web"},
+			},
+		},
+		{Id: "old", Name: "old", Host: "10.0.0.2", Port: 22, Protocol: "tcp", Scheduler: "rr"},
+		{Id: "db", Name: "db", Host: "10.0.0.3", Port: 5432, Protocol: "tcp", Scheduler: "lc", Destinations: []types.Destination{}},
+	}
+	after := []types.Service{
+		{
+			Id: "web", Name: "web", Host: "10.1.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr", Version: 10,
+			Destinations: []types.Destination{
+				{Name: "web-1", Host: "192.168.0.1", Port: 8080, Weight: 5, Mode: "nat", ServiceId: "web", Version: 11},
+				{Name: "web-3", Host: "192.168.0.3", Port: 8080, Weight: 1, Mode: "nat", ServiceId: "web"},
+			},
+		},
+		{Id: "db", Name: "db", Host: "10.0.0.3", Port: 5432, Protocol: "tcp", Scheduler: "lc"},
+		{Id: "new", Name: "new", Host: "10.1.0.4", Port: 53, Protocol: "udp", Scheduler: "rr"},
+	}
+
+	diff := statediff.Compare(before, after)
+	c.Assert(diff.Empty(), Equals, false)
+
+	var out bytes.Buffer
+	diff.Write(&out)
+	c.Assert(out.String(), Equals, `+ service new (10.1.0.4:53/udp)
+- service old (10.0.0.2:22/tcp)
+~ service web
+    Host: 10.0.0.1 -> 10.1.0.1
+  + destination web-3 (192.168.0.3:8080)
+  - destination web-2 (192.168.0.2:8080)
+  ~ destination web-1
+      Weight: 1 -> 5
+`)
+
+	c.Assert(statediff.Compare(before, before).Empty(), Equals, true)
+}
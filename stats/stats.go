@@ -0,0 +1,259 @@
+// Package stats aggregates the IPVS counters of the services over time
+// windows. IPVS only exposes cumulative counters, so each sample is turned
+// into the delta since the previous one, and the deltas of a window are
+// summed into counters and rates, along with a histogram of the
+// connections per sample interval, ready to be graphed.
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+)
+
+// DisabledLabel is the service label opting a service out of the stats
+// when set to "true", e.g. for high-cardinality services not worth their
+// stats pipeline cost.
+const DisabledLabel = "stats.disabled"
+
+// Disabled reports whether the service opted out of the stats
+func Disabled(svc types.Service) bool {
+	return svc.Labels[DisabledLabel] == "true"
+}
+
+// DefaultBuckets are the upper bounds of the connections per interval
+// histogram, unless configured otherwise.
+var DefaultBuckets = []uint32{10, 100, 1000, 10000}
+
+// counters holds the cumulative counters of a service
+type counters struct {
+	connections uint64
+	packetsIn   uint64
+	packetsOut  uint64
+	bytesIn     uint64
+	bytesOut    uint64
+}
+
+func fromServiceStats(s *types.ServiceStats) counters {
+	return counters{
+		connections: uint64(s.Connections),
+		packetsIn:   uint64(s.PacketsIn),
+		packetsOut:  uint64(s.PacketsOut),
+		bytesIn:     s.BytesIn,
+		bytesOut:    s.BytesOut,
+	}
+}
+
+// since returns the counters increase from prev. Counters going backwards
+// were reset, e.g. by the service being recreated, so they're counted from
+// zero.
+func (c counters) since(prev counters) counters {
+	delta := func(cur, prev uint64) uint64 {
+		if cur < prev {
+			return cur
+		}
+		return cur - prev
+	}
+	return counters{
+		connections: delta(c.connections, prev.connections),
+		packetsIn:   delta(c.packetsIn, prev.packetsIn),
+		packetsOut:  delta(c.packetsOut, prev.packetsOut),
+		bytesIn:     delta(c.bytesIn, prev.bytesIn),
+		bytesOut:    delta(c.bytesOut, prev.bytesOut),
+	}
+}
+
+// Window holds the stats of a service aggregated over a time window
+type Window struct {
+	Start    time.Time
+	Duration time.Duration
+	// Intervals is the number of samples aggregated
+	Intervals int
+
+	Connections uint64
+	PacketsIn   uint64
+	PacketsOut  uint64
+	BytesIn     uint64
+	BytesOut    uint64
+
+	// MinConnections and MaxConnections are the least and most
+	// connections received in a sample interval
+	MinConnections uint64
+	MaxConnections uint64
+	// Buckets are the upper bounds of the histogram, and Histogram holds
+	// the number of intervals whose connections are at most each of them.
+	// Its last item counts every interval.
+	Buckets   []uint32
+	Histogram []int
+}
+
+func (w *Window) add(delta counters) {
+	w.Intervals++
+	w.Connections += delta.connections
+	w.PacketsIn += delta.packetsIn
+	w.PacketsOut += delta.packetsOut
+	w.BytesIn += delta.bytesIn
+	w.BytesOut += delta.bytesOut
+
+	if w.Intervals == 1 || delta.connections < w.MinConnections {
+		w.MinConnections = delta.connections
+	}
+	if delta.connections > w.MaxConnections {
+		w.MaxConnections = delta.connections
+	}
+	for i, bound := range w.Buckets {
+		if delta.connections <= uint64(bound) {
+			w.Histogram[i]++
+		}
+	}
+	w.Histogram[len(w.Buckets)]++
+}
+
+// Idle returns whether the counters didn't change over the window
+func (w *Window) Idle() bool {
+	return w.Connections == 0 && w.PacketsIn == 0 && w.PacketsOut == 0 &&
+		w.BytesIn == 0 && w.BytesOut == 0
+}
+
+func (w *Window) rate(count uint64) float64 {
+	if w.Duration <= 0 {
+		return 0
+	}
+	return float64(count) / w.Duration.Seconds()
+}
+
+// Fields returns the window stats as flat log fields. Rates are per
+// second, and the histogram buckets are named after their upper bound.
+func (w *Window) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"window":          w.Duration.Seconds(),
+		"intervals":       w.Intervals,
+		"connections":     w.Connections,
+		"packets_in":      w.PacketsIn,
+		"packets_out":     w.PacketsOut,
+		"bytes_in":        w.BytesIn,
+		"bytes_out":       w.BytesOut,
+		"cps":             w.rate(w.Connections),
+		"pps_in":          w.rate(w.PacketsIn),
+		"pps_out":         w.rate(w.PacketsOut),
+		"bps_in":          w.rate(w.BytesIn),
+		"bps_out":         w.rate(w.BytesOut),
+		"connections_min": w.MinConnections,
+		"connections_max": w.MaxConnections,
+	}
+	for i, bound := range w.Buckets {
+		fields[fmt.Sprintf("connections_le_%d", bound)] = w.Histogram[i]
+	}
+	fields["connections_le_inf"] = w.Histogram[len(w.Buckets)]
+	return fields
+}
+
+type serviceStats struct {
+	last     counters
+	lastTick time.Time
+	window   *Window
+	// lastLogged is when the last window of the service was returned
+	lastLogged time.Time
+}
+
+// Aggregator turns the samples of the services into windows. It isn't safe
+// for concurrent use.
+type Aggregator struct {
+	window   time.Duration
+	buckets  []uint32
+	fullDump time.Duration
+	services map[string]*serviceStats
+}
+
+// NewAggregator creates an aggregator of windows of the given duration. A
+// window is complete once a sample arrives at least duration after it
+// started, so durations that aren't multiples of the sample interval are
+// rounded up.
+func NewAggregator(window time.Duration, buckets []uint32) *Aggregator {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Aggregator{
+		window:   window,
+		buckets:  buckets,
+		services: make(map[string]*serviceStats),
+	}
+}
+
+// SetFullDump makes the aggregator hold back the idle windows of a service,
+// unless none was returned for at least fullDump. Zero returns every window.
+func (a *Aggregator) SetFullDump(fullDump time.Duration) {
+	a.fullDump = fullDump
+}
+
+// Add records the cumulative stats of a service sampled at tick, returning
+// its window once complete, unless held back as idle. The first sample of
+// a service only sets the baseline of its counters.
+func (a *Aggregator) Add(id string, s *types.ServiceStats, tick time.Time) *Window {
+	if s == nil {
+		return nil
+	}
+	current := fromServiceStats(s)
+
+	svc, ok := a.services[id]
+	if !ok {
+		a.services[id] = &serviceStats{last: current, lastTick: tick}
+		return nil
+	}
+
+	if svc.window == nil {
+		svc.window = &Window{
+			Start:     svc.lastTick,
+			Buckets:   a.buckets,
+			Histogram: make([]int, len(a.buckets)+1),
+		}
+	}
+	svc.window.add(current.since(svc.last))
+	svc.last = current
+	svc.lastTick = tick
+
+	w := svc.window
+	w.Duration = tick.Sub(w.Start)
+	if w.Duration < a.window {
+		return nil
+	}
+	svc.window = nil
+	if a.fullDump > 0 && w.Idle() && tick.Sub(svc.lastLogged) < a.fullDump {
+		return nil
+	}
+	svc.lastLogged = tick
+	return w
+}
+
+// Retain forgets the services missing from ids, e.g. deleted ones
+func (a *Aggregator) Retain(ids map[string]bool) {
+	for id := range a.services {
+		if !ids[id] {
+			delete(a.services, id)
+		}
+	}
+}
+
+// LabelFields returns the active and inactive connections of the
+// destinations of svc summed by label, as flat log fields named like
+// active_conns_deploy_v1. The destinations of kernel, read from IPVS along
+// with their connections, are matched by address to the ones of svc, which
+// hold the labels.
+func LabelFields(svc, kernel types.Service) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, dst := range kernel.Destinations {
+		labeled, ok := svc.FindDestination(dst.Host, dst.Port)
+		if !ok || dst.Stats == nil {
+			continue
+		}
+		for k, v := range labeled.Labels {
+			suffix := fmt.Sprintf("%s_%s", k, v)
+			active, _ := fields["active_conns_"+suffix].(uint32)
+			inactive, _ := fields["inactive_conns_"+suffix].(uint32)
+			fields["active_conns_"+suffix] = active + dst.Stats.ActiveConns
+			fields["inactive_conns_"+suffix] = inactive + dst.Stats.InactiveConns
+		}
+	}
+	return fields
+}
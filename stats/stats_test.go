@@ -0,0 +1,110 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/api/types"
+	"github.com/luizbafilho/fusis/stats"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type StatsSuite struct{}
+
+var _ = Suite(&StatsSuite{})
+
+func (s *StatsSuite) TestAggregator(c *C) {
+	a := stats.NewAggregator(30*time.Second, []uint32{10, 100})
+	start := time.Now()
+	tick := func(n int) time.Time { return start.Add(time.Duration(n) * 10 * time.Second) }
+
+	c.Assert(a.Add("web", &types.ServiceStats{Connections: 100, BytesIn: 1000}, tick(0)), IsNil)
+	c.Assert(a.Add("web", &types.ServiceStats{Connections: 105, BytesIn: 1500}, tick(1)), IsNil)
+	c.Assert(a.Add("web", &types.ServiceStats{Connections: 155, BytesIn: 2500}, tick(2)), IsNil)
+	w := a.Add("web", &types.ServiceStats{Connections: 455, BytesIn: 4000}, tick(3))
+	c.Assert(w, NotNil)
+	c.Assert(w.Intervals, Equals, 3)
+	c.Assert(w.Duration, Equals, 30*time.Second)
+	c.Assert(w.Connections, Equals, uint64(355))
+	c.Assert(w.BytesIn, Equals, uint64(3000))
+	c.Assert(w.MinConnections, Equals, uint64(5))
+	c.Assert(w.MaxConnections, Equals, uint64(300))
+	c.Assert(w.Histogram, DeepEquals, []int{1, 2, 3})
+
+	fields := w.Fields()
+	c.Assert(fields["bps_in"], Equals, float64(100))
+	c.Assert(fields["connections_le_10"], Equals, 1)
+	c.Assert(fields["connections_le_100"], Equals, 2)
+	c.Assert(fields["connections_le_inf"], Equals, 3)
+
+	// Counters going backwards were reset
+	c.Assert(a.Add("web", &types.ServiceStats{Connections: 20}, tick(4)), IsNil)
+	a.Add("web", &types.ServiceStats{Connections: 30}, tick(5))
+	w = a.Add("web", &types.ServiceStats{Connections: 40}, tick(6))
+	c.Assert(w, NotNil)
+	c.Assert(w.Connections, Equals, uint64(40))
+
+	// Forgotten services start over from a new baseline
+	a.Retain(map[string]bool{})
+	c.Assert(a.Add("web", &types.ServiceStats{Connections: 1000}, tick(7)), IsNil)
+	c.Assert(a.Add("web", &types.ServiceStats{Connections: 1001}, tick(10)).Connections, Equals, uint64(1))
+}
+
+func (s *StatsSuite) TestLabelFields(c *C) {
+	svc := types.Service{Destinations: []types.Destination{
+		{Host: "10.0.0.1", Port: 80, Labels: map[string]string{"deploy": "v1", "zone": "a"}},
+		{Host: "10.0.0.2", Port: 80, Labels: map[string]string{"deploy": "v1"}},
+		{Host: "10.0.0.3", Port: 80, Labels: map[string]string{"deploy": "v2"}},
+		{Host: "10.0.0.4", Port: 80},
+	}}
+	kernel := types.Service{Destinations: []types.Destination{
+		{Host: "10.0.0.1", Port: 80, Stats: &types.DestinationStats{ActiveConns: 3, InactiveConns: 1}},
+		{Host: "10.0.0.2", Port: 80, Stats: &types.DestinationStats{ActiveConns: 4}},
+		{Host: "10.0.0.3", Port: 80, Stats: &types.DestinationStats{ActiveConns: 5, InactiveConns: 2}},
+		{Host: "10.0.0.4", Port: 80, Stats: &types.DestinationStats{ActiveConns: 6}},
+		{Host: "10.0.0.5", Port: 80, Stats: &types.DestinationStats{ActiveConns: 7}},
+	}}
+
+	c.Assert(stats.LabelFields(svc, kernel), DeepEquals, map[string]interface{}{
+		"active_conns_deploy_v1":   uint32(7),
+		"inactive_conns_deploy_v1": uint32(1),
+		"active_conns_deploy_v2":   uint32(5),
+		"inactive_conns_deploy_v2": uint32(2),
+		"active_conns_zone_a":      uint32(3),
+		"inactive_conns_zone_a":    uint32(1),
+	})
+}
+
+func (s *StatsSuite) TestAggregatorFullDump(c *C) {
+	a := stats.NewAggregator(10*time.Second, nil)
+	a.SetFullDump(60 * time.Second)
+	start := time.Now()
+	tick := func(n int) time.Time { return start.Add(time.Duration(n) * 10 * time.Second) }
+
+	c.Assert(a.Add("idle", &types.ServiceStats{Connections: 10}, tick(0)), IsNil)
+	// The first window is always returned
+	w := a.Add("idle", &types.ServiceStats{Connections: 10}, tick(1))
+	c.Assert(w, NotNil)
+	c.Assert(w.Idle(), Equals, true)
+	for n := 2; n < 7; n++ {
+		c.Assert(a.Add("idle", &types.ServiceStats{Connections: 10}, tick(n)), IsNil)
+	}
+	// Changed counters are returned right away
+	w = a.Add("idle", &types.ServiceStats{Connections: 11}, tick(7))
+	c.Assert(w, NotNil)
+	c.Assert(w.Idle(), Equals, false)
+	for n := 8; n < 13; n++ {
+		c.Assert(a.Add("idle", &types.ServiceStats{Connections: 11}, tick(n)), IsNil)
+	}
+	// Idle ones once the full dump is due
+	c.Assert(a.Add("idle", &types.ServiceStats{Connections: 11}, tick(13)), NotNil)
+}
+
+func (s *StatsSuite) TestDisabled(c *C) {
+	c.Assert(stats.Disabled(types.Service{}), Equals, false)
+	c.Assert(stats.Disabled(types.Service{Labels: map[string]string{stats.DisabledLabel: "true"}}), Equals, true)
+	c.Assert(stats.Disabled(types.Service{Labels: map[string]string{stats.DisabledLabel: "false"}}), Equals, false)
+}